@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"video-microservice/internal/streamer"
+)
+
+// Machine-readable error codes, stable for API consumers
+const (
+	codeMissingParameter    = "missing_parameter"
+	codeInvalidParameter    = "invalid_parameter"
+	codeVideoNotFound       = "video_not_found"
+	codeAuthRequired        = "auth_required"
+	codeVideoPrivate        = "video_private"
+	codeGeoBlocked          = "geo_blocked"
+	codeMetadataTimeout     = "metadata_timeout"
+	codeFormatNotFound      = "format_not_found"
+	codeFormatNotStreamable = "format_not_streamable"
+	codeNoUsableFormat      = "no_usable_format"
+	codeSubtitlesNotFound   = "subtitles_not_found"
+	codeThumbnailNotFound   = "thumbnail_not_found"
+	codeUpstreamError       = "upstream_error"
+	codeServerBusy          = "server_busy"
+	codeRateLimited         = "rate_limited"
+	codeHostNotAllowed      = "host_not_allowed"
+	codeRequestNotFound     = "request_not_found"
+	codeIsPlaylist          = "is_playlist"
+	codeBotCheck            = "bot_check"
+	codeStreamFailed        = "stream_failed"
+	codeInternalError       = "internal_error"
+)
+
+// errorResponse is the body of JSON errors
+type errorResponse struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+// writeError responds with a JSON error body for clients accepting JSON,
+// and with plain text like http.Error otherwise
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, msg string) {
+	// An error is never a download, even if stream headers were already set
+	w.Header().Del("Content-Disposition")
+	w.Header().Del("Trailer")
+
+	accept := r.Header.Get("Accept")
+	if acceptQuality(accept, "application/json") <= acceptQuality(accept, "text/plain") {
+		http.Error(w, msg, status)
+		return
+	}
+
+	// Drop headers meant for a stream that never started
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(errorResponse{Error: code, Message: msg}); err != nil {
+		slog.ErrorContext(r.Context(), "Error encoding error response", "err", err)
+	}
+}
+
+// streamErrorCode maps an early ffmpeg failure to its error code
+func streamErrorCode(reason streamer.Reason) string {
+	if reason == streamer.ReasonUnknown {
+		return codeStreamFailed
+	}
+	return string(reason)
+}
+
+// streamErrorStatus is the status for an early ffmpeg failure, the source's
+// fault except when ffmpeg was too slow to start or the output too big to keep
+func streamErrorStatus(reason streamer.Reason) int {
+	switch reason {
+	case streamer.ReasonFirstByteTimeout:
+		return http.StatusGatewayTimeout
+	case streamer.ReasonOutputTooLarge:
+		return http.StatusInsufficientStorage
+	}
+	return http.StatusBadGateway
+}
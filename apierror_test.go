@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"video-microservice/internal/streamer"
+	"video-microservice/internal/ytdlp"
+)
+
+func TestWriteError_ContentTypes(t *testing.T) {
+	stubTools(t, nil, nil)
+	getVideoInfo = func(ctx context.Context, videoURL string) (*ytdlp.Info, error) {
+		return nil, ytdlp.ErrVideoNotFound
+	}
+
+	tests := []struct {
+		name     string
+		target   string
+		accept   string
+		status   int
+		wantJSON bool
+		code     string
+		message  string
+	}{
+		{"not found json", "/video?url=http://example.com/v", "application/json", http.StatusNotFound, true, codeVideoNotFound, "Video not found"},
+		{"not found text", "/video?url=http://example.com/v", "", http.StatusNotFound, false, "", "Video not found"},
+		{"not found browser", "/video?url=http://example.com/v", "text/html,*/*;q=0.8", http.StatusNotFound, false, "", "Video not found"},
+		{"invalid param json", "/video?url=http://example.com/v&mode=bogus", "application/json", http.StatusBadRequest, true, codeInvalidParameter, "Invalid 'mode' parameter"},
+		{"invalid param text", "/video?url=http://example.com/v&mode=bogus", "text/plain", http.StatusBadRequest, false, "", "Invalid 'mode' parameter"},
+		{"missing url json", "/video", "application/json", http.StatusBadRequest, true, codeMissingParameter, "Missing 'url' parameter"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.target, nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			rec := httptest.NewRecorder()
+			videoHandler(rec, req)
+
+			if rec.Code != tt.status {
+				t.Errorf("got status %d, want %d", rec.Code, tt.status)
+			}
+			ct := rec.Header().Get("Content-Type")
+			if !tt.wantJSON {
+				if !strings.HasPrefix(ct, "text/plain") {
+					t.Errorf("got Content-Type %q, want text/plain", ct)
+				}
+				if got := strings.TrimSpace(rec.Body.String()); got != tt.message {
+					t.Errorf("got body %q, want %q", got, tt.message)
+				}
+				return
+			}
+
+			if ct != "application/json" {
+				t.Errorf("got Content-Type %q, want application/json", ct)
+			}
+			var got errorResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatalf("invalid JSON body %q: %v", rec.Body.String(), err)
+			}
+			if got.Error != tt.code || got.Message != tt.message {
+				t.Errorf("got %+v, want {%s %s}", got, tt.code, tt.message)
+			}
+		})
+	}
+}
+
+func TestWriteInfoError_Codes(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{ytdlp.ErrIsPlaylist, http.StatusBadRequest, codeIsPlaylist},
+		{ytdlp.ErrBotCheck, http.StatusBadGateway, codeBotCheck},
+		{ytdlp.ErrGeoBlocked, http.StatusUnavailableForLegalReasons, codeGeoBlocked},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/formats?url=http://example.com/v", nil)
+		req.Header.Set("Accept", "application/json")
+		rec := httptest.NewRecorder()
+		writeInfoError(rec, req, tt.err)
+
+		var got errorResponse
+		json.Unmarshal(rec.Body.Bytes(), &got)
+		if rec.Code != tt.status || got.Error != tt.code {
+			t.Errorf("%v: got %d %q, want %d %q", tt.err, rec.Code, got.Error, tt.status, tt.code)
+		}
+	}
+}
+
+func TestWriteInfoError_BotCheckWithImpersonate(t *testing.T) {
+	old := ytdlp.Impersonate
+	ytdlp.Impersonate = "chrome"
+	t.Cleanup(func() { ytdlp.Impersonate = old })
+
+	req := httptest.NewRequest("GET", "/formats?url=http://example.com/v", nil)
+	req.Header.Set("Accept", "application/json")
+	rec := httptest.NewRecorder()
+	writeInfoError(rec, req, ytdlp.ErrBotCheck)
+
+	var got errorResponse
+	json.Unmarshal(rec.Body.Bytes(), &got)
+	if rec.Code != http.StatusInternalServerError || got.Error != codeInternalError {
+		t.Errorf("got %d %q, want %d %q", rec.Code, got.Error, http.StatusInternalServerError, codeInternalError)
+	}
+}
+
+func TestWriteInfoError_GeoBlockedWithBypass(t *testing.T) {
+	old := ytdlp.GeoBypass
+	ytdlp.GeoBypass = "US"
+	t.Cleanup(func() { ytdlp.GeoBypass = old })
+
+	req := httptest.NewRequest("GET", "/formats?url=http://example.com/v", nil)
+	req.Header.Set("Accept", "application/json")
+	rec := httptest.NewRecorder()
+	writeInfoError(rec, req, ytdlp.ErrGeoBlocked)
+
+	var got errorResponse
+	json.Unmarshal(rec.Body.Bytes(), &got)
+	if rec.Code != http.StatusInternalServerError || got.Error != codeInternalError {
+		t.Errorf("got %d %q, want %d %q", rec.Code, got.Error, http.StatusInternalServerError, codeInternalError)
+	}
+}
+
+func TestStreamErrorStatus(t *testing.T) {
+	if got := streamErrorStatus(streamer.ReasonFirstByteTimeout); got != http.StatusGatewayTimeout {
+		t.Errorf("first byte timeout: got %d, want 504", got)
+	}
+	if got := streamErrorStatus(streamer.ReasonForbidden); got != http.StatusBadGateway {
+		t.Errorf("upstream forbidden: got %d, want 502", got)
+	}
+	if got := streamErrorCode(streamer.ReasonFirstByteTimeout); got != "first_byte_timeout" {
+		t.Errorf("got code %q", got)
+	}
+}
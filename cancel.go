@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"video-microservice/internal/streamer"
+)
+
+// cancelTokenHeader carries the token that POST /cancel takes as id for a /video request
+const cancelTokenHeader = "X-Cancel-Token"
+
+// errCancelled is the cause of a stream stopped through POST /cancel
+var errCancelled = streamer.ErrCancelled
+
+// cancelRegistry tracks in-flight /video requests by a random token handed
+// to their client, so it can stop a transcode without dropping the
+// connection. Request ids are chosen by clients and easy to guess, tokens aren't.
+type cancelRegistry struct {
+	mu      sync.Mutex
+	byToken map[string]context.CancelCauseFunc
+}
+
+var inFlight = &cancelRegistry{byToken: make(map[string]context.CancelCauseFunc)}
+
+// newCancelToken returns a random 32 character token
+func newCancelToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// A guessable token would defeat the point, Go 1.24 treats this as fatal too
+		panic(fmt.Sprintf("crypto/rand failed: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
+
+// add registers ctx under a new token and returns its cancelable child and
+// the token, along with the func that removes it again once the request is done
+func (c *cancelRegistry) add(ctx context.Context) (context.Context, string, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	token := newCancelToken()
+	c.mu.Lock()
+	c.byToken[token] = cancel
+	c.mu.Unlock()
+
+	return ctx, token, func() {
+		c.mu.Lock()
+		delete(c.byToken, token)
+		c.mu.Unlock()
+		cancel(nil)
+	}
+}
+
+// cancel stops the request registered under token, reporting whether there was one
+func (c *cancelRegistry) cancel(token string) bool {
+	c.mu.Lock()
+	cancel, ok := c.byToken[token]
+	c.mu.Unlock()
+	if ok {
+		cancel(errCancelled)
+	}
+	return ok
+}
+
+// len returns the number of requests in flight
+func (c *cancelRegistry) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.byToken)
+}
+
+// cancelable registers each request for POST /cancel and sends its token
+// in the X-Cancel-Token response header
+func cancelable(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, token, done := inFlight.add(r.Context())
+		defer done()
+		w.Header().Set(cancelTokenHeader, token)
+		next.ServeHTTP(w, r.WithContext(ctx))
+		if context.Cause(ctx) == errCancelled {
+			slog.InfoContext(ctx, "Request cancelled by client")
+		}
+	})
+}
+
+// cancelHandler stops the in-flight /video request whose cancel token is
+// given as id. Its client sees the stream end early.
+func cancelHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("id")
+	if token == "" {
+		writeError(w, r, http.StatusBadRequest, codeMissingParameter, "Missing 'id' parameter")
+		return
+	}
+	if !inFlight.cancel(token) {
+		writeError(w, r, http.StatusNotFound, codeRequestNotFound, "No request in flight with that token")
+		return
+	}
+	slog.InfoContext(r.Context(), "Cancelling request")
+	w.WriteHeader(http.StatusNoContent)
+}
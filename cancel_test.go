@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"video-microservice/internal/streamer"
+)
+
+func TestCancelHandler(t *testing.T) {
+	started := make(chan struct{})
+	stopped := make(chan error, 1)
+	stubTools(t, testInfo(), func(ctx context.Context, opts streamer.StreamOptions, w io.Writer) error {
+		w.Write([]byte("partial"))
+		close(started)
+		<-ctx.Done()
+		stopped <- context.Cause(ctx)
+		return fmt.Errorf("%w: ffmpeg killed", streamer.ErrCancelled)
+	})
+
+	const id = "batch-job-7"
+	handler := newMux()
+	rec := httptest.NewRecorder()
+	streamDone := make(chan struct{})
+	go func() {
+		req := httptest.NewRequest("GET", "/video?url=http://example.com/cancel-test", nil)
+		req.Header.Set(requestIDHeader, id)
+		handler.ServeHTTP(rec, req)
+		close(streamDone)
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream did not start")
+	}
+	// The headers are set before the stream starts
+	token := rec.Header().Get(cancelTokenHeader)
+	if len(token) != 32 {
+		t.Fatalf("got cancel token %q, want 32 hex characters", token)
+	}
+
+	// The request id isn't enough to cancel someone's stream
+	cancelRec := httptest.NewRecorder()
+	handler.ServeHTTP(cancelRec, httptest.NewRequest("POST", "/cancel?id="+id, nil))
+	if cancelRec.Code != http.StatusNotFound {
+		t.Fatalf("cancel by request id got status %d, want 404", cancelRec.Code)
+	}
+
+	cancelRec = httptest.NewRecorder()
+	handler.ServeHTTP(cancelRec, httptest.NewRequest("POST", "/cancel?id="+token, nil))
+	if cancelRec.Code != http.StatusNoContent {
+		t.Fatalf("cancel got status %d: %s", cancelRec.Code, cancelRec.Body.String())
+	}
+
+	select {
+	case cause := <-stopped:
+		if cause != errCancelled {
+			t.Errorf("stream stopped with cause %v", cause)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream was not cancelled")
+	}
+	<-streamDone
+	// A cancelled stream just ends, it isn't turned into an error response
+	if rec.Code != http.StatusOK || rec.Body.String() != "partial" {
+		t.Errorf("got status %d and body %q, want the partial stream", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get(requestIDHeader); got != id {
+		t.Errorf("stream response id %q, want %q", got, id)
+	}
+	if n := inFlight.len(); n != 0 {
+		t.Errorf("expected the registry to be empty after the stream, got %d tokens", n)
+	}
+
+	// Nothing is in flight under that token anymore
+	cancelRec = httptest.NewRecorder()
+	handler.ServeHTTP(cancelRec, httptest.NewRequest("POST", "/cancel?id="+token, nil))
+	if cancelRec.Code != http.StatusNotFound {
+		t.Errorf("second cancel got status %d, want 404", cancelRec.Code)
+	}
+}
+
+func TestCancelHandler_MissingToken(t *testing.T) {
+	rec := httptest.NewRecorder()
+	newMux().ServeHTTP(rec, httptest.NewRequest("POST", "/cancel", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("got status %d, want 400", rec.Code)
+	}
+}
+
+func TestCancelRegistry(t *testing.T) {
+	r := &cancelRegistry{byToken: make(map[string]context.CancelCauseFunc)}
+	a, tokenA, doneA := r.add(context.Background())
+	b, tokenB, doneB := r.add(context.Background())
+	if tokenA == tokenB {
+		t.Fatalf("two requests got the same token %q", tokenA)
+	}
+
+	doneA()
+	if a.Err() == nil {
+		t.Error("expected a finished request's context to be cancelled")
+	}
+	if r.cancel(tokenA) {
+		t.Error("expected a finished request's token to be gone")
+	}
+	if !r.cancel(tokenB) || b.Err() == nil {
+		t.Error("expected the remaining request to be cancelled")
+	}
+	doneB()
+	if r.len() != 0 {
+		t.Errorf("expected an empty registry, got %d tokens", r.len())
+	}
+}
@@ -0,0 +1,558 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"video-microservice/internal/codec"
+	"video-microservice/internal/requestid"
+	"video-microservice/internal/streamer"
+	"video-microservice/internal/ytdlp"
+)
+
+// Config holds every tunable of the service. LoadConfig layers it from the
+// code defaults, an optional JSON file and the DLP_* environment variables,
+// and apply hands the result to the internal packages.
+type Config struct {
+	Port      string `json:"port"`
+	LogFormat string `json:"log_format"`
+
+	CacheTTL        Duration `json:"cache_ttl"`
+	CacheSweep      Duration `json:"cache_sweep"`
+	NegativeTTL     Duration `json:"negative_ttl"`
+	SelectionTTL    Duration `json:"selection_ttl"`
+	CacheMaxEntries int      `json:"cache_max_entries"`
+
+	YtdlpPath      string   `json:"ytdlp_path"`
+	YtdlpTimeout   Duration `json:"ytdlp_timeout"`
+	YtdlpRetries   int      `json:"ytdlp_retries"`
+	CookiesFile    string   `json:"cookies_file"`
+	ExtractorArgs  []string `json:"extractor_args"`
+	GeoBypass      string   `json:"geo_bypass"`
+	Impersonate    string   `json:"impersonate"`
+	MaxHeight      int      `json:"max_height"`
+	DefaultQuality string   `json:"default_quality"`
+	AllowAV1       bool     `json:"allow_av1"`
+
+	FFmpegPath      string   `json:"ffmpeg_path"`
+	FFprobePath     string   `json:"ffprobe_path"`
+	Probe           bool     `json:"probe"`
+	FFmpegLogLevel  string   `json:"ffmpeg_loglevel"`
+	FFmpegThreads   int      `json:"ffmpeg_threads"`
+	FFmpegExtraArgs []string `json:"ffmpeg_extra_args"`
+	AllowExtraArgs  bool     `json:"allow_extra_args"`
+	AACBitrate      string   `json:"aac_bitrate"`
+	LoudnormTarget  float64  `json:"loudnorm_target"`
+	HWAccel         string   `json:"hwaccel"`
+	HWAccelDevice   string   `json:"hwaccel_device"`
+	TempDir         string   `json:"temp_dir"`
+	MaxOutputMB     int      `json:"max_output_mb"`
+	X264Preset      string   `json:"x264_preset"`
+	GOPSeconds      float64  `json:"gop_seconds"`
+	ConstantFPS     bool     `json:"constant_fps"`
+	StallTimeout    Duration `json:"stall_timeout"`
+	TTFBTimeout     Duration `json:"ttfb_timeout"`
+	TTFBAction      string   `json:"ttfb_action"`
+	PaceMultiplier  float64  `json:"pace_multiplier"`
+
+	MaxConcurrent    int      `json:"max_concurrent"`
+	ShutdownTimeout  Duration `json:"shutdown_timeout"`
+	ProxyProgressive bool     `json:"proxy_progressive"`
+	StrictQuality    bool     `json:"strict_quality"`
+	RateLimit        int      `json:"rate_limit"`
+	RateBurst        int      `json:"rate_burst"`
+	TrustProxy       bool     `json:"trust_proxy"`
+	AllowedHosts     []string `json:"allowed_hosts"`
+	AllowedSchemes   []string `json:"allowed_schemes"`
+	InsecureTLS      bool     `json:"insecure_tls"`
+	DefaultUA        string   `json:"default_user_agent"`
+	CORSOrigins      []string `json:"cors_origins"`
+
+	FileCacheDir       string   `json:"file_cache_dir"`
+	FileCacheMaxMB     int      `json:"file_cache_max_mb"`
+	FileCacheMaxFileMB int      `json:"file_cache_max_file_mb"`
+	FileCacheTTL       Duration `json:"file_cache_ttl"`
+}
+
+// Duration is a time.Duration written as a Go duration string in the config file, e.g. "90s"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"90s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// defaultConfig returns the current package settings, which are the code defaults at startup
+func defaultConfig() *Config {
+	return &Config{
+		Port:      "8080",
+		LogFormat: "text",
+
+		CacheTTL:        Duration(ytdlp.CacheTTL),
+		CacheSweep:      Duration(ytdlp.CacheSweepInterval),
+		NegativeTTL:     Duration(ytdlp.NegativeTTL),
+		SelectionTTL:    Duration(ytdlp.SelectionTTL),
+		CacheMaxEntries: ytdlp.CacheMaxEntries,
+
+		YtdlpPath:      ytdlp.BinaryPath,
+		YtdlpTimeout:   Duration(ytdlp.MetadataTimeout),
+		YtdlpRetries:   ytdlp.MaxRetries,
+		CookiesFile:    ytdlp.CookiesFile,
+		ExtractorArgs:  ytdlp.ExtractorArgs,
+		GeoBypass:      ytdlp.GeoBypass,
+		Impersonate:    ytdlp.Impersonate,
+		MaxHeight:      ytdlp.MaxHeight,
+		DefaultQuality: string(ytdlp.DefaultQuality),
+		AllowAV1:       codec.AllowAV1,
+
+		FFmpegPath:      streamer.FFmpegPath,
+		FFprobePath:     streamer.FFprobePath,
+		Probe:           streamer.ProbeBeforeCopy,
+		FFmpegLogLevel:  streamer.FFmpegLogLevel,
+		FFmpegThreads:   streamer.FFmpegThreads,
+		FFmpegExtraArgs: streamer.ExtraArgs,
+		AACBitrate:      streamer.AACBitrate,
+		LoudnormTarget:  streamer.LoudnormTarget,
+		HWAccel:         string(streamer.HWAccelMode),
+		HWAccelDevice:   streamer.HWAccelDevice,
+		TempDir:         streamer.TempDir,
+		MaxOutputMB:     int(streamer.MaxOutputSize >> 20),
+		X264Preset:      streamer.X264Preset,
+		GOPSeconds:      streamer.GOPSeconds,
+		ConstantFPS:     streamer.ConstantFrameRate,
+		StallTimeout:    Duration(streamer.StallTimeout),
+		TTFBTimeout:     Duration(streamer.TTFBTimeout),
+		TTFBAction:      string(streamer.TTFBAction),
+		PaceMultiplier:  streamer.PaceMultiplier,
+
+		MaxConcurrent:    cap(streamSlots),
+		ShutdownTimeout:  Duration(shutdownTimeout),
+		ProxyProgressive: proxyProgressive,
+		StrictQuality:    strictQuality,
+		RateLimit:        rateLimitPerMinute,
+		RateBurst:        rateLimitBurst,
+		TrustProxy:       trustProxy,
+		AllowedHosts:     allowedHosts,
+		AllowedSchemes:   allowedSchemes,
+		InsecureTLS:      streamer.InsecureTLS,
+		DefaultUA:        streamer.DefaultUserAgent,
+		CORSOrigins:      corsOrigins,
+
+		FileCacheDir:       fileCacheDir,
+		FileCacheMaxMB:     fileCacheMaxMB,
+		FileCacheMaxFileMB: fileCacheMaxFileMB,
+		FileCacheTTL:       Duration(fileCacheTTL),
+	}
+}
+
+// LoadConfig builds the configuration from the code defaults, overlaid by the
+// JSON file at path if it's not empty, overlaid by the environment.
+// Environment values with a fallback are logged and ignored when invalid, like
+// before config files existed. The merged result must pass validate.
+func LoadConfig(path string) (*Config, error) {
+	cfg := defaultConfig()
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return nil, fmt.Errorf("config file %s: %w", path, err)
+		}
+	}
+	cfg.loadEnv()
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// validateQuality checks the default quality, which has to be named.
+// Ignoring a bad one would quietly change what every client gets.
+func validateQuality(s string) error {
+	if _, err := ytdlp.ParseQuality(s); err != nil || s == "" {
+		return fmt.Errorf("invalid default quality %q, use low, medium or high", s)
+	}
+	return nil
+}
+
+// loadFile overlays the fields set in a JSON config file.
+// Unknown keys are rejected so typos don't go unnoticed.
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return err
+	}
+	return c.validate()
+}
+
+// validate checks the values that have no sensible fallback
+func (c *Config) validate() error {
+	for name, d := range map[string]Duration{
+		"cache_ttl": c.CacheTTL, "cache_sweep": c.CacheSweep, "negative_ttl": c.NegativeTTL, "selection_ttl": c.SelectionTTL,
+		"ytdlp_timeout": c.YtdlpTimeout, "shutdown_timeout": c.ShutdownTimeout,
+		"ttfb_timeout": c.TTFBTimeout, "file_cache_ttl": c.FileCacheTTL,
+	} {
+		if d <= 0 {
+			return fmt.Errorf("%s must be positive", name)
+		}
+	}
+	for name, n := range map[string]int{
+		"cache_max_entries": c.CacheMaxEntries, "max_concurrent": c.MaxConcurrent, "rate_burst": c.RateBurst,
+		"file_cache_max_mb": c.FileCacheMaxMB, "file_cache_max_file_mb": c.FileCacheMaxFileMB,
+		"max_output_mb": c.MaxOutputMB,
+	} {
+		if n <= 0 {
+			return fmt.Errorf("%s must be positive", name)
+		}
+	}
+	if c.YtdlpRetries < 0 || c.MaxHeight < 0 || c.RateLimit < 0 || c.FFmpegThreads < 0 {
+		return errors.New("ytdlp_retries, max_height, rate_limit and ffmpeg_threads can't be negative")
+	}
+	// Zero disables the stall check
+	if c.StallTimeout < 0 {
+		return errors.New("stall_timeout can't be negative")
+	}
+	if c.GOPSeconds <= 0 {
+		return errors.New("gop_seconds must be positive")
+	}
+	// Slower than real time would starve the player
+	if c.PaceMultiplier < 1 {
+		return errors.New("pace_multiplier must be at least 1")
+	}
+	if !validLoudnormTarget(c.LoudnormTarget) {
+		return errors.New("loudnorm_target must be between -70 and -5 LUFS")
+	}
+	if _, err := streamer.ParseHWAccel(c.HWAccel); err != nil {
+		return err
+	}
+	if _, err := streamer.ParseFirstByteAction(c.TTFBAction); err != nil {
+		return err
+	}
+	if _, err := ytdlp.ParseGeoBypass(c.GeoBypass); err != nil {
+		return err
+	}
+	if err := validateQuality(c.DefaultQuality); err != nil {
+		return err
+	}
+	switch c.LogFormat {
+	case "text", "json":
+	default:
+		return fmt.Errorf("unknown log_format %q", c.LogFormat)
+	}
+	c.AllowedHosts = parseHostList(strings.Join(c.AllowedHosts, ","))
+	c.AllowedSchemes = parseSchemeList(strings.Join(c.AllowedSchemes, ","))
+	if len(c.AllowedSchemes) == 0 {
+		return errors.New("allowed_schemes can't be empty")
+	}
+	c.CORSOrigins = parseOriginList(strings.Join(c.CORSOrigins, ","))
+	return nil
+}
+
+// loadEnv overrides the config with the DLP_* environment variables that are set
+func (c *Config) loadEnv() {
+	if v := os.Getenv("PORT"); v != "" {
+		c.Port = v
+	}
+	switch v := os.Getenv("DLP_LOG_FORMAT"); v {
+	case "":
+	case "text", "json":
+		c.LogFormat = v
+	default:
+		slog.Warn("Invalid DLP_LOG_FORMAT, ignoring it", "value", v)
+	}
+
+	c.CacheTTL = Duration(envDuration("DLP_CACHE_TTL", time.Duration(c.CacheTTL)))
+	c.CacheSweep = Duration(envDuration("DLP_CACHE_SWEEP", time.Duration(c.CacheSweep)))
+	c.NegativeTTL = Duration(envDuration("DLP_NEGATIVE_TTL", time.Duration(c.NegativeTTL)))
+	c.SelectionTTL = Duration(envDuration("DLP_SELECTION_TTL", time.Duration(c.SelectionTTL)))
+	c.CacheMaxEntries = envInt("DLP_CACHE_MAX_ENTRIES", c.CacheMaxEntries)
+
+	c.YtdlpPath = envString("DLP_YTDLP_PATH", c.YtdlpPath)
+	c.YtdlpTimeout = Duration(envDuration("DLP_YTDLP_TIMEOUT", time.Duration(c.YtdlpTimeout)))
+	c.YtdlpRetries = envNonNegativeInt("DLP_YTDLP_RETRIES", c.YtdlpRetries)
+	c.CookiesFile = envString("DLP_COOKIES_FILE", c.CookiesFile)
+	// Whitespace separated since the values themselves use ',', ';' and '='
+	if v := os.Getenv("DLP_EXTRACTOR_ARGS"); v != "" {
+		c.ExtractorArgs = strings.Fields(v)
+	}
+	if v := os.Getenv("DLP_GEO_BYPASS"); v != "" {
+		if _, err := ytdlp.ParseGeoBypass(v); err != nil {
+			slog.Warn("Invalid DLP_GEO_BYPASS, ignoring it", "value", v)
+		} else {
+			c.GeoBypass = v
+		}
+	}
+	c.Impersonate = envString("DLP_IMPERSONATE", c.Impersonate)
+	c.MaxHeight = envNonNegativeInt("DLP_MAX_HEIGHT", c.MaxHeight)
+	c.DefaultQuality = envString("DLP_DEFAULT_QUALITY", c.DefaultQuality)
+	c.AllowAV1 = envBool("DLP_ALLOW_AV1", c.AllowAV1)
+
+	c.FFmpegPath = envString("DLP_FFMPEG_PATH", c.FFmpegPath)
+	c.FFprobePath = envString("DLP_FFPROBE_PATH", c.FFprobePath)
+	c.Probe = envBool("DLP_PROBE", c.Probe)
+	c.FFmpegLogLevel = envString("DLP_FFMPEG_LOGLEVEL", c.FFmpegLogLevel)
+	c.FFmpegThreads = envNonNegativeInt("DLP_FFMPEG_THREADS", c.FFmpegThreads)
+	if v := os.Getenv("DLP_FFMPEG_EXTRA_ARGS"); v != "" {
+		c.FFmpegExtraArgs = strings.Fields(v)
+	}
+	c.AllowExtraArgs = envBool("DLP_ALLOW_EXTRA_ARGS", c.AllowExtraArgs)
+	c.AACBitrate = envString("DLP_AAC_BITRATE", c.AACBitrate)
+	if v := os.Getenv("DLP_LOUDNORM_TARGET"); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err != nil || !validLoudnormTarget(f) {
+			slog.Warn("Invalid DLP_LOUDNORM_TARGET, ignoring it", "value", v)
+		} else {
+			c.LoudnormTarget = f
+		}
+	}
+	if v := os.Getenv("DLP_HWACCEL"); v != "" {
+		if _, err := streamer.ParseHWAccel(v); err != nil {
+			slog.Warn("Invalid DLP_HWACCEL, ignoring it", "value", v)
+		} else {
+			c.HWAccel = v
+		}
+	}
+	c.HWAccelDevice = envString("DLP_HWACCEL_DEVICE", c.HWAccelDevice)
+	c.TempDir = envString("DLP_TEMP_DIR", c.TempDir)
+	c.MaxOutputMB = envInt("DLP_MAX_OUTPUT_MB", c.MaxOutputMB)
+	c.X264Preset = envString("DLP_X264_PRESET", c.X264Preset)
+	c.GOPSeconds = envFloat("DLP_GOP_SECONDS", c.GOPSeconds)
+	c.ConstantFPS = envBool("DLP_CONSTANT_FPS", c.ConstantFPS)
+	c.StallTimeout = Duration(envNonNegativeDuration("DLP_STALL_TIMEOUT", time.Duration(c.StallTimeout)))
+	c.TTFBTimeout = Duration(envDuration("DLP_TTFB_TIMEOUT", time.Duration(c.TTFBTimeout)))
+	if v := os.Getenv("DLP_TTFB_ACTION"); v != "" {
+		if _, err := streamer.ParseFirstByteAction(v); err != nil {
+			slog.Warn("Invalid DLP_TTFB_ACTION, ignoring it", "value", v)
+		} else {
+			c.TTFBAction = v
+		}
+	}
+	c.PaceMultiplier = envFloat("DLP_PACE_MULTIPLIER", c.PaceMultiplier)
+
+	c.MaxConcurrent = envInt("DLP_MAX_CONCURRENT", c.MaxConcurrent)
+	c.ShutdownTimeout = Duration(envDuration("DLP_SHUTDOWN_TIMEOUT", time.Duration(c.ShutdownTimeout)))
+	c.ProxyProgressive = envBool("DLP_PROXY_PROGRESSIVE", c.ProxyProgressive)
+	c.StrictQuality = envBool("DLP_STRICT_QUALITY", c.StrictQuality)
+	c.RateLimit = envNonNegativeInt("DLP_RATE_LIMIT", c.RateLimit)
+	c.RateBurst = envInt("DLP_RATE_BURST", c.RateBurst)
+	c.TrustProxy = envBool("DLP_TRUST_PROXY", c.TrustProxy)
+	if v := os.Getenv("DLP_ALLOWED_HOSTS"); v != "" {
+		c.AllowedHosts = parseHostList(v)
+	}
+	if v := os.Getenv("DLP_ALLOWED_SCHEMES"); v != "" {
+		if schemes := parseSchemeList(v); len(schemes) > 0 {
+			c.AllowedSchemes = schemes
+		}
+	}
+	if v := os.Getenv("DLP_CORS_ORIGINS"); v != "" {
+		c.CORSOrigins = parseOriginList(v)
+	}
+
+	c.InsecureTLS = envBool("DLP_INSECURE_TLS", c.InsecureTLS)
+	c.DefaultUA = envString("DLP_DEFAULT_UA", c.DefaultUA)
+
+	c.FileCacheDir = envString("DLP_FILE_CACHE_DIR", c.FileCacheDir)
+	c.FileCacheMaxMB = envInt("DLP_FILE_CACHE_MAX_MB", c.FileCacheMaxMB)
+	c.FileCacheMaxFileMB = envInt("DLP_FILE_CACHE_MAX_FILE_MB", c.FileCacheMaxFileMB)
+	c.FileCacheTTL = Duration(envDuration("DLP_FILE_CACHE_TTL", time.Duration(c.FileCacheTTL)))
+}
+
+// apply hands the configuration to the internal packages.
+// It must run before the server starts handling requests.
+func (c *Config) apply() {
+	ytdlp.CacheTTL = time.Duration(c.CacheTTL)
+	ytdlp.CacheSweepInterval = time.Duration(c.CacheSweep)
+	ytdlp.NegativeTTL = time.Duration(c.NegativeTTL)
+	ytdlp.SelectionTTL = time.Duration(c.SelectionTTL)
+	ytdlp.CacheMaxEntries = c.CacheMaxEntries
+	ytdlp.BinaryPath = c.YtdlpPath
+	ytdlp.MetadataTimeout = time.Duration(c.YtdlpTimeout)
+	ytdlp.MaxRetries = c.YtdlpRetries
+	ytdlp.CookiesFile = c.CookiesFile
+	ytdlp.ExtractorArgs = c.ExtractorArgs
+	ytdlp.GeoBypass, _ = ytdlp.ParseGeoBypass(c.GeoBypass)
+	ytdlp.Impersonate = c.Impersonate
+	ytdlp.MaxHeight = c.MaxHeight
+	ytdlp.DefaultQuality = ytdlp.Quality(c.DefaultQuality)
+	codec.AllowAV1 = c.AllowAV1
+
+	streamer.FFmpegPath = c.FFmpegPath
+	streamer.FFprobePath = c.FFprobePath
+	streamer.ProbeBeforeCopy = c.Probe
+	streamer.FFmpegLogLevel = c.FFmpegLogLevel
+	streamer.FFmpegThreads = c.FFmpegThreads
+	// Raw options can break every stream, so they must be opted into
+	streamer.ExtraArgs = nil
+	if c.AllowExtraArgs {
+		streamer.ExtraArgs = c.FFmpegExtraArgs
+	} else if len(c.FFmpegExtraArgs) > 0 {
+		slog.Warn("ffmpeg extra args are set without DLP_ALLOW_EXTRA_ARGS=true, ignoring them", "args", c.FFmpegExtraArgs)
+	}
+	streamer.AACBitrate = c.AACBitrate
+	streamer.LoudnormTarget = c.LoudnormTarget
+	// Validated when loaded
+	streamer.HWAccelMode, _ = streamer.ParseHWAccel(c.HWAccel)
+	streamer.HWAccelDevice = c.HWAccelDevice
+	streamer.TempDir = c.TempDir
+	streamer.MaxOutputSize = int64(c.MaxOutputMB) << 20
+	streamer.X264Preset = c.X264Preset
+	streamer.GOPSeconds = c.GOPSeconds
+	streamer.ConstantFrameRate = c.ConstantFPS
+	streamer.StallTimeout = time.Duration(c.StallTimeout)
+	streamer.TTFBTimeout = time.Duration(c.TTFBTimeout)
+	streamer.TTFBAction, _ = streamer.ParseFirstByteAction(c.TTFBAction)
+	streamer.PaceMultiplier = c.PaceMultiplier
+
+	if c.MaxConcurrent != cap(streamSlots) {
+		streamSlots = newSemaphore(c.MaxConcurrent)
+	}
+	shutdownTimeout = time.Duration(c.ShutdownTimeout)
+	proxyProgressive = c.ProxyProgressive
+	strictQuality = c.StrictQuality
+	rateLimitPerMinute = c.RateLimit
+	rateLimitBurst = c.RateBurst
+	trustProxy = c.TrustProxy
+	allowedHosts = c.AllowedHosts
+	allowedSchemes = c.AllowedSchemes
+	ytdlp.InsecureTLS = c.InsecureTLS
+	streamer.InsecureTLS = c.InsecureTLS
+	if c.InsecureTLS {
+		slog.Warn("INSECURE: TLS certificate verification is disabled for all sources (DLP_INSECURE_TLS)")
+	}
+	streamer.DefaultUserAgent = c.DefaultUA
+	corsOrigins = c.CORSOrigins
+
+	fileCacheDir = c.FileCacheDir
+	fileCacheMaxMB = c.FileCacheMaxMB
+	fileCacheMaxFileMB = c.FileCacheMaxFileMB
+	fileCacheTTL = time.Duration(c.FileCacheTTL)
+}
+
+// setupLogging sets the default logger to JSON for the "json" format and to
+// key=value text otherwise. Records logged with a request's context carry its id.
+// slog's own default handler can't be wrapped, it writes through the log
+// package which SetDefault redirects back to slog.
+func setupLogging(format string) {
+	var h slog.Handler = slog.NewTextHandler(os.Stderr, nil)
+	if format == "json" {
+		h = slog.NewJSONHandler(os.Stderr, nil)
+	}
+	slog.SetDefault(slog.New(requestid.NewHandler(h)))
+}
+
+// envString returns the environment value, or def if it's unset
+func envString(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// envDuration parses a Go duration string (e.g. "6h", "90s") from the environment
+func envDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		slog.Warn("Invalid config value, using default", "key", key, "value", v, "default", def)
+		return def
+	}
+	return d
+}
+
+// envNonNegativeDuration parses a duration that may be zero from the environment
+func envNonNegativeDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		slog.Warn("Invalid config value, using default", "key", key, "value", v, "default", def)
+		return def
+	}
+	return d
+}
+
+// envInt parses a positive integer from the environment
+func envInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		slog.Warn("Invalid config value, using default", "key", key, "value", v, "default", def)
+		return def
+	}
+	return n
+}
+
+// envNonNegativeInt parses an integer that may be zero from the environment
+func envNonNegativeInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		slog.Warn("Invalid config value, using default", "key", key, "value", v, "default", def)
+		return def
+	}
+	return n
+}
+
+// envBool parses a boolean ("true", "1", "false", ...) from the environment
+func envBool(key string, def bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		slog.Warn("Invalid config value, using default", "key", key, "value", v, "default", def)
+		return def
+	}
+	return b
+}
+
+// envFloat parses a positive number from the environment
+func envFloat(key string, def float64) float64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f <= 0 {
+		slog.Warn("Invalid config value, using default", "key", key, "value", v, "default", def)
+		return def
+	}
+	return f
+}
+
+// validLoudnormTarget reports whether ffmpeg's loudnorm filter accepts the integrated loudness target
+func validLoudnormTarget(lufs float64) bool {
+	return lufs >= -70 && lufs <= -5
+}
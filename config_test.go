@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+	"video-microservice/internal/streamer"
+	"video-microservice/internal/ytdlp"
+)
+
+func TestEnvDuration(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  time.Duration
+	}{
+		{name: "Unset uses default", value: "", want: 10 * time.Minute},
+		{name: "Valid duration", value: "6h", want: 6 * time.Hour},
+		{name: "Invalid falls back", value: "soon", want: 10 * time.Minute},
+		{name: "Negative falls back", value: "-1m", want: 10 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DLP_TEST_DURATION", tt.value)
+			if got := envDuration("DLP_TEST_DURATION", 10*time.Minute); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnvInt(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  int
+	}{
+		{name: "Unset uses default", value: "", want: 1000},
+		{name: "Valid integer", value: "50", want: 50},
+		{name: "Invalid falls back", value: "lots", want: 1000},
+		{name: "Zero falls back", value: "0", want: 1000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DLP_TEST_INT", tt.value)
+			if got := envInt("DLP_TEST_INT", 1000); got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_BinaryPaths(t *testing.T) {
+	defer func(y, f string) {
+		ytdlp.BinaryPath, streamer.FFmpegPath = y, f
+	}(ytdlp.BinaryPath, streamer.FFmpegPath)
+
+	// Stub yt-dlp that prints a fixed info document
+	stub := filepath.Join(t.TempDir(), "yt-dlp-stub")
+	script := "#!/bin/sh\necho '{\"id\":\"stub\",\"title\":\"From Stub\"}'\n"
+	if err := os.WriteFile(stub, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("DLP_YTDLP_PATH", stub)
+	t.Setenv("DLP_FFMPEG_PATH", "/opt/bin/ffmpeg")
+	cfg, err := LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.apply()
+
+	if streamer.FFmpegPath != "/opt/bin/ffmpeg" {
+		t.Errorf("got ffmpeg path %q, want /opt/bin/ffmpeg", streamer.FFmpegPath)
+	}
+
+	info, err := ytdlp.GetVideoInfo(context.Background(), "http://example.com/binary-path-test")
+	if err != nil {
+		t.Fatalf("GetVideoInfo failed: %v", err)
+	}
+	if info.Title != "From Stub" {
+		t.Errorf("got title %q, want the stub's output", info.Title)
+	}
+}
+
+func TestLoadConfig_ExtraArgs(t *testing.T) {
+	defer func(args []string) { streamer.ExtraArgs = args }(streamer.ExtraArgs)
+
+	t.Setenv("DLP_FFMPEG_EXTRA_ARGS", "-tune zerolatency  -profile:v baseline")
+	cfg, err := LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.apply()
+	if streamer.ExtraArgs != nil {
+		t.Errorf("extra args used without DLP_ALLOW_EXTRA_ARGS: %q", streamer.ExtraArgs)
+	}
+
+	t.Setenv("DLP_ALLOW_EXTRA_ARGS", "true")
+	if cfg, err = LoadConfig(""); err != nil {
+		t.Fatal(err)
+	}
+	cfg.apply()
+	if want := []string{"-tune", "zerolatency", "-profile:v", "baseline"}; !slices.Equal(streamer.ExtraArgs, want) {
+		t.Errorf("got extra args %q, want %q", streamer.ExtraArgs, want)
+	}
+}
+
+func TestLoadConfig_DefaultQuality(t *testing.T) {
+	defer func(q ytdlp.Quality) { ytdlp.DefaultQuality = q }(ytdlp.DefaultQuality)
+	info := testInfo()
+	info.Formats = append(info.Formats,
+		ytdlp.Format{FormatID: "136", URL: "http://cdn/720", VCodec: "avc1.4d401f", ACodec: "none", Width: 1280, Height: 720, TBR: 1500})
+	stubTools(t, info, func(ctx context.Context, opts streamer.StreamOptions, w io.Writer) error {
+		return nil
+	})
+
+	t.Setenv("DLP_DEFAULT_QUALITY", "medium")
+	cfg, err := LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.apply()
+
+	rec := httptest.NewRecorder()
+	videoHandler(rec, httptest.NewRequest("GET", "/video?url=http://example.com/default-quality", nil))
+	if got := rec.Header().Get("X-Selected-Video-Format"); got != "136" {
+		t.Errorf("got format %q without quality, want the 720p 136", got)
+	}
+
+	// Never silently ignored, it would change every response
+	t.Setenv("DLP_DEFAULT_QUALITY", "best")
+	if _, err := LoadConfig(""); err == nil {
+		t.Error("expected an error for an unknown default quality")
+	}
+}
+
+func TestLoadConfig_Precedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	file := `{
+		"cache_ttl": "1h",
+		"negative_ttl": "1m",
+		"max_concurrent": 3,
+		"hwaccel": "vaapi",
+		"allowed_hosts": ["YouTube.com", "vimeo.com"]
+	}`
+	if err := os.WriteFile(path, []byte(file), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DLP_CACHE_TTL", "2h")
+	t.Setenv("DLP_HWACCEL", "nvenc")
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Environment beats the file
+	if got := time.Duration(cfg.CacheTTL); got != 2*time.Hour {
+		t.Errorf("cache_ttl: got %v, want env value 2h", got)
+	}
+	if cfg.HWAccel != "nvenc" {
+		t.Errorf("hwaccel: got %q, want env value nvenc", cfg.HWAccel)
+	}
+	// The file beats the defaults
+	if got := time.Duration(cfg.NegativeTTL); got != time.Minute {
+		t.Errorf("negative_ttl: got %v, want file value 1m", got)
+	}
+	if cfg.MaxConcurrent != 3 {
+		t.Errorf("max_concurrent: got %d, want file value 3", cfg.MaxConcurrent)
+	}
+	if len(cfg.AllowedHosts) != 2 || cfg.AllowedHosts[0] != "youtube.com" {
+		t.Errorf("allowed_hosts: got %q", cfg.AllowedHosts)
+	}
+	// Anything else keeps the code default
+	if got := time.Duration(cfg.YtdlpTimeout); got != ytdlp.MetadataTimeout {
+		t.Errorf("ytdlp_timeout: got %v, want default %v", got, ytdlp.MetadataTimeout)
+	}
+	if cfg.Port != "8080" || cfg.X264Preset != streamer.X264Preset {
+		t.Errorf("got port %q and preset %q, want the defaults", cfg.Port, cfg.X264Preset)
+	}
+}
+
+func TestLoadConfig_InvalidFile(t *testing.T) {
+	dir := t.TempDir()
+	tests := map[string]string{
+		"unknown key":      `{"cache_tll": "1h"}`,
+		"bad duration":     `{"cache_ttl": "soon"}`,
+		"numeric duration": `{"cache_ttl": 600}`,
+		"zero concurrency": `{"max_concurrent": 0}`,
+		"bad hwaccel":      `{"hwaccel": "gpu"}`,
+		"slow pacing":      `{"pace_multiplier": 0.5}`,
+		"bad quality":      `{"default_quality": "4k"}`,
+	}
+	for name, body := range tests {
+		path := filepath.Join(dir, "config.json")
+		if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadConfig(path); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	if _, err := LoadConfig(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("missing file: expected an error")
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// corsOrigins are the browser origins allowed to call the API cross-origin,
+// e.g. "https://app.example.com". "*" allows any origin, none disables CORS.
+var corsOrigins []string
+
+// Request headers browsers may send cross-origin, Range for seeking in players
+const corsAllowHeaders = "Range, Accept, Content-Type, X-Request-ID"
+
+// Response headers scripts may read, beyond the few CORS always exposes
+const corsExposeHeaders = "Content-Length, Content-Range, Content-Disposition, Retry-After, " +
+	"X-Video-Duration, X-Is-Live, X-Audio, X-Stream-Duration, X-Source-Bitrate, X-Request-ID, X-Cancel-Token, " +
+	"X-Selected-Video-Format, X-Selected-Audio-Format, X-Video-Resolution, X-Transcode"
+
+// cors adds CORS headers for allowed origins and answers preflight requests.
+// Other origins get no CORS headers, so browsers block their scripts from reading the response.
+func cors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if origin == "" || len(corsOrigins) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		if allowOrigin(origin) {
+			if slices.Contains(corsOrigins, "*") {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+			}
+			if preflight {
+				w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+				w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+				w.Header().Set("Access-Control-Max-Age", "600")
+			} else {
+				w.Header().Set("Access-Control-Expose-Headers", corsExposeHeaders)
+			}
+		}
+		// Preflights never reach the handlers, which would treat them as a GET
+		if preflight {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowOrigin reports whether origin is in corsOrigins, ignoring case
+func allowOrigin(origin string) bool {
+	for _, allowed := range corsOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseOriginList splits a comma-separated list of origins, dropping
+// trailing slashes since browsers never send them
+func parseOriginList(v string) []string {
+	var origins []string
+	for _, o := range strings.Split(v, ",") {
+		o = strings.TrimSuffix(strings.TrimSpace(o), "/")
+		if o != "" {
+			origins = append(origins, o)
+		}
+	}
+	return origins
+}
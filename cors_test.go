@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+	defer func(old []string) { corsOrigins = old }(corsOrigins)
+	corsOrigins = parseOriginList("https://app.example.com/, https://admin.example.com")
+
+	reached := false
+	handler := cors(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	}))
+
+	// Preflight from an allowed origin
+	req := httptest.NewRequest("OPTIONS", "/video?url=http://example.com/v", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	req.Header.Set("Access-Control-Request-Headers", "range")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("preflight: got status %d, want 204", rec.Code)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://app.example.com" {
+		t.Errorf("preflight: got Access-Control-Allow-Origin %q", got)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Headers"); got != corsAllowHeaders {
+		t.Errorf("preflight: got Access-Control-Allow-Headers %q", got)
+	}
+	if reached {
+		t.Error("preflight must not reach the handler")
+	}
+
+	// Preflight from another origin
+	req.Header.Set("Origin", "https://evil.example.com")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("disallowed origin: got Access-Control-Allow-Origin %q", got)
+	}
+
+	// Actual request from an allowed origin
+	req = httptest.NewRequest("GET", "/formats?url=http://example.com/v", nil)
+	req.Header.Set("Origin", "https://admin.example.com")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if !reached {
+		t.Error("request not passed to the handler")
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://admin.example.com" {
+		t.Errorf("request: got Access-Control-Allow-Origin %q", got)
+	}
+	if got := rec.Header().Get("Access-Control-Expose-Headers"); !strings.Contains(got, cancelTokenHeader) {
+		t.Errorf("request: %s not exposed, got %q", cancelTokenHeader, got)
+	}
+
+	// Wildcard
+	corsOrigins = []string{"*"}
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("wildcard: got Access-Control-Allow-Origin %q", got)
+	}
+}
+
+func TestCORS_Disabled(t *testing.T) {
+	defer func(old []string) { corsOrigins = old }(corsOrigins)
+	corsOrigins = nil
+
+	req := httptest.NewRequest("GET", "/formats", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	rec := httptest.NewRecorder()
+	cors(http.NotFoundHandler()).ServeHTTP(rec, req)
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("got Access-Control-Allow-Origin %q without configured origins", got)
+	}
+}
+
+func TestNewMux_CORS(t *testing.T) {
+	defer func(old []string) { corsOrigins = old }(corsOrigins)
+	corsOrigins = []string{"https://app.example.com"}
+
+	// Preflights for routes limited to POST are answered too
+	for _, path := range []string{"/video", "/formats", "/prefetch"} {
+		req := httptest.NewRequest("OPTIONS", path, nil)
+		req.Header.Set("Origin", "https://app.example.com")
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		rec := httptest.NewRecorder()
+		newMux().ServeHTTP(rec, req)
+		if rec.Code != http.StatusNoContent || rec.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" {
+			t.Errorf("%s: got status %d and headers %v", path, rec.Code, rec.Header())
+		}
+	}
+}
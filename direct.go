@@ -0,0 +1,86 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+	"video-microservice/internal/codec"
+	"video-microservice/internal/redact"
+	"video-microservice/internal/streamer"
+	"video-microservice/internal/ytdlp"
+)
+
+// streamDirect streams a direct media URL, and opts.AudioURL if set, without
+// yt-dlp. ffprobe reports the codecs, which decide what ffmpeg can copy.
+func streamDirect(w http.ResponseWriter, r *http.Request, opts streamer.StreamOptions, download bool, startTime time.Time) {
+	ctx := r.Context()
+	// Only network protocols, the URLs are the client's
+	opts.VideoProtocol = streamer.ProtocolDirect
+	opts.AudioProtocol = streamer.ProtocolDirect
+
+	// Audio mode with a separate audio URL never touches the video
+	var video, audio streamer.ProbeResult
+	var ok bool
+	if !opts.AudioOnly || opts.AudioURL == "" {
+		if video, ok = probeInput(w, r, opts.VideoURL, "url"); !ok {
+			return
+		}
+		audio = video
+	}
+	if opts.AudioURL != "" {
+		if audio, ok = probeInput(w, r, opts.AudioURL, "aurl"); !ok {
+			return
+		}
+	} else {
+		// Both streams come from the one input
+		opts.AudioURL = opts.VideoURL
+	}
+
+	if opts.AudioOnly {
+		if audio.ACodec == "" {
+			writeError(w, r, http.StatusNotFound, codeFormatNotFound, "No audio stream found")
+			return
+		}
+		opts.VideoURL = ""
+	} else {
+		if video.VCodec == "" {
+			writeError(w, r, http.StatusNotFound, codeFormatNotFound, "No video stream found")
+			return
+		}
+		opts.VCodec = video.VCodec
+		opts.NoAudio = audio.ACodec == ""
+	}
+	opts.ACodec = audio.ACodec
+
+	// As with selected formats, WebM only takes streams it can copy
+	if opts.Container == streamer.ContainerWebM && (opts.Loudnorm || opts.AudioSync || !codec.CanCopyToWebM(opts.VCodec, opts.ACodec)) {
+		slog.InfoContext(ctx, "Streams can't be copied to webm, falling back to mp4", "vcodec", opts.VCodec, "acodec", opts.ACodec, "loudnorm", opts.Loudnorm)
+		opts.Container = streamer.ContainerMP4
+	}
+	slog.InfoContext(ctx, "Probed direct media", "vcodec", opts.VCodec, "acodec", opts.ACodec,
+		"separate_audio", opts.AudioURL != opts.VideoURL && !opts.AudioOnly,
+		"transcode_video", opts.TranscodesVideo(),
+		"transcode_audio", opts.TranscodesAudio())
+
+	info := &ytdlp.Info{Duration: video.Duration}
+	sourceKbps := video.Bitrate
+	if opts.AudioOnly {
+		info.Duration = audio.Duration
+		sourceKbps = audio.Bitrate
+	} else if opts.AudioURL != opts.VideoURL && sourceKbps > 0 {
+		sourceKbps += audio.Bitrate
+	}
+	streamResponse(w, r, opts, info, sourceKbps, download, startTime)
+}
+
+// probeInput runs ffprobe on the direct media URL of param and writes the
+// error response if it fails
+func probeInput(w http.ResponseWriter, r *http.Request, url, param string) (streamer.ProbeResult, bool) {
+	res, err := probeMedia(r.Context(), url)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Probing direct media failed", "url", redact.URL(url), "err", err)
+		writeError(w, r, http.StatusBadGateway, codeUpstreamError, "Could not read media from '"+param+"'")
+		return streamer.ProbeResult{}, false
+	}
+	return res, true
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"video-microservice/internal/codec"
+	"video-microservice/internal/streamer"
+	"video-microservice/internal/ytdlp"
+)
+
+// stubProbe replaces ffprobe with fixed results per URL, recording each probe
+func stubProbe(t *testing.T, results map[string]streamer.ProbeResult) *[]string {
+	t.Helper()
+	var probed []string
+	old := probeMedia
+	probeMedia = func(ctx context.Context, url string) (streamer.ProbeResult, error) {
+		probed = append(probed, url)
+		res, ok := results[url]
+		if !ok {
+			return streamer.ProbeResult{}, errors.New("no such media")
+		}
+		return res, nil
+	}
+	t.Cleanup(func() { probeMedia = old })
+	return &probed
+}
+
+func TestVideoHandler_Direct(t *testing.T) {
+	var got streamer.StreamOptions
+	stubTools(t, nil, func(ctx context.Context, opts streamer.StreamOptions, w io.Writer) error {
+		got = opts
+		return nil
+	})
+	getVideoInfo = func(ctx context.Context, videoURL string) (*ytdlp.Info, error) {
+		t.Error("yt-dlp must not run for direct media")
+		return nil, errors.New("unexpected")
+	}
+	probed := stubProbe(t, map[string]streamer.ProbeResult{
+		"http://cdn.example/h264.mp4":  {VCodec: "h264", ACodec: "aac", Duration: 60},
+		"http://cdn.example/vp9.webm":  {VCodec: "vp9", ACodec: "opus"},
+		"http://cdn.example/video.mp4": {VCodec: "hevc"},
+		"http://cdn.example/audio.m4a": {ACodec: "aac", Duration: 59.5},
+	})
+
+	tests := []struct {
+		name          string
+		query         string
+		vcodec        string
+		acodec        string
+		separateAudio bool
+		container     string
+		transcode     bool
+		probes        int
+	}{
+		{"copied", "url=http://cdn.example/h264.mp4", "h264", "aac", false, "", false, 1},
+		{"transcoded", "url=http://cdn.example/vp9.webm", "vp9", "opus", false, "", true, 1},
+		{"webm passthrough", "url=http://cdn.example/vp9.webm&container=webm", "vp9", "opus", false, "webm", false, 1},
+		{"webm fallback", "url=http://cdn.example/h264.mp4&container=webm", "h264", "aac", false, "mp4", false, 1},
+		{"separate audio", "url=http://cdn.example/video.mp4&aurl=http://cdn.example/audio.m4a", "hevc", "aac", true, "", false, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*probed = nil
+			rec := httptest.NewRecorder()
+			videoHandler(rec, httptest.NewRequest("GET", "/video?direct=true&"+tt.query, nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+			}
+			if got.VCodec != tt.vcodec || got.ACodec != tt.acodec || got.Container != tt.container {
+				t.Errorf("got codecs %q/%q in %q", got.VCodec, got.ACodec, got.Container)
+			}
+			if (got.AudioURL != got.VideoURL) != tt.separateAudio {
+				t.Errorf("got inputs %q and %q", got.VideoURL, got.AudioURL)
+			}
+			if transcode := codec.NeedsTranscode(got.VCodec); got.Container != "webm" && transcode != tt.transcode {
+				t.Errorf("got transcode %v, want %v", transcode, tt.transcode)
+			}
+			if len(*probed) != tt.probes {
+				t.Errorf("got probes %q", *probed)
+			}
+		})
+	}
+
+	// The audio alone is probed and streamed in audio mode
+	*probed = nil
+	rec := httptest.NewRecorder()
+	videoHandler(rec, httptest.NewRequest("GET", "/video?direct=true&mode=audio&url=http://cdn.example/video.mp4&aurl=http://cdn.example/audio.m4a", nil))
+	if rec.Code != http.StatusOK || !got.AudioOnly || got.AudioURL != "http://cdn.example/audio.m4a" || got.VideoURL != "" {
+		t.Errorf("audio mode: got status %d and %+v", rec.Code, got)
+	}
+	if len(*probed) != 1 || rec.Header().Get("X-Video-Duration") != "59.5" {
+		t.Errorf("audio mode: got probes %q, duration %q", *probed, rec.Header().Get("X-Video-Duration"))
+	}
+}
+
+func TestVideoHandler_DirectErrors(t *testing.T) {
+	stubTools(t, nil, func(ctx context.Context, opts streamer.StreamOptions, w io.Writer) error {
+		t.Error("nothing must be streamed")
+		return nil
+	})
+	stubProbe(t, map[string]streamer.ProbeResult{
+		"http://cdn.example/audio.m4a": {ACodec: "aac"},
+	})
+
+	tests := map[string]int{
+		"direct=true&url=http://cdn.example/missing.mp4":                       http.StatusBadGateway,
+		"direct=true&url=http://cdn.example/audio.m4a":                         http.StatusNotFound,
+		"url=http://cdn.example/audio.m4a&aurl=http://cdn.example/audio.m4a":   http.StatusBadRequest,
+		"direct=true&url=http://cdn.example/audio.m4a&aurl=file:///etc/passwd": http.StatusBadRequest,
+		"direct=true&url=http://cdn.example/audio.m4a&yformat=b":               http.StatusBadRequest,
+	}
+	for query, want := range tests {
+		rec := httptest.NewRecorder()
+		videoHandler(rec, httptest.NewRequest("GET", "/video?"+query, nil))
+		if rec.Code != want {
+			t.Errorf("%s: got status %d, want %d", query, rec.Code, want)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxFilenameBytes keeps the download filename well under common filesystem limits
+const maxFilenameBytes = 200
+
+// contentDisposition builds an attachment or inline header named after the video title.
+// Non-ASCII titles get an RFC 5987 filename* next to an ASCII fallback for old clients.
+func contentDisposition(disposition, title, ext string) string {
+	name := sanitizeFilename(title) + ext
+	fallback := asciiFilename(name)
+	if fallback == name {
+		return fmt.Sprintf("%s; filename=\"%s\"", disposition, name)
+	}
+	return fmt.Sprintf("%s; filename=\"%s\"; filename*=UTF-8''%s", disposition, fallback, encodeRFC5987(name))
+}
+
+// clipRange formats a clip's start and end in seconds for its filename, e.g. "30-90"
+func clipRange(start, duration float64) string {
+	return strconv.FormatFloat(start, 'f', -1, 64) + "-" + strconv.FormatFloat(start+duration, 'f', -1, 64)
+}
+
+// sanitizeFilename turns a title into a safe file name without extension.
+// Path separators, quotes and control characters are replaced, and the result
+// is trimmed to maxFilenameBytes without splitting a UTF-8 sequence.
+func sanitizeFilename(title string) string {
+	var b strings.Builder
+	for _, r := range title {
+		switch {
+		case r == '/' || r == '\\' || r == '"':
+			b.WriteRune('_')
+		case unicode.IsControl(r) || r == utf8.RuneError:
+			b.WriteRune(' ')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	name := strings.Join(strings.Fields(b.String()), " ")
+
+	if len(name) > maxFilenameBytes {
+		cut := maxFilenameBytes
+		for cut > 0 && !utf8.RuneStart(name[cut]) {
+			cut--
+		}
+		name = name[:cut]
+	}
+	// Leading dots would make the file hidden, trailing ones are dropped by Windows
+	name = strings.Trim(name, ". ")
+	if name == "" {
+		return "video"
+	}
+	return name
+}
+
+// asciiFilename replaces everything outside printable ASCII with underscores
+func asciiFilename(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		if r < 0x20 || r > 0x7e {
+			b.WriteRune('_')
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// encodeRFC5987 percent-encodes every byte that isn't an RFC 5987 attr-char
+func encodeRFC5987(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if isAttrChar(c) {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+func isAttrChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", c) >= 0
+}
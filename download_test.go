@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"video-microservice/internal/streamer"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := []struct {
+		title string
+		want  string
+	}{
+		{"My Video", "My Video"},
+		{"AC/DC - Back in Black \\ Live", "AC_DC - Back in Black _ Live"},
+		{`He said "hi"`, "He said _hi_"},
+		{"../../etc/passwd", "_.._etc_passwd"},
+		{"tab\there\nnewline", "tab here newline"},
+		{"Café – Zürich 東京", "Café – Zürich 東京"},
+		{"...", "video"},
+		{"", "video"},
+	}
+	for _, tt := range tests {
+		if got := sanitizeFilename(tt.title); got != tt.want {
+			t.Errorf("sanitizeFilename(%q) = %q, want %q", tt.title, got, tt.want)
+		}
+	}
+
+	long := sanitizeFilename(strings.Repeat("東", 100))
+	if len(long) > maxFilenameBytes || !strings.HasPrefix(strings.Repeat("東", 100), long) {
+		t.Errorf("long title not truncated on a rune boundary: %d bytes", len(long))
+	}
+}
+
+func TestContentDisposition(t *testing.T) {
+	if got, want := contentDisposition("attachment", `AC/DC "Live"`, ".mp4"), `attachment; filename="AC_DC _Live_.mp4"`; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	got := contentDisposition("attachment", "Zürich/東京", ".webm")
+	want := `attachment; filename="Z_rich___.webm"; filename*=UTF-8''Z%C3%BCrich_%E6%9D%B1%E4%BA%AC.webm`
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestVideoHandler_Download(t *testing.T) {
+	stubTools(t, testInfo(), func(ctx context.Context, opts streamer.StreamOptions, w io.Writer) error {
+		return nil
+	})
+
+	rec := httptest.NewRecorder()
+	videoHandler(rec, httptest.NewRequest("GET", "/video?url=http://example.com/v&download=true", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200", rec.Code)
+	}
+	if got, want := rec.Header().Get("Content-Disposition"), `attachment; filename="Test Video.mp4"`; got != want {
+		t.Errorf("got Content-Disposition %q, want %q", got, want)
+	}
+
+	rec = httptest.NewRecorder()
+	videoHandler(rec, httptest.NewRequest("GET", "/video?url=http://example.com/v", nil))
+	if got := rec.Header().Get("Content-Disposition"); got != "" {
+		t.Errorf("got Content-Disposition %q without download", got)
+	}
+}
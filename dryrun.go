@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"video-microservice/internal/streamer"
+)
+
+// dryRunResponse is the body returned by /video?dryrun=true
+type dryRunResponse struct {
+	// Proxy is set when the source would be copied as is, Args then show
+	// what ffmpeg would run without DLP_PROXY_PROGRESSIVE
+	Proxy          bool     `json:"proxy"`
+	TranscodeVideo bool     `json:"transcode_video"`
+	Args           []string `json:"args"`
+}
+
+// isDryRun reports whether the request asks for the ffmpeg command instead of the stream
+func isDryRun(r *http.Request) bool {
+	return r.URL.Query().Get("dryrun") == "true"
+}
+
+// writeDryRun answers with the redacted ffmpeg command for opts, starting with the binary
+func writeDryRun(w http.ResponseWriter, r *http.Request, opts streamer.StreamOptions, proxy bool) {
+	resp := dryRunResponse{
+		Proxy:          proxy,
+		TranscodeVideo: opts.TranscodesVideo(),
+		Args:           append([]string{streamer.FFmpegPath}, streamer.DryRunArgs(opts)...),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		slog.ErrorContext(r.Context(), "Error encoding dry run", "err", err)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"video-microservice/internal/streamer"
+)
+
+func TestVideoHandler_DryRun(t *testing.T) {
+	info := testInfo()
+	info.Formats[0].URL = "https://cdn/video?sig=video-secret"
+	info.Formats[1].URL = "https://cdn/audio?sig=audio-secret"
+	info.HTTPHeaders = map[string]string{"Cookie": "session=cookie-secret"}
+	stubTools(t, info, func(ctx context.Context, opts streamer.StreamOptions, w io.Writer) error {
+		t.Error("a dry run must not stream")
+		return nil
+	})
+
+	rec := httptest.NewRecorder()
+	newMux().ServeHTTP(rec, httptest.NewRequest("GET", "/video?url=http://example.com/v&dryrun=true&start=30", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("got Content-Type %q", ct)
+	}
+	for _, secret := range []string{"video-secret", "audio-secret", "cookie-secret"} {
+		if strings.Contains(rec.Body.String(), secret) {
+			t.Errorf("dry run leaks %s: %s", secret, rec.Body.String())
+		}
+	}
+
+	var resp dryRunResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.TranscodeVideo || resp.Proxy {
+		t.Errorf("expected a plain copy, got %+v", resp)
+	}
+	if len(resp.Args) == 0 || resp.Args[0] != streamer.FFmpegPath {
+		t.Fatalf("expected the command to start with the ffmpeg binary: %v", resp.Args)
+	}
+	joined := strings.Join(resp.Args, " ")
+	for _, want := range []string{"-ss 30", "-map 0:v:0 -map 1:a:0", "-c:v copy", "-c:a copy", "pipe:1"} {
+		if !strings.Contains(joined, want) {
+			t.Errorf("expected %q in %v", want, resp.Args)
+		}
+	}
+	if inputs := strings.Count(joined, "-i https://cdn"); inputs != 2 || !slices.Contains(resp.Args, "-headers") {
+		t.Errorf("expected both inputs with their headers: %v", resp.Args)
+	}
+}
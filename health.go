@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"time"
+	"video-microservice/internal/streamer"
+	"video-microservice/internal/ytdlp"
+)
+
+// toolVersions holds the external tool versions detected at startup.
+// An empty version means the tool couldn't be run.
+type toolVersions struct {
+	YtDlp  string
+	FFmpeg string
+}
+
+var tools toolVersions
+
+// detectToolVersions runs the external tools once to record their versions
+func detectToolVersions() toolVersions {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var v toolVersions
+	var err error
+	if v.YtDlp, err = ytdlp.Version(ctx); err != nil {
+		slog.Warn("Could not detect yt-dlp version", "err", err)
+	}
+	if v.FFmpeg, err = streamer.FFmpegVersion(ctx); err != nil {
+		slog.Warn("Could not detect ffmpeg version", "err", err)
+	}
+	return v
+}
+
+// healthResponse is the body returned by /healthz
+type healthResponse struct {
+	Status string `json:"status"`
+	YtDlp  string `json:"ytdlp"`
+	FFmpeg string `json:"ffmpeg"`
+}
+
+// healthHandler reports readiness without touching any external site
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	resp := healthResponse{Status: "ok", YtDlp: tools.YtDlp, FFmpeg: tools.FFmpeg}
+	status := http.StatusOK
+	if tools.YtDlp == "" || tools.FFmpeg == "" {
+		resp.Status = "unavailable"
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		slog.ErrorContext(r.Context(), "Error encoding health", "err", err)
+	}
+}
+
+// versionResponse is the body returned by /version
+type versionResponse struct {
+	Go       string `json:"go"`
+	Module   string `json:"module,omitempty"`
+	Version  string `json:"version,omitempty"`
+	Revision string `json:"revision,omitempty"`
+	Time     string `json:"time,omitempty"`
+	Modified bool   `json:"modified,omitempty"`
+	YtDlp    string `json:"ytdlp"`
+	FFmpeg   string `json:"ffmpeg"`
+}
+
+// buildVersion describes the running binary from the build info embedded by the Go toolchain
+func buildVersion() versionResponse {
+	v := versionResponse{Go: runtime.Version()}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return v
+	}
+	v.Go = info.GoVersion
+	v.Module = info.Main.Path
+	v.Version = info.Main.Version
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			v.Revision = s.Value
+		case "vcs.time":
+			v.Time = s.Value
+		case "vcs.modified":
+			v.Modified = s.Value == "true"
+		}
+	}
+	return v
+}
+
+// versionHandler reports the build and tool versions for support and debugging.
+// Unlike /healthz it's informational only, a missing tool is just an empty version.
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	resp := buildVersion()
+	resp.YtDlp = tools.YtDlp
+	resp.FFmpeg = tools.FFmpeg
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		slog.ErrorContext(r.Context(), "Error encoding version", "err", err)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHealthHandler(t *testing.T) {
+	defer func(old toolVersions) { tools = old }(tools)
+
+	tools = toolVersions{YtDlp: "2024.08.06", FFmpeg: "6.1.1"}
+	rec := httptest.NewRecorder()
+	healthHandler(rec, httptest.NewRequest("GET", "/healthz", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200", rec.Code)
+	}
+	var resp healthResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	want := healthResponse{Status: "ok", YtDlp: "2024.08.06", FFmpeg: "6.1.1"}
+	if resp != want {
+		t.Errorf("got %+v, want %+v", resp, want)
+	}
+
+	// A missing tool makes the service unready
+	tools = toolVersions{YtDlp: "2024.08.06"}
+	rec = httptest.NewRecorder()
+	healthHandler(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d, want 503", rec.Code)
+	}
+}
+
+func TestVersionHandler(t *testing.T) {
+	defer func(old toolVersions) { tools = old }(tools)
+
+	// Missing tools don't change the status
+	for _, tv := range []toolVersions{{YtDlp: "2024.08.06", FFmpeg: "6.1.1"}, {}} {
+		tools = tv
+		rec := httptest.NewRecorder()
+		versionHandler(rec, httptest.NewRequest("GET", "/version", nil))
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("got status %d, want 200", rec.Code)
+		}
+		var resp versionResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("invalid JSON: %v", err)
+		}
+		if resp.YtDlp != tv.YtDlp || resp.FFmpeg != tv.FFmpeg {
+			t.Errorf("got tools %q and %q, want %+v", resp.YtDlp, resp.FFmpeg, tv)
+		}
+		if !strings.HasPrefix(resp.Go, "go") {
+			t.Errorf("got Go version %q", resp.Go)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+// Package codec classifies the codec names reported by yt-dlp, so format
+// selection and the ffmpeg arguments agree on what can be copied as is.
+package codec
+
+import "strings"
+
+// AllowAV1 copies AV1 sources into the MP4 output instead of transcoding them,
+// and ranks them like H264. Only enable it when clients are known to decode AV1.
+var AllowAV1 bool
+
+// IsH264 reports whether vCodec is H.264, e.g. "avc1.640028"
+func IsH264(vCodec string) bool {
+	v := strings.ToLower(vCodec)
+	return strings.Contains(v, "avc1") || strings.Contains(v, "h264")
+}
+
+// IsHEVC reports whether vCodec is H.265, e.g. "hev1.1.6.L93.90"
+func IsHEVC(vCodec string) bool {
+	v := strings.ToLower(vCodec)
+	return strings.Contains(v, "hevc") || strings.Contains(v, "hvc1") || strings.Contains(v, "hev1") || strings.Contains(v, "h265")
+}
+
+// IsAV1 reports whether vCodec is AV1, e.g. "av01.0.08M.08"
+func IsAV1(vCodec string) bool {
+	v := strings.ToLower(vCodec)
+	return strings.HasPrefix(v, "av01") || strings.HasPrefix(v, "av1")
+}
+
+// IsVP9 reports whether vCodec is VP9, e.g. "vp09.00.40.08"
+func IsVP9(vCodec string) bool {
+	v := strings.ToLower(vCodec)
+	return strings.HasPrefix(v, "vp9") || strings.HasPrefix(v, "vp09")
+}
+
+// IsAAC reports whether aCodec is AAC, e.g. "mp4a.40.2"
+func IsAAC(aCodec string) bool {
+	a := strings.ToLower(aCodec)
+	return strings.Contains(a, "mp4a") || strings.Contains(a, "aac")
+}
+
+// NeedsTranscode reports whether a video codec has to be re-encoded to H264
+// for the MP4 output. H264 and HEVC are copied, AV1 only with AllowAV1.
+func NeedsTranscode(vCodec string) bool {
+	if IsH264(vCodec) || IsHEVC(vCodec) {
+		return false
+	}
+	return !(AllowAV1 && IsAV1(vCodec))
+}
+
+// AudioNeedsTranscode reports whether an audio codec has to be re-encoded to AAC for MP4
+func AudioNeedsTranscode(aCodec string) bool {
+	return !IsAAC(aCodec)
+}
+
+// CanCopyToWebM reports whether the codecs can be copied into a WebM container
+// without transcoding, i.e. VP9/AV1 video with Opus/Vorbis audio.
+// An empty audio codec means there is no audio.
+func CanCopyToWebM(vCodec, aCodec string) bool {
+	a := strings.ToLower(aCodec)
+	audioOK := a == "" || a == "none" || strings.Contains(a, "opus") || strings.Contains(a, "vorbis")
+	return (IsVP9(vCodec) || IsAV1(vCodec)) && audioOK
+}
@@ -0,0 +1,82 @@
+package codec
+
+import "testing"
+
+func TestNeedsTranscode(t *testing.T) {
+	defer func(old bool) { AllowAV1 = old }(AllowAV1)
+	AllowAV1 = false
+
+	tests := map[string]bool{
+		"avc1.640028":     false,
+		"h264":            false,
+		"hev1.1.6.L93.90": false,
+		"hvc1.2.4.L120":   false,
+		"vp09.00.40.08":   true,
+		"vp9":             true,
+		"av01.0.08M.08":   true,
+		"theora":          true,
+		"":                true,
+	}
+	for c, want := range tests {
+		if got := NeedsTranscode(c); got != want {
+			t.Errorf("NeedsTranscode(%q) = %v, want %v", c, got, want)
+		}
+	}
+}
+
+func TestAudioNeedsTranscode(t *testing.T) {
+	tests := map[string]bool{
+		"mp4a.40.2": false,
+		"aac":       false,
+		"opus":      true,
+		"vorbis":    true,
+		"mp3":       true,
+	}
+	for c, want := range tests {
+		if got := AudioNeedsTranscode(c); got != want {
+			t.Errorf("AudioNeedsTranscode(%q) = %v, want %v", c, got, want)
+		}
+	}
+}
+
+func TestCanCopyToWebM(t *testing.T) {
+	tests := []struct {
+		vCodec, aCodec string
+		want           bool
+	}{
+		{"vp9", "opus", true},
+		{"vp09.00.40.08", "opus", true},
+		{"av01.0.08M.08", "opus", true},
+		{"vp9", "", true},
+		{"vp9", "mp4a.40.2", false},
+		{"avc1.640028", "opus", false},
+	}
+	for _, tt := range tests {
+		if got := CanCopyToWebM(tt.vCodec, tt.aCodec); got != tt.want {
+			t.Errorf("CanCopyToWebM(%q, %q) = %v, want %v", tt.vCodec, tt.aCodec, got, tt.want)
+		}
+	}
+}
+
+func TestNeedsTranscode_AV1(t *testing.T) {
+	defer func(old bool) { AllowAV1 = old }(AllowAV1)
+
+	codecs := []string{"av01.0.08M.08", "av1"}
+
+	AllowAV1 = false
+	for _, c := range codecs {
+		if !NeedsTranscode(c) {
+			t.Errorf("%s should be transcoded when AV1 is not allowed", c)
+		}
+	}
+
+	AllowAV1 = true
+	for _, c := range codecs {
+		if NeedsTranscode(c) {
+			t.Errorf("%s should be copied when AV1 is allowed", c)
+		}
+	}
+	if !NeedsTranscode("vp9") {
+		t.Errorf("vp9 should still be transcoded")
+	}
+}
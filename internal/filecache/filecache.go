@@ -0,0 +1,317 @@
+// Package filecache keeps finished stream outputs on disk, so repeated
+// requests for the same small file are served without running ffmpeg again.
+package filecache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dataExt = ".data"
+	metaExt = ".json"
+	tempExt = ".tmp"
+)
+
+// meta is stored next to each file, holding the response headers to replay
+type meta struct {
+	Key     string      `json:"key"`
+	Header  http.Header `json:"header"`
+	Created time.Time   `json:"created"`
+}
+
+type entry struct {
+	name    string // file name without extension
+	size    int64
+	header  http.Header
+	created time.Time
+}
+
+// Cache is a size-bounded LRU of files in a directory. Least recently used
+// files are removed once the total passes the limit, and any file once it's
+// older than the TTL. It is safe for concurrent use.
+type Cache struct {
+	dir         string
+	maxSize     int64
+	maxFileSize int64
+	ttl         time.Duration
+
+	mu    sync.Mutex
+	size  int64
+	ll    *list.List // front is most recently used
+	items map[string]*list.Element
+}
+
+// New opens the cache in dir, creating it if needed. Files left by a previous
+// run are kept, oldest first in line for eviction, and unfinished or expired
+// ones removed. maxFileSize bounds a single file, maxSize all of them, and
+// ttl how long a file is served after it was stored.
+func New(dir string, maxSize, maxFileSize int64, ttl time.Duration) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create file cache dir: %w", err)
+	}
+	c := &Cache{
+		dir:         dir,
+		maxSize:     maxSize,
+		maxFileSize: maxFileSize,
+		ttl:         ttl,
+		ll:          list.New(),
+		items:       make(map[string]*list.Element),
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+	return c, nil
+}
+
+// load indexes the files already in the directory by modification time,
+// which Get bumps, so the LRU order survives restarts
+func (c *Cache) load() error {
+	dirEntries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read file cache dir: %w", err)
+	}
+	type found struct {
+		entry
+		modTime time.Time
+	}
+	var files []found
+	for _, de := range dirEntries {
+		path := filepath.Join(c.dir, de.Name())
+		ext := filepath.Ext(de.Name())
+		name := strings.TrimSuffix(de.Name(), ext)
+		switch ext {
+		case tempExt:
+			os.Remove(path)
+		case metaExt:
+			if _, err := os.Stat(c.path(name, dataExt)); err != nil {
+				os.Remove(path)
+			}
+		case dataExt:
+			info, err := de.Info()
+			if err != nil {
+				continue
+			}
+			m, err := readMeta(c.path(name, metaExt))
+			// Without its headers the file can't be served. Files from before
+			// creation times were stored count as expired.
+			if err != nil || c.expired(m.Created) {
+				os.Remove(path)
+				os.Remove(c.path(name, metaExt))
+				continue
+			}
+			files = append(files, found{entry{name: name, size: info.Size(), header: m.Header, created: m.Created}, info.ModTime()})
+		}
+	}
+	slices.SortFunc(files, func(a, b found) int { return a.modTime.Compare(b.modTime) })
+	for _, f := range files {
+		e := f.entry
+		c.items[e.name] = c.ll.PushFront(&e)
+		c.size += e.size
+	}
+	return nil
+}
+
+// expired reports whether a file stored at created is past the TTL
+func (c *Cache) expired(created time.Time) bool {
+	return time.Since(created) > c.ttl
+}
+
+func readMeta(path string) (meta, error) {
+	var m meta
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return m, err
+	}
+	return m, json.Unmarshal(b, &m)
+}
+
+// fileName maps a key to its file name, keys may contain anything
+func fileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:16])
+}
+
+func (c *Cache) path(name, ext string) string {
+	return filepath.Join(c.dir, name+ext)
+}
+
+// Entry is an open cached file
+type Entry struct {
+	*os.File
+	Header  http.Header
+	Size    int64
+	ModTime time.Time
+}
+
+// Get opens the file stored for key and marks it as recently used.
+// An expired file is removed instead. The caller must close it.
+func (c *Cache) Get(key string) (*Entry, bool) {
+	name := fileName(key)
+	c.mu.Lock()
+	el, ok := c.items[name]
+	if !ok {
+		c.mu.Unlock()
+		return nil, false
+	}
+	e := el.Value.(*entry)
+	if c.expired(e.created) {
+		c.removeElement(el)
+		c.mu.Unlock()
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	c.mu.Unlock()
+
+	// An evicted file stays readable once opened
+	f, err := os.Open(c.path(name, dataExt))
+	if err != nil {
+		c.remove(name)
+		return nil, false
+	}
+	now := time.Now()
+	os.Chtimes(f.Name(), now, now)
+	return &Entry{File: f, Header: e.header.Clone(), Size: e.size, ModTime: now}, true
+}
+
+// Writer stores a file while it is being produced. It never fails a write,
+// the file is silently dropped once it passes the size limit or the disk fails.
+type Writer struct {
+	c      *Cache
+	key    string
+	header http.Header
+	f      *os.File
+	size   int64
+}
+
+// NewWriter starts storing a file for key, served later with header
+func (c *Cache) NewWriter(key string, header http.Header) (*Writer, error) {
+	f, err := os.CreateTemp(c.dir, "*"+tempExt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cache file: %w", err)
+	}
+	return &Writer{c: c, key: key, header: header.Clone(), f: f}, nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.f == nil {
+		return len(p), nil
+	}
+	w.size += int64(len(p))
+	if w.size > w.c.maxFileSize {
+		w.Abort()
+		return len(p), nil
+	}
+	if _, err := w.f.Write(p); err != nil {
+		w.Abort()
+	}
+	return len(p), nil
+}
+
+// Abort drops the file, e.g. when the stream failed
+func (w *Writer) Abort() {
+	if w.f == nil {
+		return
+	}
+	w.f.Close()
+	os.Remove(w.f.Name())
+	w.f = nil
+}
+
+// Commit makes the complete file available to Get, replacing any previous
+// one for the key. It does nothing after Abort.
+func (w *Writer) Commit() error {
+	if w.f == nil {
+		return nil
+	}
+	f := w.f
+	w.f = nil
+	err := f.Close()
+	if err == nil {
+		err = w.c.commit(f.Name(), w.key, w.header, w.size)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to store cache file: %w", err)
+	}
+	return nil
+}
+
+func (c *Cache) commit(tmp, key string, header http.Header, size int64) error {
+	name := fileName(key)
+	created := time.Now()
+	b, err := json.Marshal(meta{Key: key, Header: header, Created: created})
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := os.WriteFile(c.path(name, metaExt), b, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, c.path(name, dataExt)); err != nil {
+		return err
+	}
+
+	e := &entry{name: name, size: size, header: header, created: created}
+	if el, ok := c.items[name]; ok {
+		c.size -= el.Value.(*entry).size
+		el.Value = e
+		c.ll.MoveToFront(el)
+	} else {
+		c.items[name] = c.ll.PushFront(e)
+	}
+	c.size += size
+	c.evict()
+	return nil
+}
+
+// evict removes the least recently used files until the total fits.
+// c.mu must be held.
+func (c *Cache) evict() {
+	for c.size > c.maxSize {
+		el := c.ll.Back()
+		if el == nil {
+			return
+		}
+		c.removeElement(el)
+	}
+}
+
+func (c *Cache) remove(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[name]; ok {
+		c.removeElement(el)
+	}
+}
+
+// removeElement deletes an entry and its files, c.mu must be held
+func (c *Cache) removeElement(el *list.Element) {
+	e := el.Value.(*entry)
+	c.ll.Remove(el)
+	delete(c.items, e.name)
+	c.size -= e.size
+	os.Remove(c.path(e.name, dataExt))
+	os.Remove(c.path(e.name, metaExt))
+}
+
+// Size returns the total size of the cached files
+func (c *Cache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
@@ -0,0 +1,186 @@
+package filecache
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// store writes a complete file for key
+func store(t *testing.T, c *Cache, key, content string) {
+	t.Helper()
+	w, err := c.NewWriter(key, http.Header{"Content-Type": {"video/mp4"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, content)
+	if err := w.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// read returns the content stored for key, or "" if there is none
+func read(t *testing.T, c *Cache, key string) string {
+	t.Helper()
+	e, ok := c.Get(key)
+	if !ok {
+		return ""
+	}
+	defer e.Close()
+	b, err := io.ReadAll(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Size != int64(len(b)) {
+		t.Errorf("entry size %d for %d bytes", e.Size, len(b))
+	}
+	return string(b)
+}
+
+func TestCache_StoreAndGet(t *testing.T) {
+	c, err := New(t.TempDir(), 100, 50, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store(t, c, "a", "first")
+	if got := read(t, c, "a"); got != "first" {
+		t.Errorf("got %q", got)
+	}
+	e, _ := c.Get("a")
+	defer e.Close()
+	if e.Header.Get("Content-Type") != "video/mp4" {
+		t.Errorf("got header %v", e.Header)
+	}
+	if _, ok := c.Get("b"); ok {
+		t.Error("unknown key found")
+	}
+
+	// Storing again replaces the file
+	store(t, c, "a", "second")
+	if got := read(t, c, "a"); got != "second" || c.Size() != 6 {
+		t.Errorf("got %q, total size %d", got, c.Size())
+	}
+}
+
+func TestCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	c, err := New(t.TempDir(), 10, 10, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store(t, c, "a", "aaaa")
+	store(t, c, "b", "bbbb")
+	read(t, c, "a")
+	store(t, c, "c", "cccc")
+
+	if read(t, c, "b") != "" {
+		t.Error("least recently used file survived")
+	}
+	if read(t, c, "a") != "aaaa" || read(t, c, "c") != "cccc" || c.Size() != 8 {
+		t.Errorf("recently used files evicted, total size %d", c.Size())
+	}
+}
+
+func TestWriter_Limits(t *testing.T) {
+	dir := t.TempDir()
+	c, err := New(dir, 100, 5, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Past the file limit the file is dropped, writes still succeed
+	w, err := c.NewWriter("big", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := io.WriteString(w, "too large"); n != 9 || err != nil {
+		t.Errorf("got (%d, %v)", n, err)
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Get("big"); ok {
+		t.Error("oversized file was stored")
+	}
+
+	w, err = c.NewWriter("aborted", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "part")
+	w.Abort()
+	if _, ok := c.Get("aborted"); ok {
+		t.Error("aborted file was stored")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("files left behind: %v", entries)
+	}
+}
+
+func TestNew_ReloadsDirectory(t *testing.T) {
+	dir := t.TempDir()
+	c, err := New(dir, 100, 50, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store(t, c, "kept", "content")
+	// Leftovers of an interrupted run
+	os.WriteFile(filepath.Join(dir, "unfinished.tmp"), []byte("x"), 0o644)
+	os.WriteFile(filepath.Join(dir, "orphan.data"), []byte("x"), 0o644)
+
+	c, err = New(dir, 100, 50, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := read(t, c, "kept"); got != "content" {
+		t.Errorf("got %q after reload", got)
+	}
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), "unfinished") || strings.HasPrefix(e.Name(), "orphan") {
+			t.Errorf("leftover %s not removed", e.Name())
+		}
+	}
+
+	// A smaller limit evicts on open
+	if c, err = New(dir, 3, 3, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if c.Size() != 0 {
+		t.Errorf("got size %d over the limit", c.Size())
+	}
+}
+
+func TestCache_Expires(t *testing.T) {
+	dir := t.TempDir()
+	c, err := New(dir, 100, 50, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store(t, c, "fresh", "content")
+	store(t, c, "stale", "content")
+	if got := read(t, c, "stale"); got != "content" {
+		t.Fatalf("got %q before expiry", got)
+	}
+
+	// Reopened with a TTL both files are past, neither is loaded
+	time.Sleep(2 * time.Millisecond)
+	if c, err = New(dir, 100, 50, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if c.Size() != 0 {
+		t.Errorf("got size %d, want expired files removed on open", c.Size())
+	}
+
+	store(t, c, "stale", "content")
+	time.Sleep(2 * time.Millisecond)
+	if got := read(t, c, "stale"); got != "" {
+		t.Errorf("got %q past the TTL, want a miss", got)
+	}
+	if c.Size() != 0 {
+		t.Errorf("got size %d, want the expired file removed", c.Size())
+	}
+}
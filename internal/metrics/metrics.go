@@ -0,0 +1,47 @@
+// Package metrics defines the Prometheus metrics exported by the service.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Registry holds all service metrics, served on /metrics
+var Registry = prometheus.NewRegistry()
+
+var factory = promauto.With(Registry)
+
+var (
+	// Requests counts /video requests by requested quality and response status
+	Requests = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "dlp_requests_total",
+		Help: "Video requests by quality and HTTP status.",
+	}, []string{"quality", "status"})
+
+	// CacheLookups counts info cache lookups by result (hit or miss)
+	CacheLookups = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "dlp_cache_lookups_total",
+		Help: "Video info cache lookups by result.",
+	}, []string{"result"})
+
+	// Streams counts finished ffmpeg runs by video handling (copy, transcode or audio) and outcome
+	Streams = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "dlp_streams_total",
+		Help: "Finished ffmpeg streams by video handling and outcome.",
+	}, []string{"mode", "outcome"})
+
+	// StreamDuration observes how long ffmpeg streams run
+	StreamDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dlp_stream_duration_seconds",
+		Help:    "Duration of ffmpeg streams.",
+		Buckets: []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600},
+	}, []string{"mode"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
@@ -0,0 +1,50 @@
+package metrics
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats are plain counters behind /stats, for deployments that don't scrape
+// Prometheus. The handlers count streams, the streamer and the info cache
+// the rest.
+var Stats stats
+
+type stats struct {
+	// StreamsInFlight counts streams being sent right now
+	StreamsInFlight atomic.Int64
+	// StreamsServed counts streams sent in full, from ffmpeg, a proxied
+	// source or the output cache
+	StreamsServed atomic.Int64
+	// CacheHits and CacheMisses count video info cache lookups
+	CacheHits   atomic.Int64
+	CacheMisses atomic.Int64
+
+	ttfbTotal atomic.Int64 // nanoseconds
+	ttfbCount atomic.Int64
+}
+
+// ObserveTTFB records how long a stream took to send its first byte
+func (s *stats) ObserveTTFB(d time.Duration) {
+	s.ttfbTotal.Add(int64(d))
+	s.ttfbCount.Add(1)
+}
+
+// AverageTTFB returns the mean time to first byte, zero before any stream
+func (s *stats) AverageTTFB() time.Duration {
+	// Read as a pair that may be a write apart, close enough for an average
+	n := s.ttfbCount.Load()
+	if n == 0 {
+		return 0
+	}
+	return time.Duration(s.ttfbTotal.Load() / n)
+}
+
+// CacheHitRatio returns the share of info cache lookups that hit, zero before any
+func (s *stats) CacheHitRatio() float64 {
+	hits, misses := s.CacheHits.Load(), s.CacheMisses.Load()
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
@@ -0,0 +1,62 @@
+// Package netguard keeps outgoing media requests away from internal addresses
+package netguard
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+// ErrBlocked is returned for connections to a Blocked address
+var ErrBlocked = errors.New("address not allowed")
+
+// Blocked reports whether media may not be fetched from addr. Nil allows
+// every address, the service sets it to IsInternal at startup.
+var Blocked func(addr netip.Addr) bool
+
+// sharedAddrSpace is the carrier-grade NAT range, RFC 6598
+var sharedAddrSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// thisNetwork is 0.0.0.0/8, which some systems route to the local host
+var thisNetwork = netip.MustParsePrefix("0.0.0.0/8")
+
+// IsInternal reports whether addr is a loopback, private, link-local,
+// shared or unspecified address
+func IsInternal(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() ||
+		addr.IsLinkLocalMulticast() || addr.IsUnspecified() || addr.IsInterfaceLocalMulticast() ||
+		sharedAddrSpace.Contains(addr) || thisNetwork.Contains(addr)
+}
+
+// Check returns ErrBlocked if addr is Blocked
+func Check(addr netip.Addr) error {
+	if Blocked != nil && Blocked(addr) {
+		return fmt.Errorf("%w: %s", ErrBlocked, addr)
+	}
+	return nil
+}
+
+// control refuses connections to Blocked addresses. It runs on the address
+// actually dialed, after DNS resolution and for every redirect, so neither a
+// 302 nor a rebinding DNS answer gets past it.
+func control(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	return Check(addrPort.Addr())
+}
+
+// Transport returns a clone of http.DefaultTransport that refuses to
+// connect to Blocked addresses
+func Transport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: control}
+	t.DialContext = dialer.DialContext
+	return t
+}
@@ -0,0 +1,57 @@
+package netguard
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestIsInternal(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"142.250.74.14", false},
+		{"2a00:1450:4001:80b::200e", false},
+		{"127.0.0.1", true},
+		{"::1", true},
+		{"::ffff:127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"192.168.0.1", true},
+		{"169.254.169.254", true},
+		{"100.64.0.1", true},
+		{"100.127.255.254", true},
+		{"100.128.0.1", false},
+		{"0.0.0.0", true},
+		{"0.1.2.3", true},
+		{"fd00::1", true},
+	}
+	for _, tt := range tests {
+		if got := IsInternal(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("IsInternal(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestTransport(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	client := &http.Client{Transport: Transport()}
+
+	// Unset, the loopback test server is reachable
+	resp, err := client.Get(upstream.URL)
+	if err != nil {
+		t.Fatalf("request without Blocked failed: %v", err)
+	}
+	resp.Body.Close()
+
+	defer func(old func(netip.Addr) bool) { Blocked = old }(Blocked)
+	Blocked = IsInternal
+	// A fresh transport, the first one keeps its connection alive
+	client = &http.Client{Transport: Transport()}
+	if _, err := client.Get(upstream.URL); !errors.Is(err, ErrBlocked) {
+		t.Errorf("got error %v, want ErrBlocked", err)
+	}
+}
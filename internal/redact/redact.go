@@ -0,0 +1,20 @@
+// Package redact strips credentials from values before they are logged.
+package redact
+
+import "net/url"
+
+// Placeholder replaces redacted content
+const Placeholder = "<redacted>"
+
+// URL keeps only the scheme and host of a URL, since signed CDN URLs carry
+// auth tokens in their path and query. The host is kept for debugging.
+func URL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return Placeholder
+	}
+	if u.Path == "" && u.RawQuery == "" && u.Fragment == "" {
+		return u.Scheme + "://" + u.Host
+	}
+	return u.Scheme + "://" + u.Host + "?…" + Placeholder
+}
@@ -0,0 +1,34 @@
+package redact
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestURL(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{
+			in:   "https://rr3---sn-abc.googlevideo.com/videoplayback?expire=1700000000&sig=SECRET",
+			want: "https://rr3---sn-abc.googlevideo.com?…<redacted>",
+		},
+		{
+			in:   "https://www.youtube.com/watch?v=dQw4w9WgXcQ",
+			want: "https://www.youtube.com?…<redacted>",
+		},
+		{in: "https://example.com", want: "https://example.com"},
+		{in: "not a url", want: "<redacted>"},
+	}
+
+	for _, tt := range tests {
+		got := URL(tt.in)
+		if got != tt.want {
+			t.Errorf("URL(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+		if strings.Contains(got, "SECRET") {
+			t.Errorf("URL(%q) leaked the signature", tt.in)
+		}
+	}
+}
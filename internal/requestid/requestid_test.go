@@ -0,0 +1,56 @@
+package requestid
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	a, b := New(), New()
+	if len(a) != 12 || !Valid(a) {
+		t.Errorf("got id %q", a)
+	}
+	if a == b {
+		t.Errorf("two ids are both %q", a)
+	}
+}
+
+func TestValid(t *testing.T) {
+	tests := map[string]bool{
+		"abc123":                true,
+		"5f0c-41d2.a_b":         true,
+		"":                      false,
+		"with space":            false,
+		"line\nbreak":           false,
+		strings.Repeat("a", 64): true,
+		strings.Repeat("a", 65): false,
+		"quote\"":               false,
+	}
+	for id, want := range tests {
+		if got := Valid(id); got != want {
+			t.Errorf("Valid(%q) = %v, want %v", id, got, want)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(NewHandler(slog.NewTextHandler(&buf, nil))).With("component", "test")
+
+	logger.InfoContext(NewContext(context.Background(), "abc123"), "tagged")
+	logger.InfoContext(context.Background(), "untagged")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines: %q", len(lines), buf.String())
+	}
+	if !strings.Contains(lines[0], "request_id=abc123") || !strings.Contains(lines[0], "component=test") {
+		t.Errorf("tagged line: %q", lines[0])
+	}
+	if strings.Contains(lines[1], "request_id") {
+		t.Errorf("untagged line carries an id: %q", lines[1])
+	}
+}
@@ -0,0 +1,79 @@
+package streamer
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Chapter is a titled section of the source, in seconds from its start
+type Chapter struct {
+	Start float64
+	End   float64
+	Title string
+}
+
+// chaptersMetadata renders chapters as an ffmetadata file, shifted and cut to
+// the streamed range: start is where the stream begins in the source and a
+// positive duration ends it early. Chapters outside the range are dropped.
+func chaptersMetadata(chapters []Chapter, start, duration float64) string {
+	var b strings.Builder
+	b.WriteString(";FFMETADATA1\n")
+	for _, c := range chapters {
+		from, to := c.Start-start, c.End-start
+		if duration > 0 {
+			to = math.Min(to, duration)
+		}
+		from = math.Max(from, 0)
+		if to <= from {
+			continue
+		}
+		fmt.Fprintf(&b, "[CHAPTER]\nTIMEBASE=1/1000\nSTART=%d\nEND=%d\ntitle=%s\n",
+			int64(math.Round(from*1000)), int64(math.Round(to*1000)), escapeMetadata(c.Title))
+	}
+	return b.String()
+}
+
+// escapeMetadata escapes the characters ffmetadata gives a meaning to
+func escapeMetadata(v string) string {
+	r := strings.NewReplacer(`\`, `\\`, "=", `\=`, ";", `\;`, "#", `\#`, "\n", "\\\n")
+	return r.Replace(v)
+}
+
+// writeChaptersFile writes the chapters of opts to a temp file ffmpeg reads as an extra input
+func writeChaptersFile(opts StreamOptions) (string, error) {
+	f, err := os.CreateTemp(TempDir, "dlp-*.ffmeta")
+	if err != nil {
+		return "", fmt.Errorf("failed to create chapters file: %w", err)
+	}
+	defer f.Close()
+	// ffmpeg shifts chapters by the output seek itself, like the media
+	seek, duration := opts.seek(), opts.Duration
+	if duration > 0 {
+		duration += seek.output
+	}
+	if _, err := f.WriteString(chaptersMetadata(opts.Chapters, seek.input, duration)); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to write chapters file: %w", err)
+	}
+	return f.Name(), nil
+}
+
+// chaptersInputArgs returns the chapters file input, placed after all media inputs
+func (o StreamOptions) chaptersInputArgs() []string {
+	if o.chaptersPath == "" {
+		return nil
+	}
+	return []string{"-f", "ffmetadata", "-i", o.chaptersPath}
+}
+
+// chaptersMapArgs takes the chapters and global metadata from the chapters file at input index
+func (o StreamOptions) chaptersMapArgs(input int) []string {
+	if o.chaptersPath == "" {
+		return nil
+	}
+	i := strconv.Itoa(input)
+	return []string{"-map_metadata", i, "-map_chapters", i}
+}
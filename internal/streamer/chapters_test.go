@@ -0,0 +1,108 @@
+package streamer
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+)
+
+var testChapters = []Chapter{
+	{Start: 0, End: 62.5, Title: "Intro"},
+	{Start: 62.5, End: 180, Title: "Part 1; setup = done"},
+	{Start: 180, End: 201.45, Title: "Outro"},
+}
+
+func TestChaptersMetadata(t *testing.T) {
+	want := `;FFMETADATA1
+[CHAPTER]
+TIMEBASE=1/1000
+START=0
+END=62500
+title=Intro
+[CHAPTER]
+TIMEBASE=1/1000
+START=62500
+END=180000
+title=Part 1\; setup \= done
+[CHAPTER]
+TIMEBASE=1/1000
+START=180000
+END=201450
+title=Outro
+`
+	if got := chaptersMetadata(testChapters, 0, 0); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	// A clip keeps only the chapters it overlaps, relative to its start
+	want = `;FFMETADATA1
+[CHAPTER]
+TIMEBASE=1/1000
+START=0
+END=2500
+title=Intro
+[CHAPTER]
+TIMEBASE=1/1000
+START=2500
+END=30000
+title=Part 1\; setup \= done
+`
+	if got := chaptersMetadata(testChapters, 60, 30); got != want {
+		t.Errorf("clip: got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestBuildFfmpegArgs_Chapters(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  StreamOptions
+		input string
+	}{
+		{"single input", StreamOptions{VideoURL: "http://video", VCodec: "h264"}, "1"},
+		{"separate audio", StreamOptions{VideoURL: "http://video", AudioURL: "http://audio", VCodec: "h264", ACodec: "aac"}, "2"},
+		{"subtitles", StreamOptions{VideoURL: "http://video", AudioURL: "http://audio", VCodec: "h264", ACodec: "aac", SubtitleURL: "http://subs"}, "3"},
+		{"audio only", StreamOptions{AudioURL: "http://audio", ACodec: "aac", AudioOnly: true}, "1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			opts.chaptersPath = "/tmp/dlp-1.ffmeta"
+			args := buildFfmpegArgs(opts)
+
+			i := slices.Index(args, opts.chaptersPath)
+			if i < 3 || args[i-1] != "-i" || args[i-3] != "-f" || args[i-2] != "ffmetadata" {
+				t.Errorf("expected -f ffmetadata -i %s, got %v", opts.chaptersPath, args)
+			}
+			if got := argValue(args, "-map_metadata"); got != tt.input {
+				t.Errorf("got -map_metadata %q, want %s", got, tt.input)
+			}
+			if got := argValue(args, "-map_chapters"); got != tt.input {
+				t.Errorf("got -map_chapters %q, want %s", got, tt.input)
+			}
+		})
+	}
+
+	if args := buildFfmpegArgs(StreamOptions{VideoURL: "http://video", VCodec: "h264"}); slices.Contains(args, "-map_metadata") {
+		t.Errorf("unexpected chapters without a chapters file: %v", args)
+	}
+}
+
+func TestStreamVideo_ChaptersFileRemoved(t *testing.T) {
+	dir := t.TempDir()
+	defer func(old string) { TempDir = old }(TempDir)
+	TempDir = dir
+	// Echoes the chapters file, the input after ffmetadata
+	writeFfmpegStub(t, `while [ "$1" != ffmetadata ]; do shift; done
+cat "$3"`)
+
+	var out strings.Builder
+	opts := StreamOptions{VideoURL: "http://video", VCodec: "h264", Chapters: testChapters}
+	if err := StreamVideo(context.Background(), opts, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "title=Outro") {
+		t.Errorf("ffmpeg didn't get the chapters, read %q", out.String())
+	}
+	assertEmptyDir(t, dir)
+}
@@ -0,0 +1,83 @@
+package streamer
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Reason classifies why ffmpeg failed
+type Reason string
+
+const (
+	ReasonForbidden     Reason = "upstream_forbidden"
+	ReasonNotFound      Reason = "upstream_not_found"
+	ReasonUpstreamError Reason = "upstream_error"
+	ReasonInvalidData   Reason = "invalid_data"
+	// ReasonFirstByteTimeout is reported when FirstByteFail stopped ffmpeg
+	ReasonFirstByteTimeout Reason = "first_byte_timeout"
+	// ReasonOutputTooLarge is reported when a Faststart output reached MaxOutputSize
+	ReasonOutputTooLarge Reason = "output_too_large"
+	ReasonUnknown        Reason = "unknown"
+)
+
+// StreamError is returned when ffmpeg or a proxied source fails before any
+// output is written.
+// Nothing has been sent to the client yet, so the caller can still respond
+// with a proper HTTP error instead of a truncated stream.
+type StreamError struct {
+	Reason Reason
+	Err    error
+}
+
+func (e *StreamError) Error() string {
+	return fmt.Sprintf("stream failed before output (%s): %v", e.Reason, e.Err)
+}
+
+func (e *StreamError) Unwrap() error {
+	return e.Err
+}
+
+// classifyFfmpegError maps ffmpeg stderr output to a failure reason
+func classifyFfmpegError(stderr string) Reason {
+	switch {
+	case strings.Contains(stderr, "403 Forbidden"):
+		return ReasonForbidden
+	case strings.Contains(stderr, "404 Not Found"):
+		return ReasonNotFound
+	case strings.Contains(stderr, "Server returned 5"):
+		return ReasonUpstreamError
+	case strings.Contains(stderr, "Invalid data found"):
+		return ReasonInvalidData
+	}
+	return ReasonUnknown
+}
+
+// upstreamReason maps the status of a failed source request to a failure reason
+func upstreamReason(status int) Reason {
+	switch status {
+	case http.StatusForbidden:
+		return ReasonForbidden
+	case http.StatusNotFound:
+		return ReasonNotFound
+	}
+	return ReasonUpstreamError
+}
+
+// tailBuffer keeps the last max bytes written to it
+type tailBuffer struct {
+	max int
+	buf []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.max {
+		t.buf = t.buf[len(t.buf)-t.max:]
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+	return string(t.buf)
+}
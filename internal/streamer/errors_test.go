@@ -0,0 +1,319 @@
+package streamer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// writeFfmpegStub points FFmpegPath at a shell script for the duration of the test
+func writeFfmpegStub(t *testing.T, script string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ffmpeg")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	old := FFmpegPath
+	FFmpegPath = path
+	t.Cleanup(func() { FFmpegPath = old })
+}
+
+func TestStreamVideo_EarlyExit(t *testing.T) {
+	writeFfmpegStub(t, `echo "[https @ 0x1] HTTP error 403 Forbidden" >&2
+echo "http://video: Server returned 403 Forbidden (access denied)" >&2
+exit 1`)
+
+	var out bytes.Buffer
+	err := StreamVideo(context.Background(), StreamOptions{VideoURL: "http://video", VCodec: "h264"}, &out)
+
+	var streamErr *StreamError
+	if !errors.As(err, &streamErr) {
+		t.Fatalf("expected StreamError, got %v", err)
+	}
+	if streamErr.Reason != ReasonForbidden {
+		t.Errorf("got reason %s, want %s", streamErr.Reason, ReasonForbidden)
+	}
+	if out.Len() != 0 {
+		t.Errorf("unexpected output written: %q", out.Bytes())
+	}
+}
+
+func TestStreamVideo_FailureAfterOutput(t *testing.T) {
+	writeFfmpegStub(t, `printf 'partial'
+echo "Invalid data found when processing input" >&2
+exit 1`)
+
+	var out bytes.Buffer
+	err := StreamVideo(context.Background(), StreamOptions{VideoURL: "http://video", VCodec: "h264"}, &out)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	// Output was already sent, the failure can't be reported as a status anymore
+	var streamErr *StreamError
+	if errors.As(err, &streamErr) {
+		t.Errorf("unexpected StreamError after output was written")
+	}
+}
+
+func TestClassifyFfmpegError(t *testing.T) {
+	tests := map[string]Reason{
+		"Server returned 403 Forbidden (access denied)":      ReasonForbidden,
+		"Server returned 404 Not Found":                      ReasonNotFound,
+		"Server returned 5XX Server Error reply":             ReasonUpstreamError,
+		"http://x: Invalid data found when processing input": ReasonInvalidData,
+		"Conversion failed!":                                 ReasonUnknown,
+	}
+	for stderr, want := range tests {
+		if got := classifyFfmpegError(stderr); got != want {
+			t.Errorf("classifyFfmpegError(%q) = %s, want %s", stderr, got, want)
+		}
+	}
+}
+
+func TestTailBuffer(t *testing.T) {
+	tb := &tailBuffer{max: 5}
+	tb.Write([]byte("abc"))
+	tb.Write([]byte("defg"))
+	if got := tb.String(); got != "cdefg" {
+		t.Errorf("got %q, want cdefg", got)
+	}
+}
+
+func TestStreamVideo_CancelKillsStuckProcess(t *testing.T) {
+	defer func(old time.Duration) { KillGracePeriod = old }(KillGracePeriod)
+	KillGracePeriod = 200 * time.Millisecond
+
+	// Ignores SIGTERM like an ffmpeg stuck in a network wait, exec keeps the pid
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	writeFfmpegStub(t, `echo $$ > `+pidFile+`
+trap '' TERM
+exec sleep 30`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		// Give the stub time to record its pid and install the trap
+		time.Sleep(200 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	err := StreamVideo(ctx, StreamOptions{VideoURL: "http://video", VCodec: "h264"}, io.Discard)
+	if err == nil {
+		t.Fatal("expected error after cancellation")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("StreamVideo took %v to return after cancellation", elapsed)
+	}
+
+	data, readErr := os.ReadFile(pidFile)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err := syscall.Kill(pid, 0); !errors.Is(err, syscall.ESRCH) {
+		t.Errorf("ffmpeg process %d still running after StreamVideo returned", pid)
+	}
+}
+
+func TestStreamVideo_StallTimeout(t *testing.T) {
+	defer func(old time.Duration) { StallTimeout = old }(StallTimeout)
+	defer func(old time.Duration) { KillGracePeriod = old }(KillGracePeriod)
+	StallTimeout = 200 * time.Millisecond
+	KillGracePeriod = 200 * time.Millisecond
+
+	// Sends a first chunk, then hangs like ffmpeg reading from a stalled CDN
+	writeFfmpegStub(t, `echo data
+exec sleep 30`)
+
+	var out bytes.Buffer
+	start := time.Now()
+	err := StreamVideo(context.Background(), StreamOptions{VideoURL: "http://video", VCodec: "h264"}, &out)
+	if !errors.Is(err, ErrStalled) {
+		t.Fatalf("expected ErrStalled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("StreamVideo took %v to give up on a stalled stream", elapsed)
+	}
+	if out.String() != "data\n" {
+		t.Errorf("got output %q", out.String())
+	}
+}
+
+func TestStreamVideo_NoStallWhileWriting(t *testing.T) {
+	defer func(old time.Duration) { StallTimeout = old }(StallTimeout)
+	StallTimeout = 200 * time.Millisecond
+
+	// Slower than the check interval but well within the timeout
+	writeFfmpegStub(t, `for i in 1 2 3 4 5 6 7 8; do echo data; sleep 0.05; done`)
+
+	var out bytes.Buffer
+	if err := StreamVideo(context.Background(), StreamOptions{VideoURL: "http://video", VCodec: "h264"}, &out); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := strings.Count(out.String(), "data"); got != 8 {
+		t.Errorf("got %d writes, want 8", got)
+	}
+}
+
+func TestStreamVideo_NoStallBeforeFirstByte(t *testing.T) {
+	defer func(old time.Duration) { StallTimeout = old }(StallTimeout)
+	StallTimeout = 100 * time.Millisecond
+
+	// A slow start is not a stall, e.g. a long seek or a Faststart output
+	writeFfmpegStub(t, `sleep 0.5; echo data`)
+
+	var out bytes.Buffer
+	if err := StreamVideo(context.Background(), StreamOptions{VideoURL: "http://video", VCodec: "h264"}, &out); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestStreamVideo_StallTimeoutDisabled(t *testing.T) {
+	defer func(old time.Duration) { StallTimeout = old }(StallTimeout)
+	StallTimeout = 0
+
+	writeFfmpegStub(t, `echo data; sleep 0.3; echo data`)
+
+	var out bytes.Buffer
+	if err := StreamVideo(context.Background(), StreamOptions{VideoURL: "http://video", VCodec: "h264"}, &out); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestStreamVideo_TinyStallTimeout(t *testing.T) {
+	defer func(old time.Duration) { StallTimeout = old }(StallTimeout)
+	defer func(old time.Duration) { KillGracePeriod = old }(KillGracePeriod)
+	StallTimeout = time.Nanosecond
+	KillGracePeriod = 200 * time.Millisecond
+
+	// Too short for a tenth of it to be a valid ticker interval
+	writeFfmpegStub(t, `echo data; exec sleep 30`)
+
+	err := StreamVideo(context.Background(), StreamOptions{VideoURL: "http://video", VCodec: "h264"}, io.Discard)
+	if !errors.Is(err, ErrStalled) {
+		t.Fatalf("expected ErrStalled, got %v", err)
+	}
+}
+
+func TestStreamVideo_FirstByteTimeout(t *testing.T) {
+	defer func(old time.Duration) { TTFBTimeout = old }(TTFBTimeout)
+	defer func(old FirstByteAction) { TTFBAction = old }(TTFBAction)
+	defer func(old time.Duration) { KillGracePeriod = old }(KillGracePeriod)
+	TTFBTimeout = 200 * time.Millisecond
+	TTFBAction = FirstByteFail
+	KillGracePeriod = 200 * time.Millisecond
+
+	// A transcode that doesn't get to its first fragment in time
+	writeFfmpegStub(t, `exec sleep 30`)
+
+	start := time.Now()
+	err := StreamVideo(context.Background(), StreamOptions{VideoURL: "http://video", VCodec: "vp9"}, io.Discard)
+	var streamErr *StreamError
+	if !errors.As(err, &streamErr) || streamErr.Reason != ReasonFirstByteTimeout {
+		t.Fatalf("expected a first_byte_timeout StreamError, got %v", err)
+	}
+	if !errors.Is(err, ErrFirstByteTimeout) {
+		t.Errorf("expected ErrFirstByteTimeout in the chain, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("StreamVideo took %v to give up", elapsed)
+	}
+}
+
+func TestStreamVideo_FirstByteTimeoutSendsHeaders(t *testing.T) {
+	defer func(old time.Duration) { TTFBTimeout = old }(TTFBTimeout)
+	defer func(old FirstByteAction) { TTFBAction = old }(TTFBAction)
+	TTFBTimeout = 100 * time.Millisecond
+	TTFBAction = FirstByteHeaders
+
+	writeFfmpegStub(t, `sleep 0.5; echo data`)
+
+	rec := httptest.NewRecorder()
+	rec.Header().Set("Content-Type", "video/mp4")
+	if err := StreamVideo(context.Background(), StreamOptions{VideoURL: "http://video", VCodec: "vp9"}, rec); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !rec.Flushed || rec.Code != http.StatusOK {
+		t.Errorf("expected the headers to be sent ahead of the output, got flushed %v status %d", rec.Flushed, rec.Code)
+	}
+	if rec.Body.String() != "data\n" {
+		t.Errorf("got output %q", rec.Body.String())
+	}
+
+	// Once the headers are out a failure can't be reported with a status anymore
+	writeFfmpegStub(t, `sleep 0.5; exit 1`)
+	err := StreamVideo(context.Background(), StreamOptions{VideoURL: "http://video", VCodec: "vp9"}, httptest.NewRecorder())
+	var streamErr *StreamError
+	if err == nil || errors.As(err, &streamErr) {
+		t.Errorf("expected a plain error after the headers were sent, got %v", err)
+	}
+}
+
+// brokenPipeWriter fails like a response to a client that hung up
+type brokenPipeWriter struct{ writes int }
+
+func (w *brokenPipeWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return 0, syscall.EPIPE
+}
+
+func TestStreamVideo_ClientDisconnected(t *testing.T) {
+	// ffmpeg keeps writing until the closed pipe stops it
+	writeFfmpegStub(t, `while true; do echo data; done`)
+
+	w := &brokenPipeWriter{}
+	err := StreamVideo(context.Background(), StreamOptions{VideoURL: "http://video", VCodec: "h264"}, w)
+	if !errors.Is(err, ErrClientDisconnected) || !errors.Is(err, syscall.EPIPE) {
+		t.Fatalf("expected ErrClientDisconnected wrapping EPIPE, got %v", err)
+	}
+	var streamErr *StreamError
+	if errors.As(err, &streamErr) {
+		t.Errorf("a disconnect is not an ffmpeg failure: %v", err)
+	}
+	if w.writes != 1 {
+		t.Errorf("expected writes to stop at the first failure, got %d", w.writes)
+	}
+}
+
+func TestStreamVideo_ClientCancelled(t *testing.T) {
+	defer func(old time.Duration) { KillGracePeriod = old }(KillGracePeriod)
+	KillGracePeriod = 200 * time.Millisecond
+	writeFfmpegStub(t, `exec sleep 30`)
+
+	// The request context ends before any output
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	time.AfterFunc(100*time.Millisecond, cancel)
+	err := StreamVideo(ctx, StreamOptions{VideoURL: "http://video", VCodec: "h264"}, io.Discard)
+	if !errors.Is(err, ErrClientDisconnected) {
+		t.Fatalf("expected ErrClientDisconnected, got %v", err)
+	}
+
+	// A deliberate cancel is neither a disconnect nor a failure
+	writeFfmpegStub(t, `exec sleep 30`)
+	cancelCtx, cancelStream := context.WithCancelCause(context.Background())
+	defer cancelStream(nil)
+	time.AfterFunc(100*time.Millisecond, func() { cancelStream(ErrCancelled) })
+	err = StreamVideo(cancelCtx, StreamOptions{VideoURL: "http://video", VCodec: "h264"}, io.Discard)
+	var streamErr *StreamError
+	if !errors.Is(err, ErrCancelled) || errors.As(err, &streamErr) {
+		t.Errorf("expected ErrCancelled, got %v", err)
+	}
+
+	// A genuine failure is still reported as one
+	writeFfmpegStub(t, `exit 1`)
+	err = StreamVideo(context.Background(), StreamOptions{VideoURL: "http://video", VCodec: "h264"}, io.Discard)
+	if errors.Is(err, ErrClientDisconnected) {
+		t.Errorf("expected an ffmpeg failure, got %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+package streamer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// TempDir holds Faststart outputs while ffmpeg writes them, empty means the OS default
+var TempDir string
+
+// MaxOutputSize caps a Faststart output in bytes, ffmpeg stops writing once it's reached
+var MaxOutputSize int64 = 4 << 30
+
+// ErrOutputTooLarge is returned when a Faststart output reached MaxOutputSize
+var ErrOutputTooLarge = errors.New("output too large")
+
+// writesMP4 reports whether the output container is MP4, for video or audio
+func (o StreamOptions) writesMP4() bool {
+	return o.Container != ContainerWebM && o.Container != ContainerMP3 && !o.adtsOutput()
+}
+
+// SendsFile reports whether the output is written to a temp file and only
+// sent once complete, with a Content-Length and so without HTTP trailers
+func (o StreamOptions) SendsFile() bool {
+	return o.Faststart && o.writesMP4()
+}
+
+// mp4OutputArgs returns the MP4 muxer options and the output target: a
+// fragmented stream on stdout, or a regular file with the index up front
+// once StreamVideo has picked a temp file for a Faststart output
+func (o StreamOptions) mp4OutputArgs() []string {
+	if o.outputPath != "" {
+		args := []string{"-f", "mp4", "-movflags", "+faststart"}
+		if MaxOutputSize > 0 {
+			args = append(args, "-fs", strconv.FormatInt(MaxOutputSize, 10))
+		}
+		// -y since the temp file already exists
+		return append(args, "-y", o.outputPath)
+	}
+	return []string{"-f", "mp4", "-movflags", "frag_keyframe+empty_moov", "pipe:1"}
+}
+
+// createOutputFile reserves the temp file ffmpeg writes a Faststart output to
+func createOutputFile() (string, error) {
+	f, err := os.CreateTemp(TempDir, "dlp-*.mp4")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp output: %w", err)
+	}
+	f.Close()
+	return f.Name(), nil
+}
+
+// checkOutputSize fails for an output ffmpeg cut short at MaxOutputSize.
+// -fs makes ffmpeg end the file cleanly, so it exits as if the stream was complete.
+func checkOutputSize(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to stat output: %w", err)
+	}
+	if MaxOutputSize > 0 && fi.Size() >= MaxOutputSize {
+		return &StreamError{Reason: ReasonOutputTooLarge, Err: fmt.Errorf("%w, reached the limit of %d bytes", ErrOutputTooLarge, MaxOutputSize)}
+	}
+	return nil
+}
+
+// sendFile copies a finished output to the client.
+// If the client is an http.ResponseWriter, the file size is sent as Content-Length.
+func sendFile(path string, mw *monitoringWriter) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open output: %w", err)
+	}
+	defer f.Close()
+
+	if rw, ok := mw.w.(http.ResponseWriter); ok {
+		if fi, err := f.Stat(); err == nil {
+			rw.Header().Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+		}
+	}
+	if _, err := io.Copy(mw, f); err != nil {
+		return fmt.Errorf("output copy failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package streamer
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestBuildFfmpegArgs_Faststart(t *testing.T) {
+	tests := []struct {
+		name string
+		opts StreamOptions
+	}{
+		{"copy", StreamOptions{VideoURL: "http://video", AudioURL: "http://audio", VCodec: "h264", ACodec: "aac"}},
+		{"transcode", StreamOptions{VideoURL: "http://video", AudioURL: "http://audio", VCodec: "vp9", ACodec: "opus"}},
+		{"audio", StreamOptions{AudioURL: "http://audio", ACodec: "opus", AudioOnly: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			opts.Faststart = true
+			opts.outputPath = "/tmp/dlp-1.mp4"
+			args := buildFfmpegArgs(opts)
+
+			i := slices.Index(args, "-movflags")
+			if i < 0 || args[i+1] != "+faststart" {
+				t.Errorf("expected -movflags +faststart, got %v", args)
+			}
+			if args[len(args)-1] != opts.outputPath || slices.Contains(args, "pipe:1") {
+				t.Errorf("expected the temp file as output target, got %v", args)
+			}
+		})
+	}
+
+	args := buildFfmpegArgs(StreamOptions{VideoURL: "http://video", VCodec: "h264"})
+	if i := slices.Index(args, "-movflags"); i < 0 || args[i+1] != "frag_keyframe+empty_moov" || args[len(args)-1] != "pipe:1" {
+		t.Errorf("expected a fragmented stream on stdout by default, got %v", args)
+	}
+}
+
+func TestStreamVideo_Faststart(t *testing.T) {
+	dir := t.TempDir()
+	defer func(old string) { TempDir = old }(TempDir)
+	TempDir = dir
+	// Writes the output file, which is always the last argument
+	writeFfmpegStub(t, `for last; do :; done
+printf 'moov-mdat' > "$last"`)
+
+	rec := httptest.NewRecorder()
+	opts := StreamOptions{VideoURL: "http://video", VCodec: "h264", Faststart: true}
+	if err := StreamVideo(context.Background(), opts, rec); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := rec.Body.String(); got != "moov-mdat" {
+		t.Errorf("expected the finished file as body, got %q", got)
+	}
+	if got := rec.Header().Get("Content-Length"); got != "9" {
+		t.Errorf("expected Content-Length 9, got %q", got)
+	}
+	assertEmptyDir(t, dir)
+}
+
+func TestStreamVideo_FaststartTooLarge(t *testing.T) {
+	dir := t.TempDir()
+	defer func(old string) { TempDir = old }(TempDir)
+	TempDir = dir
+	defer func(old int64) { MaxOutputSize = old }(MaxOutputSize)
+	MaxOutputSize = 4
+	// Like ffmpeg with -fs, stops past the limit and exits cleanly
+	writeFfmpegStub(t, `for last; do :; done
+printf 'moov-mdat' > "$last"`)
+
+	rec := httptest.NewRecorder()
+	opts := StreamOptions{VideoURL: "http://video", VCodec: "h264", Faststart: true}
+	err := StreamVideo(context.Background(), opts, rec)
+	var streamErr *StreamError
+	if !errors.As(err, &streamErr) || streamErr.Reason != ReasonOutputTooLarge || !errors.Is(err, ErrOutputTooLarge) {
+		t.Fatalf("expected an output_too_large StreamError, got %v", err)
+	}
+	if rec.Body.Len() != 0 {
+		t.Errorf("unexpected output for a cut-off file: %q", rec.Body.String())
+	}
+	assertEmptyDir(t, dir)
+
+	opts.outputPath = "/tmp/dlp-1.mp4"
+	if got := argValue(buildFfmpegArgs(opts), "-fs"); got != "4" {
+		t.Errorf("expected -fs 4, got %q", got)
+	}
+}
+
+func TestStreamVideo_FaststartCancelRemovesFile(t *testing.T) {
+	dir := t.TempDir()
+	defer func(old string) { TempDir = old }(TempDir)
+	TempDir = dir
+	writeFfmpegStub(t, "exec sleep 10")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	rec := httptest.NewRecorder()
+	opts := StreamOptions{VideoURL: "http://video", VCodec: "h264", Faststart: true}
+	if err := StreamVideo(ctx, opts, rec); err == nil {
+		t.Fatal("expected error after the client went away")
+	}
+	if rec.Body.Len() != 0 {
+		t.Errorf("unexpected output for an unfinished file: %q", rec.Body.String())
+	}
+	assertEmptyDir(t, dir)
+}
+
+func assertEmptyDir(t *testing.T, dir string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected temp output to be removed, found %v", entries)
+	}
+}
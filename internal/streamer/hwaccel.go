@@ -0,0 +1,108 @@
+package streamer
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// HWAccel selects the H264 encoder used when transcoding
+type HWAccel string
+
+const (
+	HWAccelNone  HWAccel = "none"
+	HWAccelNVENC HWAccel = "nvenc"
+	HWAccelVAAPI HWAccel = "vaapi"
+	HWAccelQSV   HWAccel = "qsv"
+)
+
+// Transcode settings, set once at startup
+var (
+	HWAccelMode = HWAccelNone
+	// HWAccelDevice is the render node used by VAAPI
+	HWAccelDevice = "/dev/dri/renderD128"
+	// X264Preset is the libx264 speed/size tradeoff
+	X264Preset = "ultrafast"
+	// GOPSeconds is the keyframe interval, which is also the fragment duration
+	GOPSeconds = 2.0
+)
+
+// defaultFPS is assumed when the source frame rate is unknown
+const defaultFPS = 30
+
+// ParseHWAccel validates a hardware acceleration mode name
+func ParseHWAccel(s string) (HWAccel, error) {
+	switch HWAccel(s) {
+	case "", HWAccelNone:
+		return HWAccelNone, nil
+	case HWAccelNVENC, HWAccelVAAPI, HWAccelQSV:
+		return HWAccel(s), nil
+	}
+	return "", fmt.Errorf("unknown hwaccel mode %q", s)
+}
+
+// hwaccelInputArgs returns the decoder options placed before the video input
+// when it's going to be transcoded.
+func hwaccelInputArgs() []string {
+	switch HWAccelMode {
+	case HWAccelNVENC:
+		return []string{"-hwaccel", "cuda"}
+	case HWAccelVAAPI:
+		// Keep decoded frames on the GPU, the hwupload filter below
+		// handles sources the GPU can't decode itself
+		return []string{
+			"-hwaccel", "vaapi",
+			"-hwaccel_output_format", "vaapi",
+			"-vaapi_device", HWAccelDevice,
+		}
+	case HWAccelQSV:
+		return []string{"-hwaccel", "qsv"}
+	}
+	return nil
+}
+
+// gopSize returns the keyframe interval in frames for the given source frame rate
+func gopSize(fps float64) int {
+	if fps <= 0 {
+		fps = defaultFPS
+	}
+	return max(1, int(math.Round(fps*GOPSeconds)))
+}
+
+// videoEncoderArgs returns the output options for transcoding to H264.
+// filters are software video filters applied before encoding.
+func videoEncoderArgs(fps float64, filters []string) []string {
+	// Force keyframes every GOPSeconds for frequent fragmentation.
+	g := strconv.Itoa(gopSize(fps))
+	gop := []string{"-g", g, "-keyint_min", g}
+
+	var args []string
+	switch HWAccelMode {
+	case HWAccelNVENC:
+		// p1 is the fastest NVENC preset
+		args = []string{"-c:v", "h264_nvenc", "-preset", "p1"}
+	case HWAccelVAAPI:
+		// Upload frames the GPU didn't decode itself
+		filters = append(filters, "format=nv12|vaapi", "hwupload")
+		args = []string{"-c:v", "h264_vaapi"}
+	case HWAccelQSV:
+		args = []string{"-c:v", "h264_qsv", "-preset", "veryfast"}
+	default:
+		// Software fallback
+		// -preset ultrafast (the default) to be efficient but decent size.
+		// We remove zerolatency to allow better buffering/throughput.
+		// -sc_threshold 0 ensures strict GOP adherence.
+		args = []string{"-c:v", "libx264", "-preset", X264Preset, "-sc_threshold", "0"}
+	}
+	args = append(args, gop...)
+	if ConstantFrameRate {
+		// Duplicate or drop frames so the keyframe interval is steady in wall-clock time
+		args = append(args, "-fps_mode", "cfr")
+	}
+
+	if len(filters) > 0 {
+		args = append([]string{"-vf", strings.Join(filters, ",")}, args...)
+	}
+	return args
+}
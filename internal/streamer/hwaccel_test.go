@@ -0,0 +1,151 @@
+package streamer
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestBuildFfmpegArgs_HWAccel(t *testing.T) {
+	tests := []struct {
+		mode        HWAccel
+		wantEncoder string
+		wantHWAccel string
+	}{
+		{mode: HWAccelNone, wantEncoder: "libx264", wantHWAccel: ""},
+		{mode: HWAccelNVENC, wantEncoder: "h264_nvenc", wantHWAccel: "cuda"},
+		{mode: HWAccelVAAPI, wantEncoder: "h264_vaapi", wantHWAccel: "vaapi"},
+		{mode: HWAccelQSV, wantEncoder: "h264_qsv", wantHWAccel: "qsv"},
+	}
+
+	defer func(old HWAccel) { HWAccelMode = old }(HWAccelMode)
+
+	for _, tt := range tests {
+		t.Run(string(tt.mode), func(t *testing.T) {
+			HWAccelMode = tt.mode
+			args := buildFfmpegArgs(StreamOptions{
+				VideoURL: "http://video",
+				AudioURL: "http://audio",
+				VCodec:   "vp9",
+				ACodec:   "opus",
+			})
+
+			if got := argValue(args, "-c:v"); got != tt.wantEncoder {
+				t.Errorf("got encoder %q, want %q", got, tt.wantEncoder)
+			}
+
+			hwaccel := slices.Index(args, "-hwaccel")
+			if tt.wantHWAccel == "" {
+				if hwaccel != -1 {
+					t.Errorf("unexpected -hwaccel %s", args[hwaccel+1])
+				}
+				return
+			}
+			if hwaccel == -1 {
+				t.Fatalf("-hwaccel not found")
+			}
+			if args[hwaccel+1] != tt.wantHWAccel {
+				t.Errorf("got hwaccel %q, want %q", args[hwaccel+1], tt.wantHWAccel)
+			}
+			// Decoder options only apply if they precede the video input
+			if hwaccel > slices.Index(args, "-i") {
+				t.Errorf("-hwaccel placed after the video input")
+			}
+			if tt.mode == HWAccelVAAPI && argValue(args, "-vaapi_device") != HWAccelDevice {
+				t.Errorf("vaapi device not set")
+			}
+		})
+	}
+}
+
+func TestBuildFfmpegArgs_HWAccelSkippedOnCopy(t *testing.T) {
+	defer func(old HWAccel) { HWAccelMode = old }(HWAccelMode)
+	HWAccelMode = HWAccelNVENC
+
+	args := buildFfmpegArgs(StreamOptions{VideoURL: "http://video", VCodec: "avc1.640028", ACodec: "mp4a.40.2"})
+	if slices.Contains(args, "-hwaccel") {
+		t.Errorf("hwaccel should not be used when copying video")
+	}
+	if got := argValue(args, "-c:v"); got != "copy" {
+		t.Errorf("got encoder %q, want copy", got)
+	}
+}
+
+func TestBuildFfmpegArgs_GOP(t *testing.T) {
+	defer func(old float64) { GOPSeconds = old }(GOPSeconds)
+
+	tests := []struct {
+		name       string
+		fps        float64
+		gopSeconds float64
+		want       string
+	}{
+		{name: "Unknown fps keeps default", fps: 0, gopSeconds: 2, want: "60"},
+		{name: "24fps", fps: 24, gopSeconds: 2, want: "48"},
+		{name: "30fps", fps: 30, gopSeconds: 2, want: "60"},
+		{name: "60fps", fps: 60, gopSeconds: 2, want: "120"},
+		{name: "23.976fps rounds", fps: 23.976, gopSeconds: 2, want: "48"},
+		{name: "Custom interval", fps: 30, gopSeconds: 4, want: "120"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			GOPSeconds = tt.gopSeconds
+			args := buildFfmpegArgs(StreamOptions{VideoURL: "http://video", VCodec: "vp9", FPS: tt.fps})
+			if got := argValue(args, "-g"); got != tt.want {
+				t.Errorf("got -g %s, want %s", got, tt.want)
+			}
+			if got := argValue(args, "-keyint_min"); got != tt.want {
+				t.Errorf("got -keyint_min %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildFfmpegArgs_ConstantFrameRate(t *testing.T) {
+	defer func(old bool) { ConstantFrameRate = old }(ConstantFrameRate)
+	transcode := StreamOptions{VideoURL: "http://video", VCodec: "vp9", FPS: 30}
+
+	ConstantFrameRate = false
+	if args := buildFfmpegArgs(transcode); slices.Contains(args, "-fps_mode") {
+		t.Errorf("unexpected -fps_mode by default: %v", args)
+	}
+
+	ConstantFrameRate = true
+	if got := argValue(buildFfmpegArgs(transcode), "-fps_mode"); got != "cfr" {
+		t.Errorf("got -fps_mode %q, want cfr", got)
+	}
+	// Copied video keeps its timestamps
+	if args := buildFfmpegArgs(StreamOptions{VideoURL: "http://video", VCodec: "h264"}); slices.Contains(args, "-fps_mode") {
+		t.Errorf("unexpected -fps_mode when copying: %v", args)
+	}
+}
+
+func TestBuildFfmpegArgs_X264Preset(t *testing.T) {
+	defer func(old string) { X264Preset = old }(X264Preset)
+	X264Preset = "veryfast"
+
+	args := buildFfmpegArgs(StreamOptions{VideoURL: "http://video", VCodec: "vp9"})
+	if got := argValue(args, "-preset"); got != "veryfast" {
+		t.Errorf("got preset %s, want veryfast", got)
+	}
+}
+
+func TestParseHWAccel(t *testing.T) {
+	for _, s := range []string{"", "none", "nvenc", "vaapi", "qsv"} {
+		if _, err := ParseHWAccel(s); err != nil {
+			t.Errorf("ParseHWAccel(%q) failed: %v", s, err)
+		}
+	}
+	if _, err := ParseHWAccel("cuda"); err == nil {
+		t.Error("expected error for unknown mode")
+	}
+}
+
+// argValue returns the value following flag in args, or "" if absent
+func argValue(args []string, flag string) string {
+	i := slices.Index(args, flag)
+	if i == -1 || i+1 >= len(args) {
+		return ""
+	}
+	return args[i+1]
+}
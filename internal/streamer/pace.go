@@ -0,0 +1,48 @@
+package streamer
+
+import (
+	"context"
+	"io"
+
+	"golang.org/x/time/rate"
+)
+
+// PaceMultiplier is how many times faster than real time a paced stream is
+// sent, leaving players room to build a buffer
+var PaceMultiplier = 2.0
+
+// minPaceBurst keeps the chunks of very low bitrate streams from getting tiny
+const minPaceBurst = 4 << 10
+
+// pacedWriter holds writes to a byte rate, so the output doesn't run far
+// ahead of playback and pile up in proxy buffers
+type pacedWriter struct {
+	ctx     context.Context
+	w       io.Writer
+	limiter *rate.Limiter
+}
+
+// newPacedWriter paces w to PaceMultiplier times kbps. Up to a second of
+// output is let through at once, chunks are waited for until ctx is done.
+func newPacedWriter(ctx context.Context, w io.Writer, kbps int) *pacedWriter {
+	bytesPerSecond := float64(kbps) * 1000 / 8 * PaceMultiplier
+	burst := max(int(bytesPerSecond), minPaceBurst)
+	return &pacedWriter{ctx: ctx, w: w, limiter: rate.NewLimiter(rate.Limit(bytesPerSecond), burst)}
+}
+
+func (pw *pacedWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		chunk := p[:min(len(p), pw.limiter.Burst())]
+		if err := pw.limiter.WaitN(pw.ctx, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := pw.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
@@ -0,0 +1,61 @@
+package streamer
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPacedWriter(t *testing.T) {
+	defer func(old float64) { PaceMultiplier = old }(PaceMultiplier)
+
+	tests := []struct {
+		name       string
+		kbps       int
+		multiplier float64
+	}{
+		// 1 MB/s either way
+		{"realtime", 8000, 1},
+		{"twice realtime", 4000, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			PaceMultiplier = tt.multiplier
+			var out bytes.Buffer
+			pw := newPacedWriter(context.Background(), &out, tt.kbps)
+			if got := pw.limiter.Limit(); got != 1_000_000 {
+				t.Errorf("got a limit of %v bytes/s, want 1000000", got)
+			}
+
+			// The first second's worth goes out at once
+			data := make([]byte, 1_000_000)
+			for off := 0; off < len(data); off += 32 << 10 {
+				if _, err := pw.Write(data[off:min(off+32<<10, len(data))]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if out.Len() != len(data) {
+				t.Errorf("wrote %d bytes, want %d", out.Len(), len(data))
+			}
+			// Anything more has to wait for the rate, refilled only by the time the writes took
+			now := time.Now()
+			r := pw.limiter.ReserveN(now, 500_000)
+			if !r.OK() {
+				t.Fatal("reservation within the burst refused")
+			}
+			if d := r.DelayFrom(now); d < 400*time.Millisecond || d > 500*time.Millisecond {
+				t.Errorf("next 500 kB delayed %v, want about 500ms", d)
+			}
+		})
+	}
+}
+
+func TestPacedWriter_Cancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	pw := newPacedWriter(ctx, &bytes.Buffer{}, 8)
+	cancel()
+	if _, err := pw.Write(make([]byte, 1<<20)); err == nil {
+		t.Error("expected an error once the context is done")
+	}
+}
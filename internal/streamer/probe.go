@@ -0,0 +1,161 @@
+package streamer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+	"video-microservice/internal/codec"
+)
+
+// FFprobePath is the ffprobe executable, looked up in PATH unless absolute
+var FFprobePath = "ffprobe"
+
+// ProbeTimeout bounds a single ffprobe run
+var ProbeTimeout = 30 * time.Second
+
+// ProbeBeforeCopy checks the video with ffprobe before copying it into the
+// MP4 output, since the codec reported by yt-dlp is occasionally wrong.
+// Streams that turn out not to be copyable are transcoded instead.
+var ProbeBeforeCopy bool
+
+// ProbeResult describes a media URL as ffprobe sees it. Codecs use ffprobe's
+// names, e.g. "h264" or "opus", and are empty when there is no such stream.
+type ProbeResult struct {
+	VCodec   string
+	VProfile string
+	ACodec   string
+	Duration float64
+	// Bitrate is the overall bitrate in kb/s, zero if unknown
+	Bitrate int
+}
+
+// prober wraps ffprobe. run executes it and returns its stdout, tests
+// replace it to script the output.
+type prober struct {
+	run func(ctx context.Context, name string, args ...string) ([]byte, error)
+}
+
+var defaultProber = prober{run: func(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return exec.CommandContext(ctx, name, args...).Output()
+}}
+
+// Probe runs ffprobe on a direct media URL to learn its codecs
+func Probe(ctx context.Context, url string) (ProbeResult, error) {
+	return defaultProber.probe(ctx, url, manifestInputArgs(ProtocolDirect))
+}
+
+// probe runs ffprobe on url, preceded by any input options like headers
+func (p prober) probe(ctx context.Context, url string, inputArgs []string) (ProbeResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, ProbeTimeout)
+	defer cancel()
+
+	inputArgs = append(tlsInputArgs(), inputArgs...)
+	out, err := p.run(ctx, FFprobePath, buildProbeArgs(url, inputArgs)...)
+	if err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return ProbeResult{}, fmt.Errorf("ffprobe binary not found, make sure it is installed and in PATH: %w", err)
+		}
+		return ProbeResult{}, fmt.Errorf("ffprobe failed: %w", err)
+	}
+	return parseProbeOutput(out)
+}
+
+// confirmCopy probes the video input and reports whether it can really be
+// copied into the MP4 output. A failed probe keeps the copy, it isn't
+// evidence against yt-dlp's codec and ffmpeg reports unreadable inputs anyway.
+func (p prober) confirmCopy(ctx context.Context, opts StreamOptions) bool {
+	var inputArgs []string
+	inputArgs = append(inputArgs, argsFromHeaders(opts.VideoHeaders)...)
+	inputArgs = append(inputArgs, manifestInputArgs(opts.VideoProtocol)...)
+	res, err := p.probe(ctx, opts.VideoURL, inputArgs)
+	if err != nil {
+		slog.WarnContext(ctx, "Probing video before copy failed, copying anyway", "err", err)
+		return true
+	}
+	if !copyableVideo(res) {
+		slog.InfoContext(ctx, "Probed video can't be copied, transcoding", "reported", opts.VCodec, "vcodec", res.VCodec, "profile", res.VProfile)
+		return false
+	}
+	return true
+}
+
+// copyableVideo reports whether a probed video can be copied into the MP4
+// output. Players decode 8-bit 4:2:0 H264 but not its professional profiles.
+func copyableVideo(res ProbeResult) bool {
+	if res.VCodec == "" || codec.NeedsTranscode(res.VCodec) {
+		return false
+	}
+	profile := strings.ToLower(res.VProfile)
+	if codec.IsH264(res.VCodec) {
+		for _, p := range []string{"high 10", "4:2:2", "4:4:4"} {
+			if strings.Contains(profile, p) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// buildProbeArgs asks for just the stream codecs, the duration and the bitrate, as JSON
+func buildProbeArgs(url string, inputArgs []string) []string {
+	args := []string{
+		"-v", "error",
+		"-show_entries", "stream=codec_type,codec_name,profile:stream_disposition=attached_pic:format=duration,bit_rate",
+		"-of", "json",
+	}
+	args = append(args, inputArgs...)
+	return append(args, url)
+}
+
+// probeOutput is the part of ffprobe's JSON output we use
+type probeOutput struct {
+	Streams []struct {
+		CodecType   string `json:"codec_type"`
+		CodecName   string `json:"codec_name"`
+		Profile     string `json:"profile"`
+		Disposition struct {
+			AttachedPic int `json:"attached_pic"`
+		} `json:"disposition"`
+	} `json:"streams"`
+	Format struct {
+		Duration string `json:"duration"`
+		BitRate  string `json:"bit_rate"`
+	} `json:"format"`
+}
+
+// parseProbeOutput takes the first video and audio streams.
+// Cover art is reported as a video stream, it doesn't count as one.
+func parseProbeOutput(out []byte) (ProbeResult, error) {
+	var p probeOutput
+	if err := json.Unmarshal(out, &p); err != nil {
+		return ProbeResult{}, fmt.Errorf("failed to parse ffprobe output: %w", err)
+	}
+	var res ProbeResult
+	for _, s := range p.Streams {
+		switch {
+		case s.CodecType == "video" && s.Disposition.AttachedPic == 0 && res.VCodec == "":
+			res.VCodec = s.CodecName
+			res.VProfile = s.Profile
+		case s.CodecType == "audio" && res.ACodec == "":
+			res.ACodec = s.CodecName
+		}
+	}
+	if res.VCodec == "" && res.ACodec == "" {
+		return ProbeResult{}, errors.New("no audio or video stream found")
+	}
+	// Unknown for live streams, reported as "N/A" or left out
+	if d, err := strconv.ParseFloat(p.Format.Duration, 64); err == nil && d > 0 {
+		res.Duration = d
+	}
+	// In bit/s, ffmpeg's own summary rounds to kb/s the same way
+	if b, err := strconv.Atoi(p.Format.BitRate); err == nil && b > 0 {
+		res.Bitrate = b / 1000
+	}
+	return res, nil
+}
@@ -0,0 +1,152 @@
+package streamer
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseProbeOutput(t *testing.T) {
+	tests := []struct {
+		name    string
+		out     string
+		want    ProbeResult
+		wantErr bool
+	}{
+		{
+			"video and audio",
+			`{"streams":[{"codec_name":"h264","codec_type":"video","profile":"High","disposition":{"attached_pic":0}},{"codec_name":"aac","codec_type":"audio","profile":"LC","disposition":{"attached_pic":0}}],"format":{"duration":"212.480000","bit_rate":"1234567"}}`,
+			ProbeResult{VCodec: "h264", VProfile: "High", ACodec: "aac", Duration: 212.48, Bitrate: 1234},
+			false,
+		},
+		{
+			"first of each type",
+			`{"streams":[{"codec_name":"vp9","codec_type":"video"},{"codec_name":"opus","codec_type":"audio"},{"codec_name":"vorbis","codec_type":"audio"}],"format":{}}`,
+			ProbeResult{VCodec: "vp9", ACodec: "opus"},
+			false,
+		},
+		{
+			"cover art is no video",
+			`{"streams":[{"codec_name":"mp3","codec_type":"audio"},{"codec_name":"mjpeg","codec_type":"video","disposition":{"attached_pic":1}}],"format":{"duration":"N/A"}}`,
+			ProbeResult{ACodec: "mp3"},
+			false,
+		},
+		{"no streams", `{"streams":[],"format":{}}`, ProbeResult{}, true},
+		{"not JSON", `Invalid data found when processing input`, ProbeResult{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseProbeOutput([]byte(tt.out))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProbe(t *testing.T) {
+	// The stub checks it gets the URL as the last argument, limited to network protocols
+	path := filepath.Join(t.TempDir(), "ffprobe")
+	script := `#!/bin/sh
+for last; do :; done
+[ "$last" = "http://cdn/media.mp4" ] || exit 1
+case "$*" in *"-protocol_whitelist http,https,tcp,tls,crypto "*) ;; *) exit 2 ;; esac
+echo '{"streams":[{"codec_name":"hevc","codec_type":"video"},{"codec_name":"aac","codec_type":"audio"}],"format":{"duration":"10.0"}}'
+`
+	if err := os.WriteFile(path, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	defer func(old string) { FFprobePath = old }(FFprobePath)
+	FFprobePath = path
+
+	got, err := Probe(context.Background(), "http://cdn/media.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != (ProbeResult{VCodec: "hevc", ACodec: "aac", Duration: 10}) {
+		t.Errorf("got %+v", got)
+	}
+	if _, err := Probe(context.Background(), "http://cdn/other.mp4"); err == nil {
+		t.Error("expected an error when ffprobe fails")
+	}
+}
+
+func TestBuildProbeArgs(t *testing.T) {
+	args := buildProbeArgs("http://cdn/media.mp4", []string{"-user_agent", "test"})
+	if args[len(args)-1] != "http://cdn/media.mp4" || argValue(args, "-of") != "json" {
+		t.Errorf("got %v", args)
+	}
+	if !slices.Contains(args, "-show_entries") || argValue(args, "-user_agent") != "test" {
+		t.Errorf("expected -show_entries and the input options: %v", args)
+	}
+}
+
+func TestConfirmCopy(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		err    error
+		want   bool
+	}{
+		{"confirmed", `{"streams":[{"codec_type":"video","codec_name":"h264","profile":"High"}]}`, nil, true},
+		{"hevc", `{"streams":[{"codec_type":"video","codec_name":"hevc","profile":"Main 10"}]}`, nil, true},
+		{"other codec", `{"streams":[{"codec_type":"video","codec_name":"vp9","profile":"Profile 0"}]}`, nil, false},
+		{"10-bit profile", `{"streams":[{"codec_type":"video","codec_name":"h264","profile":"High 10"}]}`, nil, false},
+		{"4:4:4 profile", `{"streams":[{"codec_type":"video","codec_name":"h264","profile":"High 4:4:4 Predictive"}]}`, nil, false},
+		{"no video", `{"streams":[{"codec_type":"audio","codec_name":"aac"}]}`, nil, false},
+		{"probe failed", "", errors.New("exit status 1"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotArgs []string
+			p := prober{run: func(ctx context.Context, name string, args ...string) ([]byte, error) {
+				gotArgs = args
+				return []byte(tt.output), tt.err
+			}}
+			opts := StreamOptions{VideoURL: "http://video", VCodec: "avc1.640028", VideoHeaders: map[string]string{"User-Agent": "ua"}}
+			if got := p.confirmCopy(context.Background(), opts); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			if gotArgs[len(gotArgs)-1] != "http://video" || argValue(gotArgs, "-user_agent") != "ua" {
+				t.Errorf("probe args %v", gotArgs)
+			}
+		})
+	}
+}
+
+func TestStreamVideo_ProbeBeforeCopy(t *testing.T) {
+	// The ffmpeg stub prints the codec options it was given
+	writeFfmpegStub(t, `while [ $# -gt 0 ]; do [ "$1" = "-c:v" ] && printf '%s' "$2"; shift; done`)
+	defer func(on bool, p prober) { ProbeBeforeCopy, defaultProber = on, p }(ProbeBeforeCopy, defaultProber)
+	ProbeBeforeCopy = true
+
+	probed := 0
+	defaultProber = prober{run: func(ctx context.Context, name string, args ...string) ([]byte, error) {
+		probed++
+		return []byte(`{"streams":[{"codec_type":"video","codec_name":"h264","profile":"High 4:2:2"}]}`), nil
+	}}
+
+	var out strings.Builder
+	if err := StreamVideo(context.Background(), StreamOptions{VideoURL: "http://video", VCodec: "avc1.640028"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "libx264" || probed != 1 {
+		t.Errorf("got -c:v %q after %d probes, want the mismatch transcoded", out.String(), probed)
+	}
+
+	// Streams that are transcoded anyway aren't probed
+	out.Reset()
+	if err := StreamVideo(context.Background(), StreamOptions{VideoURL: "http://video", VCodec: "vp9"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if probed != 1 {
+		t.Errorf("transcoded stream was probed")
+	}
+}
@@ -0,0 +1,124 @@
+package streamer
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Progress is one ffmpeg status update
+type Progress struct {
+	Frame int64         // Frames written, zero for audio-only streams
+	FPS   float64       // Encoding rate in frames per second
+	Time  time.Duration // Position in the output
+	Speed float64       // Processing speed as a multiple of realtime
+}
+
+// ProgressFunc receives status updates while a stream runs.
+// It's called from the stderr reader, so it must not block.
+type ProgressFunc func(Progress)
+
+// InputInfo is ffmpeg's summary of the first input, printed once it's opened
+type InputInfo struct {
+	Duration time.Duration // Zero if unknown, e.g. for live inputs
+	Bitrate  int           // Overall bitrate in kb/s, zero if unknown
+}
+
+// InputFunc receives the first input's summary, at most once per stream.
+// ffmpeg only prints it at loglevel info or more verbose, see ReportsInput.
+// Like ProgressFunc, it's called from the stderr reader and must not block.
+type InputFunc func(InputInfo)
+
+// ReportsInput reports whether FFmpegLogLevel is verbose enough for ffmpeg to
+// print the input summaries InputFunc receives
+func ReportsInput() bool {
+	// Flags like "repeat+level+" may come first
+	level := FFmpegLogLevel[strings.LastIndex(FFmpegLogLevel, "+")+1:]
+	switch level {
+	case "info", "verbose", "debug", "trace":
+		return true
+	}
+	n, err := strconv.Atoi(level)
+	return err == nil && n >= 32
+}
+
+// parseInputInfo parses the line ffmpeg prints below each input header, like
+// "  Duration: 00:03:21.45, start: 0.000000, bitrate: 1234 kb/s".
+// It reports false if the line isn't an input summary.
+func parseInputInfo(line string) (InputInfo, bool) {
+	rest, ok := strings.CutPrefix(strings.TrimSpace(line), "Duration:")
+	if !ok {
+		return InputInfo{}, false
+	}
+	var in InputInfo
+	fields := strings.Split(rest, ",")
+	if d, ok := parseTimestamp(strings.TrimSpace(fields[0])); ok {
+		in.Duration = d
+	}
+	for _, field := range fields[1:] {
+		key, value, _ := strings.Cut(strings.TrimSpace(field), ":")
+		if key == "bitrate" {
+			if n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(value), " kb/s")); err == nil {
+				in.Bitrate = n
+			}
+		}
+	}
+	return in, true
+}
+
+// parseProgress parses an ffmpeg status line like
+// "frame=  240 fps= 60 q=28.0 size=    1024kB time=00:00:08.00 bitrate=1048.6kbits/s speed=2.01x".
+// It reports false if the line isn't a status line.
+func parseProgress(line string) (Progress, bool) {
+	var p Progress
+	found := false
+	fields := strings.Fields(line)
+	for i := 0; i < len(fields); i++ {
+		key, value, ok := strings.Cut(fields[i], "=")
+		if !ok {
+			continue
+		}
+		// ffmpeg pads values, so "fps= 60" splits into two fields
+		if value == "" && i+1 < len(fields) && !strings.Contains(fields[i+1], "=") {
+			i++
+			value = fields[i]
+		}
+
+		switch key {
+		case "frame":
+			if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+				p.Frame = n
+			}
+		case "fps":
+			if f, err := strconv.ParseFloat(value, 64); err == nil {
+				p.FPS = f
+			}
+		case "time":
+			found = true
+			if d, ok := parseTimestamp(value); ok {
+				p.Time = d
+			}
+		case "speed":
+			found = true
+			if f, err := strconv.ParseFloat(strings.TrimSuffix(value, "x"), 64); err == nil {
+				p.Speed = f
+			}
+		}
+	}
+	return p, found
+}
+
+// parseTimestamp parses ffmpeg's HH:MM:SS.ss timestamps
+func parseTimestamp(s string) (time.Duration, bool) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return 0, false
+	}
+	h, err1 := strconv.Atoi(parts[0])
+	m, err2 := strconv.Atoi(parts[1])
+	sec, err3 := strconv.ParseFloat(parts[2], 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return 0, false
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(sec*float64(time.Second)), true
+}
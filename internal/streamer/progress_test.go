@@ -0,0 +1,160 @@
+package streamer
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseProgress(t *testing.T) {
+	tests := map[string]Progress{
+		"frame=  240 fps= 60 q=28.0 size=    1024kB time=00:00:08.00 bitrate=1048.6kbits/s speed=2.01x": {
+			Frame: 240, FPS: 60, Time: 8 * time.Second, Speed: 2.01,
+		},
+		"frame=12345 fps=120 q=-1.0 size= 204800kB time=01:02:03.50 bitrate=N/A speed=4x": {
+			Frame: 12345, FPS: 120, Time: time.Hour + 2*time.Minute + 3500*time.Millisecond, Speed: 4,
+		},
+		// Audio-only streams have no frames
+		"size=     512kB time=00:00:32.10 bitrate= 130.6kbits/s speed=12.3x": {
+			Time: 32100 * time.Millisecond, Speed: 12.3,
+		},
+		// Unknown values are left zero
+		"frame=    0 fps=0.0 q=0.0 size=       0kB time=N/A bitrate=N/A speed=N/A": {},
+	}
+	for line, want := range tests {
+		got, ok := parseProgress(line)
+		if !ok {
+			t.Errorf("%q: not recognized as progress", line)
+			continue
+		}
+		if got != want {
+			t.Errorf("%q: got %+v, want %+v", line, got, want)
+		}
+	}
+
+	for _, line := range []string{"Input #0, mov,mp4,m4a,3gp,3g2,mj2, from 'http://video':", "  Stream #0:0: Video: h264"} {
+		if _, ok := parseProgress(line); ok {
+			t.Errorf("%q: unexpectedly parsed as progress", line)
+		}
+	}
+}
+
+func TestStreamVideo_ProgressFunc(t *testing.T) {
+	writeFfmpegStub(t, `printf 'frame=   30 fps=30 q=28.0 size=  256kB time=00:00:01.00 bitrate=N/A speed=1.5x\r' >&2
+printf 'frame=   60 fps=30 q=28.0 size=  512kB time=00:00:02.00 bitrate=N/A speed=1.5x\r' >&2
+printf 'data'`)
+
+	var updates []Progress
+	opts := StreamOptions{
+		VideoURL:     "http://video",
+		VCodec:       "h264",
+		ProgressFunc: func(p Progress) { updates = append(updates, p) },
+	}
+	if err := StreamVideo(context.Background(), opts, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != 2 || updates[1].Frame != 60 || updates[1].Time != 2*time.Second {
+		t.Errorf("unexpected progress updates: %+v", updates)
+	}
+}
+
+func TestReadStderr_SplitUpdates(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	pr, pw := io.Pipe()
+	go func() {
+		// Updates split across writes, as they come off the pipe
+		pw.Write([]byte("Input #0, mov,mp4, from 'http://video':\nframe=   30 fps=30 q=28.0 time=00:00:01.00 "))
+		pw.Write([]byte("speed=1.5x\rframe=   60 fps=30 q=28.0 time=00:00:02.00 speed=1.5x\rframe=   9"))
+		pw.Write([]byte("0 fps=30 q=28.0 time=00:00:03.00 speed=1.5x\r\n"))
+		pw.Close()
+	}()
+
+	tail := &tailBuffer{max: 4096}
+	var frames []int64
+	readStderr(context.Background(), pr, tail, func(p Progress) { frames = append(frames, p.Frame) }, nil)
+
+	if !slices.Equal(frames, []int64{30, 60, 90}) {
+		t.Errorf("got frames %v, want [30 60 90]", frames)
+	}
+	for _, want := range []string{"frame=30", "frame=60", "frame=90"} {
+		if n := strings.Count(logs.String(), want+"\n"); n != 1 {
+			t.Errorf("%s logged %d times, want once:\n%s", want, n, logs.String())
+		}
+	}
+	if !strings.Contains(tail.String(), "Input #0") {
+		t.Errorf("stderr tail is missing non-status output: %q", tail.String())
+	}
+}
+
+func TestParseInputInfo(t *testing.T) {
+	tests := map[string]InputInfo{
+		"  Duration: 00:03:21.45, start: 0.000000, bitrate: 1234 kb/s": {
+			Duration: 3*time.Minute + 21450*time.Millisecond, Bitrate: 1234,
+		},
+		"  Duration: 01:00:00.00, start: 1.500000, bitrate: N/A": {Duration: time.Hour},
+		// Live inputs have no duration
+		"  Duration: N/A, start: 12345.600000, bitrate: N/A": {},
+	}
+	for line, want := range tests {
+		got, ok := parseInputInfo(line)
+		if !ok {
+			t.Errorf("%q: not recognized as input summary", line)
+			continue
+		}
+		if got != want {
+			t.Errorf("%q: got %+v, want %+v", line, got, want)
+		}
+	}
+	if in, _ := parseInputInfo("  Duration: 00:03:21.45, start: 0.000000, bitrate: 1234 kb/s"); in.Duration.Seconds() != 201.45 {
+		t.Errorf("got %v seconds, want 201.45", in.Duration.Seconds())
+	}
+
+	for _, line := range []string{"Input #0, mov,mp4, from 'http://video':", "frame=   30 fps=30 time=00:00:01.00 speed=1.5x"} {
+		if _, ok := parseInputInfo(line); ok {
+			t.Errorf("%q: unexpectedly parsed as input summary", line)
+		}
+	}
+}
+
+func TestStreamVideo_InputFunc(t *testing.T) {
+	writeFfmpegStub(t, `printf "Input #0, mov,mp4, from 'http://video':\n  Duration: 00:03:21.45, start: 0.000000, bitrate: 1234 kb/s\n" >&2
+printf "Input #1, webm, from 'http://audio':\n  Duration: 00:03:22.00, start: 0.000000, bitrate: 128 kb/s\n" >&2
+printf 'data'`)
+
+	var inputs []InputInfo
+	opts := StreamOptions{
+		VideoURL:  "http://video",
+		AudioURL:  "http://audio",
+		VCodec:    "h264",
+		InputFunc: func(in InputInfo) { inputs = append(inputs, in) },
+	}
+	if err := StreamVideo(context.Background(), opts, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	want := InputInfo{Duration: 3*time.Minute + 21450*time.Millisecond, Bitrate: 1234}
+	if len(inputs) != 1 || inputs[0] != want {
+		t.Errorf("got inputs %+v, want only the first input %+v", inputs, want)
+	}
+}
+
+func TestReportsInput(t *testing.T) {
+	defer func(old string) { FFmpegLogLevel = old }(FFmpegLogLevel)
+	for level, want := range map[string]bool{
+		"warning": false, "error": false, "24": false,
+		"info": true, "verbose": true, "32": true, "repeat+level+debug": true, "level+warning": false,
+	} {
+		FFmpegLogLevel = level
+		if got := ReportsInput(); got != want {
+			t.Errorf("ReportsInput() at %q = %v, want %v", level, got, want)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package streamer
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+	"video-microservice/internal/codec"
+	"video-microservice/internal/netguard"
+	"video-microservice/internal/redact"
+)
+
+// proxyClient fetches sources served without ffmpeg.
+// It has no overall timeout since streams can be long, cancellation comes from the request context.
+// Connections to addresses netguard blocks are refused, redirects included.
+var proxyClient = &http.Client{Transport: netguard.Transport()}
+
+// insecureProxyClient is proxyClient without certificate checks, for InsecureTLS
+var insecureProxyClient = func() *http.Client {
+	t := netguard.Transport()
+	t.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	return &http.Client{Transport: t}
+}()
+
+// CanProxy reports whether the stream can be served by copying the source
+// bytes unchanged instead of running ffmpeg: a single progressive input with
+// codecs that need no transcoding, streamed as MP4 from the start.
+// The caller must also make sure the source itself is an MP4 file.
+func (o StreamOptions) CanProxy() bool {
+	if o.AudioOnly || o.Live || o.Start > 0 || o.Duration > 0 || o.SubtitleURL != "" || o.Loudnorm || o.AudioSync || len(o.Chapters) > 0 {
+		return false
+	}
+	if o.Container != "" && o.Container != ContainerMP4 {
+		return false
+	}
+	if o.SeparateAudio() {
+		return false
+	}
+	return !codec.NeedsTranscode(o.VCodec) && (o.AudioURL == "" || !codec.AudioNeedsTranscode(o.ACodec))
+}
+
+// ProxyStream copies the source at url to w unchanged.
+// If w is an http.ResponseWriter, the upstream Content-Type and Content-Length are forwarded.
+// A source that can't be fetched is reported as a *StreamError, nothing is written then.
+func ProxyStream(ctx context.Context, url string, headers map[string]string, w io.Writer) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to build upstream request: %w", err)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	if req.Header.Get("User-Agent") == "" && DefaultUserAgent != "" {
+		req.Header.Set("User-Agent", DefaultUserAgent)
+	}
+
+	slog.InfoContext(ctx, "Proxying source directly", "url", redact.URL(url))
+	client := proxyClient
+	if InsecureTLS {
+		client = insecureProxyClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("upstream request failed: %w", err)
+		}
+		return &StreamError{Reason: ReasonUpstreamError, Err: fmt.Errorf("upstream request failed: %w", err)}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return &StreamError{Reason: upstreamReason(resp.StatusCode), Err: fmt.Errorf("upstream returned %s", resp.Status)}
+	}
+
+	// The upstream knows the exact size and type best
+	if rw, ok := w.(http.ResponseWriter); ok {
+		if ct := resp.Header.Get("Content-Type"); ct != "" {
+			rw.Header().Set("Content-Type", ct)
+		}
+		if resp.ContentLength >= 0 {
+			rw.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+		}
+	}
+
+	mw := &monitoringWriter{w: w, ctx: ctx, start: time.Now()}
+	if _, err := io.Copy(mw, resp.Body); err != nil {
+		if gone := mw.disconnected(ctx); gone != nil {
+			return gone
+		}
+		return fmt.Errorf("proxy copy failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package streamer
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCanProxy(t *testing.T) {
+	progressive := StreamOptions{
+		VideoURL: "http://cdn/18.mp4",
+		AudioURL: "http://cdn/18.mp4",
+		VCodec:   "avc1.42001E",
+		ACodec:   "mp4a.40.2",
+	}
+	if !progressive.CanProxy() {
+		t.Error("progressive H264/AAC should be proxied")
+	}
+
+	tests := map[string]func(o *StreamOptions){
+		"separate audio": func(o *StreamOptions) { o.AudioURL = "http://cdn/140" },
+		"transcode":      func(o *StreamOptions) { o.VCodec = "vp9" },
+		"seek":           func(o *StreamOptions) { o.Start = 10 },
+		"webm":           func(o *StreamOptions) { o.Container = ContainerWebM },
+		"audio only":     func(o *StreamOptions) { o.AudioOnly = true },
+	}
+	for name, modify := range tests {
+		opts := progressive
+		modify(&opts)
+		if opts.CanProxy() {
+			t.Errorf("%s: should not be proxied", name)
+		}
+	}
+}
+
+func TestProxyStream(t *testing.T) {
+	payload := []byte("ftypisom-progressive-bytes")
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Referer") != "https://www.youtube.com/" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write(payload)
+	}))
+	defer upstream.Close()
+
+	var out bytes.Buffer
+	err := ProxyStream(context.Background(), upstream.URL, map[string]string{"Referer": "https://www.youtube.com/"}, &out)
+	if err != nil {
+		t.Fatalf("ProxyStream failed: %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), payload) {
+		t.Errorf("got %q, want source bytes unchanged", out.Bytes())
+	}
+
+	// Upstream errors are reported instead of streaming an error page
+	out.Reset()
+	if err := ProxyStream(context.Background(), upstream.URL, nil, &out); err == nil {
+		t.Error("expected error for 403 upstream")
+	}
+	if out.Len() != 0 {
+		t.Errorf("unexpected body written on error: %q", out.Bytes())
+	}
+}
+
+func TestProxyStream_InsecureTLS(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("bytes"))
+	}))
+	defer upstream.Close()
+	defer func(old bool) { InsecureTLS = old }(InsecureTLS)
+
+	// The test server's certificate is self-signed
+	InsecureTLS = false
+	if err := ProxyStream(context.Background(), upstream.URL, nil, io.Discard); err == nil {
+		t.Error("expected a certificate error")
+	}
+	InsecureTLS = true
+	var out bytes.Buffer
+	if err := ProxyStream(context.Background(), upstream.URL, nil, &out); err != nil || out.String() != "bytes" {
+		t.Errorf("got %q, %v with InsecureTLS", out.String(), err)
+	}
+}
+
+func TestProxyStream_DefaultUserAgent(t *testing.T) {
+	defer func(old string) { DefaultUserAgent = old }(DefaultUserAgent)
+	DefaultUserAgent = "Fallback/1.0"
+	var got string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.UserAgent()
+	}))
+	defer upstream.Close()
+
+	for headers, want := range map[string]string{"": "Fallback/1.0", "Mozilla/5.0": "Mozilla/5.0"} {
+		var h map[string]string
+		if headers != "" {
+			h = map[string]string{"User-Agent": headers}
+		}
+		if err := ProxyStream(context.Background(), upstream.URL, h, io.Discard); err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("got User-Agent %q, want %q", got, want)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package streamer
+
+import (
+	"net/url"
+	"path"
+	"strings"
+)
+
+// isRadio reports whether an input is a SHOUTcast style radio stream, by an
+// ICY protocol or a .pls or .m3u playlist URL. Their in-band ICY metadata
+// confuses the MP4 muxer.
+func isRadio(protocol, rawURL string) bool {
+	if strings.Contains(strings.ToLower(protocol), "icy") {
+		return true
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	ext := strings.ToLower(path.Ext(u.Path))
+	return ext == ".pls" || ext == ".m3u"
+}
+
+// icyInputArgs asks radio servers not to interleave ICY metadata with the audio
+func icyInputArgs(protocol, url string) []string {
+	if isRadio(protocol, url) {
+		return []string{"-icy", "0"}
+	}
+	return nil
+}
+
+// adtsOutput reports whether radio audio is sent as a raw ADTS stream, which
+// suits continuous audio better than MP4. Only when no container was asked for.
+func (o StreamOptions) adtsOutput() bool {
+	return o.AudioOnly && o.Container == "" && isRadio(o.AudioProtocol, o.AudioURL)
+}
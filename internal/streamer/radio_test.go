@@ -0,0 +1,65 @@
+package streamer
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestIsRadio(t *testing.T) {
+	tests := []struct {
+		protocol, url string
+		want          bool
+	}{
+		{"icy", "http://radio.example/stream", true},
+		{"ICY", "http://radio.example/stream", true},
+		{"", "http://radio.example/listen.pls", true},
+		{"http", "http://radio.example/live.M3U?token=1", true},
+		{"m3u8_native", "http://cdn.example/index.m3u8", false},
+		{"https", "http://cdn.example/audio.m4a", false},
+	}
+	for _, tt := range tests {
+		if got := isRadio(tt.protocol, tt.url); got != tt.want {
+			t.Errorf("isRadio(%q, %q) = %v, want %v", tt.protocol, tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestBuildFfmpegArgs_ICY(t *testing.T) {
+	opts := StreamOptions{AudioOnly: true, AudioURL: "http://radio.example/stream", AudioProtocol: "icy", ACodec: "mp3"}
+	args := buildFfmpegArgs(opts)
+	icy := slices.Index(args, "-icy")
+	if icy < 0 || args[icy+1] != "0" || icy > slices.Index(args, "-i") {
+		t.Errorf("expected -icy 0 on the input: %v", args)
+	}
+	if argValue(args, "-f") != "adts" || args[len(args)-1] != "pipe:1" {
+		t.Errorf("expected an ADTS stream: %v", args)
+	}
+	if argValue(args, "-c:a") != "aac" {
+		t.Errorf("expected MP3 radio to be transcoded to AAC: %v", args)
+	}
+	if opts.ContentType() != "audio/aac" || opts.Extension() != ".aac" {
+		t.Errorf("got %s %s, want audio/aac .aac", opts.ContentType(), opts.Extension())
+	}
+
+	// An explicit container is kept, the input still skips the metadata
+	opts.Container = ContainerMP3
+	args = buildFfmpegArgs(opts)
+	if !slices.Contains(args, "-icy") || argValue(args, "-f") != "mp3" {
+		t.Errorf("expected ICY off and an MP3 output: %v", args)
+	}
+
+	// Muxed with a video, only the radio input is affected
+	video := StreamOptions{VideoURL: "http://video", VCodec: "h264", AudioURL: "http://radio.example/listen.pls", ACodec: "aac"}
+	args = buildFfmpegArgs(video)
+	if icy := slices.Index(args, "-icy"); icy < slices.Index(args, "http://video") {
+		t.Errorf("expected -icy 0 on the audio input only: %v", args)
+	}
+	if argValue(args, "-f") != "mp4" {
+		t.Errorf("expected an MP4 output with video: %v", args)
+	}
+
+	plain := StreamOptions{AudioOnly: true, AudioURL: "http://cdn/audio", AudioProtocol: "https", ACodec: "mp4a.40.2"}
+	if args := buildFfmpegArgs(plain); slices.Contains(args, "-icy") || argValue(args, "-f") != "mp4" {
+		t.Errorf("expected a regular source untouched: %v", args)
+	}
+}
@@ -1,104 +1,575 @@
 package streamer
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"math"
 	"os"
 	"os/exec"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
+	"video-microservice/internal/codec"
+	"video-microservice/internal/metrics"
+	"video-microservice/internal/redact"
 )
 
 type monitoringWriter struct {
 	w     io.Writer
+	ctx   context.Context
 	start time.Time
 	first bool
+
+	mu        sync.Mutex
+	lastWrite time.Time // when the last write completed, zero before the first
+	started   bool      // set once output or the headers ahead of it are on their way
+	writeErr  error     // the first failed write, the client went away
 }
 
 func (mw *monitoringWriter) Write(p []byte) (n int, err error) {
 	if !mw.first {
 		mw.first = true
-		log.Printf("Streamer: First byte sent to client after %v", time.Since(mw.start))
+		mw.mu.Lock()
+		mw.started = true
+		mw.mu.Unlock()
+		ttfb := time.Since(mw.start)
+		metrics.Stats.ObserveTTFB(ttfb)
+		slog.InfoContext(mw.ctx, "Streamer: First byte sent to client", "ttfb_ms", ttfb.Milliseconds())
+	}
+	n, err = mw.w.Write(p)
+	mw.mu.Lock()
+	mw.lastWrite = time.Now()
+	if err != nil && mw.writeErr == nil {
+		mw.writeErr = err
 	}
-	return mw.w.Write(p)
+	mw.mu.Unlock()
+	return n, err
 }
 
-// StreamVideo starts the ffmpeg process to stream the content
-func StreamVideo(ctx context.Context, videoURL string, videoHeaders map[string]string, audioURL string, audioHeaders map[string]string, vCodec, aCodec string, w io.Writer) error {
-	args := buildFfmpegArgs(videoURL, videoHeaders, audioURL, audioHeaders, vCodec, aCodec)
+// disconnected returns ErrClientDisconnected if a write to the client failed
+// or ctx was cancelled, i.e. the request went away, and ErrCancelled if the
+// stream was cancelled on purpose. It returns nil otherwise.
+func (mw *monitoringWriter) disconnected(ctx context.Context) error {
+	mw.mu.Lock()
+	writeErr := mw.writeErr
+	mw.mu.Unlock()
+	if writeErr != nil {
+		return fmt.Errorf("%w: %w", ErrClientDisconnected, writeErr)
+	}
+	// Not a cause set by us, like ErrStalled, or by the caller
+	switch context.Cause(ctx) {
+	case context.Canceled:
+		return ErrClientDisconnected
+	case ErrCancelled:
+		return ErrCancelled
+	}
+	return nil
+}
 
-	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+// outcome is the dlp_streams_total outcome for a stream ended by gone
+func outcome(gone error) string {
+	if errors.Is(gone, ErrCancelled) {
+		return "cancelled"
+	}
+	return "disconnected"
+}
 
-	// Wrap writer to monitor TTFB
-	mw := &monitoringWriter{w: w, start: time.Now()}
-	cmd.Stdout = mw
+// idle returns how long ago the last write completed, zero before the first
+func (mw *monitoringWriter) idle() time.Duration {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	if mw.lastWrite.IsZero() {
+		return 0
+	}
+	return time.Since(mw.lastWrite)
+}
+
+// watchStalls calls stalled once nothing has been written for timeout after
+// the first byte, until done is closed. A zero timeout disables it.
+func (mw *monitoringWriter) watchStalls(timeout time.Duration, stalled func(), done <-chan struct{}) {
+	if timeout <= 0 {
+		return
+	}
+	ticker := time.NewTicker(max(timeout/10, 10*time.Millisecond))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if idle := mw.idle(); idle >= timeout {
+				slog.WarnContext(mw.ctx, "Stream stalled, stopping ffmpeg", "idle", idle.Round(time.Millisecond))
+				stalled()
+				return
+			}
+		}
+	}
+}
+
+// FFmpegPath is the ffmpeg executable, looked up in PATH unless absolute
+var FFmpegPath = "ffmpeg"
+
+// AACBitrate is the bitrate used when transcoding audio to AAC
+var AACBitrate = "128k"
+
+// LoudnormTarget is the integrated loudness in LUFS that Loudnorm streams are normalized to
+var LoudnormTarget = -16.0
+
+// KillGracePeriod is how long ffmpeg gets to exit after SIGTERM when a stream
+// is cancelled, before it is killed
+var KillGracePeriod = 5 * time.Second
+
+// StallTimeout stops a stream once no output has been written for this long
+// after the first byte, e.g. ffmpeg stuck on a stalled CDN. Zero disables it.
+var StallTimeout = 60 * time.Second
+
+// ErrStalled is returned when a stream is stopped after StallTimeout
+var ErrStalled = errors.New("stream stalled")
+
+// ErrClientDisconnected is returned when the client went away mid-stream.
+// ffmpeg's exit is only a consequence, there's no one left to tell.
+var ErrClientDisconnected = errors.New("client disconnected")
+
+// ErrCancelled is the context cause for a stream stopped on purpose, e.g.
+// through POST /cancel. It's reported as itself rather than a failure.
+var ErrCancelled = errors.New("cancelled by client request")
+
+// ConstantFrameRate re-times transcoded video to a constant frame rate, for
+// variable frame rate sources whose uneven keyframes break fragmentation
+var ConstantFrameRate bool
+
+// FFmpegThreads caps the threads of each ffmpeg run, zero lets it use every
+// core. With concurrent transcodes, cores divided by their limit keeps one
+// from starving the others.
+var FFmpegThreads int
 
-	// Pipe stderr to capture progress
-	stderrPipe, err := cmd.StderrPipe()
+// FFmpegLogLevel is passed to ffmpeg's -loglevel.
+// Progress stats are always printed, whatever the level.
+var FFmpegLogLevel = "warning"
+
+// DefaultUserAgent is sent to sources whose headers don't set a User-Agent,
+// some CDNs refuse requests without one. Empty leaves ffmpeg's own.
+var DefaultUserAgent string
+
+// InsecureTLS skips certificate verification for sources, e.g. self-hosted
+// ones with self-signed certificates. Only for trusted networks.
+var InsecureTLS bool
+
+// ExtraArgs are passed to every ffmpeg run right before the output format,
+// after our own codec options so they can override them, e.g.
+// "-profile:v baseline". They are not checked in any way.
+var ExtraArgs []string
+
+// Output containers
+const (
+	ContainerMP4  = "mp4"
+	ContainerMP3  = "mp3"
+	ContainerWebM = "webm"
+)
+
+// StreamOptions describes the inputs and output settings of a stream
+type StreamOptions struct {
+	VideoURL     string
+	VideoHeaders map[string]string
+	AudioURL     string
+	AudioHeaders map[string]string
+	VCodec       string
+	ACodec       string
+	// Protocols as reported by yt-dlp, e.g. https or m3u8_native, or ProtocolDirect
+	VideoProtocol string
+	AudioProtocol string
+	// FPS is the source frame rate, used to space keyframes when transcoding
+	FPS float64
+
+	// AudioOnly drops the video and streams just the audio input.
+	// Only the Audio* fields are used in this mode.
+	AudioOnly bool
+	// NoAudio marks a video without any audio track, so none is mapped
+	NoAudio bool
+	// Container is the output format, defaulting to MP4
+	Container string
+
+	// SubtitleURL is an optional WebVTT track, muxed as a mov_text stream
+	// or, with BurnSubtitles, rendered into the video which forces a transcode.
+	SubtitleURL     string
+	SubtitleHeaders map[string]string
+	BurnSubtitles   bool
+
+	// Start is the offset in seconds to begin streaming from.
+	// Copied video is seeked on the input side, which is fast but snaps to
+	// the nearest preceding keyframe, so playback may begin slightly earlier.
+	// Transcoded video starts at the exact frame.
+	Start float64
+	// Duration limits the output to this many seconds from Start, zero streams to the end.
+	// Copied video can only be cut at keyframes, transcoded video is cut exactly.
+	Duration float64
+
+	// Live sources aren't seekable, Start is ignored and timestamps are regenerated
+	Live bool
+
+	// AudioBitrate overrides AACBitrate when the audio is transcoded, e.g. "96k"
+	AudioBitrate string
+	// Loudnorm normalizes the audio to LoudnormTarget following EBU R128.
+	// A copied stream can't be filtered, so this forces the audio to be transcoded.
+	Loudnorm bool
+	// AudioSync keeps separate video and audio in sync when their timestamps
+	// drift, stretching the audio and, when the video is transcoded,
+	// duplicating or dropping frames. This forces the audio to be transcoded.
+	AudioSync bool
+	// AudioOffset shifts a separate audio input by this many seconds,
+	// positive values delay it. A single input can't be shifted, callers
+	// check SeparateAudio.
+	AudioOffset float64
+
+	// CopyCodecs copies both streams into an MP4 as they are, for sources
+	// whose codecs aren't known but are expected to fit, e.g. yt-dlp's best
+	// pre-merged format. Loudnorm and burned subtitles still transcode.
+	CopyCodecs bool
+	// TranscodeVideo and TranscodeAudio carry the format selection's verdict
+	// on the codecs, see ytdlp.Selection. Options built without a selection
+	// leave them unset, the codecs are then classified by the same rule here.
+	TranscodeVideo bool
+	TranscodeAudio bool
+	// forceTranscode re-encodes video that ProbeBeforeCopy found unfit to copy
+	forceTranscode bool
+
+	// MaxBitrate caps the transcoded video bitrate in kbps, zero means unconstrained.
+	// Copied streams keep their source bitrate.
+	MaxBitrate int
+
+	// Faststart writes a regular MP4 with its index at the front instead of a
+	// fragmented stream, for clients that can't handle fragmented files.
+	// ffmpeg can't do this over a pipe, so the output goes to a temp file in
+	// TempDir and is only sent once complete. Other containers ignore it.
+	Faststart bool
+	// outputPath is the temp file ffmpeg writes a Faststart output to
+	outputPath string
+
+	// Chapters are embedded in the output, shifted to match Start and Duration
+	Chapters []Chapter
+	// chaptersPath is the temp ffmetadata file holding Chapters
+	chaptersPath string
+
+	// PaceBitrate, in kbps, holds the output to PaceMultiplier times this
+	// rate, so a fast transcode doesn't run far ahead of playback.
+	// Zero sends the output as fast as ffmpeg produces it, as does Faststart.
+	PaceBitrate int
+
+	// ProgressFunc is called with every ffmpeg status update, if set
+	ProgressFunc ProgressFunc
+	// InputFunc is called with the first input's duration and bitrate, if set and known.
+	// When SendsFile, that's before anything is written to the output.
+	InputFunc InputFunc
+}
+
+// FFmpegVersion returns the installed ffmpeg version, e.g. "6.1.1"
+func FFmpegVersion(ctx context.Context) (string, error) {
+	out, err := exec.CommandContext(ctx, FFmpegPath, "-version").Output()
 	if err != nil {
-		return fmt.Errorf("failed to pipe stderr: %w", err)
+		return "", fmt.Errorf("failed to run ffmpeg -version: %w", err)
+	}
+	return parseFFmpegVersion(string(out)), nil
+}
+
+// parseFFmpegVersion extracts the version from the first line of ffmpeg -version,
+// which looks like "ffmpeg version 6.1.1 Copyright (c) 2000-2023 the FFmpeg developers"
+func parseFFmpegVersion(output string) string {
+	line, _, _ := strings.Cut(output, "\n")
+	fields := strings.Fields(line)
+	if len(fields) >= 3 && fields[1] == "version" {
+		return fields[2]
 	}
+	return strings.TrimSpace(line)
+}
 
-	log.Printf("Starting ffmpeg with args: %v", args)
+// ContentType returns the MIME type of the stream produced for these options
+func (o StreamOptions) ContentType() string {
+	if o.AudioOnly {
+		if o.Container == ContainerMP3 {
+			return "audio/mpeg"
+		}
+		if o.adtsOutput() {
+			return "audio/aac"
+		}
+		return "audio/mp4"
+	}
+	if o.Container == ContainerWebM {
+		return "video/webm"
+	}
+	return "video/mp4"
+}
 
+// Extension returns the file extension matching ContentType, with the leading dot
+func (o StreamOptions) Extension() string {
+	if o.AudioOnly {
+		if o.Container == ContainerMP3 {
+			return ".mp3"
+		}
+		if o.adtsOutput() {
+			return ".aac"
+		}
+		return ".m4a"
+	}
+	if o.Container == ContainerWebM {
+		return ".webm"
+	}
+	return ".mp4"
+}
+
+// StreamVideo starts the ffmpeg process to stream the content
+func StreamVideo(ctx context.Context, opts StreamOptions, w io.Writer) error {
+	// WebM is only chosen for codecs that fit it, MP4 copies are the risky ones
+	if ProbeBeforeCopy && !opts.AudioOnly && opts.Container != ContainerWebM && !opts.TranscodesVideo() {
+		opts.forceTranscode = !defaultProber.confirmCopy(ctx, opts)
+	}
+	if opts.SendsFile() {
+		path, err := createOutputFile()
+		if err != nil {
+			return err
+		}
+		// Also covers ffmpeg being stopped when the client goes away
+		defer os.Remove(path)
+		opts.outputPath = path
+	}
+	if len(opts.Chapters) > 0 && !opts.Live {
+		path, err := writeChaptersFile(opts)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(path)
+		opts.chaptersPath = path
+	}
+	args := buildFfmpegArgs(opts)
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	cmd := exec.CommandContext(ctx, FFmpegPath, args...)
+	// On cancellation ask ffmpeg to exit first, it may be stuck in a network
+	// wait. WaitDelay later kills it and stops Wait from hanging on its output.
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(syscall.SIGTERM)
+	}
+	cmd.WaitDelay = KillGracePeriod
+
+	// Wrap writer to monitor TTFB
+	mw := &monitoringWriter{w: w, ctx: ctx, start: time.Now()}
+	var out io.Writer = mw
+	if opts.PaceBitrate > 0 {
+		out = newPacedWriter(ctx, mw, opts.PaceBitrate)
+	}
+	cmd.Stdout = out
+
+	// Pipe stderr to capture progress.
+	// Not cmd.StderrPipe, so WaitDelay also covers the stderr copy.
+	stderrReader, stderrWriter := io.Pipe()
+	cmd.Stderr = stderrWriter
+
+	slog.InfoContext(ctx, "Starting ffmpeg", "args", sanitizeArgs(args))
+	if opts.Duration > 0 && !opts.AudioOnly && !opts.TranscodesVideo() {
+		slog.InfoContext(ctx, "Clipping copied video, cuts are aligned to keyframes", "start", opts.Start, "duration", opts.Duration)
+	}
+
+	mode := streamMode(opts)
 	if err := cmd.Start(); err != nil {
+		metrics.Streams.WithLabelValues(mode, "failure").Inc()
+		if errors.Is(err, exec.ErrNotFound) {
+			return fmt.Errorf("ffmpeg binary not found, make sure it is installed and in PATH: %w", err)
+		}
 		return fmt.Errorf("ffmpeg start failed: %w", err)
 	}
 
 	// Read stderr in a goroutine
+	// The tail is kept to classify the failure if ffmpeg exits early
+	stderrTail := &tailBuffer{max: 4096}
+	stderrDone := make(chan struct{})
 	go func() {
-		buf := make([]byte, 1024)
-		for {
-			n, err := stderrPipe.Read(buf)
-			if n > 0 {
-				chunk := buf[:n]
-				os.Stderr.Write(chunk) // Pass through to original stderr
-
-				// Simple heuristic: if we see "speed=", log it as a distinct log line for visibility
-				s := string(chunk)
-				if strings.Contains(s, "speed=") {
-					// Extract the line or just log the chunk.
-					// Since chunk might be partial, this isn't perfect, but good enough for debug.
-					// We'll log it if it looks like a stats line.
-					log.Printf("FFMPEG PROGRESS: %s", strings.TrimSpace(s))
-				}
-			}
-			if err != nil {
-				break
-			}
+		defer close(stderrDone)
+		readStderr(ctx, stderrReader, stderrTail, opts.ProgressFunc, opts.InputFunc)
+	}()
+
+	watchDone := make(chan struct{})
+	var watchers sync.WaitGroup
+	watchers.Add(2)
+	go func() {
+		defer watchers.Done()
+		mw.watchStalls(StallTimeout, func() { cancel(ErrStalled) }, watchDone)
+	}()
+	go func() {
+		defer watchers.Done()
+		// A Faststart output is only sent once ffmpeg is done
+		if opts.outputPath == "" {
+			mw.watchFirstByte(TTFBTimeout, TTFBAction, func() { cancel(ErrFirstByteTimeout) }, watchDone)
 		}
 	}()
 
-	if err := cmd.Wait(); err != nil {
+	err := cmd.Wait()
+	close(watchDone)
+	// Neither may act on the response once it's handed back
+	watchers.Wait()
+	// Wait has copied all of stderr, let the reader finish before using the tail
+	stderrWriter.Close()
+	<-stderrDone
+	metrics.StreamDuration.WithLabelValues(mode).Observe(time.Since(mw.start).Seconds())
+	if err != nil {
+		if gone := mw.disconnected(ctx); gone != nil {
+			metrics.Streams.WithLabelValues(mode, outcome(gone)).Inc()
+			return gone
+		}
+		metrics.Streams.WithLabelValues(mode, "failure").Inc()
+		if errors.Is(context.Cause(ctx), ErrStalled) {
+			return fmt.Errorf("%w: no output for %s: %w", ErrStalled, StallTimeout, err)
+		}
+		if errors.Is(context.Cause(ctx), ErrFirstByteTimeout) && !mw.responded() {
+			return &StreamError{Reason: ReasonFirstByteTimeout, Err: fmt.Errorf("%w of %s: %w", ErrFirstByteTimeout, TTFBTimeout, err)}
+		}
+		if !mw.responded() {
+			return &StreamError{Reason: classifyFfmpegError(stderrTail.String()), Err: err}
+		}
 		return fmt.Errorf("ffmpeg execution failed: %w", err)
 	}
+	if opts.outputPath != "" {
+		if err := checkOutputSize(opts.outputPath); err != nil {
+			metrics.Streams.WithLabelValues(mode, "failure").Inc()
+			return err
+		}
+		if err := sendFile(opts.outputPath, mw); err != nil {
+			if gone := mw.disconnected(ctx); gone != nil {
+				metrics.Streams.WithLabelValues(mode, outcome(gone)).Inc()
+				return gone
+			}
+			metrics.Streams.WithLabelValues(mode, "failure").Inc()
+			return err
+		}
+	}
+	metrics.Streams.WithLabelValues(mode, "success").Inc()
 
 	return nil
 }
 
-func buildFfmpegArgs(videoURL string, videoHeaders map[string]string, audioURL string, audioHeaders map[string]string, vCodec, aCodec string) []string {
+// readStderr passes ffmpeg's stderr through to our own and into tail,
+// logging each status line once and reporting the first input's summary
+func readStderr(ctx context.Context, r io.Reader, tail io.Writer, progress ProgressFunc, input InputFunc) {
+	tee := io.TeeReader(r, io.MultiWriter(os.Stderr, tail))
+	scanner := bufio.NewScanner(tee)
+	scanner.Buffer(make([]byte, 4096), 1<<20)
+	scanner.Split(scanStatusLines)
+	inputSeen := false
+	for scanner.Scan() {
+		if !inputSeen {
+			if in, ok := parseInputInfo(scanner.Text()); ok {
+				// Later summaries belong to the audio or subtitle inputs
+				inputSeen = true
+				if input != nil {
+					input(in)
+				}
+				continue
+			}
+		}
+		p, ok := parseProgress(scanner.Text())
+		if !ok {
+			continue
+		}
+		slog.InfoContext(ctx, "FFMPEG PROGRESS", "time", p.Time, "speed", p.Speed, "frame", p.Frame)
+		if progress != nil {
+			progress(p)
+		}
+	}
+	// Keep draining after a scan error so ffmpeg never blocks on a full pipe
+	io.Copy(io.Discard, tee)
+}
+
+// scanStatusLines is a bufio.SplitFunc for ffmpeg's stderr, where status
+// updates end with \r so the terminal overwrites them in place
+func scanStatusLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// streamMode labels how ffmpeg handles the video: copy, transcode, or audio for audio-only streams
+func streamMode(opts StreamOptions) string {
+	switch {
+	case opts.AudioOnly:
+		return "audio"
+	case opts.TranscodesVideo():
+		return "transcode"
+	}
+	return "copy"
+}
+
+func buildFfmpegArgs(opts StreamOptions) []string {
 	args := []string{
 		"-hide_banner",
-		"-loglevel", "info",
-		"-threads", "0",
+		"-loglevel", FFmpegLogLevel,
+		// Stats are only shown at info level unless asked for explicitly
+		"-stats",
+		"-threads", strconv.Itoa(FFmpegThreads),
 	}
 
+	if opts.AudioOnly {
+		return append(args, buildAudioOnlyArgs(opts)...)
+	}
+
+	webm := opts.Container == ContainerWebM
+	transcodeVideo := opts.TranscodesVideo()
+	burnSubtitles := opts.BurnSubtitles && opts.SubtitleURL != ""
+
 	// Add inputs
 	// Input 0: Video
-	args = append(args, argsFromHeaders(videoHeaders)...)
-	args = append(args, "-i", videoURL)
+	args = append(args, argsFromHeaders(opts.VideoHeaders)...)
+	args = append(args, tlsInputArgs()...)
+	args = append(args, manifestInputArgs(opts.VideoProtocol)...)
+	// Burning subtitles is a software filter, so frames must be decoded on the CPU
+	if transcodeVideo && !burnSubtitles {
+		args = append(args, hwaccelInputArgs()...)
+	}
+	seek := opts.seek()
+	args = append(args, opts.timingArgs(seek)...)
+	args = append(args, "-i", opts.VideoURL)
 
-	hasSeparateAudio := audioURL != "" && audioURL != videoURL
+	hasSeparateAudio := opts.SeparateAudio()
 	if hasSeparateAudio {
 		// Input 1: Audio
-		args = append(args, argsFromHeaders(audioHeaders)...)
-		args = append(args, "-i", audioURL)
+		// Seek it by the same offset so both inputs stay in sync
+		args = append(args, argsFromHeaders(opts.AudioHeaders)...)
+		args = append(args, tlsInputArgs()...)
+		args = append(args, manifestInputArgs(opts.AudioProtocol)...)
+		args = append(args, opts.timingArgs(seek)...)
+		args = append(args, icyInputArgs(opts.AudioProtocol, opts.AudioURL)...)
+		args = append(args, audioOffsetArgs(opts.AudioOffset)...)
+		args = append(args, "-i", opts.AudioURL)
 	}
 
+	softSubtitles := opts.SubtitleURL != "" && !burnSubtitles
+	if softSubtitles {
+		// Last input: Subtitles
+		args = append(args, argsFromHeaders(opts.SubtitleHeaders)...)
+		args = append(args, tlsInputArgs()...)
+		args = append(args, opts.timingArgs(seek)...)
+		args = append(args, "-i", opts.SubtitleURL)
+	}
+	// After the media inputs: chapters
+	args = append(args, opts.chaptersInputArgs()...)
+
 	// Map streams
-	if hasSeparateAudio {
+	if opts.NoAudio {
+		args = append(args, "-map", "0:v:0")
+	} else if hasSeparateAudio {
 		args = append(args, "-map", "0:v:0", "-map", "1:a:0")
 	} else {
 		// Single input with both (or just video)
@@ -108,46 +579,366 @@ func buildFfmpegArgs(videoURL string, videoHeaders map[string]string, audioURL s
 		// But explicit map is better.
 		args = append(args, "-map", "0:a:0?") // ? means optional
 	}
+	if softSubtitles {
+		subtitleInput := 1
+		if hasSeparateAudio {
+			subtitleInput = 2
+		}
+		args = append(args, "-map", strconv.Itoa(subtitleInput)+":s:0")
+	}
+	chaptersInput := 1
+	if hasSeparateAudio {
+		chaptersInput++
+	}
+	if softSubtitles {
+		chaptersInput++
+	}
+	args = append(args, opts.chaptersMapArgs(chaptersInput)...)
 
-	// Video Codec settings
-	// User requirement: "output encoded in h264".
-	// If source is already h264 (avc1) or h265 (hevc), we copy.
-	vCodecLower := strings.ToLower(vCodec)
-	if strings.Contains(vCodecLower, "avc1") || strings.Contains(vCodecLower, "h264") ||
-		strings.Contains(vCodecLower, "hevc") || strings.Contains(vCodecLower, "hvc1") || strings.Contains(vCodecLower, "hev1") || strings.Contains(vCodecLower, "h265") {
+	if webm {
 		args = append(args, "-c:v", "copy")
-	} else {
+		if opts.NoAudio {
+			args = append(args, "-an")
+		} else {
+			args = append(args, "-c:a", "copy")
+		}
+		args = append(args, opts.durationArgs()...)
+		args = append(args, ExtraArgs...)
+		return append(args, "-f", "webm", "pipe:1")
+	}
+
+	// Video Codec settings
+	if transcodeVideo {
 		// Transcode to H264
-		// -preset ultrafast to be efficient but decent size.
-		// We remove zerolatency to allow better buffering/throughput.
-		// We add -g 60 to force keyframes every ~2s (assuming 30fps) for frequent fragmentation.
-		// -sc_threshold 0 ensures strict GOP adherence.
-		args = append(args, "-c:v", "libx264", "-preset", "ultrafast", "-g", "60", "-keyint_min", "60", "-sc_threshold", "0")
+		var filters []string
+		if burnSubtitles {
+			filters = burnSubtitlesFilters(opts.SubtitleURL, seek.input)
+		}
+		args = append(args, videoEncoderArgs(opts.FPS, filters)...)
+		args = append(args, bitrateArgs(opts.MaxBitrate)...)
+	} else {
+		args = append(args, "-c:v", "copy")
 	}
 
 	// Audio Codec settings
-	if strings.Contains(strings.ToLower(aCodec), "mp4a") || strings.Contains(strings.ToLower(aCodec), "aac") {
+	if opts.NoAudio {
+		args = append(args, "-an")
+	} else if !opts.TranscodesAudio() {
 		args = append(args, "-c:a", "copy")
 	} else {
-		args = append(args, "-c:a", "aac")
+		args = append(args, opts.aacEncoderArgs()...)
+		args = append(args, opts.syncArgs(transcodeVideo)...)
 	}
 
-	// Output format settings for streaming MP4
-	args = append(args, "-f", "mp4", "-movflags", "frag_keyframe+empty_moov", "pipe:1")
+	if softSubtitles {
+		args = append(args, "-c:s", "mov_text")
+	}
 
+	// Output format settings, a fragmented MP4 unless Faststart
+	args = append(args, seek.outputArgs()...)
+	args = append(args, opts.durationArgs()...)
+	args = append(args, ExtraArgs...)
+	return append(args, opts.mp4OutputArgs()...)
+}
+
+// DryRunArgs returns the ffmpeg arguments StreamVideo would run for opts,
+// redacted like the "Starting ffmpeg" log. Nothing is probed or created, so
+// temp files show as their name patterns and ProbeBeforeCopy can't turn a
+// copy into a transcode.
+func DryRunArgs(opts StreamOptions) []string {
+	if opts.Faststart && opts.writesMP4() {
+		opts.outputPath = "dlp-*.mp4"
+	}
+	if len(opts.Chapters) > 0 && !opts.Live {
+		opts.chaptersPath = "dlp-*.ffmeta"
+	}
+	return sanitizeArgs(buildFfmpegArgs(opts))
+}
+
+// TranscodesVideo reports whether the video is re-encoded to H264.
+// User requirement: "output encoded in h264".
+// If source is already h264 (avc1) or h265 (hevc), we copy, unless subtitles
+// are burned in. WebM output is only used when both streams can be copied as is.
+// It's the one place this is decided, callers reporting it must ask here.
+// ProbeBeforeCopy can still turn a copy into a transcode once the stream starts.
+func (o StreamOptions) TranscodesVideo() bool {
+	if o.AudioOnly || o.Container == ContainerWebM {
+		return false
+	}
+	if (o.BurnSubtitles && o.SubtitleURL != "") || o.forceTranscode || o.TranscodeVideo {
+		return true
+	}
+	return !o.CopyCodecs && codec.NeedsTranscode(o.VCodec)
+}
+
+// SeparateAudio reports whether the audio comes from its own input
+func (o StreamOptions) SeparateAudio() bool {
+	return o.AudioURL != "" && o.AudioURL != o.VideoURL
+}
+
+// TranscodesAudio reports whether the audio is re-encoded to AAC in an MP4 output
+func (o StreamOptions) TranscodesAudio() bool {
+	return o.Loudnorm || o.AudioSync || o.TranscodeAudio || (!o.CopyCodecs && codec.AudioNeedsTranscode(o.ACodec))
+}
+
+// aacEncoderArgs returns the output options for transcoding the audio to AAC
+func (o StreamOptions) aacEncoderArgs() []string {
+	bitrate := AACBitrate
+	if o.AudioBitrate != "" {
+		bitrate = o.AudioBitrate
+	}
+	return append(o.loudnormArgs(), "-c:a", "aac", "-b:a", bitrate)
+}
+
+// syncArgs returns the output options resyncing the audio with AudioSync.
+// Copied video keeps its frames, only a transcode can duplicate or drop them.
+func (o StreamOptions) syncArgs(transcodeVideo bool) []string {
+	if !o.AudioSync {
+		return nil
+	}
+	args := []string{"-async", "1"}
+	// ConstantFrameRate already asks for the same
+	if transcodeVideo && !ConstantFrameRate {
+		args = append(args, "-fps_mode", "cfr")
+	}
 	return args
 }
 
+// audioOffsetArgs returns the input option shifting the audio timestamps by offset seconds
+func audioOffsetArgs(offset float64) []string {
+	if offset == 0 {
+		return nil
+	}
+	return []string{"-itsoffset", strconv.FormatFloat(offset, 'f', -1, 64)}
+}
+
+// loudnormArgs returns the audio filter normalizing loudness, if requested.
+// True peak and loudness range are fixed at common streaming values.
+func (o StreamOptions) loudnormArgs() []string {
+	if !o.Loudnorm {
+		return nil
+	}
+	target := strconv.FormatFloat(LoudnormTarget, 'f', -1, 64)
+	return []string{"-af", "loudnorm=I=" + target + ":TP=-1.5:LRA=11"}
+}
+
+// bitrateArgs returns the rate control options capping the encoder at kbps
+func bitrateArgs(kbps int) []string {
+	if kbps <= 0 {
+		return nil
+	}
+	rate := strconv.Itoa(kbps) + "k"
+	return []string{"-b:v", rate, "-maxrate", rate, "-bufsize", strconv.Itoa(2*kbps) + "k"}
+}
+
+// burnSubtitlesFilters returns the video filters rendering the subtitle track into the frames
+func burnSubtitlesFilters(subtitleURL string, start float64) []string {
+	subtitles := "subtitles=" + escapeFilterValue(subtitleURL)
+	if start <= 0 {
+		return []string{subtitles}
+	}
+	// Input seeking resets timestamps to zero, shift them back while
+	// rendering so the cues line up with the seeked video
+	offset := strconv.FormatFloat(start, 'f', -1, 64)
+	return []string{"setpts=PTS+" + offset + "/TB", subtitles, "setpts=PTS-STARTPTS"}
+}
+
+// escapeFilterValue quotes a value for use as a filter option in a filtergraph
+func escapeFilterValue(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, `:`, `\:`)
+	v = strings.ReplaceAll(v, `'`, `'\''`)
+	return "'" + v + "'"
+}
+
+// buildAudioOnlyArgs returns the input and output args for streaming just the audio
+func buildAudioOnlyArgs(opts StreamOptions) []string {
+	var args []string
+	args = append(args, argsFromHeaders(opts.AudioHeaders)...)
+	args = append(args, tlsInputArgs()...)
+	args = append(args, manifestInputArgs(opts.AudioProtocol)...)
+	args = append(args, icyInputArgs(opts.AudioProtocol, opts.AudioURL)...)
+	args = append(args, opts.timingArgs(opts.seek())...)
+	args = append(args, "-i", opts.AudioURL)
+	args = append(args, opts.chaptersInputArgs()...)
+
+	// Drop any video, e.g. when the audio comes from a pre-merged format
+	args = append(args, "-map", "0:a:0", "-vn")
+	args = append(args, opts.chaptersMapArgs(1)...)
+
+	if opts.Container == ContainerMP3 {
+		if strings.Contains(strings.ToLower(opts.ACodec), "mp3") && !opts.Loudnorm {
+			args = append(args, "-c:a", "copy")
+		} else {
+			args = append(args, opts.loudnormArgs()...)
+			args = append(args, "-c:a", "libmp3lame")
+			if opts.AudioBitrate != "" {
+				args = append(args, "-b:a", opts.AudioBitrate)
+			}
+		}
+		args = append(args, opts.durationArgs()...)
+		args = append(args, ExtraArgs...)
+		return append(args, "-f", "mp3", "pipe:1")
+	}
+
+	if !opts.TranscodesAudio() {
+		args = append(args, "-c:a", "copy")
+	} else {
+		args = append(args, opts.aacEncoderArgs()...)
+	}
+	args = append(args, opts.durationArgs()...)
+	args = append(args, ExtraArgs...)
+	if opts.adtsOutput() {
+		return append(args, "-f", "adts", "pipe:1")
+	}
+	return append(args, opts.mp4OutputArgs()...)
+}
+
+// sanitizeArgs returns a copy of args safe for logging.
+// Signed input URLs and request headers (which may carry cookies) are redacted.
+func sanitizeArgs(args []string) []string {
+	out := make([]string, len(args))
+	for i, arg := range args {
+		switch {
+		case i > 0 && args[i-1] == "-headers":
+			out[i] = redact.Placeholder
+		case strings.HasPrefix(arg, "http"):
+			out[i] = redact.URL(arg)
+		default:
+			out[i] = arg
+		}
+	}
+	return out
+}
+
+// manifestProtocols are the protocols HLS and DASH inputs may use for their
+// playlists, keys and segments
+const manifestProtocols = "file,http,https,tcp,tls,crypto,hls"
+
+// ProtocolDirect marks inputs whose URL came from the client, see direct=true
+const ProtocolDirect = "direct"
+
+// directProtocols are all direct inputs may use. ffmpeg still follows
+// redirects and playlist entries to any host, those aren't checked.
+const directProtocols = "http,https,tcp,tls,crypto"
+
+// manifestInputArgs returns the input options for segmented sources, so that
+// every segment is fetched instead of failing on the first unusual one.
+// The headers set for the input are reused for each segment request.
+// Direct inputs are restricted to network protocols instead.
+func manifestInputArgs(protocol string) []string {
+	switch {
+	case protocol == ProtocolDirect:
+		return []string{"-protocol_whitelist", directProtocols}
+	case strings.HasPrefix(protocol, "m3u8"):
+		// Segment URLs often lack a media extension, which the HLS demuxer rejects by default
+		return []string{"-protocol_whitelist", manifestProtocols, "-allowed_extensions", "ALL"}
+	case strings.Contains(protocol, "dash"):
+		return []string{"-protocol_whitelist", manifestProtocols}
+	}
+	return nil
+}
+
+// tlsInputArgs turns off certificate checks on an input with InsecureTLS.
+// Explicit even though many ffmpeg builds don't verify by default.
+func tlsInputArgs() []string {
+	if InsecureTLS {
+		return []string{"-tls_verify", "0"}
+	}
+	return nil
+}
+
+// timingArgs returns the input options controlling where timestamps start.
+// Live sources can't be seeked and may have timestamp gaps, so ffmpeg regenerates them.
+func (o StreamOptions) timingArgs(seek seekSpec) []string {
+	if o.Live {
+		return []string{"-fflags", "+genpts"}
+	}
+	return seekArgs(seek.input)
+}
+
+// transcodeSeekPreroll is how far before Start a transcoded stream's inputs
+// are seeked to, the rest is decoded and dropped on the output side
+const transcodeSeekPreroll = 10.0
+
+// seekSpec splits the start offset between the input side, before -i, and
+// the output side
+type seekSpec struct {
+	input  float64
+	output float64
+}
+
+// seek places the start offset for the stream mode. Copies are seeked on the
+// input side only, which is fast and where keyframes are all they can start
+// at anyway. Transcoded video seeks the input to a little before Start then
+// drops the frames up to it on the output side, for a frame exact start
+// without decoding the source from the beginning.
+func (o StreamOptions) seek() seekSpec {
+	start := o.timingStart()
+	if start <= 0 || !o.TranscodesVideo() {
+		return seekSpec{input: start}
+	}
+	input := math.Max(start-transcodeSeekPreroll, 0)
+	return seekSpec{input: input, output: start - input}
+}
+
+// outputArgs returns the output-side part of the seek, if any
+func (s seekSpec) outputArgs() []string {
+	return seekArgs(s.output)
+}
+
+// timingStart is the effective start offset, live sources always start at the live edge
+func (o StreamOptions) timingStart() float64 {
+	if o.Live {
+		return 0
+	}
+	return o.Start
+}
+
+// durationArgs returns the output-side limit for a clip.
+// It's a duration rather than an end time (-to) since the input seek
+// resets the timestamps to zero, it counts from the output seek if any.
+func (o StreamOptions) durationArgs() []string {
+	if o.Duration <= 0 || o.Live {
+		return nil
+	}
+	return []string{"-t", strconv.FormatFloat(o.Duration, 'f', -1, 64)}
+}
+
+// seekArgs returns the seek option for the given offset.
+// Placed before -i, ffmpeg seeks the input quickly but copies can only start
+// at a keyframe. Placed after, it decodes and drops everything before it.
+func seekArgs(start float64) []string {
+	if start <= 0 {
+		return nil
+	}
+	return []string{"-ss", strconv.FormatFloat(start, 'f', -1, 64)}
+}
+
 func argsFromHeaders(headers map[string]string) []string {
 	var args []string
 	var headerList []string
-	for k, v := range headers {
+
+	// Iterate in a stable order so the generated command is deterministic
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	hasUserAgent := false
+	for _, k := range keys {
+		v := headers[k]
 		if strings.EqualFold(k, "User-Agent") {
 			args = append(args, "-user_agent", v)
+			hasUserAgent = true
 		} else {
 			headerList = append(headerList, fmt.Sprintf("%s: %s", k, v))
 		}
 	}
+	if !hasUserAgent && DefaultUserAgent != "" {
+		args = append(args, "-user_agent", DefaultUserAgent)
+	}
 	if len(headerList) > 0 {
 		// CRLF separated
 		headerStr := strings.Join(headerList, "\r\n") + "\r\n"
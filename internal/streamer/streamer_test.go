@@ -1,7 +1,16 @@
 package streamer
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os/exec"
+	"slices"
+	"strings"
 	"testing"
+	"video-microservice/internal/requestid"
 )
 
 func TestBuildFfmpegArgs(t *testing.T) {
@@ -37,7 +46,12 @@ func TestBuildFfmpegArgs(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			args := buildFfmpegArgs("http://video", nil, "http://audio", nil, tt.vCodec, "aac")
+			args := buildFfmpegArgs(StreamOptions{
+				VideoURL: "http://video",
+				AudioURL: "http://audio",
+				VCodec:   tt.vCodec,
+				ACodec:   "aac",
+			})
 
 			// Check for preset
 			foundPreset := false
@@ -81,3 +95,774 @@ func TestBuildFfmpegArgs(t *testing.T) {
 		})
 	}
 }
+
+func TestBuildFfmpegArgs_Headers(t *testing.T) {
+	videoHeaders := map[string]string{
+		"Referer":    "https://www.youtube.com/",
+		"User-Agent": "Mozilla/5.0",
+	}
+	args := buildFfmpegArgs(StreamOptions{
+		VideoURL:     "http://video",
+		VideoHeaders: videoHeaders,
+		VCodec:       "h264",
+		ACodec:       "aac",
+	})
+
+	foundHeaders := false
+	foundUA := false
+	for i, arg := range args {
+		if arg == "-headers" && i+1 < len(args) {
+			if args[i+1] != "Referer: https://www.youtube.com/\r\n" {
+				t.Errorf("got headers %q, want Referer line only", args[i+1])
+			}
+			foundHeaders = true
+		}
+		if arg == "-user_agent" && i+1 < len(args) {
+			if args[i+1] != "Mozilla/5.0" {
+				t.Errorf("got user agent %q, want Mozilla/5.0", args[i+1])
+			}
+			foundUA = true
+		}
+		if arg == "-i" {
+			// Header options must precede the input they apply to
+			if !foundHeaders || !foundUA {
+				t.Errorf("header options not placed before input")
+			}
+			break
+		}
+	}
+	if !foundHeaders {
+		t.Errorf("-headers not found")
+	}
+	if !foundUA {
+		t.Errorf("-user_agent not found")
+	}
+}
+
+func TestArgsFromHeaders_DefaultUserAgent(t *testing.T) {
+	defer func(old string) { DefaultUserAgent = old }(DefaultUserAgent)
+
+	tests := []struct {
+		name     string
+		fallback string
+		headers  map[string]string
+		want     []string
+	}{
+		{"no default", "", map[string]string{"Referer": "r"}, []string{"-headers", "Referer: r\r\n"}},
+		{"default when absent", "Fallback/1.0", map[string]string{"Referer": "r"}, []string{"-user_agent", "Fallback/1.0", "-headers", "Referer: r\r\n"}},
+		{"default without headers", "Fallback/1.0", nil, []string{"-user_agent", "Fallback/1.0"}},
+		{"headers win", "Fallback/1.0", map[string]string{"user-agent": "Mozilla/5.0"}, []string{"-user_agent", "Mozilla/5.0"}},
+	}
+	for _, tt := range tests {
+		DefaultUserAgent = tt.fallback
+		if got := argsFromHeaders(tt.headers); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBuildFfmpegArgs_Start(t *testing.T) {
+	args := buildFfmpegArgs(StreamOptions{
+		VideoURL: "http://video",
+		AudioURL: "http://audio",
+		VCodec:   "h264",
+		ACodec:   "aac",
+		Start:    12.5,
+	})
+
+	// Every input must be preceded by the same seek so the streams stay in sync
+	seeks := 0
+	for i, arg := range args {
+		if arg == "-i" {
+			if i < 2 || args[i-2] != "-ss" || args[i-1] != "12.5" {
+				t.Errorf("input %s not preceded by -ss 12.5", args[i+1])
+			}
+			seeks++
+		}
+	}
+	if seeks != 2 {
+		t.Errorf("expected 2 seeked inputs, got %d", seeks)
+	}
+
+	// No start means no seek at all
+	args = buildFfmpegArgs(StreamOptions{VideoURL: "http://video", VCodec: "h264"})
+	for _, arg := range args {
+		if arg == "-ss" {
+			t.Errorf("unexpected -ss without start offset")
+		}
+	}
+}
+
+func TestBuildFfmpegArgs_Threads(t *testing.T) {
+	defer func(old int) { FFmpegThreads = old }(FFmpegThreads)
+	FFmpegThreads = 3
+	for _, opts := range []StreamOptions{
+		{VideoURL: "http://video", VCodec: "vp9"},
+		{AudioOnly: true, AudioURL: "http://audio", ACodec: "opus"},
+	} {
+		args := buildFfmpegArgs(opts)
+		if got := argValue(args, "-threads"); got != "3" {
+			t.Errorf("got -threads %q, want 3: %v", got, args)
+		}
+	}
+}
+
+func TestBuildFfmpegArgs_Clip(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      StreamOptions
+		inputSeek string
+	}{
+		{"copy", StreamOptions{VideoURL: "http://video", AudioURL: "http://audio", VCodec: "h264", ACodec: "aac"}, "30"},
+		// The rest of the seek is done on the output side, see TestBuildFfmpegArgs_SeekPlacement
+		{"transcode", StreamOptions{VideoURL: "http://video", AudioURL: "http://audio", VCodec: "vp9", ACodec: "opus"}, "20"},
+		{"webm", StreamOptions{VideoURL: "http://video", AudioURL: "http://audio", VCodec: "vp9", ACodec: "opus", Container: ContainerWebM}, "30"},
+		{"audio", StreamOptions{AudioURL: "http://audio", ACodec: "opus", AudioOnly: true}, "30"},
+		{"mp3", StreamOptions{AudioURL: "http://audio", ACodec: "opus", AudioOnly: true, Container: ContainerMP3}, "30"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			opts.Start = 30
+			opts.Duration = 60
+			args := buildFfmpegArgs(opts)
+
+			// The seek is on every input, the limit once on the output after all inputs
+			lastInput := slices.IndexFunc(args, func(a string) bool { return a == "http://audio" })
+			ss := slices.Index(args, "-ss")
+			if ss < 0 || ss > lastInput || args[ss+1] != tt.inputSeek {
+				t.Errorf("expected input-side -ss %s, got %v", tt.inputSeek, args)
+			}
+			limit := slices.Index(args, "-t")
+			if limit < lastInput || args[limit+1] != "60" {
+				t.Errorf("expected output-side -t 60, got %v", args)
+			}
+			if limit > len(args)-3 || args[len(args)-1] != "pipe:1" {
+				t.Errorf("-t must come before the output format, got %v", args)
+			}
+		})
+	}
+
+	args := buildFfmpegArgs(StreamOptions{VideoURL: "http://video", VCodec: "h264", Start: 30})
+	if slices.Contains(args, "-t") || slices.Contains(args, "-to") {
+		t.Errorf("unexpected clip limit without duration: %v", args)
+	}
+	if (StreamOptions{VideoURL: "http://video", VCodec: "h264", Duration: 10}).CanProxy() {
+		t.Errorf("clips must not be proxied")
+	}
+}
+
+func TestBuildFfmpegArgs_AudioOnly(t *testing.T) {
+	tests := []struct {
+		name       string
+		aCodec     string
+		container  string
+		wantCodec  string
+		wantFormat string
+	}{
+		{
+			name:       "AAC copied into MP4",
+			aCodec:     "mp4a.40.2",
+			wantCodec:  "copy",
+			wantFormat: "mp4",
+		},
+		{
+			name:       "Opus transcoded to AAC",
+			aCodec:     "opus",
+			wantCodec:  "aac",
+			wantFormat: "mp4",
+		},
+		{
+			name:       "AAC transcoded to MP3",
+			aCodec:     "mp4a.40.2",
+			container:  ContainerMP3,
+			wantCodec:  "libmp3lame",
+			wantFormat: "mp3",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := StreamOptions{
+				AudioURL:  "http://audio",
+				ACodec:    tt.aCodec,
+				AudioOnly: true,
+				Container: tt.container,
+			}
+			args := buildFfmpegArgs(opts)
+
+			foundVN := false
+			inputs := 0
+			for i, arg := range args {
+				switch arg {
+				case "-vn":
+					foundVN = true
+				case "-i":
+					inputs++
+					if args[i+1] != "http://audio" {
+						t.Errorf("got input %s, want http://audio", args[i+1])
+					}
+				case "-c:a":
+					if args[i+1] != tt.wantCodec {
+						t.Errorf("got audio codec %s, want %s", args[i+1], tt.wantCodec)
+					}
+				case "-f":
+					if args[i+1] != tt.wantFormat {
+						t.Errorf("got format %s, want %s", args[i+1], tt.wantFormat)
+					}
+				case "-c:v":
+					t.Errorf("unexpected video codec option in audio-only mode")
+				}
+			}
+			if !foundVN {
+				t.Errorf("-vn not found")
+			}
+			if inputs != 1 {
+				t.Errorf("expected 1 input, got %d", inputs)
+			}
+		})
+	}
+}
+
+func TestStreamVideo_FfmpegNotFound(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+
+	err := StreamVideo(context.Background(), StreamOptions{VideoURL: "http://video", VCodec: "h264"}, io.Discard)
+	if err == nil {
+		t.Fatal("expected error with ffmpeg missing from PATH")
+	}
+	if !errors.Is(err, exec.ErrNotFound) {
+		t.Errorf("expected exec.ErrNotFound in chain, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "ffmpeg binary not found") {
+		t.Errorf("expected descriptive error, got %q", err)
+	}
+}
+
+func TestSanitizeArgs(t *testing.T) {
+	args := buildFfmpegArgs(StreamOptions{
+		VideoURL:     "https://rr1.googlevideo.com/videoplayback?sig=SECRET",
+		VideoHeaders: map[string]string{"Cookie": "SID=SECRET"},
+		AudioURL:     "https://rr2.googlevideo.com/videoplayback?sig=SECRET",
+		VCodec:       "h264",
+		ACodec:       "aac",
+	})
+
+	sanitized := sanitizeArgs(args)
+	joined := strings.Join(sanitized, " ")
+	if strings.Contains(joined, "SECRET") {
+		t.Errorf("sanitized args leaked secrets: %v", sanitized)
+	}
+	// Hosts remain for debugging
+	if !strings.Contains(joined, "https://rr1.googlevideo.com") || !strings.Contains(joined, "https://rr2.googlevideo.com") {
+		t.Errorf("sanitized args lost the input hosts: %v", sanitized)
+	}
+	// The original slice is untouched
+	if !strings.Contains(strings.Join(args, " "), "sig=SECRET") {
+		t.Errorf("sanitizeArgs modified its input")
+	}
+}
+
+func TestBuildFfmpegArgs_WebM(t *testing.T) {
+	args := buildFfmpegArgs(StreamOptions{
+		VideoURL:  "http://video",
+		AudioURL:  "http://audio",
+		VCodec:    "vp09.00.40.08",
+		ACodec:    "opus",
+		Container: ContainerWebM,
+	})
+
+	want := []string{"-c:v", "copy", "-c:a", "copy", "-f", "webm", "pipe:1"}
+	if got := args[len(args)-len(want):]; !slices.Equal(got, want) {
+		t.Errorf("got output args %v, want %v", got, want)
+	}
+	if slices.Contains(args, "libx264") || slices.Contains(args, "-movflags") {
+		t.Errorf("unexpected MP4/transcode args in webm output: %v", args)
+	}
+}
+
+func TestBuildFfmpegArgs_SeekPlacement(t *testing.T) {
+	// Returns the -ss values before the first -i and after the last one
+	seeks := func(args []string) (input, output string) {
+		firstInput, lastInput := slices.Index(args, "-i"), 0
+		for i, a := range args {
+			if a == "-i" {
+				lastInput = i
+			}
+		}
+		for i, a := range args[:len(args)-1] {
+			if a != "-ss" {
+				continue
+			}
+			switch {
+			case i < firstInput:
+				input = args[i+1]
+			case i > lastInput:
+				output = args[i+1]
+			}
+		}
+		return input, output
+	}
+
+	tests := []struct {
+		name   string
+		opts   StreamOptions
+		input  string
+		output string
+	}{
+		// Copies start at the keyframe the input seek lands on
+		{"copy", StreamOptions{VideoURL: "http://video", VCodec: "h264", Start: 30}, "30", ""},
+		{"copied video, transcoded audio", StreamOptions{VideoURL: "http://video", VCodec: "h264", ACodec: "opus", Start: 30}, "30", ""},
+		{"audio only", StreamOptions{AudioURL: "http://audio", ACodec: "opus", AudioOnly: true, Start: 30}, "30", ""},
+		// Transcodes seek the input close to the start, then drop frames up to it
+		{"transcode", StreamOptions{VideoURL: "http://video", VCodec: "vp9", Start: 30}, "20", "10"},
+		{"transcode near the beginning", StreamOptions{VideoURL: "http://video", VCodec: "vp9", Start: 4.5}, "", "4.5"},
+		{"forced transcode", StreamOptions{VideoURL: "http://video", VCodec: "h264", Start: 30, forceTranscode: true}, "20", "10"},
+		{"live transcode", StreamOptions{VideoURL: "http://video", VCodec: "vp9", Start: 30, Live: true}, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := buildFfmpegArgs(tt.opts)
+			input, output := seeks(args)
+			if input != tt.input || output != tt.output {
+				t.Errorf("got input seek %q and output seek %q, want %q and %q: %v", input, output, tt.input, tt.output, args)
+			}
+		})
+	}
+}
+
+func TestBuildFfmpegArgs_SoftSubtitles(t *testing.T) {
+	args := buildFfmpegArgs(StreamOptions{
+		VideoURL:    "http://video",
+		AudioURL:    "http://audio",
+		VCodec:      "h264",
+		ACodec:      "aac",
+		SubtitleURL: "http://subs/en.vtt",
+		Start:       5,
+	})
+
+	// Subtitles are the third input, seeked like the others
+	i := slices.Index(args, "http://subs/en.vtt")
+	if i < 3 || args[i-1] != "-i" || args[i-3] != "-ss" {
+		t.Fatalf("subtitle input missing or not seeked: %v", args)
+	}
+	if !slices.Contains(args, "2:s:0") {
+		t.Errorf("expected subtitle stream mapping, got %v", args)
+	}
+	if got := argValue(args, "-c:s"); got != "mov_text" {
+		t.Errorf("expected mov_text subtitles, got %q", got)
+	}
+	// The video itself is still copied
+	if got := argValue(args, "-c:v"); got != "copy" {
+		t.Errorf("expected video copy, got %q", got)
+	}
+}
+
+func TestBuildFfmpegArgs_BurnSubtitles(t *testing.T) {
+	opts := StreamOptions{
+		VideoURL:      "http://video",
+		VCodec:        "h264",
+		SubtitleURL:   "http://subs/it's.vtt",
+		BurnSubtitles: true,
+	}
+	args := buildFfmpegArgs(opts)
+
+	// Burning in forces a transcode even for H264 sources
+	if got := argValue(args, "-c:v"); got != "libx264" {
+		t.Errorf("expected libx264, got %q", got)
+	}
+	want := `subtitles='http\://subs/it'\''s.vtt'`
+	if got := argValue(args, "-vf"); got != want {
+		t.Errorf("got filter %q, want %q", got, want)
+	}
+	if slices.Contains(args, "-c:s") || slices.Index(args, opts.SubtitleURL) != -1 {
+		t.Errorf("unexpected subtitle input/stream when burning: %v", args)
+	}
+	if opts.CanProxy() {
+		t.Errorf("subtitled streams must not be proxied")
+	}
+
+	// An input seek shifts the timestamps so cues line up, the output seek
+	// comes after the filters
+	opts.Start = 30
+	if got := argValue(buildFfmpegArgs(opts), "-vf"); !strings.HasPrefix(got, "setpts=PTS+20/TB,subtitles=") {
+		t.Errorf("expected timestamp shift in filter, got %q", got)
+	}
+}
+
+func TestBuildFfmpegArgs_MaxBitrate(t *testing.T) {
+	opts := StreamOptions{VideoURL: "http://video", VCodec: "vp9", MaxBitrate: 1500}
+	args := buildFfmpegArgs(opts)
+	for flag, want := range map[string]string{"-b:v": "1500k", "-maxrate": "1500k", "-bufsize": "3000k"} {
+		if got := argValue(args, flag); got != want {
+			t.Errorf("transcode: got %s %q, want %q", flag, got, want)
+		}
+	}
+
+	// A copied stream can't be capped
+	opts.VCodec = "avc1.640028"
+	args = buildFfmpegArgs(opts)
+	for _, flag := range []string{"-b:v", "-maxrate", "-bufsize"} {
+		if slices.Contains(args, flag) {
+			t.Errorf("copy: unexpected %s in %v", flag, args)
+		}
+	}
+}
+
+func TestBuildFfmpegArgs_LogLevel(t *testing.T) {
+	defer func(old string) { FFmpegLogLevel = old }(FFmpegLogLevel)
+
+	opts := StreamOptions{VideoURL: "http://video", VCodec: "h264"}
+	if got := argValue(buildFfmpegArgs(opts), "-loglevel"); got != "warning" {
+		t.Errorf("default: got -loglevel %q, want warning", got)
+	}
+
+	FFmpegLogLevel = "error"
+	args := buildFfmpegArgs(opts)
+	if got := argValue(args, "-loglevel"); got != "error" {
+		t.Errorf("got -loglevel %q, want error", got)
+	}
+	// Progress parsing relies on stats being printed below info level
+	if !slices.Contains(args, "-stats") {
+		t.Errorf("expected -stats in %v", args)
+	}
+}
+
+func TestBuildFfmpegArgs_Live(t *testing.T) {
+	opts := StreamOptions{
+		VideoURL: "http://live/video.m3u8",
+		AudioURL: "http://live/audio.m3u8",
+		VCodec:   "avc1.4d401f",
+		ACodec:   "mp4a.40.2",
+		Live:     true,
+		Start:    30, // Ignored for live sources
+	}
+	args := buildFfmpegArgs(opts)
+
+	// Both inputs regenerate timestamps instead of seeking
+	genpts := 0
+	for i, arg := range args {
+		if arg == "-i" && args[i-2] == "-fflags" && args[i-1] == "+genpts" {
+			genpts++
+		}
+	}
+	if genpts != 2 {
+		t.Errorf("expected +genpts on both inputs, got %v", args)
+	}
+	if slices.Contains(args, "-ss") {
+		t.Errorf("unexpected seek for a live source: %v", args)
+	}
+	if got := argValue(args, "-c:v"); got != "copy" {
+		t.Errorf("expected live H264 to be copied, got %q", got)
+	}
+	if opts.CanProxy() {
+		t.Errorf("live streams must not be proxied")
+	}
+}
+
+func TestBuildFfmpegArgs_ManifestInputs(t *testing.T) {
+	args := buildFfmpegArgs(StreamOptions{
+		VideoURL:      "http://cdn/video.m3u8",
+		VideoHeaders:  map[string]string{"User-Agent": "UA", "Cookie": "a=b"},
+		VideoProtocol: "m3u8_native",
+		AudioURL:      "http://cdn/audio",
+		AudioProtocol: "https",
+		VCodec:        "h264",
+		ACodec:        "aac",
+	})
+
+	// The HLS input gets the whitelist and headers, all before its -i
+	videoInput := slices.Index(args, "http://cdn/video.m3u8")
+	i := slices.Index(args, "-protocol_whitelist")
+	if i == -1 || i > videoInput || args[i+1] != "file,http,https,tcp,tls,crypto,hls" {
+		t.Errorf("expected protocol whitelist before the HLS input, got %v", args)
+	}
+	if got := argValue(args, "-allowed_extensions"); got != "ALL" {
+		t.Errorf("got -allowed_extensions %q, want ALL", got)
+	}
+	if ua := slices.Index(args, "-user_agent"); ua == -1 || ua > videoInput {
+		t.Errorf("expected -user_agent before the HLS input, got %v", args)
+	}
+
+	// The plain HTTPS input gets neither
+	if n := strings.Count(strings.Join(args, " "), "-protocol_whitelist"); n != 1 {
+		t.Errorf("expected one protocol whitelist, got %d in %v", n, args)
+	}
+
+	direct := buildFfmpegArgs(StreamOptions{VideoURL: "http://video", AudioURL: "http://audio", VCodec: "h264", ACodec: "aac", VideoProtocol: ProtocolDirect, AudioProtocol: ProtocolDirect})
+	if n := strings.Count(strings.Join(direct, " "), "-protocol_whitelist "+directProtocols); n != 2 {
+		t.Errorf("expected both direct inputs limited to network protocols, got %v", direct)
+	}
+
+	dash := manifestInputArgs("http_dash_segments")
+	if !slices.Contains(dash, "-protocol_whitelist") || slices.Contains(dash, "-allowed_extensions") {
+		t.Errorf("unexpected DASH input args %v", dash)
+	}
+}
+
+func TestBuildFfmpegArgs_AudioBitrate(t *testing.T) {
+	opts := StreamOptions{VideoURL: "http://video", AudioURL: "http://audio", VCodec: "h264", ACodec: "opus"}
+	if got := argValue(buildFfmpegArgs(opts), "-b:a"); got != "128k" {
+		t.Errorf("transcode: got -b:a %q, want 128k", got)
+	}
+
+	opts.AudioBitrate = "96k"
+	if got := argValue(buildFfmpegArgs(opts), "-b:a"); got != "96k" {
+		t.Errorf("override: got -b:a %q, want 96k", got)
+	}
+
+	// Copied audio keeps its bitrate
+	opts.ACodec = "mp4a.40.2"
+	if args := buildFfmpegArgs(opts); slices.Contains(args, "-b:a") {
+		t.Errorf("copy: unexpected -b:a in %v", args)
+	}
+	audioOnly := StreamOptions{AudioOnly: true, AudioURL: "http://audio", ACodec: "mp4a.40.2"}
+	if args := buildFfmpegArgs(audioOnly); slices.Contains(args, "-b:a") {
+		t.Errorf("audio-only copy: unexpected -b:a in %v", args)
+	}
+	audioOnly.ACodec = "opus"
+	if got := argValue(buildFfmpegArgs(audioOnly), "-b:a"); got != "128k" {
+		t.Errorf("audio-only transcode: got -b:a %q, want 128k", got)
+	}
+}
+
+func TestBuildFfmpegArgs_Loudnorm(t *testing.T) {
+	const filter = "loudnorm=I=-16:TP=-1.5:LRA=11"
+	tests := []struct {
+		name string
+		opts StreamOptions
+		want bool
+	}{
+		{"transcode", StreamOptions{VideoURL: "http://video", AudioURL: "http://audio", VCodec: "h264", ACodec: "opus", Loudnorm: true}, true},
+		{"forces transcode", StreamOptions{VideoURL: "http://video", AudioURL: "http://audio", VCodec: "h264", ACodec: "mp4a.40.2", Loudnorm: true}, true},
+		{"audio only", StreamOptions{AudioOnly: true, AudioURL: "http://audio", ACodec: "mp4a.40.2", Loudnorm: true}, true},
+		{"mp3", StreamOptions{AudioOnly: true, AudioURL: "http://audio", ACodec: "mp3", Container: ContainerMP3, Loudnorm: true}, true},
+		{"not requested", StreamOptions{VideoURL: "http://video", AudioURL: "http://audio", VCodec: "h264", ACodec: "opus"}, false},
+		{"no audio", StreamOptions{VideoURL: "http://video", VCodec: "h264", NoAudio: true, Loudnorm: true}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := buildFfmpegArgs(tt.opts)
+			if got := argValue(args, "-af") == filter; got != tt.want {
+				t.Errorf("got loudnorm filter %v, want %v: %v", got, tt.want, args)
+			}
+			if tt.want && argValue(args, "-c:a") == "copy" {
+				t.Errorf("normalized audio can't be copied: %v", args)
+			}
+		})
+	}
+
+	defer func(old float64) { LoudnormTarget = old }(LoudnormTarget)
+	LoudnormTarget = -23
+	opts := StreamOptions{AudioOnly: true, AudioURL: "http://audio", ACodec: "opus", Loudnorm: true}
+	if got := argValue(buildFfmpegArgs(opts), "-af"); got != "loudnorm=I=-23:TP=-1.5:LRA=11" {
+		t.Errorf("got -af %q with a -23 LUFS target", got)
+	}
+	if (StreamOptions{VideoURL: "http://video", VCodec: "h264", Loudnorm: true}).CanProxy() {
+		t.Errorf("normalized streams must not be proxied")
+	}
+}
+
+func TestBuildFfmpegArgs_CopyCodecs(t *testing.T) {
+	// A single pre-merged URL with unknown codecs is one input, copied as is
+	opts := StreamOptions{VideoURL: "http://merged", AudioURL: "http://merged", CopyCodecs: true}
+	args := buildFfmpegArgs(opts)
+	if n := strings.Count(strings.Join(args, " "), "-i "); n != 1 {
+		t.Errorf("got %d inputs, want 1: %v", n, args)
+	}
+	if argValue(args, "-c:v") != "copy" || argValue(args, "-c:a") != "copy" {
+		t.Errorf("expected both streams copied: %v", args)
+	}
+	if !strings.Contains(strings.Join(args, " "), "-map 0:a:0?") {
+		t.Errorf("expected the audio mapped from the only input: %v", args)
+	}
+
+	opts.Loudnorm = true
+	if args := buildFfmpegArgs(opts); argValue(args, "-c:a") == "copy" {
+		t.Errorf("normalized audio can't be copied: %v", args)
+	}
+}
+
+func TestBuildFfmpegArgs_SelectionFlags(t *testing.T) {
+	// The selection's verdict is followed even where the codecs alone say copy
+	opts := StreamOptions{VideoURL: "http://video", AudioURL: "http://audio", VCodec: "h264", ACodec: "mp4a.40.2"}
+	if args := buildFfmpegArgs(opts); argValue(args, "-c:v") != "copy" || argValue(args, "-c:a") != "copy" {
+		t.Fatalf("expected both streams copied without flags: %v", args)
+	}
+
+	video := opts
+	video.TranscodeVideo = true
+	if args := buildFfmpegArgs(video); argValue(args, "-c:v") == "copy" || argValue(args, "-c:a") != "copy" {
+		t.Errorf("expected only the video transcoded: %v", args)
+	}
+
+	audio := opts
+	audio.TranscodeAudio = true
+	if args := buildFfmpegArgs(audio); argValue(args, "-c:v") != "copy" || argValue(args, "-c:a") != "aac" {
+		t.Errorf("expected only the audio transcoded: %v", args)
+	}
+}
+
+func TestBuildFfmpegArgs_ExtraArgs(t *testing.T) {
+	defer func(args []string) { ExtraArgs = args }(ExtraArgs)
+	ExtraArgs = []string{"-profile:v", "baseline"}
+
+	tests := []struct {
+		name   string
+		opts   StreamOptions
+		after  string
+		format string
+	}{
+		{"mp4", StreamOptions{VideoURL: "http://video", AudioURL: "http://audio", VCodec: "vp9", ACodec: "opus"}, "-c:a", "mp4"},
+		{"webm", StreamOptions{VideoURL: "http://video", AudioURL: "http://audio", VCodec: "vp9", ACodec: "opus", Container: ContainerWebM}, "-c:a", "webm"},
+		{"audio only", StreamOptions{AudioOnly: true, AudioURL: "http://audio", ACodec: "opus"}, "-c:a", "mp4"},
+		{"mp3", StreamOptions{AudioOnly: true, AudioURL: "http://audio", ACodec: "opus", Container: ContainerMP3}, "-c:a", "mp3"},
+		{"clip", StreamOptions{VideoURL: "http://video", VCodec: "h264", Duration: 10}, "-t", "mp4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := buildFfmpegArgs(tt.opts)
+			i := slices.Index(args, "-profile:v")
+			if i < 0 || i+3 >= len(args) {
+				t.Fatalf("extra args missing: %v", args)
+			}
+			// Right before the output format, after every option of ours
+			if args[i+2] != "-f" || args[i+3] != tt.format {
+				t.Errorf("extra args not followed by -f %s: %v", tt.format, args)
+			}
+			if j := slices.Index(args, tt.after); j < 0 || j > i {
+				t.Errorf("extra args come before %s: %v", tt.after, args)
+			}
+		})
+	}
+}
+
+func TestBuildFfmpegArgs_InsecureTLS(t *testing.T) {
+	defer func(old bool) { InsecureTLS = old }(InsecureTLS)
+	opts := StreamOptions{VideoURL: "https://video", AudioURL: "https://audio", VCodec: "h264", ACodec: "aac", SubtitleURL: "https://subs"}
+	audioOnly := StreamOptions{AudioOnly: true, AudioURL: "https://audio", ACodec: "aac"}
+
+	for _, insecure := range []bool{false, true} {
+		InsecureTLS = insecure
+		for _, args := range [][]string{buildFfmpegArgs(opts), buildFfmpegArgs(audioOnly)} {
+			inputs := strings.Count(strings.Join(args, " "), " -i ")
+			want := 0
+			if insecure {
+				// Every input gets its own, the option only applies to the next one
+				want = inputs
+			}
+			if got := strings.Count(strings.Join(args, " "), "-tls_verify 0"); got != want {
+				t.Errorf("InsecureTLS %v: got %d of %d inputs unverified: %v", insecure, got, inputs, args)
+			}
+		}
+	}
+}
+
+func TestBuildFfmpegArgs_AudioOffset(t *testing.T) {
+	opts := StreamOptions{VideoURL: "http://video", AudioURL: "http://audio", VCodec: "h264", ACodec: "aac", AudioOffset: 0.25}
+	args := buildFfmpegArgs(opts)
+	offset := slices.Index(args, "-itsoffset")
+	audioInput := slices.Index(args, "http://audio")
+	if offset < 0 || args[offset+1] != "0.25" {
+		t.Fatalf("expected -itsoffset 0.25: %v", args)
+	}
+	// Input options only apply to the next -i, which must be the audio
+	if offset < slices.Index(args, "http://video") || slices.Index(args[offset:], "-i") != audioInput-1-offset {
+		t.Errorf("expected -itsoffset right before the audio input: %v", args)
+	}
+	if strings.Count(strings.Join(args, " "), "-itsoffset") != 1 {
+		t.Errorf("expected only the audio to be shifted: %v", args)
+	}
+
+	opts.AudioOffset = 0
+	if args := buildFfmpegArgs(opts); slices.Contains(args, "-itsoffset") {
+		t.Errorf("expected no offset by default: %v", args)
+	}
+}
+
+func TestBuildFfmpegArgs_AudioSync(t *testing.T) {
+	copied := StreamOptions{VideoURL: "http://video", AudioURL: "http://audio", VCodec: "h264", ACodec: "mp4a.40.2", AudioSync: true}
+	args := buildFfmpegArgs(copied)
+	if argValue(args, "-async") != "1" || argValue(args, "-c:a") != "aac" {
+		t.Errorf("expected the audio to be transcoded and resynced: %v", args)
+	}
+	if slices.Contains(args, "-fps_mode") {
+		t.Errorf("copied video can't have frames duplicated or dropped: %v", args)
+	}
+
+	transcoded := copied
+	transcoded.VCodec = "vp9"
+	if args := buildFfmpegArgs(transcoded); argValue(args, "-fps_mode") != "cfr" {
+		t.Errorf("expected -fps_mode cfr on a transcode: %v", args)
+	}
+	if (StreamOptions{VideoURL: "http://video", VCodec: "h264", AudioSync: true}).CanProxy() {
+		t.Errorf("resynced streams must not be proxied")
+	}
+}
+
+func TestStreamVideo_RequestID(t *testing.T) {
+	writeFfmpegStub(t, `printf 'frame=   30 fps=30 q=28.0 size=  256kB time=00:00:01.00 bitrate=N/A speed=1.5x\r' >&2
+printf 'data'`)
+
+	var logs bytes.Buffer
+	old := slog.Default()
+	slog.SetDefault(slog.New(requestid.NewHandler(slog.NewTextHandler(&logs, nil))))
+	t.Cleanup(func() { slog.SetDefault(old) })
+
+	ctx := requestid.NewContext(context.Background(), "abc123")
+	if err := StreamVideo(ctx, StreamOptions{VideoURL: "http://video", VCodec: "h264"}, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every line, from ffmpeg's start to its progress, carries the id
+	for _, msg := range []string{"Starting ffmpeg", "FFMPEG PROGRESS", "First byte sent"} {
+		found := false
+		for _, line := range strings.Split(logs.String(), "\n") {
+			if strings.Contains(line, msg) {
+				found = true
+				if !strings.Contains(line, "request_id=abc123") {
+					t.Errorf("missing request id: %q", line)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("no %q line in logs:\n%s", msg, logs.String())
+		}
+	}
+}
+
+func TestParseFFmpegVersion(t *testing.T) {
+	tests := map[string]string{
+		"ffmpeg version 6.1.1 Copyright (c) 2000-2023 the FFmpeg developers\nbuilt with gcc 13.2.1": "6.1.1",
+		"ffmpeg version n7.0-15-gabc Copyright (c) 2000-2024":                                       "n7.0-15-gabc",
+		"something unexpected": "something unexpected",
+	}
+	for in, want := range tests {
+		if got := parseFFmpegVersion(in); got != want {
+			t.Errorf("parseFFmpegVersion(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestBuildFfmpegArgs_NoAudio(t *testing.T) {
+	opts := StreamOptions{
+		VideoURL: "http://cdn/video",
+		VCodec:   "vp9",
+		NoAudio:  true,
+	}
+	args := buildFfmpegArgs(opts)
+
+	if got := strings.Join(args, " "); strings.Contains(got, ":a:") || strings.Contains(got, "-c:a") {
+		t.Errorf("expected no audio mapping or codec, got %v", args)
+	}
+	if !slices.Contains(args, "-an") {
+		t.Errorf("expected -an, got %v", args)
+	}
+
+	opts.VCodec = "vp09.00.40.08"
+	opts.Container = ContainerWebM
+	args = buildFfmpegArgs(opts)
+	if slices.Contains(args, "-c:a") || !slices.Contains(args, "-an") {
+		t.Errorf("expected silent webm output, got %v", args)
+	}
+}
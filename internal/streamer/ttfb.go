@@ -0,0 +1,96 @@
+package streamer
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// FirstByteAction is what a stream does when ffmpeg has no output within TTFBTimeout
+type FirstByteAction string
+
+const (
+	// FirstByteHeaders sends the response headers ahead of the output, so
+	// clients see the response start, and keeps waiting for ffmpeg
+	FirstByteHeaders FirstByteAction = "headers"
+	// FirstByteFail stops ffmpeg and fails with ReasonFirstByteTimeout
+	FirstByteFail FirstByteAction = "fail"
+)
+
+// TTFBTimeout is how long ffmpeg may take to produce its first output, e.g.
+// a slow VP9 transcode, before TTFBAction is taken. Faststart outputs are
+// only sent once complete and never time out.
+var TTFBTimeout = 20 * time.Second
+
+// TTFBAction is taken once TTFBTimeout passes without output
+var TTFBAction = FirstByteHeaders
+
+// ErrFirstByteTimeout is the cause of a stream stopped by FirstByteFail
+var ErrFirstByteTimeout = errors.New("no output before the first byte timeout")
+
+// ParseFirstByteAction validates a first byte timeout action name
+func ParseFirstByteAction(s string) (FirstByteAction, error) {
+	switch FirstByteAction(s) {
+	case "":
+		return FirstByteHeaders, nil
+	case FirstByteHeaders, FirstByteFail:
+		return FirstByteAction(s), nil
+	}
+	return "", fmt.Errorf("unknown first byte timeout action %q", s)
+}
+
+// watchFirstByte takes action once nothing has been written for timeout
+// from the start, unless done is closed first. expired stops the stream.
+func (mw *monitoringWriter) watchFirstByte(timeout time.Duration, action FirstByteAction, expired func(), done <-chan struct{}) {
+	if timeout <= 0 {
+		return
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return
+	case <-timer.C:
+	}
+
+	if action == FirstByteHeaders {
+		if mw.sendHeaders() {
+			slog.WarnContext(mw.ctx, "No output yet, sending the response headers ahead of it", "after", timeout)
+		}
+		return
+	}
+	if !mw.responded() {
+		slog.WarnContext(mw.ctx, "No output in time, stopping ffmpeg", "after", timeout)
+		expired()
+	}
+}
+
+// sendHeaders commits the response headers of an http.ResponseWriter before
+// any output, reporting whether it did. Failures can't be answered with an
+// error status anymore afterwards.
+func (mw *monitoringWriter) sendHeaders() bool {
+	rw, ok := mw.w.(http.ResponseWriter)
+	if !ok {
+		return false
+	}
+	// Held while flushing so the first write waits for it
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	if mw.started {
+		return false
+	}
+	if err := http.NewResponseController(rw).Flush(); err != nil {
+		return false
+	}
+	mw.started = true
+	return true
+}
+
+// responded reports whether anything, output or headers, has reached the client
+func (mw *monitoringWriter) responded() bool {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	return mw.started
+}
@@ -0,0 +1,112 @@
+package ytdlp
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// CacheMaxEntries bounds the number of cached infos.
+// Storing past the cap evicts the least recently used entry.
+var CacheMaxEntries = 1000
+
+type cachedInfo struct {
+	info      *Info
+	timestamp time.Time
+	// err marks a negative entry for a video that can't be fetched, info is then nil
+	err error
+}
+
+// expired reports whether the entry is older than its TTL,
+// negative entries use the shorter negativeTTL
+func (c cachedInfo) expired(ttl, negativeTTL time.Duration) bool {
+	if c.err != nil {
+		ttl = negativeTTL
+	}
+	return time.Since(c.timestamp) >= ttl
+}
+
+type lruEntry struct {
+	key   string
+	value cachedInfo
+}
+
+// infoLRU is a size-bounded, concurrency-safe LRU cache of video infos.
+// Entries additionally expire after CacheTTL, see sweepCache.
+type infoLRU struct {
+	mu    sync.Mutex
+	ll    *list.List // front is most recently used
+	items map[string]*list.Element
+}
+
+func newInfoLRU() *infoLRU {
+	return &infoLRU{
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// Load returns the entry for key and marks it as recently used
+func (c *infoLRU) Load(key string) (cachedInfo, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return cachedInfo{}, false
+	}
+	c.ll.MoveToFront(el)
+	return el.Value.(*lruEntry).value, true
+}
+
+// Store inserts or replaces the entry for key, evicting old entries past the cap
+func (c *infoLRU) Store(key string, value cachedInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		el.Value.(*lruEntry).value = value
+		c.ll.MoveToFront(el)
+	} else {
+		c.items[key] = c.ll.PushFront(&lruEntry{key: key, value: value})
+	}
+	for CacheMaxEntries > 0 && c.ll.Len() > CacheMaxEntries {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+func (c *infoLRU) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+}
+
+// CacheLen returns the number of video info entries cached, including failures
+func CacheLen() int {
+	return infoCache.Len()
+}
+
+// Len returns the number of cached entries
+func (c *infoLRU) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+// removeExpired drops all entries older than their TTL
+func (c *infoLRU) removeExpired(ttl, negativeTTL time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for el := c.ll.Back(); el != nil; {
+		prev := el.Prev()
+		if el.Value.(*lruEntry).value.expired(ttl, negativeTTL) {
+			c.removeElement(el)
+		}
+		el = prev
+	}
+}
+
+func (c *infoLRU) removeElement(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.items, el.Value.(*lruEntry).key)
+}
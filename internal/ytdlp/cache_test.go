@@ -0,0 +1,53 @@
+package ytdlp
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestInfoLRU_EvictsLeastRecentlyUsed(t *testing.T) {
+	oldMax := CacheMaxEntries
+	CacheMaxEntries = 3
+	defer func() { CacheMaxEntries = oldMax }()
+
+	c := newInfoLRU()
+	for i := 0; i <= CacheMaxEntries; i++ {
+		c.Store(fmt.Sprintf("url-%d", i), cachedInfo{info: &Info{}, timestamp: time.Now()})
+	}
+
+	if c.Len() != CacheMaxEntries {
+		t.Errorf("Expected %d entries, got %d", CacheMaxEntries, c.Len())
+	}
+	if _, ok := c.Load("url-0"); ok {
+		t.Error("Expected oldest entry to be evicted")
+	}
+	if _, ok := c.Load(fmt.Sprintf("url-%d", CacheMaxEntries)); !ok {
+		t.Error("Expected newest entry to survive")
+	}
+
+	// Touching an entry protects it from the next eviction
+	c.Load("url-1")
+	c.Store("url-new", cachedInfo{info: &Info{}, timestamp: time.Now()})
+	if _, ok := c.Load("url-1"); !ok {
+		t.Error("Expected recently used entry to survive")
+	}
+	if _, ok := c.Load("url-2"); ok {
+		t.Error("Expected least recently used entry to be evicted")
+	}
+}
+
+func TestInfoLRU_RemoveExpired(t *testing.T) {
+	c := newInfoLRU()
+	c.Store("old", cachedInfo{info: &Info{}, timestamp: time.Now().Add(-time.Hour)})
+	c.Store("new", cachedInfo{info: &Info{}, timestamp: time.Now()})
+
+	c.removeExpired(time.Minute, time.Minute)
+
+	if _, ok := c.Load("old"); ok {
+		t.Error("Expected expired entry to be removed")
+	}
+	if _, ok := c.Load("new"); !ok {
+		t.Error("Expected fresh entry to remain")
+	}
+}
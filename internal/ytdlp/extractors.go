@@ -0,0 +1,90 @@
+package ytdlp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// brokenSuffix marks extractors yt-dlp knows don't work at the moment
+const brokenSuffix = "(CURRENTLY BROKEN)"
+
+// extractors caches the list, it only changes with the yt-dlp version.
+// A failure is remembered for NegativeTTL, so a broken yt-dlp isn't run on every call.
+var extractors struct {
+	mu       sync.Mutex
+	list     []string
+	err      error
+	failedAt time.Time
+}
+
+var extractorsFlight singleflight.Group
+
+// Extractors returns the names of the working yt-dlp extractors, e.g.
+// "youtube" or "vimeo:album". The list is fetched once, a failure is
+// retried after NegativeTTL.
+func Extractors(ctx context.Context) ([]string, error) {
+	extractors.mu.Lock()
+	list, err, failedAt := extractors.list, extractors.err, extractors.failedAt
+	extractors.mu.Unlock()
+	if list != nil {
+		return list, nil
+	}
+	if err != nil && time.Since(failedAt) < NegativeTTL {
+		return nil, err
+	}
+
+	// Concurrent callers share one yt-dlp run. It isn't tied to any single
+	// caller's context, MetadataTimeout still bounds it.
+	ch := extractorsFlight.DoChan("extractors", func() (any, error) {
+		return fetchExtractors(context.WithoutCancel(ctx))
+	})
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.([]string), nil
+	}
+}
+
+// fetchExtractors runs yt-dlp and caches the list, or the failure
+func fetchExtractors(ctx context.Context) ([]string, error) {
+	runCtx, cancel := context.WithTimeout(ctx, MetadataTimeout)
+	defer cancel()
+	out, _, err := runCommand(runCtx, BinaryPath, "--list-extractors")
+
+	extractors.mu.Lock()
+	defer extractors.mu.Unlock()
+	if err != nil {
+		extractors.err = fmt.Errorf("failed to run yt-dlp --list-extractors: %w", err)
+		extractors.failedAt = time.Now()
+		return nil, extractors.err
+	}
+	extractors.list = parseExtractors(out)
+	extractors.err = nil
+	return extractors.list, nil
+}
+
+// parseExtractors reads the one name per line printed by --list-extractors,
+// leaving out broken extractors
+func parseExtractors(out []byte) []string {
+	list := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		name := strings.TrimSpace(scanner.Text())
+		if name == "" || strings.HasSuffix(name, brokenSuffix) {
+			continue
+		}
+		list = append(list, name)
+	}
+	return list
+}
@@ -0,0 +1,98 @@
+package ytdlp
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func resetExtractors(t *testing.T) {
+	t.Cleanup(func() {
+		extractors.list, extractors.err = nil, nil
+	})
+}
+
+func TestExtractors(t *testing.T) {
+	resetExtractors(t)
+	defer func(old time.Duration) { NegativeTTL = old }(NegativeTTL)
+	NegativeTTL = time.Hour
+	calls := 0
+	var fail error = errors.New("exit status 2")
+	stubRunner(t, func(name string, args []string) ([]byte, []byte, error) {
+		calls++
+		if !slices.Equal(args, []string{"--list-extractors"}) {
+			t.Errorf("unexpected args %v", args)
+		}
+		if fail != nil {
+			return nil, nil, fail
+		}
+		return []byte("generic\nvimeo\nvimeo:album\nWeiboMobile (CURRENTLY BROKEN)\n\nyoutube\nyoutube:tab\n"), nil, nil
+	})
+
+	// The failure is remembered for NegativeTTL
+	for range 2 {
+		if _, err := Extractors(context.Background()); err == nil {
+			t.Fatal("expected an error from the failed run")
+		}
+	}
+	if calls != 1 {
+		t.Errorf("yt-dlp ran %d times for the failure, want 1", calls)
+	}
+
+	fail = nil
+	NegativeTTL = 0
+	for range 2 {
+		got, err := Extractors(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"generic", "vimeo", "vimeo:album", "youtube", "youtube:tab"}; !slices.Equal(got, want) {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+	// Retried once the failure expired, the success is kept
+	if calls != 2 {
+		t.Errorf("yt-dlp ran %d times, want 2", calls)
+	}
+}
+
+func TestExtractors_CallerGoesAway(t *testing.T) {
+	resetExtractors(t)
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	calls := 0
+	stubRunner(t, func(name string, args []string) ([]byte, []byte, error) {
+		calls++
+		started <- struct{}{}
+		<-release
+		return []byte("youtube\n"), nil, nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := Extractors(ctx)
+		first <- err
+	}()
+	<-started
+	second := make(chan []string, 1)
+	go func() {
+		list, _ := Extractors(context.Background())
+		second <- list
+	}()
+
+	// The first caller leaving doesn't stop the run the second one waits for
+	cancel()
+	if err := <-first; !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v for the cancelled caller, want context.Canceled", err)
+	}
+	close(release)
+	if got := <-second; !slices.Equal(got, []string{"youtube"}) {
+		t.Errorf("got %q, want the shared result", got)
+	}
+	if calls != 1 {
+		t.Errorf("yt-dlp ran %d times, want 1", calls)
+	}
+}
@@ -0,0 +1,136 @@
+package ytdlp
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SelectionTTL is the longest a format selection is reused. Selections end
+// earlier when their signed URLs expire, minus selectionExpiryMargin so a
+// stream doesn't start on a URL about to stop working.
+var SelectionTTL = 5 * time.Minute
+
+const selectionExpiryMargin = time.Minute
+
+// selectionKey identifies a selection request for a video
+type selectionKey struct {
+	url     string
+	quality Quality
+	opts    SelectOptions
+}
+
+type cachedSelection struct {
+	sel     Selection
+	expires time.Time
+}
+
+// selectionCache remembers format selections apart from the info cache,
+// which keeps serving the full format list
+type selectionCache struct {
+	mu    sync.Mutex
+	items map[selectionKey]cachedSelection
+}
+
+var selections = &selectionCache{items: make(map[selectionKey]cachedSelection)}
+
+// SelectCached is Select for the info of videoURL, reusing an earlier
+// selection for the same quality and options while its URLs stay valid,
+// even when info was fetched again since.
+func SelectCached(videoURL string, info *Info, quality Quality, opts SelectOptions) Selection {
+	key := selectionKey{url: videoURL, quality: quality, opts: opts}
+	if sel, ok := selections.load(key); ok {
+		return sel
+	}
+	sel := Select(info, quality, opts)
+	if sel.Video != nil {
+		selections.store(key, cachedSelection{sel: sel, expires: selectionExpiry(sel, time.Now())})
+	}
+	return sel
+}
+
+func (c *selectionCache) load(key selectionKey) (Selection, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.items[key]
+	if !ok {
+		return Selection{}, false
+	}
+	if !time.Now().Before(entry.expires) {
+		delete(c.items, key)
+		return Selection{}, false
+	}
+	return entry.sel, true
+}
+
+// store keeps entry until it expires. Past CacheMaxEntries only expired entries
+// make room, new selections are dropped rather than evicting live ones.
+func (c *selectionCache) store(key selectionKey, entry cachedSelection) {
+	now := time.Now()
+	if !now.Before(entry.expires) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if CacheMaxEntries > 0 && len(c.items) >= CacheMaxEntries {
+		c.removeExpiredLocked(now)
+		if len(c.items) >= CacheMaxEntries {
+			return
+		}
+	}
+	c.items[key] = entry
+}
+
+func (c *selectionCache) removeExpired() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeExpiredLocked(time.Now())
+}
+
+func (c *selectionCache) removeExpiredLocked(now time.Time) {
+	for key, entry := range c.items {
+		if !now.Before(entry.expires) {
+			delete(c.items, key)
+		}
+	}
+}
+
+// selectionExpiry returns when a selection made at now should stop being reused
+func selectionExpiry(sel Selection, now time.Time) time.Time {
+	expires := now.Add(SelectionTTL)
+	for _, f := range []*Format{sel.Video, sel.Audio} {
+		if f == nil {
+			continue
+		}
+		if t, ok := urlExpiry(f.URL); ok && t.Add(-selectionExpiryMargin).Before(expires) {
+			expires = t.Add(-selectionExpiryMargin)
+		}
+	}
+	return expires
+}
+
+// urlExpiry reads the expiry of a signed media URL, given as an "expire"
+// query parameter or, in manifest URLs, an "/expire/<unix>/" path segment
+func urlExpiry(raw string) (time.Time, bool) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return time.Time{}, false
+	}
+	v := u.Query().Get("expire")
+	if v == "" {
+		segments := strings.Split(u.Path, "/")
+		for i := 0; i+1 < len(segments); i++ {
+			if segments[i] == "expire" {
+				v = segments[i+1]
+				break
+			}
+		}
+	}
+	unix, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(unix, 0), true
+}
@@ -0,0 +1,87 @@
+package ytdlp
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSelectCached_ReusesSelection(t *testing.T) {
+	defer func(old *selectionCache) { selections = old }(selections)
+	selections = &selectionCache{items: make(map[selectionKey]cachedSelection)}
+
+	info := &Info{Formats: []Format{
+		{FormatID: "137", URL: "http://cdn/137", VCodec: "avc1.640028", ACodec: "none", Width: 1920, Height: 1080},
+		{FormatID: "140", URL: "http://cdn/140", VCodec: "none", ACodec: "mp4a.40.2"},
+	}}
+	first := SelectCached("http://v", info, QualityHigh, SelectOptions{})
+	if first.Video == nil || first.Video.FormatID != "137" {
+		t.Fatalf("unexpected first selection %+v", first)
+	}
+
+	// A better format appearing in the same info isn't picked up, proving the
+	// cached selection is returned without selecting again
+	info.Formats = append(info.Formats, Format{FormatID: "313", URL: "http://cdn/313", VCodec: "avc1.640033", ACodec: "none", Width: 3840, Height: 2160})
+	if got := SelectCached("http://v", info, QualityHigh, SelectOptions{}); got.Video.FormatID != "137" {
+		t.Errorf("expected the cached selection, got %s", got.Video.FormatID)
+	}
+
+	// Other qualities and options are selected on their own
+	if got := SelectCached("http://v", info, QualityHigh, SelectOptions{Height: 2160}); got.Video.FormatID != "313" {
+		t.Errorf("height option: got %s, want 313", got.Video.FormatID)
+	}
+
+	// Metadata fetched again doesn't matter while the cached URLs stay valid
+	refetched := &Info{Formats: info.Formats}
+	if got := SelectCached("http://v", refetched, QualityHigh, SelectOptions{}); got.Video.FormatID != "137" {
+		t.Errorf("refetched info: got %s, want the cached 137", got.Video.FormatID)
+	}
+
+	// Other videos are selected on their own
+	if got := SelectCached("http://other", refetched, QualityHigh, SelectOptions{}); got.Video.FormatID != "313" {
+		t.Errorf("other video: got %s, want 313", got.Video.FormatID)
+	}
+}
+
+func TestSelectionExpiry(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	soon := strconv.FormatInt(now.Add(3*time.Minute).Unix(), 10)
+	later := strconv.FormatInt(now.Add(time.Hour).Unix(), 10)
+
+	tests := []struct {
+		name       string
+		video, aud string
+		want       time.Time
+	}{
+		{"unsigned", "http://cdn/v", "", now.Add(SelectionTTL)},
+		{"far expiry", "http://cdn/v?expire=" + later, "", now.Add(SelectionTTL)},
+		{"audio expires first", "http://cdn/v?expire=" + later, "http://cdn/a?expire=" + soon, now.Add(2 * time.Minute)},
+		{"manifest path", "https://manifest.googlevideo.com/api/manifest/hls_playlist/expire/" + soon + "/id/x", "", now.Add(2 * time.Minute)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sel := Selection{Video: &Format{URL: tt.video}}
+			if tt.aud != "" {
+				sel.Audio = &Format{URL: tt.aud}
+			}
+			if got := selectionExpiry(sel, now); !got.Equal(tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectCached_SkipsExpiringURLs(t *testing.T) {
+	defer func(old *selectionCache) { selections = old }(selections)
+	selections = &selectionCache{items: make(map[selectionKey]cachedSelection)}
+
+	// Within the margin of its expiry, the URL isn't worth caching
+	expire := strconv.FormatInt(time.Now().Add(30*time.Second).Unix(), 10)
+	info := &Info{Formats: []Format{
+		{FormatID: "18", URL: "http://cdn/18?expire=" + expire, VCodec: "avc1.42001E", ACodec: "mp4a.40.2", Width: 640, Height: 360},
+	}}
+	SelectCached("http://v", info, QualityHigh, SelectOptions{})
+	if len(selections.items) != 0 {
+		t.Errorf("expected no cached selection, got %d", len(selections.items))
+	}
+}
@@ -1,70 +1,189 @@
 package ytdlp
 
 import (
+	"bytes"
+	"cmp"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"os/exec"
 	"slices"
 	"strings"
-	"sync"
 	"time"
-)
+	"video-microservice/internal/codec"
+	"video-microservice/internal/metrics"
+	"video-microservice/internal/redact"
 
-var (
-	infoCache sync.Map
+	"golang.org/x/sync/singleflight"
 )
 
-type cachedInfo struct {
-	info      *Info
-	timestamp time.Time
-}
+var infoCache = newInfoLRU()
 
-const cacheTTL = 10 * time.Minute
+// infoFlight deduplicates concurrent yt-dlp runs for the same URL
+var infoFlight singleflight.Group
+
+// Cache settings. They are read by GetVideoInfo and the sweeper,
+// so they should be set before either is used.
+var (
+	CacheTTL           = 10 * time.Minute
+	CacheSweepInterval = 1 * time.Minute
+	// NegativeTTL is how long not-found and auth failures are remembered
+	NegativeTTL = 30 * time.Second
+)
 
-func init() {
+// StartCacheSweeper periodically removes expired entries from the info cache
+// until ctx is cancelled.
+func StartCacheSweeper(ctx context.Context) {
 	go func() {
-		ticker := time.NewTicker(1 * time.Minute)
+		ticker := time.NewTicker(CacheSweepInterval)
 		defer ticker.Stop()
-		for range ticker.C {
-			infoCache.Range(func(key, value interface{}) bool {
-				entry, ok := value.(cachedInfo)
-				if !ok {
-					infoCache.Delete(key)
-					return true
-				}
-				if time.Since(entry.timestamp) > cacheTTL {
-					infoCache.Delete(key)
-				}
-				return true
-			})
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				sweepCache()
+			}
 		}
 	}()
 }
-var ErrVideoNotFound = errors.New("video not found")
+
+func sweepCache() {
+	infoCache.removeExpired(CacheTTL, NegativeTTL)
+	selections.removeExpired()
+}
+
+// BinaryPath is the yt-dlp executable, looked up in PATH unless absolute
+var BinaryPath = "yt-dlp"
+
+// MetadataTimeout bounds a single yt-dlp run, so a stalled extractor
+// can't hold a request forever
+var MetadataTimeout = 30 * time.Second
+
+// Retry settings for transient yt-dlp failures.
+// The backoff doubles after every attempt.
+var (
+	MaxRetries   = 2
+	RetryBackoff = 500 * time.Millisecond
+)
+
+// MaxHeight caps the video height picked by SelectFormats for every quality, zero means no cap
+var MaxHeight int
+
+// CookiesFile is an optional Netscape cookie file passed to yt-dlp,
+// needed for age-restricted or members-only videos
+var CookiesFile string
+
+// ExtractorArgs are passed to yt-dlp as one --extractor-args each, in order,
+// e.g. "youtube:player_client=android" to avoid throttling
+var ExtractorArgs []string
+
+// GeoBypass has yt-dlp fake a forwarded address to get around geo blocks:
+// "auto" lets it guess the country, a code such as "US" forces one, empty disables it
+var GeoBypass string
+
+// Impersonate has yt-dlp impersonate a browser, e.g. "chrome", for sites
+// that block clients they detect as bots. Empty disables it.
+var Impersonate string
+
+// InsecureTLS has yt-dlp skip certificate verification, for sources with
+// self-signed certificates. Only for trusted networks.
+var InsecureTLS bool
+
+var (
+	ErrVideoNotFound   = errors.New("video not found")
+	ErrFormatNotFound  = errors.New("format not found")
+	ErrNoSubtitles     = errors.New("subtitles not available")
+	ErrAuthRequired    = errors.New("authentication required")
+	ErrPrivate         = errors.New("video is private")
+	ErrGeoBlocked      = errors.New("video not available in this region")
+	ErrMetadataTimeout = errors.New("metadata fetch timed out")
+	// ErrIsPlaylist is returned for URLs that yt-dlp resolves to a playlist
+	// even with --no-playlist, those are listed by GetPlaylist instead
+	ErrIsPlaylist = errors.New("url is a playlist")
+	// ErrNoUsableFormats is reported for videos yt-dlp found but whose
+	// formats can't be streamed, e.g. when it only lists storyboards
+	ErrNoUsableFormats = errors.New("no usable formats")
+	// ErrBotCheck is returned when the site wants to confirm we're not a bot,
+	// see Impersonate
+	ErrBotCheck = errors.New("blocked by a bot check")
+)
 
 // Format represents a single stream format
 type Format struct {
-	FormatID    string            `json:"format_id"`
-	URL         string            `json:"url"`
-	VCodec      string            `json:"vcodec"`
-	ACodec      string            `json:"acodec"`
-	Width       int               `json:"width,omitempty"`
-	Height      int               `json:"height,omitempty"`
-	TBR         float64           `json:"tbr,omitempty"` // Total bitrate
-	ABR         float64           `json:"abr,omitempty"` // Audio bitrate
-	Protocol    string            `json:"protocol,omitempty"`
-	HTTPHeaders map[string]string `json:"http_headers"`
+	FormatID string  `json:"format_id"`
+	URL      string  `json:"url"`
+	Ext      string  `json:"ext,omitempty"` // Container, e.g. mp4 or webm
+	VCodec   string  `json:"vcodec"`
+	ACodec   string  `json:"acodec"`
+	Width    int     `json:"width,omitempty"`
+	Height   int     `json:"height,omitempty"`
+	TBR      float64 `json:"tbr,omitempty"` // Total bitrate
+	ABR      float64 `json:"abr,omitempty"` // Audio bitrate
+	FPS      float64 `json:"fps,omitempty"`
+	Protocol string  `json:"protocol,omitempty"`
+	// Language of the audio, e.g. "en" or "es-419", empty if unknown
+	Language string `json:"language,omitempty"`
+	// Sizes in bytes, zero if unknown. The approximate one is estimated by yt-dlp.
+	Filesize       int64             `json:"filesize,omitempty"`
+	FilesizeApprox int64             `json:"filesize_approx,omitempty"`
+	HTTPHeaders    map[string]string `json:"http_headers"`
+}
+
+// EstimatedSize returns the format's size in bytes: the exact one if known,
+// else yt-dlp's approximation, else its bitrate over the duration in seconds.
+// Zero if none of them is known.
+func (f *Format) EstimatedSize(duration float64) int64 {
+	switch {
+	case f.Filesize > 0:
+		return f.Filesize
+	case f.FilesizeApprox > 0:
+		return f.FilesizeApprox
+	}
+	// TBR is in kbit/s
+	return int64(f.TBR * 1000 / 8 * duration)
 }
 
 // Info represents the video metadata
 type Info struct {
+	Type        string            `json:"_type"` // "video", or "playlist" for URLs that can't be streamed
 	ID          string            `json:"id"`
 	Title       string            `json:"title"`
+	Duration    float64           `json:"duration"` // Seconds, zero if unknown
+	Thumbnail   string            `json:"thumbnail"`
+	Thumbnails  []Thumbnail       `json:"thumbnails"`
+	Uploader    string            `json:"uploader"`
+	IsLive      bool              `json:"is_live"`
 	Formats     []Format          `json:"formats"`
 	HTTPHeaders map[string]string `json:"http_headers"`
+	// Subtitle tracks keyed by language code
+	Subtitles         map[string][]Subtitle `json:"subtitles"`
+	AutomaticCaptions map[string][]Subtitle `json:"automatic_captions"`
+	Chapters          []Chapter             `json:"chapters"`
+}
+
+// Chapter is a titled section of a video, in seconds
+type Chapter struct {
+	StartTime float64 `json:"start_time"`
+	EndTime   float64 `json:"end_time"`
+	Title     string  `json:"title"`
+}
+
+// Thumbnail is one of the poster images of a video
+type Thumbnail struct {
+	URL        string `json:"url"`
+	Width      int    `json:"width,omitempty"`
+	Height     int    `json:"height,omitempty"`
+	Preference int    `json:"preference,omitempty"` // Higher is better
+}
+
+// Subtitle is one encoding of a subtitle track
+type Subtitle struct {
+	Ext  string `json:"ext"` // e.g. vtt, srv3 or json3
+	URL  string `json:"url"`
+	Name string `json:"name,omitempty"`
 }
 
 // Quality enum
@@ -76,50 +195,358 @@ const (
 	QualityHigh   Quality = "high"
 )
 
+// ErrUnknownQuality is returned by ParseQuality for values other than low, medium and high
+var ErrUnknownQuality = errors.New("unknown quality")
+
+// DefaultQuality is used for requests that don't ask for a quality
+var DefaultQuality = QualityHigh
+
+// ParseQuality parses a quality name, empty meaning DefaultQuality.
+// Unknown names return DefaultQuality too, along with ErrUnknownQuality,
+// so lenient callers can ignore the error.
+func ParseQuality(s string) (Quality, error) {
+	switch q := Quality(s); q {
+	case QualityLow, QualityMedium, QualityHigh:
+		return q, nil
+	case "":
+		return DefaultQuality, nil
+	}
+	return DefaultQuality, ErrUnknownQuality
+}
+
+// runCommand runs an external program and returns its stdout and stderr.
+// Tests replace it to exercise the yt-dlp handling without the binary.
+var runCommand = func(ctx context.Context, name string, args ...string) (stdout, stderr []byte, err error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	var errBuf bytes.Buffer
+	cmd.Stderr = &errBuf
+	out, err := cmd.Output()
+	return out, errBuf.Bytes(), err
+}
+
+// Version returns the installed yt-dlp version, e.g. "2024.08.06"
+func Version(ctx context.Context) (string, error) {
+	out, _, err := runCommand(ctx, BinaryPath, "--version")
+	if err != nil {
+		return "", fmt.Errorf("failed to run yt-dlp --version: %w", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
 // GetVideoInfo fetches metadata for the given URL
 func GetVideoInfo(ctx context.Context, videoURL string) (*Info, error) {
-	if val, ok := infoCache.Load(videoURL); ok {
-		entry, ok := val.(cachedInfo)
-		if ok && time.Since(entry.timestamp) < cacheTTL {
-			log.Printf("Cache HIT for URL: %s", videoURL)
-			return entry.info, nil
+	if entry, ok := infoCache.Load(videoURL); ok {
+		if !entry.expired(CacheTTL, NegativeTTL) {
+			slog.InfoContext(ctx, "Cache HIT", "url", redact.URL(videoURL))
+			metrics.CacheLookups.WithLabelValues("hit").Inc()
+			metrics.Stats.CacheHits.Add(1)
+			return entry.info, entry.err
 		}
 		infoCache.Delete(videoURL)
 	}
-	log.Printf("Cache MISS for URL: %s", videoURL)
+	slog.InfoContext(ctx, "Cache MISS", "url", redact.URL(videoURL))
+	metrics.CacheLookups.WithLabelValues("miss").Inc()
+	metrics.Stats.CacheMisses.Add(1)
 
-	cmd := exec.CommandContext(ctx, "yt-dlp", "-J", "--no-playlist", videoURL)
-	output, err := cmd.Output()
+	// Concurrent misses for the same URL share one yt-dlp run. It isn't tied to
+	// any single caller's context, MetadataTimeout still bounds it.
+	ch := infoFlight.DoChan(videoURL, func() (any, error) {
+		return fetchVideoInfo(context.WithoutCancel(ctx), videoURL)
+	})
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.(*Info), nil
+	}
+}
+
+// fetchVideoInfo runs yt-dlp and caches the result.
+// Only definitive failures are cached, with NegativeTTL.
+func fetchVideoInfo(ctx context.Context, videoURL string) (*Info, error) {
+	output, err := runWithRetries(ctx, buildYtdlpArgs(videoURL))
 	if err != nil {
-		var exitErr *exec.ExitError
-		if errors.As(err, &exitErr) {
-			stderr := string(exitErr.Stderr)
-			if strings.Contains(stderr, "Video unavailable") || strings.Contains(stderr, "HTTP Error 404") {
-				return nil, ErrVideoNotFound
-			}
+		// Videos that are gone or locked stay so for a while, fail fast on retries
+		if isPermanent(err) {
+			infoCache.Store(videoURL, cachedInfo{err: err, timestamp: time.Now()})
 		}
-		return nil, fmt.Errorf("failed to run yt-dlp: %w", err)
+		return nil, err
 	}
 
 	var info Info
 	if err := json.Unmarshal(output, &info); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal JSON: %w", err)
 	}
+	// It would carry no formats, which looks like nothing suitable was found
+	if info.Type == "playlist" {
+		infoCache.Store(videoURL, cachedInfo{err: ErrIsPlaylist, timestamp: time.Now()})
+		return nil, ErrIsPlaylist
+	}
 
 	infoCache.Store(videoURL, cachedInfo{info: &info, timestamp: time.Now()})
 
 	return &info, nil
 }
 
-// SelectFormats chooses the best video and audio formats based on quality
-func SelectFormats(info *Info, quality Quality) (video *Format, audio *Format) {
+// SimpleSelector is yt-dlp's best pre-merged format, a single URL carrying
+// both video and audio
+const SimpleSelector = "b"
+
+// ResolveFormatURLs lets yt-dlp pick the formats with its own selector syntax,
+// e.g. "bv*[height<=720]+ba/b", and returns their direct URLs.
+// audioURL is empty when the selector resolved to a single format.
+// Nothing is cached, the URLs are signed and short-lived.
+func ResolveFormatURLs(ctx context.Context, pageURL, selector string) (videoURL, audioURL string, err error) {
+	output, err := runWithRetries(ctx, buildSelectorArgs(pageURL, selector))
+	if err != nil {
+		return "", "", err
+	}
+	return parseFormatURLs(output)
+}
+
+// parseFormatURLs splits the output of -g, one URL per selected format:
+// video then audio for a merged selection, or a single URL
+func parseFormatURLs(output []byte) (videoURL, audioURL string, err error) {
+	var urls []string
+	for _, line := range strings.Split(string(output), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			urls = append(urls, line)
+		}
+	}
+	switch len(urls) {
+	case 1:
+		return urls[0], "", nil
+	case 2:
+		return urls[0], urls[1], nil
+	case 0:
+		return "", "", ErrFormatNotFound
+	}
+	return "", "", fmt.Errorf("unexpected yt-dlp output: %d URLs", len(urls))
+}
+
+// ParseGeoBypass validates a geo bypass setting. Boolean-like values turn
+// the automatic bypass on or off, two letters are taken as a country code.
+func ParseGeoBypass(s string) (string, error) {
+	switch strings.ToLower(s) {
+	case "", "off", "false", "0":
+		return "", nil
+	case "auto", "on", "true", "1":
+		return "auto", nil
+	}
+	if len(s) == 2 && isLetter(s[0]) && isLetter(s[1]) {
+		return strings.ToUpper(s), nil
+	}
+	return "", fmt.Errorf("invalid geo bypass %q, want auto or a two-letter country code", s)
+}
+
+func isLetter(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+// isPermanent reports whether a fetch failure won't go away on its own soon
+func isPermanent(err error) bool {
+	for _, target := range []error{ErrVideoNotFound, ErrAuthRequired, ErrPrivate, ErrGeoBlocked} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Playlist is a flat listing of a playlist's videos
+type Playlist struct {
+	Type       string          `json:"_type"` // "playlist", or "video" for a single video URL
+	ID         string          `json:"id"`
+	Title      string          `json:"title"`
+	WebpageURL string          `json:"webpage_url"`
+	Entries    []PlaylistEntry `json:"entries"`
+}
+
+// PlaylistEntry is a video in a playlist, its URL can be passed to GetVideoInfo
+type PlaylistEntry struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+	URL   string `json:"url"`
+}
+
+// GetPlaylist lists the videos of a playlist URL.
+// A single video URL gives a playlist with just that video.
+// Listings aren't cached since they're cheap and change often.
+func GetPlaylist(ctx context.Context, playlistURL string) (*Playlist, error) {
+	output, err := runWithRetries(ctx, buildPlaylistArgs(playlistURL))
+	if err != nil {
+		return nil, err
+	}
+
+	var playlist Playlist
+	if err := json.Unmarshal(output, &playlist); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal JSON: %w", err)
+	}
+
+	if playlist.Type != "playlist" {
+		url := playlist.WebpageURL
+		if url == "" {
+			url = playlistURL
+		}
+		playlist.Entries = []PlaylistEntry{{ID: playlist.ID, Title: playlist.Title, URL: url}}
+	}
+	return &playlist, nil
+}
+
+// runWithRetries runs yt-dlp, retrying transient failures with exponential backoff
+func runWithRetries(ctx context.Context, args []string) ([]byte, error) {
+	backoff := RetryBackoff
+	for attempt := 0; ; attempt++ {
+		output, stderr, err := runYtdlp(ctx, args)
+		// Known outcomes like a missing video are final, never retry them
+		if err == nil || attempt >= MaxRetries || !isTransient(stderr) || classifyError(stderr) != nil {
+			return output, err
+		}
+
+		slog.WarnContext(ctx, "yt-dlp transient failure, retrying", "attempt", attempt+1, "attempts", MaxRetries+1, "backoff", backoff)
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// runYtdlp runs a single yt-dlp metadata fetch.
+// It returns the stdout JSON, the captured stderr and a classified error.
+func runYtdlp(ctx context.Context, args []string) ([]byte, string, error) {
+	runCtx, cancel := context.WithTimeout(ctx, MetadataTimeout)
+	defer cancel()
+
+	output, errOutput, err := runCommand(runCtx, BinaryPath, args...)
+	if err == nil {
+		return output, "", nil
+	}
+	if errors.Is(runCtx.Err(), context.DeadlineExceeded) {
+		return nil, "", ErrMetadataTimeout
+	}
+
+	stderr := string(errOutput)
+	if classified := classifyError(stderr); classified != nil {
+		return nil, stderr, classified
+	}
+	return nil, stderr, fmt.Errorf("failed to run yt-dlp: %w", err)
+}
+
+// transientSignatures are yt-dlp error fragments for failures that usually
+// succeed when retried
+var transientSignatures = []string{
+	"HTTP Error 429",
+	"Too Many Requests",
+	"Unable to download webpage",
+	"timed out",
+	"Connection reset",
+	"Temporary failure in name resolution",
+	"HTTP Error 503",
+}
+
+// isTransient reports whether a yt-dlp failure is worth retrying
+func isTransient(stderr string) bool {
+	for _, sig := range transientSignatures {
+		if strings.Contains(stderr, sig) {
+			return true
+		}
+	}
+	return false
+}
+
+func buildYtdlpArgs(videoURL string) []string {
+	return withSharedArgs([]string{"-J", "--no-playlist"}, videoURL)
+}
+
+// buildSelectorArgs prints the URLs of the formats matching a yt-dlp selector.
+// The selector is attached to the option so it can't be parsed as a flag.
+func buildSelectorArgs(videoURL, selector string) []string {
+	return withSharedArgs([]string{"--format=" + selector, "-g", "--no-playlist"}, videoURL)
+}
+
+// buildPlaylistArgs lists playlist entries without resolving each video
+func buildPlaylistArgs(playlistURL string) []string {
+	return withSharedArgs([]string{"-J", "--flat-playlist"}, playlistURL)
+}
+
+// withSharedArgs appends the options common to every yt-dlp run, then the URL.
+// Each option value is its own argv entry, nothing goes through a shell.
+func withSharedArgs(args []string, url string) []string {
+	if CookiesFile != "" {
+		args = append(args, "--cookies", CookiesFile)
+	}
+	for _, ea := range ExtractorArgs {
+		args = append(args, "--extractor-args", ea)
+	}
+	switch GeoBypass {
+	case "":
+	case "auto":
+		args = append(args, "--geo-bypass")
+	default:
+		args = append(args, "--geo-bypass-country", GeoBypass)
+	}
+	if Impersonate != "" {
+		args = append(args, "--impersonate", Impersonate)
+	}
+	if InsecureTLS {
+		args = append(args, "--no-check-certificates")
+	}
+	return append(args, url)
+}
+
+// errorSignatures map lowercased yt-dlp error fragments to sentinel errors.
+// The first match wins, so more specific messages come first: a geo block
+// is also reported as "Video unavailable".
+var errorSignatures = []struct {
+	fragment string
+	err      error
+}{
+	{"available in your country", ErrGeoBlocked},
+	{"geo restrict", ErrGeoBlocked},
+	{"this video is private", ErrPrivate},
+	{"private video", ErrPrivate},
+	{"sign in to confirm your age", ErrAuthRequired},
+	{"not a bot", ErrBotCheck},
+	{"members-only", ErrAuthRequired},
+	{"requested format is not available", ErrFormatNotFound},
+	{"video unavailable", ErrVideoNotFound},
+	{"this video has been removed", ErrVideoNotFound},
+	{"incomplete youtube id", ErrVideoNotFound},
+	{"http error 404", ErrVideoNotFound},
+}
+
+// classifyError maps known yt-dlp failure messages to sentinel errors, ignoring case.
+// It returns nil if the message isn't recognized.
+func classifyError(stderr string) error {
+	lower := strings.ToLower(stderr)
+	for _, sig := range errorSignatures {
+		if strings.Contains(lower, sig.fragment) {
+			return sig.err
+		}
+	}
+	return nil
+}
+
+// candidateFormats returns the video and audio formats to pick from, best
+// first, and whether any video was left out for being above MaxHeight
+func candidateFormats(info *Info, pref CodecPreference) (videos []Format, audios []Format, capped bool) {
 	// Filter video and audio formats
-	videos := make([]Format, 0, len(info.Formats))
-	audios := make([]Format, 0, len(info.Formats))
+	videos = make([]Format, 0, len(info.Formats))
+	audios = make([]Format, 0, len(info.Formats))
 
 	for _, f := range info.Formats {
 		isVideo := f.VCodec != "none" && f.Width > 0
 		isAudio := f.ACodec != "none"
+		// Formats above the cap are never candidates, so every quality picks among the rest
+		if isVideo && MaxHeight > 0 && f.Height > MaxHeight {
+			isVideo = false
+			capped = true
+		}
 
 		// Some formats are container only or video-only or audio-only
 		// We prefer separate streams usually for high quality, but mixed is fine too if it matches
@@ -132,25 +559,254 @@ func SelectFormats(info *Info, quality Quality) (video *Format, audio *Format) {
 	}
 
 	// Sort videos by bitrate (quality) descending
-	slices.SortFunc(videos, func(a, b Format) int {
+	slices.SortFunc(videos, videoComparator(pref, info.IsLive))
+
+	sortAudios(audios)
+	return videos, audios, capped
+}
+
+// SelectFormats chooses the best video and audio formats based on quality.
+// The video is nil when there is none to choose, see Selection.Err.
+func SelectFormats(info *Info, quality Quality) (video *Format, audio *Format) {
+	sel := Select(info, quality, SelectOptions{})
+	return sel.Video, sel.Audio
+}
+
+// SelectOptions refines how Select picks formats
+type SelectOptions struct {
+	// CodecPref decides between formats of the same resolution, defaulting to H264
+	CodecPref CodecPreference
+	// Height targets the closest resolution instead of the quality bucket when positive
+	Height int
+	// Language prefers audio tracks in this language, e.g. "es",
+	// falling back to every track when there's none
+	Language string
+	// AudioCodec prefers audio tracks in this codec, e.g. "opus" for WebM,
+	// falling back to every track when there's none. Language comes first.
+	AudioCodec string
+}
+
+// Selection is the video and audio chosen for a stream, and what the MP4
+// output has to do with them
+type Selection struct {
+	Video *Format
+	// Audio is nil when there is no audio to pair with Video
+	Audio *Format
+	// AudioMissing is set when the video has no audio track at all,
+	// so the stream will be silent
+	AudioMissing bool
+	// TranscodeVideo and TranscodeAudio are set when the codec can't be copied
+	// into MP4, by the rule streamer.StreamOptions applies too. The stream can
+	// still add reasons to transcode, e.g. burned subtitles or loudnorm.
+	TranscodeVideo bool
+	TranscodeAudio bool
+	// SameInput is set when Video and Audio are one progressive format
+	SameInput bool
+	// capped is set when videos were left out for being above MaxHeight
+	capped bool
+}
+
+// Err explains a selection without video: ErrFormatNotFound when every video
+// is above MaxHeight, ErrNoUsableFormats when there was none to begin with.
+// Otherwise a quality or height never leaves Video nil, the closest format is taken.
+func (s Selection) Err() error {
+	switch {
+	case s.Video != nil:
+		return nil
+	case s.capped:
+		return ErrFormatNotFound
+	}
+	return ErrNoUsableFormats
+}
+
+// NewSelection describes a video and audio pair chosen by the caller
+func NewSelection(video, audio *Format) Selection {
+	sel := Selection{Video: video, Audio: audio}
+	if video != nil {
+		sel.AudioMissing = audio == nil
+		sel.TranscodeVideo = codec.NeedsTranscode(video.VCodec)
+	}
+	if audio != nil {
+		sel.TranscodeAudio = codec.AudioNeedsTranscode(audio.ACodec)
+		sel.SameInput = video != nil && audio.URL == video.URL
+	}
+	return sel
+}
+
+// Select chooses the formats for a stream by quality, or by height when set in opts
+func Select(info *Info, quality Quality, opts SelectOptions) Selection {
+	pref := opts.CodecPref
+	if pref == "" {
+		pref = CodecPrefH264
+	}
+	videos, audios, capped := candidateFormats(info, pref)
+	audios = preferLanguage(audios, opts.Language)
+	audios = preferAudioCodec(audios, opts.AudioCodec)
+	var sel Selection
+	if opts.Height > 0 {
+		sel = selectByHeight(videos, audios, opts.Height)
+	} else {
+		sel = selectByQuality(videos, audios, quality, pref, opts.Language)
+	}
+	sel.capped = capped
+	return sel
+}
+
+// selectByQuality picks the video for a quality bucket, with pref
+// deciding between formats of the same resolution
+func selectByQuality(videos, audios []Format, quality Quality, pref CodecPreference, lang string) Selection {
+	var video, audio *Format
+
+	// A small progressive H264 format needs neither muxing nor transcoding,
+	// but its audio track may not be in the requested language
+	if quality == QualityLow && pref == CodecPrefH264 && lang == "" {
+		if p := selectLowProgressive(videos); p != nil {
+			return NewSelection(p, p)
+		}
+	}
+
+	// Select Video
+	if len(videos) > 0 {
+		switch quality {
+		case QualityHigh:
+			video = &videos[0]
+		case QualityMedium:
+			// Aim for 720p or closest
+			video = findClosestResolution(videos, 720)
+		case QualityLow:
+			// Aim for 360p or lowest
+			video = findClosestResolution(videos, 360)
+		default:
+			video = &videos[0]
+		}
+	}
+
+	// Select Audio
+	// Just pick best audio usually, unless we want to save bandwidth on low quality
+	if len(audios) > 0 {
+		if quality == QualityLow {
+			// Pick lowest bitrate audio
+			audio = &audios[len(audios)-1]
+		} else {
+			audio = &audios[0]
+		}
+	} else {
+		// Fallback: if video format contains audio (pre-merged), use it as audio source too
+		// But in our pipeline we treat them as inputs.
+		// If video struct has ACodec != none, it has audio.
+		if video != nil && video.ACodec != "none" {
+			audio = video
+		}
+	}
+
+	// Refinement: If we picked a video that is NOT H264, check if there is an H264 option
+	// with the SAME height and similar bitrate (or just exists).
+	// The sort logic above already puts H264 first if heights are equal.
+	// So video[0] for a given height bucket is already the H264 one if available.
+	// e.g. if we have [1080p VP9, 1080p H264], sorting by height (equal) -> H264 (prio) -> H264 wins.
+	// Wait, my sort logic:
+	// if height != -> height desc.
+	// if height == -> H264 prio.
+	// So yes, we already prioritize H264 for the SAME resolution.
+	// But what if High Quality (Max) finds 4K VP9 (Height 2160) and 1080p H264 (Height 1080).
+	// The sort puts 4K first. We pick 4K. We will transcode. This is correct behavior for "Max Quality".
+
+	return NewSelection(video, audio)
+}
+
+// selectByHeight chooses the video closest to an exact target height,
+// paired with the best audio. MaxHeight still applies.
+func selectByHeight(videos, audios []Format, height int) Selection {
+	var video, audio *Format
+	if len(videos) > 0 {
+		video = findClosestResolution(videos, height)
+	}
+	if len(audios) > 0 {
+		audio = &audios[0]
+	} else if video != nil && video.ACodec != "none" {
+		audio = video
+	}
+	return NewSelection(video, audio)
+}
+
+// CodecPreference decides between video formats of the same resolution
+type CodecPreference string
+
+const (
+	// CodecPrefH264 prefers formats streamed without transcoding, the default
+	CodecPrefH264 CodecPreference = "h264"
+	// CodecPrefBitrate picks the highest bitrate regardless of codec
+	CodecPrefBitrate CodecPreference = "bitrate"
+	CodecPrefVP9     CodecPreference = "vp9"
+	CodecPrefAV1     CodecPreference = "av1"
+)
+
+// ParseCodecPreference parses a codec preference name, reporting false if it's unknown
+func ParseCodecPreference(s string) (CodecPreference, bool) {
+	switch p := CodecPreference(s); p {
+	case CodecPrefH264, CodecPrefBitrate, CodecPrefVP9, CodecPrefAV1:
+		return p, true
+	}
+	return "", false
+}
+
+// videoComparator orders videos from best to worst: by resolution, then by
+// the preferred codec, then by bitrate
+func videoComparator(pref CodecPreference, live bool) func(a, b Format) int {
+	var preferred func(vCodec string) bool
+	switch pref {
+	case CodecPrefBitrate:
+		// No codec preference
+	case CodecPrefVP9:
+		preferred = codec.IsVP9
+	case CodecPrefAV1:
+		preferred = codec.IsAV1
+	default:
+		// H264 (avc1) avoids transcoding
+		// AV1 is just as good when it can be streamed without transcoding
+		preferred = isPassthroughCodec
+	}
+
+	return func(a, b Format) int {
+		// A live stream must be transcoded in realtime, copying matters more than resolution
+		if live {
+			if c := preferTrue(isPassthroughCodec(a.VCodec), isPassthroughCodec(b.VCodec)); c != 0 {
+				return c
+			}
+		}
 		// If resolution is different, prefer higher resolution
 		if a.Height != b.Height {
 			return b.Height - a.Height
 		}
-		// If resolution is same, prefer H264 (avc1) to avoid transcoding
-		aH264 := strings.HasPrefix(a.VCodec, "avc1")
-		bH264 := strings.HasPrefix(b.VCodec, "avc1")
-		if aH264 != bH264 {
-			if aH264 {
-				return -1
+		// If resolution is same, prefer the preferred codec
+		if preferred != nil {
+			if c := preferTrue(preferred(a.VCodec), preferred(b.VCodec)); c != 0 {
+				return c
 			}
-			return 1
 		}
 		// Otherwise bitrate
-		return int(b.TBR - a.TBR)
-	})
+		return cmp.Compare(b.TBR, a.TBR)
+	}
+}
 
-	// Sort audios by quality
+// preferTrue orders a before b if only a is true, and the reverse if only b is
+func preferTrue(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case a:
+		return -1
+	}
+	return 1
+}
+
+// isPassthroughCodec reports whether a video codec is streamed without transcoding
+func isPassthroughCodec(vCodec string) bool {
+	return !codec.NeedsTranscode(vCodec)
+}
+
+// sortAudios orders audio candidates from best to worst
+func sortAudios(audios []Format) {
 	slices.SortFunc(audios, func(a, b Format) int {
 		// 1. Prefer Audio Only (VCodec == "none")
 		aAudioOnly := a.VCodec == "none"
@@ -162,8 +818,22 @@ func SelectFormats(info *Info, quality Quality) (video *Format, audio *Format) {
 			return 1
 		}
 
-		// 2. Prefer HTTPS over m3u8 (HLS)
-		// m3u8 streams often require complex header handling or cookie propagation for segments which can fail.
+		// 2. Prefer Higher ABR (or TBR if ABR missing)
+		aRate := a.ABR
+		if aRate == 0 {
+			aRate = a.TBR
+		}
+		bRate := b.ABR
+		if bRate == 0 {
+			bRate = b.TBR
+		}
+		if aRate != bRate {
+			return cmp.Compare(bRate, aRate)
+		}
+
+		// 3. Prefer HTTPS over m3u8 (HLS) at the same bitrate
+		// HLS inputs work since the streamer passes headers to every segment,
+		// but a single request is still cheaper than a playlist of segments.
 		aHttps := strings.HasPrefix(a.Protocol, "http") && !strings.Contains(a.Protocol, "m3u8")
 		bHttps := strings.HasPrefix(b.Protocol, "http") && !strings.Contains(b.Protocol, "m3u8")
 		if aHttps != bHttps {
@@ -172,66 +842,159 @@ func SelectFormats(info *Info, quality Quality) (video *Format, audio *Format) {
 			}
 			return 1
 		}
+		return 0
+	})
+}
 
-		// 3. Prefer Higher ABR (or TBR if ABR missing)
-		aRate := a.ABR
-		if aRate == 0 {
-			aRate = a.TBR
+// preferLanguage narrows sorted audio formats to those in lang, where "es"
+// also matches regional tags like "es-419". Without any match every format
+// is kept, so the default track plays.
+func preferLanguage(audios []Format, lang string) []Format {
+	if lang == "" {
+		return audios
+	}
+	var matched []Format
+	for _, f := range audios {
+		if matchesLanguage(f.Language, lang) {
+			matched = append(matched, f)
 		}
-		bRate := b.ABR
-		if bRate == 0 {
-			bRate = b.TBR
+	}
+	if len(matched) == 0 {
+		return audios
+	}
+	return matched
+}
+
+// preferAudioCodec narrows audios to the tracks in the codec, keeping them
+// all when none is
+func preferAudioCodec(audios []Format, codec string) []Format {
+	if codec == "" {
+		return audios
+	}
+	var matched []Format
+	for _, f := range audios {
+		if strings.Contains(strings.ToLower(f.ACodec), codec) {
+			matched = append(matched, f)
 		}
-		return int(bRate - aRate)
-	})
+	}
+	if len(matched) == 0 {
+		return audios
+	}
+	return matched
+}
 
-	// Select Video
-	if len(videos) > 0 {
-		switch quality {
-		case QualityHigh:
-			video = &videos[0]
-		case QualityMedium:
-			// Aim for 720p or closest
-			video = findClosestResolution(videos, 720)
-		case QualityLow:
-			// Aim for 360p or lowest
-			video = findClosestResolution(videos, 360)
-		default:
-			video = &videos[0]
+// matchesLanguage reports whether a format's language tag is lang, ignoring case and region
+func matchesLanguage(tag, lang string) bool {
+	if strings.EqualFold(tag, lang) {
+		return true
+	}
+	primary, _, _ := strings.Cut(tag, "-")
+	return strings.EqualFold(primary, lang)
+}
+
+// SelectAudioFormat chooses the best audio format for audio-only streaming,
+// in lang if there is one
+func SelectAudioFormat(info *Info, lang string) *Format {
+	audios := make([]Format, 0, len(info.Formats))
+	for _, f := range info.Formats {
+		if f.ACodec != "none" {
+			audios = append(audios, f)
+		}
+	}
+	if len(audios) == 0 {
+		return nil
+	}
+	sortAudios(audios)
+	return &preferLanguage(audios, lang)[0]
+}
+
+// SelectFormatByID picks the format with the given ID.
+// If it's video-only, the best audio format is paired with it.
+// If it's audio-only, only audio is returned.
+func SelectFormatByID(info *Info, formatID string) (video *Format, audio *Format, err error) {
+	var selected *Format
+	for i := range info.Formats {
+		if info.Formats[i].FormatID == formatID {
+			selected = &info.Formats[i]
+			break
 		}
 	}
+	if selected == nil {
+		return nil, nil, ErrFormatNotFound
+	}
 
-	// Select Audio
-	// Just pick best audio usually, unless we want to save bandwidth on low quality
+	if selected.VCodec == "none" {
+		return nil, selected, nil
+	}
+	video = selected
+
+	if video.ACodec != "none" {
+		// Pre-merged format, use it for both
+		return video, video, nil
+	}
+
+	audios := make([]Format, 0, len(info.Formats))
+	for _, f := range info.Formats {
+		if f.ACodec != "none" {
+			audios = append(audios, f)
+		}
+	}
 	if len(audios) > 0 {
-		if quality == QualityLow {
-             // Pick lowest bitrate audio
-             audio = &audios[len(audios)-1]
-		} else {
-             audio = &audios[0]
+		sortAudios(audios)
+		audio = &audios[0]
+	}
+	return video, audio, nil
+}
+
+// SelectThumbnail picks the best thumbnail URL, by yt-dlp's preference then resolution.
+// Falls back to the single thumbnail field, empty if there is none.
+func SelectThumbnail(info *Info) string {
+	var best *Thumbnail
+	for i := range info.Thumbnails {
+		t := &info.Thumbnails[i]
+		if t.URL == "" {
+			continue
 		}
-	} else {
-		// Fallback: if video format contains audio (pre-merged), use it as audio source too
-		// But in our pipeline we treat them as inputs.
-		// If video struct has ACodec != none, it has audio.
-		if video != nil && video.ACodec != "none" {
-			audio = video
+		if best == nil || t.Preference > best.Preference ||
+			(t.Preference == best.Preference && t.Width*t.Height > best.Width*best.Height) {
+			best = t
+		}
+	}
+	if best != nil {
+		return best.URL
+	}
+	return info.Thumbnail
+}
+
+// SelectSubtitle picks the WebVTT track for the given language.
+// Uploaded subtitles are preferred over automatic captions.
+func SelectSubtitle(info *Info, lang string) (*Subtitle, error) {
+	for _, tracks := range []map[string][]Subtitle{info.Subtitles, info.AutomaticCaptions} {
+		for i := range tracks[lang] {
+			if tracks[lang][i].Ext == "vtt" {
+				return &tracks[lang][i], nil
+			}
 		}
 	}
+	return nil, ErrNoSubtitles
+}
 
-    // Refinement: If we picked a video that is NOT H264, check if there is an H264 option
-    // with the SAME height and similar bitrate (or just exists).
-    // The sort logic above already puts H264 first if heights are equal.
-    // So video[0] for a given height bucket is already the H264 one if available.
-    // e.g. if we have [1080p VP9, 1080p H264], sorting by height (equal) -> H264 (prio) -> H264 wins.
-    // Wait, my sort logic:
-    // if height != -> height desc.
-    // if height == -> H264 prio.
-    // So yes, we already prioritize H264 for the SAME resolution.
-    // But what if High Quality (Max) finds 4K VP9 (Height 2160) and 1080p H264 (Height 1080).
-    // The sort puts 4K first. We pick 4K. We will transcode. This is correct behavior for "Max Quality".
+// lowProgressiveMaxHeight is the largest progressive format QualityLow settles for
+const lowProgressiveMaxHeight = 480
 
-	return video, audio
+// selectLowProgressive picks the H264 format with audio closest to 360p from sorted videos,
+// or nil if there is none small enough
+func selectLowProgressive(videos []Format) *Format {
+	progressive := make([]Format, 0, len(videos))
+	for _, f := range videos {
+		if f.ACodec != "none" && codec.IsH264(f.VCodec) && f.Height <= lowProgressiveMaxHeight {
+			progressive = append(progressive, f)
+		}
+	}
+	if len(progressive) == 0 {
+		return nil
+	}
+	return findClosestResolution(progressive, 360)
 }
 
 func findClosestResolution(videos []Format, targetHeight int) *Format {
@@ -243,10 +1006,12 @@ func findClosestResolution(videos []Format, targetHeight int) *Format {
 		if diff < minDiff {
 			minDiff = diff
 			best = &videos[i]
-		} else if diff == minDiff {
-			// If equal diff (e.g. same resolution candidates), the list is already sorted by H264 preference then bitrate
-			// So we stick with the earlier one (which is better due to sort)
+		} else if diff == minDiff && videos[i].Height <= targetHeight && best.Height > targetHeight {
+			// Equidistant above and below the target, prefer the lighter one below
+			best = &videos[i]
 		}
+		// Otherwise, on equal diff (e.g. same resolution candidates), the list is already sorted by
+		// H264 preference then bitrate, so we stick with the earlier one (which is better due to sort)
 	}
 	return best
 }
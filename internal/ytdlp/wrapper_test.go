@@ -2,8 +2,17 @@ package ytdlp
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+	"video-microservice/internal/codec"
 )
 
 func TestGetVideoInfo_CacheHit(t *testing.T) {
@@ -31,6 +40,444 @@ func TestGetVideoInfo_CacheHit(t *testing.T) {
 	}
 }
 
+func TestStartCacheSweeper(t *testing.T) {
+	oldTTL, oldInterval := CacheTTL, CacheSweepInterval
+	CacheTTL = time.Minute
+	CacheSweepInterval = 10 * time.Millisecond
+	defer func() {
+		CacheTTL, CacheSweepInterval = oldTTL, oldInterval
+	}()
+
+	infoCache.Store("http://expired", cachedInfo{info: &Info{}, timestamp: time.Now().Add(-2 * time.Minute)})
+	infoCache.Store("http://fresh", cachedInfo{info: &Info{}, timestamp: time.Now()})
+	defer infoCache.Delete("http://fresh")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	StartCacheSweeper(ctx)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, ok := infoCache.Load("http://expired"); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expired entry was not swept")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if _, ok := infoCache.Load("http://fresh"); !ok {
+		t.Error("Fresh entry was swept")
+	}
+}
+
+func TestInfo_Unmarshal(t *testing.T) {
+	// Trimmed down output of yt-dlp -J
+	sample := `{
+		"id": "dQw4w9WgXcQ",
+		"title": "Rick Astley - Never Gonna Give You Up",
+		"duration": 212.091,
+		"formats": [
+			{"format_id": "137", "url": "https://cdn/v", "vcodec": "avc1.640028", "acodec": "none",
+			 "width": 1920, "height": 1080, "fps": 25, "tbr": 4400.5, "protocol": "https",
+			 "http_headers": {"User-Agent": "Mozilla/5.0"}}
+		],
+		"http_headers": {"User-Agent": "Mozilla/5.0"}
+	}`
+
+	var info Info
+	if err := json.Unmarshal([]byte(sample), &info); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if info.Duration != 212.091 {
+		t.Errorf("Expected duration 212.091, got %v", info.Duration)
+	}
+	if len(info.Formats) != 1 || info.Formats[0].FPS != 25 {
+		t.Errorf("Expected one 25fps format, got %+v", info.Formats)
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		stderr string
+		want   error
+	}{
+		{stderr: "ERROR: [youtube] zzzzzzzzzzz: Video unavailable", want: ErrVideoNotFound},
+		{stderr: "ERROR: unable to download webpage: HTTP Error 404: Not Found", want: ErrVideoNotFound},
+		{stderr: "ERROR: [youtube] abc: Sign in to confirm your age. This video may be inappropriate for some users.", want: ErrAuthRequired},
+		{stderr: "ERROR: [youtube] abc: Join this channel to get access to members-only content like this video", want: ErrAuthRequired},
+		{stderr: "ERROR: [youtube] abc: Private video. Sign in if you've been granted access to this video", want: ErrPrivate},
+		{stderr: "ERROR: [vimeo] 123: This video is private", want: ErrPrivate},
+		{stderr: "ERROR: [youtube] abc: This video has been removed by the uploader", want: ErrVideoNotFound},
+		{stderr: "ERROR: [youtube] abc: Video unavailable. The uploader has not made this video available in your country", want: ErrGeoBlocked},
+		{stderr: "ERROR: [dailymotion] x: This video is not available in your country", want: ErrGeoBlocked},
+		{stderr: "ERROR: [bbc] p0: This video is not available from your location due to geo restriction", want: ErrGeoBlocked},
+		{stderr: "ERROR: [youtube:truncated_id] abc: Incomplete YouTube ID abc. URL https://youtu.be/abc looks truncated.", want: ErrVideoNotFound},
+		{stderr: "ERROR: [youtube] abc: VIDEO UNAVAILABLE", want: ErrVideoNotFound},
+		{stderr: "ERROR: [youtube] abc: Requested format is not available", want: ErrFormatNotFound},
+		{stderr: "ERROR: [youtube] abc: Sign in to confirm you’re not a bot. Use --cookies-from-browser or --cookies for the authentication.", want: ErrBotCheck},
+		{stderr: "ERROR: [youtube] abc: Sign in to confirm you're not a bot", want: ErrBotCheck},
+		{stderr: "ERROR: Unsupported URL: https://example.com", want: nil},
+	}
+
+	for _, tt := range tests {
+		if got := classifyError(tt.stderr); got != tt.want {
+			t.Errorf("classifyError(%q) = %v, want %v", tt.stderr, got, tt.want)
+		}
+	}
+}
+
+func TestBuildYtdlpArgs_Cookies(t *testing.T) {
+	defer func(old string) { CookiesFile = old }(CookiesFile)
+
+	CookiesFile = ""
+	if args := buildYtdlpArgs("http://v"); slices.Contains(args, "--cookies") {
+		t.Errorf("unexpected --cookies without a cookie file: %v", args)
+	}
+
+	CookiesFile = "/run/secrets/cookies.txt"
+	args := buildYtdlpArgs("http://v")
+	i := slices.Index(args, "--cookies")
+	if i == -1 || args[i+1] != CookiesFile {
+		t.Errorf("expected --cookies %s, got %v", CookiesFile, args)
+	}
+	if args[len(args)-1] != "http://v" {
+		t.Errorf("expected URL as last argument, got %v", args)
+	}
+}
+
+func TestBuildYtdlpArgs_ExtractorArgs(t *testing.T) {
+	defer func(old []string) { ExtractorArgs = old }(ExtractorArgs)
+
+	ExtractorArgs = []string{"youtube:player_client=android,web", "generic:impersonate"}
+	for _, args := range [][]string{buildYtdlpArgs("http://v"), buildPlaylistArgs("http://v")} {
+		var got []string
+		for i, arg := range args {
+			if arg == "--extractor-args" {
+				got = append(got, args[i+1])
+			}
+		}
+		if !slices.Equal(got, ExtractorArgs) {
+			t.Errorf("expected extractor args %v in order, got %v", ExtractorArgs, args)
+		}
+		if args[len(args)-1] != "http://v" {
+			t.Errorf("expected URL after the extractor args, got %v", args)
+		}
+	}
+}
+
+func TestBuildYtdlpArgs_GeoBypass(t *testing.T) {
+	defer func(old string) { GeoBypass = old }(GeoBypass)
+
+	tests := []struct {
+		setting string
+		want    []string
+	}{
+		{setting: "", want: nil},
+		{setting: "auto", want: []string{"--geo-bypass"}},
+		{setting: "US", want: []string{"--geo-bypass-country", "US"}},
+	}
+	for _, tt := range tests {
+		GeoBypass = tt.setting
+		args := buildYtdlpArgs("http://v")
+		var got []string
+		for i, arg := range args {
+			if strings.HasPrefix(arg, "--geo-bypass") {
+				got = append(got, arg)
+				if arg == "--geo-bypass-country" {
+					got = append(got, args[i+1])
+				}
+			}
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("GeoBypass %q: expected %v, got %v", tt.setting, tt.want, args)
+		}
+		if args[len(args)-1] != "http://v" {
+			t.Errorf("expected URL as last argument, got %v", args)
+		}
+	}
+}
+
+func TestBuildYtdlpArgs_Impersonate(t *testing.T) {
+	defer func(old string) { Impersonate = old }(Impersonate)
+
+	Impersonate = ""
+	if args := buildYtdlpArgs("http://v"); slices.Contains(args, "--impersonate") {
+		t.Errorf("unexpected --impersonate when disabled: %v", args)
+	}
+	Impersonate = "chrome"
+	for _, args := range [][]string{buildYtdlpArgs("http://v"), buildSelectorArgs("http://v", "b"), buildPlaylistArgs("http://v")} {
+		i := slices.Index(args, "--impersonate")
+		if i < 0 || args[i+1] != "chrome" || args[len(args)-1] != "http://v" {
+			t.Errorf("expected --impersonate chrome before the URL, got %v", args)
+		}
+	}
+}
+
+func TestBuildYtdlpArgs_InsecureTLS(t *testing.T) {
+	defer func(old bool) { InsecureTLS = old }(InsecureTLS)
+
+	for _, insecure := range []bool{false, true} {
+		InsecureTLS = insecure
+		for _, args := range [][]string{buildYtdlpArgs("http://v"), buildSelectorArgs("http://v", "b"), buildPlaylistArgs("http://v")} {
+			if got := slices.Contains(args, "--no-check-certificates"); got != insecure {
+				t.Errorf("InsecureTLS %v: got %v", insecure, args)
+			}
+			if args[len(args)-1] != "http://v" {
+				t.Errorf("expected URL as last argument, got %v", args)
+			}
+		}
+	}
+}
+
+func TestParseGeoBypass(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "", want: ""},
+		{in: "false", want: ""},
+		{in: "auto", want: "auto"},
+		{in: "true", want: "auto"},
+		{in: "de", want: "DE"},
+		{in: "USA", wantErr: true},
+		{in: "1x", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseGeoBypass(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseGeoBypass(%q) = %q, %v; want %q, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestGetVideoInfo_GeoBlocked(t *testing.T) {
+	defer func(old string) { BinaryPath = old }(BinaryPath)
+	defer func(old string) { GeoBypass = old }(GeoBypass)
+	GeoBypass = ""
+	BinaryPath = writeStub(t, `echo "ERROR: [youtube] abc: Video unavailable. The uploader has not made this video available in your country" >&2; exit 1`)
+
+	defer infoCache.Delete("http://geo-blocked")
+	_, err := GetVideoInfo(context.Background(), "http://geo-blocked")
+	if !errors.Is(err, ErrGeoBlocked) {
+		t.Errorf("expected ErrGeoBlocked, got %v", err)
+	}
+}
+
+// writeStub creates an executable shell script standing in for yt-dlp
+func writeStub(t *testing.T, script string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "yt-dlp")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestGetVideoInfo_Timeout(t *testing.T) {
+	defer func(bin string, timeout time.Duration) {
+		BinaryPath, MetadataTimeout = bin, timeout
+	}(BinaryPath, MetadataTimeout)
+
+	// exec so the kill reaches sleep directly and stdout closes immediately
+	BinaryPath = writeStub(t, "exec sleep 10")
+	MetadataTimeout = 100 * time.Millisecond
+
+	start := time.Now()
+	_, err := GetVideoInfo(context.Background(), "http://slow.example.com/video")
+	if !errors.Is(err, ErrMetadataTimeout) {
+		t.Errorf("Expected ErrMetadataTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Timeout took too long to fire: %v", elapsed)
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	retryable := []string{
+		"ERROR: [youtube] abc: Unable to download webpage: HTTP Error 429: Too Many Requests",
+		"ERROR: [generic] Unable to download webpage: The read operation timed out",
+		"ERROR: Unable to download webpage: [Errno 104] Connection reset by peer",
+	}
+	for _, stderr := range retryable {
+		if !isTransient(stderr) {
+			t.Errorf("Expected %q to be transient", stderr)
+		}
+	}
+
+	final := []string{
+		"ERROR: [youtube] zzzzzzzzzzz: Video unavailable",
+		"ERROR: Unsupported URL: https://example.com",
+		"",
+	}
+	for _, stderr := range final {
+		if isTransient(stderr) {
+			t.Errorf("Expected %q not to be transient", stderr)
+		}
+	}
+}
+
+func TestGetVideoInfo_Retry(t *testing.T) {
+	defer func(bin string, retries int, backoff time.Duration) {
+		BinaryPath, MaxRetries, RetryBackoff = bin, retries, backoff
+	}(BinaryPath, MaxRetries, RetryBackoff)
+
+	// Fails with a 429 on the first run only
+	counter := filepath.Join(t.TempDir(), "runs")
+	BinaryPath = writeStub(t, `n=$(cat `+counter+` 2>/dev/null || echo 0)
+echo $((n+1)) > `+counter+`
+if [ "$n" = 0 ]; then echo "ERROR: HTTP Error 429: Too Many Requests" >&2; exit 1; fi
+echo '{"id":"retried"}'`)
+	MaxRetries = 2
+	RetryBackoff = time.Millisecond
+
+	info, err := GetVideoInfo(context.Background(), "http://flaky.example.com/video")
+	if err != nil {
+		t.Fatalf("GetVideoInfo failed: %v", err)
+	}
+	if info.ID != "retried" {
+		t.Errorf("Expected info from the second attempt, got %s", info.ID)
+	}
+	if runs, _ := os.ReadFile(counter); string(runs) != "2\n" {
+		t.Errorf("Expected 2 runs, got %q", runs)
+	}
+}
+
+func TestGetVideoInfo_NoRetryOnNotFound(t *testing.T) {
+	defer func(bin string, backoff time.Duration) {
+		BinaryPath, RetryBackoff = bin, backoff
+	}(BinaryPath, RetryBackoff)
+
+	counter := filepath.Join(t.TempDir(), "runs")
+	BinaryPath = writeStub(t, `echo run >> `+counter+`
+echo "ERROR: Unable to download webpage: HTTP Error 404: Not Found" >&2; exit 1`)
+	RetryBackoff = time.Millisecond
+
+	defer infoCache.Delete("http://gone.example.com/video")
+	if _, err := GetVideoInfo(context.Background(), "http://gone.example.com/video"); !errors.Is(err, ErrVideoNotFound) {
+		t.Errorf("Expected ErrVideoNotFound, got %v", err)
+	}
+	if runs, _ := os.ReadFile(counter); string(runs) != "run\n" {
+		t.Errorf("Expected a single run, got %q", runs)
+	}
+}
+
+func TestGetVideoInfo_Singleflight(t *testing.T) {
+	defer func(bin string) { BinaryPath = bin }(BinaryPath)
+
+	counter := filepath.Join(t.TempDir(), "runs")
+	runs := func() int {
+		data, _ := os.ReadFile(counter)
+		return strings.Count(string(data), "run")
+	}
+	callConcurrently := func(url string) []error {
+		const callers = 8
+		errs := make([]error, callers)
+		var wg sync.WaitGroup
+		for i := range errs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, errs[i] = GetVideoInfo(context.Background(), url)
+			}(i)
+		}
+		wg.Wait()
+		return errs
+	}
+
+	// Slow enough for all callers to arrive while it's in flight
+	BinaryPath = writeStub(t, `echo run >> `+counter+`
+sleep 0.3
+echo '{"id":"shared"}'`)
+	defer infoCache.Delete("http://popular.example.com/video")
+	for _, err := range callConcurrently("http://popular.example.com/video") {
+		if err != nil {
+			t.Errorf("GetVideoInfo failed: %v", err)
+		}
+	}
+	if n := runs(); n != 1 {
+		t.Errorf("Expected 1 yt-dlp run for concurrent callers, got %d", n)
+	}
+
+	// Errors are shared while in flight too
+	os.Remove(counter)
+	BinaryPath = writeStub(t, `echo run >> `+counter+`
+sleep 0.3
+echo "ERROR: [youtube] abc: Video unavailable" >&2; exit 1`)
+	for _, err := range callConcurrently("http://gone-shared.example.com/video") {
+		if !errors.Is(err, ErrVideoNotFound) {
+			t.Errorf("Expected ErrVideoNotFound, got %v", err)
+		}
+	}
+	if n := runs(); n != 1 {
+		t.Errorf("Expected 1 yt-dlp run for concurrent callers, got %d", n)
+	}
+	infoCache.Delete("http://gone-shared.example.com/video")
+}
+
+func TestGetVideoInfo_NegativeCache(t *testing.T) {
+	defer func(bin string, ttl time.Duration) { BinaryPath, NegativeTTL = bin, ttl }(BinaryPath, NegativeTTL)
+
+	counter := filepath.Join(t.TempDir(), "runs")
+	BinaryPath = writeStub(t, `echo run >> `+counter+`
+echo "ERROR: [youtube] abc: Sign in to confirm your age" >&2; exit 1`)
+	NegativeTTL = time.Minute
+	url := "http://locked.example.com/video"
+	defer infoCache.Delete(url)
+
+	for i := 0; i < 2; i++ {
+		if _, err := GetVideoInfo(context.Background(), url); !errors.Is(err, ErrAuthRequired) {
+			t.Errorf("Call %d: Expected ErrAuthRequired, got %v", i+1, err)
+		}
+	}
+	if runs, _ := os.ReadFile(counter); string(runs) != "run\n" {
+		t.Errorf("Expected the second call to be served from the negative cache, got runs %q", runs)
+	}
+
+	// Negative entries expire sooner than regular ones
+	NegativeTTL = 0
+	GetVideoInfo(context.Background(), url)
+	if runs, _ := os.ReadFile(counter); string(runs) != "run\nrun\n" {
+		t.Errorf("Expected a new run after the negative TTL, got runs %q", runs)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	defer func(old string) { BinaryPath = old }(BinaryPath)
+	BinaryPath = writeStub(t, "echo 2024.08.06")
+
+	v, err := Version(context.Background())
+	if err != nil {
+		t.Fatalf("Version failed: %v", err)
+	}
+	if v != "2024.08.06" {
+		t.Errorf("Expected 2024.08.06, got %q", v)
+	}
+}
+
+func TestParseQuality(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Quality
+		wantErr error
+	}{
+		{in: "low", want: QualityLow},
+		{in: "medium", want: QualityMedium},
+		{in: "high", want: QualityHigh},
+		{in: "", want: QualityHigh},
+		{in: "ultra", want: QualityHigh, wantErr: ErrUnknownQuality},
+		{in: "HIGH", want: QualityHigh, wantErr: ErrUnknownQuality},
+	}
+	for _, tt := range tests {
+		got, err := ParseQuality(tt.in)
+		if got != tt.want || !errors.Is(err, tt.wantErr) {
+			t.Errorf("ParseQuality(%q) = %q, %v; want %q, %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
 func TestSelectFormats(t *testing.T) {
 	formats := []Format{
 		{FormatID: "1", VCodec: "vp9", ACodec: "none", Width: 3840, Height: 2160, TBR: 5000},         // 4K VP9
@@ -82,6 +529,200 @@ func TestSelectFormats(t *testing.T) {
 	if v.FormatID != "2" {
 		t.Errorf("H264 Preference: Expected video 2 (1080p H264), got %s", v.FormatID)
 	}
+
+	// Test 5: Medium Quality tie-break
+	// 1080p and 480p are both 360 away from 720p, the lower one wins.
+	formats3 := []Format{
+		{FormatID: "137", VCodec: "avc1.640028", ACodec: "none", Width: 1920, Height: 1080, TBR: 3000},
+		{FormatID: "135", VCodec: "avc1.4d401e", ACodec: "none", Width: 854, Height: 480, TBR: 900},
+	}
+	v, _ = SelectFormats(&Info{Formats: formats3}, QualityMedium)
+	if v.FormatID != "135" {
+		t.Errorf("Medium tie-break: Expected video 135 (480p), got %s", v.FormatID)
+	}
+}
+
+func TestSelectFormatsByHeight(t *testing.T) {
+	info := &Info{Formats: []Format{
+		{FormatID: "137", VCodec: "avc1.640028", ACodec: "none", Width: 1920, Height: 1080, TBR: 3000},
+		{FormatID: "136", VCodec: "avc1.4d401f", ACodec: "none", Width: 1280, Height: 720, TBR: 1500},
+		{FormatID: "135", VCodec: "avc1.4d401e", ACodec: "none", Width: 854, Height: 480, TBR: 900},
+		{FormatID: "140", VCodec: "none", ACodec: "mp4a.40.2", TBR: 129},
+	}}
+
+	for target, want := range map[int]string{540: "135", 600: "135", 700: "136", 2160: "137", 144: "135"} {
+		sel := Select(info, QualityHigh, SelectOptions{Height: target})
+		v, a := sel.Video, sel.Audio
+		if v == nil || v.FormatID != want {
+			t.Errorf("height=%d: Expected video %s, got %v", target, want, v)
+		}
+		if a == nil || a.FormatID != "140" {
+			t.Errorf("height=%d: Expected audio 140, got %v", target, a)
+		}
+	}
+}
+
+func TestSelectFormats_LivePrefersCopy(t *testing.T) {
+	info := &Info{IsLive: true, Formats: []Format{
+		{FormatID: "vp9-1080", VCodec: "vp9", ACodec: "none", Width: 1920, Height: 1080, TBR: 4000},
+		{FormatID: "avc-720", VCodec: "avc1.4d401f", ACodec: "none", Width: 1280, Height: 720, TBR: 2500},
+	}}
+	if v, _ := SelectFormats(info, QualityHigh); v.FormatID != "avc-720" {
+		t.Errorf("Live: Expected copyable avc-720, got %s", v.FormatID)
+	}
+
+	info.IsLive = false
+	if v, _ := SelectFormats(info, QualityHigh); v.FormatID != "vp9-1080" {
+		t.Errorf("VOD: Expected highest resolution vp9-1080, got %s", v.FormatID)
+	}
+}
+
+func TestSelectFormats_CodecPreference(t *testing.T) {
+	info := &Info{Formats: []Format{
+		{FormatID: "137", VCodec: "avc1.640028", ACodec: "none", Width: 1920, Height: 1080, TBR: 3000},
+		{FormatID: "248", VCodec: "vp9", ACodec: "none", Width: 1920, Height: 1080, TBR: 3500},
+		{FormatID: "399", VCodec: "av01.0.08M.08", ACodec: "none", Width: 1920, Height: 1080, TBR: 2500},
+		{FormatID: "136", VCodec: "avc1.4d401f", ACodec: "none", Width: 1280, Height: 720, TBR: 9000},
+	}}
+
+	tests := map[CodecPreference]string{
+		CodecPrefH264:    "137",
+		CodecPrefBitrate: "248", // Higher TBR VP9 beats H264 at the same resolution
+		CodecPrefVP9:     "248",
+		CodecPrefAV1:     "399",
+	}
+	for pref, want := range tests {
+		// Resolution still comes first, the 720p format never wins on bitrate
+		if v := Select(info, QualityHigh, SelectOptions{CodecPref: pref}).Video; v.FormatID != want {
+			t.Errorf("%s: Expected video %s, got %s", pref, want, v.FormatID)
+		}
+	}
+
+	if _, ok := ParseCodecPreference("hevc"); ok {
+		t.Error("Expected unknown preference to be rejected")
+	}
+}
+
+func TestSelectFormats_AllowAV1(t *testing.T) {
+	defer func(old bool) { codec.AllowAV1 = old }(codec.AllowAV1)
+
+	info := &Info{Formats: []Format{
+		{FormatID: "137", VCodec: "avc1.640028", ACodec: "none", Width: 1920, Height: 1080, TBR: 3000},
+		{FormatID: "399", VCodec: "av01.0.08M.08", ACodec: "none", Width: 1920, Height: 1080, TBR: 3500},
+	}}
+
+	codec.AllowAV1 = false
+	if v, _ := SelectFormats(info, QualityHigh); v.FormatID != "137" {
+		t.Errorf("AV1 disallowed: Expected H264 format 137, got %s", v.FormatID)
+	}
+
+	// With AV1 allowed, the higher bitrate wins among passthrough codecs
+	codec.AllowAV1 = true
+	if v, _ := SelectFormats(info, QualityHigh); v.FormatID != "399" {
+		t.Errorf("AV1 allowed: Expected AV1 format 399, got %s", v.FormatID)
+	}
+}
+
+func TestSelectFormats_MaxHeight(t *testing.T) {
+	defer func(old int) { MaxHeight = old }(MaxHeight)
+
+	info := &Info{Formats: []Format{
+		{FormatID: "313", VCodec: "vp9", ACodec: "none", Width: 3840, Height: 2160, TBR: 12000},
+		{FormatID: "137", VCodec: "avc1.640028", ACodec: "none", Width: 1920, Height: 1080, TBR: 3000},
+		{FormatID: "136", VCodec: "avc1.4d401f", ACodec: "none", Width: 1280, Height: 720, TBR: 1500},
+	}}
+
+	MaxHeight = 1080
+	if v, _ := SelectFormats(info, QualityHigh); v == nil || v.FormatID != "137" {
+		t.Errorf("High Quality capped: Expected 1080p format 137, got %v", v)
+	}
+	// The closest match is searched among the remaining formats only
+	MaxHeight = 720
+	info.Formats = append(info.Formats, Format{FormatID: "271", VCodec: "vp9", ACodec: "none", Width: 2560, Height: 1440})
+	if v, _ := SelectFormats(info, QualityMedium); v == nil || v.FormatID != "136" {
+		t.Errorf("Medium Quality capped: Expected 720p format 136, got %v", v)
+	}
+	MaxHeight = 480
+	if v, _ := SelectFormats(info, QualityHigh); v != nil {
+		t.Errorf("Expected no video when every format is above the cap, got %s", v.FormatID)
+	}
+	// That's the cap's doing, not a video without formats
+	if err := Select(info, QualityHigh, SelectOptions{}).Err(); !errors.Is(err, ErrFormatNotFound) {
+		t.Errorf("Expected ErrFormatNotFound with every format above the cap, got %v", err)
+	}
+}
+
+func TestSelect_PreferWebM(t *testing.T) {
+	info := &Info{Formats: []Format{
+		{FormatID: "18", VCodec: "avc1.42001E", ACodec: "mp4a.40.2", Width: 640, Height: 360, TBR: 500},
+		{FormatID: "134", VCodec: "avc1.4d401e", ACodec: "none", Width: 640, Height: 360, TBR: 400},
+		{FormatID: "243", VCodec: "vp9", ACodec: "none", Width: 640, Height: 360, TBR: 300},
+		{FormatID: "137", VCodec: "avc1.640028", ACodec: "none", Width: 1920, Height: 1080, TBR: 3000},
+		{FormatID: "139", VCodec: "none", ACodec: "mp4a.40.5", ABR: 48},
+		{FormatID: "140", VCodec: "none", ACodec: "mp4a.40.2", ABR: 129},
+		{FormatID: "249", VCodec: "none", ACodec: "opus", ABR: 50},
+		{FormatID: "251", VCodec: "none", ACodec: "opus", ABR: 160},
+	}}
+	sel := Select(info, QualityLow, SelectOptions{CodecPref: CodecPrefVP9, AudioCodec: "opus"})
+	if sel.Video == nil || sel.Video.FormatID != "243" {
+		t.Errorf("expected VP9 video 243, got %v", sel.Video)
+	}
+	if sel.Audio == nil || sel.Audio.FormatID != "249" {
+		t.Errorf("expected the smaller Opus audio 249, got %v", sel.Audio)
+	}
+
+	// Without any Opus track the usual audio is picked
+	info.Formats = info.Formats[:6]
+	want := Select(info, QualityLow, SelectOptions{CodecPref: CodecPrefVP9}).Audio
+	if got := Select(info, QualityLow, SelectOptions{CodecPref: CodecPrefVP9, AudioCodec: "opus"}).Audio; got == nil || got.FormatID != want.FormatID {
+		t.Errorf("expected the fallback %v, got %v", want, got)
+	}
+}
+
+func TestSelect_StoryboardsOnly(t *testing.T) {
+	info := &Info{Formats: []Format{
+		{FormatID: "sb0", VCodec: "none", ACodec: "none", Ext: "mhtml", Width: 160, Height: 90},
+		{FormatID: "sb1", VCodec: "none", ACodec: "none", Ext: "mhtml", Width: 320, Height: 180},
+	}}
+	sel := Select(info, QualityHigh, SelectOptions{})
+	if sel.Video != nil || sel.Audio != nil {
+		t.Fatalf("expected nothing selected from storyboards, got %+v", sel)
+	}
+	if err := sel.Err(); err != ErrNoUsableFormats {
+		t.Errorf("got %v, want ErrNoUsableFormats", err)
+	}
+	info.Formats = append(info.Formats, Format{FormatID: "18", VCodec: "avc1.42001E", ACodec: "mp4a.40.2", Width: 640, Height: 360})
+	if err := Select(info, QualityHigh, SelectOptions{}).Err(); err != nil {
+		t.Errorf("expected no error for a playable video, got %v", err)
+	}
+}
+
+func TestSelectFormats_LowPrefersProgressive(t *testing.T) {
+	info := &Info{Formats: []Format{
+		{FormatID: "18", VCodec: "avc1.42001E", ACodec: "mp4a.40.2", Width: 640, Height: 360, TBR: 500},
+		{FormatID: "22", VCodec: "avc1.64001F", ACodec: "mp4a.40.2", Width: 1280, Height: 720, TBR: 1200},
+		{FormatID: "243", VCodec: "vp9", ACodec: "none", Width: 640, Height: 360, TBR: 300},
+		{FormatID: "134", VCodec: "avc1.4d401e", ACodec: "none", Width: 640, Height: 360, TBR: 400},
+		{FormatID: "249", VCodec: "none", ACodec: "opus", TBR: 50},
+	}}
+
+	v, a := SelectFormats(info, QualityLow)
+	if v == nil || v.FormatID != "18" || a != v {
+		t.Errorf("Low Quality: Expected progressive 18 as single input, got %v / %v", v, a)
+	}
+
+	// 720p progressive is too large for low quality
+	info.Formats = info.Formats[1:]
+	if v, _ = SelectFormats(info, QualityLow); v == nil || v.FormatID != "134" {
+		t.Errorf("Low Quality: Expected separate video 134 over 720p progressive, got %v", v)
+	}
+
+	// Without any progressive format, separate streams are used
+	info.Formats = info.Formats[1:]
+	v, a = SelectFormats(info, QualityLow)
+	if v == nil || v.FormatID != "134" || a == nil || a.FormatID != "249" {
+		t.Errorf("Low Quality fallback: Expected 134 + 249, got %v / %v", v, a)
+	}
 }
 
 func TestSelectFormats_AudioPreference(t *testing.T) {
@@ -92,7 +733,7 @@ func TestSelectFormats_AudioPreference(t *testing.T) {
 			VCodec:   "avc1.4D401E",
 			ACodec:   "mp4a.40.2",
 			Width:    634, Height: 480,
-			TBR:      572, ABR: 128,
+			TBR: 572, ABR: 128,
 			Protocol: "m3u8",
 		},
 		// Audio only format: HTTPS, Lower TBR (e.g. 129k)
@@ -113,3 +754,437 @@ func TestSelectFormats_AudioPreference(t *testing.T) {
 		t.Errorf("Expected audio format 140 (Audio Only, HTTPS), got %s (Protocol: %s, VCodec: %s)", audio.FormatID, audio.Protocol, audio.VCodec)
 	}
 }
+
+func TestSortAudios_HLS(t *testing.T) {
+	// A higher bitrate HLS audio now wins over plain HTTPS
+	audios := []Format{
+		{FormatID: "140", VCodec: "none", ACodec: "mp4a.40.2", ABR: 129, Protocol: "https"},
+		{FormatID: "hls-160", VCodec: "none", ACodec: "mp4a.40.2", ABR: 160, Protocol: "m3u8_native"},
+	}
+	sortAudios(audios)
+	if audios[0].FormatID != "hls-160" {
+		t.Errorf("Expected higher bitrate HLS audio first, got %s", audios[0].FormatID)
+	}
+
+	// At the same bitrate, HTTPS is still preferred
+	audios = []Format{
+		{FormatID: "hls-129", VCodec: "none", ACodec: "mp4a.40.2", ABR: 129, Protocol: "m3u8_native"},
+		{FormatID: "140", VCodec: "none", ACodec: "mp4a.40.2", ABR: 129, Protocol: "https"},
+	}
+	sortAudios(audios)
+	if audios[0].FormatID != "140" {
+		t.Errorf("Expected HTTPS audio first on equal bitrate, got %s", audios[0].FormatID)
+	}
+}
+
+func TestSelectFormatByID(t *testing.T) {
+	formats := []Format{
+		{FormatID: "137", VCodec: "avc1.640028", ACodec: "none", Width: 1920, Height: 1080, TBR: 3000},
+		{FormatID: "18", VCodec: "avc1.42001E", ACodec: "mp4a.40.2", Width: 640, Height: 360, TBR: 500},
+		{FormatID: "140", VCodec: "none", ACodec: "mp4a.40.2", TBR: 129, Protocol: "https"},
+		{FormatID: "251", VCodec: "none", ACodec: "opus", TBR: 160, Protocol: "https"},
+	}
+	info := &Info{Formats: formats}
+
+	// Video-only format gets paired with the best audio
+	v, a, err := SelectFormatByID(info, "137")
+	if err != nil {
+		t.Fatalf("SelectFormatByID failed: %v", err)
+	}
+	if v.FormatID != "137" {
+		t.Errorf("Expected video 137, got %s", v.FormatID)
+	}
+	if a == nil || a.FormatID != "251" {
+		t.Errorf("Expected best audio 251, got %v", a)
+	}
+
+	// Pre-merged format is used for both
+	v, a, err = SelectFormatByID(info, "18")
+	if err != nil {
+		t.Fatalf("SelectFormatByID failed: %v", err)
+	}
+	if v.FormatID != "18" || a != v {
+		t.Errorf("Expected merged format 18 for both, got video %s, audio %v", v.FormatID, a)
+	}
+
+	// Audio-only format returns no video
+	v, a, err = SelectFormatByID(info, "140")
+	if err != nil {
+		t.Fatalf("SelectFormatByID failed: %v", err)
+	}
+	if v != nil || a == nil || a.FormatID != "140" {
+		t.Errorf("Expected audio-only 140, got video %v, audio %v", v, a)
+	}
+
+	// Unknown format
+	if _, _, err := SelectFormatByID(info, "999"); !errors.Is(err, ErrFormatNotFound) {
+		t.Errorf("Expected ErrFormatNotFound, got %v", err)
+	}
+}
+
+func TestSelectAudioFormat(t *testing.T) {
+	info := &Info{Formats: []Format{
+		{FormatID: "18", VCodec: "avc1.42001E", ACodec: "mp4a.40.2", Width: 640, Height: 360, TBR: 500},
+		{FormatID: "137", VCodec: "avc1.640028", ACodec: "none", Width: 1920, Height: 1080, TBR: 3000},
+		{FormatID: "140", VCodec: "none", ACodec: "mp4a.40.2", TBR: 129, Protocol: "https"},
+	}}
+
+	// Audio-only beats the higher bitrate merged format
+	if a := SelectAudioFormat(info, ""); a == nil || a.FormatID != "140" {
+		t.Errorf("Expected audio 140, got %v", a)
+	}
+
+	if a := SelectAudioFormat(&Info{Formats: info.Formats[1:2]}, ""); a != nil {
+		t.Errorf("Expected no audio for video-only info, got %s", a.FormatID)
+	}
+}
+
+func TestSelect_AudioLanguage(t *testing.T) {
+	info := &Info{Formats: []Format{
+		{FormatID: "137", URL: "http://v", VCodec: "avc1.640028", ACodec: "none", Width: 1920, Height: 1080, TBR: 3000},
+		{FormatID: "140-en", URL: "http://en", VCodec: "none", ACodec: "mp4a.40.2", ABR: 129, Language: "en"},
+		{FormatID: "139-es", URL: "http://es-low", VCodec: "none", ACodec: "mp4a.40.5", ABR: 48, Language: "es"},
+		{FormatID: "140-es", URL: "http://es", VCodec: "none", ACodec: "mp4a.40.2", ABR: 129, Language: "es-419"},
+	}}
+
+	tests := []struct {
+		name string
+		lang string
+		want string
+	}{
+		{"default track", "", "140-en"},
+		{"spanish", "es", "140-es"},
+		{"case and region", "ES-419", "140-es"},
+		{"unavailable falls back", "fr", "140-en"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, opts := range []SelectOptions{{Language: tt.lang}, {Language: tt.lang, Height: 720}} {
+				sel := Select(info, QualityHigh, opts)
+				if sel.Audio == nil || sel.Audio.FormatID != tt.want {
+					t.Errorf("%+v: got audio %v, want %s", opts, sel.Audio, tt.want)
+				}
+			}
+			if a := SelectAudioFormat(info, tt.lang); a == nil || a.FormatID != tt.want {
+				t.Errorf("audio only: got %v, want %s", a, tt.want)
+			}
+		})
+	}
+
+	// Low quality still takes the lowest bitrate track, in the requested language
+	if sel := Select(info, QualityLow, SelectOptions{Language: "es"}); sel.Audio == nil || sel.Audio.FormatID != "139-es" {
+		t.Errorf("low quality: got audio %v, want 139-es", sel.Audio)
+	}
+}
+
+func TestSelectSubtitle(t *testing.T) {
+	var info Info
+	data := `{"subtitles": {"en": [{"ext": "json3", "url": "http://subs/en.json3"}, {"ext": "vtt", "url": "http://subs/en.vtt"}]},
+		"automatic_captions": {"en": [{"ext": "vtt", "url": "http://auto/en.vtt"}], "de": [{"ext": "vtt", "url": "http://auto/de.vtt"}]}}`
+	if err := json.Unmarshal([]byte(data), &info); err != nil {
+		t.Fatal(err)
+	}
+
+	// Uploaded subtitles win over automatic captions, and only vtt is used
+	if s, err := SelectSubtitle(&info, "en"); err != nil || s.URL != "http://subs/en.vtt" {
+		t.Errorf("Expected uploaded en.vtt, got %v, %v", s, err)
+	}
+	if s, err := SelectSubtitle(&info, "de"); err != nil || s.URL != "http://auto/de.vtt" {
+		t.Errorf("Expected automatic de.vtt, got %v, %v", s, err)
+	}
+	if _, err := SelectSubtitle(&info, "fr"); !errors.Is(err, ErrNoSubtitles) {
+		t.Errorf("Expected ErrNoSubtitles, got %v", err)
+	}
+}
+
+func TestSelectThumbnail(t *testing.T) {
+	info := &Info{
+		Thumbnail: "http://img/default.jpg",
+		Thumbnails: []Thumbnail{
+			{URL: "http://img/big.webp", Width: 1920, Height: 1080, Preference: -1},
+			{URL: "http://img/small.jpg", Width: 320, Height: 180},
+			{URL: "http://img/medium.jpg", Width: 640, Height: 360},
+		},
+	}
+	if got := SelectThumbnail(info); got != "http://img/medium.jpg" {
+		t.Errorf("got %s, want the largest preferred thumbnail", got)
+	}
+	if got := SelectThumbnail(&Info{Thumbnail: "http://img/default.jpg"}); got != "http://img/default.jpg" {
+		t.Errorf("got %s, want fallback to thumbnail field", got)
+	}
+}
+
+func TestPlaylistUnmarshal(t *testing.T) {
+	data := `{"_type": "playlist", "id": "PL123", "title": "Mix", "entries": [
+		{"_type": "url", "ie_key": "Youtube", "id": "a1", "title": "First", "url": "https://www.youtube.com/watch?v=a1", "duration": 61},
+		{"_type": "url", "ie_key": "Youtube", "id": "b2", "title": "Second", "url": "https://www.youtube.com/watch?v=b2", "duration": null}
+	]}`
+	var p Playlist
+	if err := json.Unmarshal([]byte(data), &p); err != nil {
+		t.Fatalf("Failed to unmarshal: %v", err)
+	}
+	if p.Type != "playlist" || p.ID != "PL123" || p.Title != "Mix" {
+		t.Errorf("Unexpected playlist fields: %+v", p)
+	}
+	want := []PlaylistEntry{
+		{ID: "a1", Title: "First", URL: "https://www.youtube.com/watch?v=a1"},
+		{ID: "b2", Title: "Second", URL: "https://www.youtube.com/watch?v=b2"},
+	}
+	if !slices.Equal(p.Entries, want) {
+		t.Errorf("Got entries %+v, want %+v", p.Entries, want)
+	}
+}
+
+func TestGetPlaylist_SingleVideo(t *testing.T) {
+	defer func(bin string) { BinaryPath = bin }(BinaryPath)
+
+	// A plain video URL is listed as a playlist of one
+	BinaryPath = writeStub(t, `case "$*" in *--flat-playlist*) ;; *) exit 1 ;; esac
+echo '{"_type": "video", "id": "v1", "title": "Solo", "webpage_url": "https://example.com/v1"}'`)
+
+	p, err := GetPlaylist(context.Background(), "https://example.com/v1?share=x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []PlaylistEntry{{ID: "v1", Title: "Solo", URL: "https://example.com/v1"}}
+	if !slices.Equal(p.Entries, want) {
+		t.Errorf("Got entries %+v, want %+v", p.Entries, want)
+	}
+}
+
+func TestSelectFormats_AudioMissing(t *testing.T) {
+	info := &Info{Formats: []Format{
+		{FormatID: "137", URL: "http://cdn/137", VCodec: "avc1.640028", ACodec: "none", Width: 1920, Height: 1080},
+		{FormatID: "136", URL: "http://cdn/136", VCodec: "avc1.4d401f", ACodec: "none", Width: 1280, Height: 720},
+	}}
+	for _, q := range []Quality{QualityHigh, QualityMedium, QualityLow} {
+		sel := Select(info, q, SelectOptions{})
+		if sel.Video == nil || sel.Audio != nil || !sel.AudioMissing {
+			t.Errorf("%s: got %+v, want video with audio missing", q, sel)
+		}
+	}
+	if sel := Select(info, QualityHigh, SelectOptions{Height: 720}); !sel.AudioMissing {
+		t.Errorf("by height: expected audio missing, got %+v", sel)
+	}
+
+	// Progressive formats carry their own audio
+	info.Formats = append(info.Formats, Format{FormatID: "18", URL: "http://cdn/18", VCodec: "avc1.42001E", ACodec: "mp4a.40.2", Width: 640, Height: 360})
+	if sel := Select(info, QualityLow, SelectOptions{}); sel.AudioMissing || sel.Audio == nil {
+		t.Errorf("progressive: got %+v, want audio", sel)
+	}
+
+	// Nothing to stream at all isn't reported as missing audio
+	if sel := Select(&Info{}, QualityHigh, SelectOptions{}); sel.AudioMissing {
+		t.Errorf("empty info: got %+v", sel)
+	}
+}
+
+func TestSelect_Flags(t *testing.T) {
+	h264 := Format{FormatID: "137", URL: "http://cdn/137", VCodec: "avc1.640028", ACodec: "none", Width: 1920, Height: 1080}
+	vp9 := Format{FormatID: "248", URL: "http://cdn/248", VCodec: "vp09.00.40.08", ACodec: "none", Width: 1920, Height: 1080}
+	aac := Format{FormatID: "140", URL: "http://cdn/140", VCodec: "none", ACodec: "mp4a.40.2", TBR: 129}
+	opus := Format{FormatID: "251", URL: "http://cdn/251", VCodec: "none", ACodec: "opus", TBR: 160}
+	progressive := Format{FormatID: "18", URL: "http://cdn/18", VCodec: "avc1.42001E", ACodec: "mp4a.40.2", Width: 640, Height: 360}
+
+	tests := []struct {
+		name    string
+		formats []Format
+		quality Quality
+		want    Selection
+	}{
+		{"h264 and aac", []Format{h264, aac}, QualityHigh, Selection{}},
+		{"vp9 and opus", []Format{vp9, opus}, QualityHigh, Selection{TranscodeVideo: true, TranscodeAudio: true}},
+		{"vp9 and aac", []Format{vp9, aac}, QualityHigh, Selection{TranscodeVideo: true}},
+		{"h264 and opus", []Format{h264, opus}, QualityHigh, Selection{TranscodeAudio: true}},
+		{"progressive", []Format{h264, aac, progressive}, QualityLow, Selection{SameInput: true}},
+		{"video only", []Format{vp9}, QualityHigh, Selection{TranscodeVideo: true, AudioMissing: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sel := Select(&Info{Formats: tt.formats}, tt.quality, SelectOptions{})
+			if sel.Video == nil {
+				t.Fatal("no video selected")
+			}
+			got := Selection{
+				AudioMissing:   sel.AudioMissing,
+				TranscodeVideo: sel.TranscodeVideo,
+				TranscodeAudio: sel.TranscodeAudio,
+				SameInput:      sel.SameInput,
+			}
+			if got != tt.want {
+				t.Errorf("got flags %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseFormatURLs(t *testing.T) {
+	tests := []struct {
+		name         string
+		output       string
+		video, audio string
+		err          bool
+	}{
+		{"merged", "https://cdn/video?sig=1\nhttps://cdn/audio?sig=2\n", "https://cdn/video?sig=1", "https://cdn/audio?sig=2", false},
+		{"single", "https://cdn/progressive\n", "https://cdn/progressive", "", false},
+		{"blank lines", "\nhttps://cdn/v\r\n\nhttps://cdn/a\n\n", "https://cdn/v", "https://cdn/a", false},
+		{"empty", "", "", "", true},
+		{"too many", "a\nb\nc\n", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			video, audio, err := parseFormatURLs([]byte(tt.output))
+			if (err != nil) != tt.err {
+				t.Fatalf("got error %v, want error %v", err, tt.err)
+			}
+			if video != tt.video || audio != tt.audio {
+				t.Errorf("got (%q, %q), want (%q, %q)", video, audio, tt.video, tt.audio)
+			}
+		})
+	}
+}
+
+func TestResolveFormatURLs(t *testing.T) {
+	defer func(bin string) { BinaryPath = bin }(BinaryPath)
+
+	// The selector must reach yt-dlp as a single option, never as its own flag
+	BinaryPath = writeStub(t, `[ "$1" = "--format=-bv*+ba/b" ] && [ "$2" = "-g" ] || exit 1
+printf 'https://cdn/v\nhttps://cdn/a\n'`)
+
+	video, audio, err := ResolveFormatURLs(context.Background(), "https://example.com/v", "-bv*+ba/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if video != "https://cdn/v" || audio != "https://cdn/a" {
+		t.Errorf("got (%q, %q)", video, audio)
+	}
+}
+
+func TestResolveFormatURLs_Simple(t *testing.T) {
+	defer func(bin string) { BinaryPath = bin }(BinaryPath)
+
+	BinaryPath = writeStub(t, `[ "$1" = "--format=b" ] && [ "$2" = "-g" ] && [ "$3" = "--no-playlist" ] || exit 1
+printf 'https://cdn/merged\n'`)
+
+	video, audio, err := ResolveFormatURLs(context.Background(), "https://example.com/v", SimpleSelector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if video != "https://cdn/merged" || audio != "" {
+		t.Errorf("got (%q, %q), want a single merged URL", video, audio)
+	}
+}
+
+// stubRunner replaces runCommand for the duration of the test
+func stubRunner(t *testing.T, run func(name string, args []string) (stdout, stderr []byte, err error)) {
+	t.Helper()
+	old := runCommand
+	runCommand = func(ctx context.Context, name string, args ...string) ([]byte, []byte, error) {
+		return run(name, args)
+	}
+	t.Cleanup(func() { runCommand = old })
+}
+
+func TestGetVideoInfo_Runner(t *testing.T) {
+	defer func(n int) { MaxRetries = n }(MaxRetries)
+	MaxRetries = 0
+	errExit := errors.New("exit status 1")
+
+	tests := []struct {
+		name             string
+		stdout           string
+		stderr           string
+		err              error
+		want             error
+		wrapped          bool
+		wantUnmarshalErr bool
+	}{
+		{name: "unmarshal", stdout: `{"id":"abc","title":"Runner","duration":12.5,"formats":[{"format_id":"18","url":"http://cdn/18","vcodec":"avc1.42001E","acodec":"mp4a.40.2"}]}`},
+		{name: "not found", stderr: "ERROR: [youtube] abc: Video unavailable", err: errExit, want: ErrVideoNotFound},
+		{name: "auth", stderr: "ERROR: Sign in to confirm your age", err: errExit, want: ErrAuthRequired},
+		{name: "generic failure", stderr: "ERROR: something broke", err: errExit, want: errExit, wrapped: true},
+		{name: "bad json", stdout: `{"id":`, wantUnmarshalErr: true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url := fmt.Sprintf("http://example.com/runner-%d", i)
+			var gotName string
+			var gotArgs []string
+			stubRunner(t, func(name string, args []string) ([]byte, []byte, error) {
+				gotName, gotArgs = name, args
+				return []byte(tt.stdout), []byte(tt.stderr), tt.err
+			})
+
+			info, err := GetVideoInfo(context.Background(), url)
+			if gotName != BinaryPath || len(gotArgs) == 0 || gotArgs[0] != "-J" || gotArgs[len(gotArgs)-1] != url {
+				t.Errorf("unexpected command %s %v", gotName, gotArgs)
+			}
+
+			switch {
+			case tt.wantUnmarshalErr:
+				if err == nil || !strings.Contains(err.Error(), "unmarshal") {
+					t.Errorf("expected an unmarshal error, got %v", err)
+				}
+			case tt.want == nil:
+				if err != nil {
+					t.Fatal(err)
+				}
+				if info.ID != "abc" || info.Title != "Runner" || info.Duration != 12.5 || len(info.Formats) != 1 || info.Formats[0].URL != "http://cdn/18" {
+					t.Errorf("unexpected info %+v", info)
+				}
+			default:
+				if !errors.Is(err, tt.want) {
+					t.Errorf("got error %v, want %v", err, tt.want)
+				}
+				if tt.wrapped && !strings.Contains(err.Error(), "failed to run yt-dlp") {
+					t.Errorf("expected the failure to be wrapped, got %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestFormat_EstimatedSize(t *testing.T) {
+	tests := []struct {
+		name   string
+		format Format
+		want   int64
+	}{
+		{"exact", Format{Filesize: 1000, FilesizeApprox: 900, TBR: 8}, 1000},
+		{"approximate", Format{FilesizeApprox: 900, TBR: 8}, 900},
+		// 2000 kbit/s for 60 seconds
+		{"from bitrate", Format{TBR: 2000}, 15_000_000},
+		{"unknown", Format{}, 0},
+	}
+	for _, tt := range tests {
+		if got := tt.format.EstimatedSize(60); got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	// Without a duration the bitrate says nothing about the size
+	if got := (&Format{TBR: 2000}).EstimatedSize(0); got != 0 {
+		t.Errorf("unknown duration: got %d, want 0", got)
+	}
+}
+
+func TestGetVideoInfo_Playlist(t *testing.T) {
+	defer func(n int) { MaxRetries = n }(MaxRetries)
+	MaxRetries = 0
+	calls := 0
+	stubRunner(t, func(name string, args []string) ([]byte, []byte, error) {
+		calls++
+		return []byte(`{"_type":"playlist","id":"PL1","title":"Mix","entries":[{"id":"a","url":"http://example.com/a"}]}`), nil, nil
+	})
+
+	const url = "http://example.com/playlist-shaped"
+	defer infoCache.Delete(url)
+	for range 2 {
+		if _, err := GetVideoInfo(context.Background(), url); !errors.Is(err, ErrIsPlaylist) {
+			t.Fatalf("expected ErrIsPlaylist, got %v", err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("expected the error to be cached, yt-dlp ran %d times", calls)
+	}
+}
@@ -1,27 +1,183 @@
 package main
 
 import (
+	"cmp"
+	"context"
+	"encoding/json"
 	"errors"
-	"log"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
 	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"syscall"
 	"time"
+	"video-microservice/internal/codec"
+	"video-microservice/internal/filecache"
+	"video-microservice/internal/metrics"
+	"video-microservice/internal/netguard"
+	"video-microservice/internal/redact"
 	"video-microservice/internal/streamer"
 	"video-microservice/internal/ytdlp"
 )
 
+// shutdownTimeout is how long in-flight streams get to finish on shutdown
+var shutdownTimeout = 30 * time.Second
+
+// streamSlots limits the number of concurrent ffmpeg processes, since
+// transcoding is CPU heavy. Requests wait up to streamSlotWait for a free
+// slot before being rejected with 503.
+var (
+	streamSlots    = newSemaphore(runtime.NumCPU())
+	streamSlotWait = 2 * time.Second
+)
+
+// proxyProgressive serves progressive MP4 sources that need no changes
+// straight from the CDN instead of through ffmpeg
+var proxyProgressive = true
+
+// strictQuality rejects unknown quality values instead of treating them as high.
+// Clients can also opt in per request with strict=true.
+var strictQuality bool
+
+// retryAfterSeconds is suggested to clients rejected because the server is busy
+const retryAfterSeconds = 5
+
+// Indirections over the external tools, and the caches in front of them, so
+// handlers can be tested without them
+var (
+	getVideoInfo      = ytdlp.GetVideoInfo
+	selectFormats     = ytdlp.SelectCached
+	getPlaylist       = ytdlp.GetPlaylist
+	resolveFormatURLs = ytdlp.ResolveFormatURLs
+	streamVideo       = streamer.StreamVideo
+	proxyStream       = streamer.ProxyStream
+	probeMedia        = streamer.Probe
+)
+
 func main() {
-	http.HandleFunc("/video", videoHandler)
+	configPath := flag.String("config", os.Getenv("DLP_CONFIG"), "JSON config file, overridden by DLP_* environment variables")
+	flag.Parse()
+
+	cfg, err := LoadConfig(*configPath)
+	if err != nil {
+		fatal(err)
+	}
+	setupLogging(cfg.LogFormat)
+	cfg.apply()
+	// Media URLs come from pages anyone can write, they must stay off internal hosts
+	netguard.Blocked = netguard.IsInternal
+	if err := openOutputCache(); err != nil {
+		fatal(err)
+	}
+
+	if err := checkDependencies(); err != nil {
+		fatal(err)
+	}
+	tools = detectToolVersions()
+	slog.Info("Detected tools", "ytdlp", tools.YtDlp, "ffmpeg", tools.FFmpeg)
+	warmExtractors()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	ytdlp.StartCacheSweeper(ctx)
+	if rateLimitPerMinute > 0 {
+		videoLimiter = newIPLimiter(float64(rateLimitPerMinute)/60, rateLimitBurst)
+		videoLimiter.startPruner(ctx, time.Minute)
 	}
 
-	log.Printf("Server listening on port %s", port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		log.Fatal(err)
+	ln, err := net.Listen("tcp", ":"+cfg.Port)
+	if err != nil {
+		fatal(err)
+	}
+
+	slog.Info("Server listening", "port", cfg.Port)
+	if err := serve(ctx, ln, newMux(), shutdownTimeout); err != nil {
+		fatal(err)
 	}
+	slog.Info("Server stopped")
+}
+
+// fatal logs err and exits, slog has no Fatal of its own
+func fatal(err error) {
+	slog.Error(err.Error())
+	os.Exit(1)
+}
+
+// checkDependencies verifies the external tools are installed,
+// so a broken deployment fails at startup rather than on the first request.
+func checkDependencies() error {
+	for _, bin := range []string{streamer.FFmpegPath, ytdlp.BinaryPath} {
+		if _, err := exec.LookPath(bin); err != nil {
+			return fmt.Errorf("required binary %q not found in PATH: %w", bin, err)
+		}
+	}
+	return nil
+}
+
+// newMux routes every endpoint, behind the request id and CORS middleware
+func newMux() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/video", instrumentVideo(rateLimit(videoLimiter, cancelable(http.HandlerFunc(videoHandler)))))
+	mux.Handle("POST /cancel", rateLimit(videoLimiter, http.HandlerFunc(cancelHandler)))
+	mux.Handle("POST /prefetch", rateLimit(videoLimiter, http.HandlerFunc(prefetchHandler)))
+	mux.HandleFunc("/formats", formatsHandler)
+	mux.HandleFunc("/metadata", metadataHandler)
+	mux.HandleFunc("/thumbnail", thumbnailHandler)
+	mux.HandleFunc("/playlist", playlistHandler)
+	mux.HandleFunc("/sites", sitesHandler)
+	mux.HandleFunc("/stats", statsHandler)
+	mux.HandleFunc("/healthz", healthHandler)
+	mux.HandleFunc("/version", versionHandler)
+	mux.Handle("/metrics", metricsHandler)
+	return withRequestID(cors(mux))
+}
+
+// serve handles requests on ln until ctx is cancelled, then shuts down gracefully.
+// New connections are refused immediately, while in-flight requests get up to
+// timeout to finish before their contexts are cancelled, which kills any
+// ffmpeg processes still running.
+func serve(ctx context.Context, ln net.Listener, handler http.Handler, timeout time.Duration) error {
+	requestsCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+
+	srv := &http.Server{
+		Handler:     handler,
+		BaseContext: func(net.Listener) context.Context { return requestsCtx },
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(ln)
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("Shutting down, waiting for active streams", "timeout", timeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("Grace period expired, cancelling remaining streams")
+		cancelRequests()
+		return srv.Close()
+	}
+	// Prefetches outlive their requests, they share what's left of the grace period
+	if !waitPrefetches(shutdownCtx) {
+		slog.Warn("Grace period expired with prefetches still running")
+	}
+	return nil
 }
 
 func videoHandler(w http.ResponseWriter, r *http.Request) {
@@ -31,79 +187,991 @@ func videoHandler(w http.ResponseWriter, r *http.Request) {
 	query := r.URL.Query()
 	url := query.Get("url")
 	if url == "" {
-		http.Error(w, "Missing 'url' parameter", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, codeMissingParameter, "Missing 'url' parameter")
+		return
+	}
+	if !checkSourceURL(w, r, url) {
 		return
 	}
 
-	qParam := query.Get("quality")
-	var quality ytdlp.Quality
-	switch qParam {
-	case "low":
-		quality = ytdlp.QualityLow
-	case "medium":
-		quality = ytdlp.QualityMedium
-	case "high":
-		quality = ytdlp.QualityHigh
+	// Unknown qualities fall back to high, unless strict mode rejects them
+	quality, err := ytdlp.ParseQuality(query.Get("quality"))
+	if err != nil && (strictQuality || query.Get("strict") == "true") {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParameter, "Unknown 'quality' parameter")
+		return
+	}
+
+	// Optional exact target height, takes precedence over quality
+	var height int
+	if v := query.Get("height"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, r, http.StatusBadRequest, codeInvalidParameter, "Invalid 'height' parameter")
+			return
+		}
+		height = n
+	}
+
+	// Codec preference between formats of the same resolution
+	codecPref := ytdlp.CodecPrefH264
+	if v := query.Get("codec_pref"); v != "" {
+		p, ok := ytdlp.ParseCodecPreference(v)
+		if !ok {
+			writeError(w, r, http.StatusBadRequest, codeInvalidParameter, "Invalid 'codec_pref' parameter")
+			return
+		}
+		codecPref = p
+	}
+
+	// Optional start offset in seconds.
+	// Byte ranges can't be honored since the output length is unknown,
+	// so time-based seeking is the only way to start mid-stream.
+	var start float64
+	if startParam := query.Get("start"); startParam != "" {
+		s, err := strconv.ParseFloat(startParam, 64)
+		if err != nil || s < 0 {
+			writeError(w, r, http.StatusBadRequest, codeInvalidParameter, "Invalid 'start' parameter")
+			return
+		}
+		start = s
+	}
+
+	// Optional clip end, either as an absolute 'end' time or a 'duration' from start
+	var duration float64
+	endParam, durationParam := query.Get("end"), query.Get("duration")
+	switch {
+	case endParam != "" && durationParam != "":
+		writeError(w, r, http.StatusBadRequest, codeInvalidParameter, "Only one of 'end' and 'duration' can be set")
+		return
+	case endParam != "":
+		e, err := strconv.ParseFloat(endParam, 64)
+		if err != nil || e <= start {
+			writeError(w, r, http.StatusBadRequest, codeInvalidParameter, "Invalid 'end' parameter")
+			return
+		}
+		duration = e - start
+	case durationParam != "":
+		d, err := strconv.ParseFloat(durationParam, 64)
+		if err != nil || d <= 0 {
+			writeError(w, r, http.StatusBadRequest, codeInvalidParameter, "Invalid 'duration' parameter")
+			return
+		}
+		duration = d
+	}
+
+	// Optional bitrate ceiling in kbps, only applied when transcoding
+	var maxBitrate int
+	if v := query.Get("maxbitrate"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, r, http.StatusBadRequest, codeInvalidParameter, "Invalid 'maxbitrate' parameter")
+			return
+		}
+		maxBitrate = n
+	}
+
+	// Optional audio bitrate in kbps, only applied when the audio is transcoded
+	var audioBitrate string
+	if v := query.Get("abitrate"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, r, http.StatusBadRequest, codeInvalidParameter, "Invalid 'abitrate' parameter")
+			return
+		}
+		audioBitrate = strconv.Itoa(n) + "k"
+	}
+
+	// Stream mode: full video (default) or just the audio track
+	mode := query.Get("mode")
+	if mode != "" && mode != "video" && mode != "audio" {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParameter, "Invalid 'mode' parameter")
+		return
+	}
+	audioOnly := mode == "audio"
+
+	container := query.Get("container")
+	switch {
+	case container == "" || container == streamer.ContainerMP4:
+	case container == streamer.ContainerMP3 && audioOnly:
+	case container == streamer.ContainerWebM && !audioOnly:
+	default:
+		writeError(w, r, http.StatusBadRequest, codeInvalidParameter, "Unsupported 'container' parameter")
+		return
+	}
+
+	// prefer=webm steers the selection to VP9 and Opus, copied into a WebM
+	// that's much smaller than a transcode to H264 and AAC
+	var audioCodec string
+	preferWebM := false
+	defaultPref, defaultContainer := codecPref, container
+	switch prefer := query.Get("prefer"); prefer {
+	case "":
+	case streamer.ContainerWebM:
+		if audioOnly || (container != "" && container != streamer.ContainerWebM) {
+			writeError(w, r, http.StatusBadRequest, codeInvalidParameter, "'prefer=webm' needs video mode and a webm container")
+			return
+		}
+		preferWebM = true
+		// An explicit preference may still pick AV1, which fits WebM too
+		if query.Get("codec_pref") == "" {
+			codecPref = ytdlp.CodecPrefVP9
+		}
+		audioCodec = "opus"
+		container = streamer.ContainerWebM
 	default:
-		// Default to high if not specified or invalid
-		quality = ytdlp.QualityHigh
+		writeError(w, r, http.StatusBadRequest, codeInvalidParameter, "Invalid 'prefer' parameter")
+		return
+	}
+
+	// Optional subtitle language, muxed as a track or burned into the video
+	subsLang := query.Get("subs")
+	burnSubs := query.Get("subs_burn") == "true"
+	download := query.Get("download") == "true"
+	loudnorm := query.Get("loudnorm") == "true"
+	// Preferred audio language for multilingual videos
+	alang := query.Get("alang")
+	chapters := query.Get("chapters") == "true"
+	// Some downloaders can't handle fragmented MP4, they get a complete file instead
+	faststart := query.Get("streaming") == "false"
+	// Hold the output close to playback speed instead of sending it as fast as it's made
+	pace := query.Get("pace") == "true"
+	if subsLang != "" && audioOnly {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParameter, "Subtitles are not supported in audio mode")
+		return
+	}
+
+	// Lip-sync fixes for a separate audio input: resync drifting timestamps,
+	// and shift the audio by a fixed offset in milliseconds
+	audioSync := query.Get("async") == "true"
+	var audioOffset float64
+	if v := query.Get("aoffset"); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, codeInvalidParameter, "Invalid 'aoffset' parameter")
+			return
+		}
+		audioOffset = float64(ms) / 1000
+	}
+	if (audioSync || audioOffset != 0) && audioOnly {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParameter, "'async' and 'aoffset' are not supported in audio mode")
+		return
+	}
+
+	// Optional yt-dlp format selector, overriding 'format', 'quality' and 'height'
+	selector := query.Get("yformat")
+	// Simple mode takes yt-dlp's best pre-merged format and copies it as is,
+	// a fallback for sites where our own selection misbehaves
+	simple := query.Get("simple") == "true"
+	if simple {
+		if selector != "" {
+			writeError(w, r, http.StatusBadRequest, codeInvalidParameter, "'simple' can't be combined with 'yformat'")
+			return
+		}
+		selector = ytdlp.SimpleSelector
+	}
+	if selector != "" && subsLang != "" {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParameter, "Subtitles are not supported with 'yformat' or 'simple'")
+		return
 	}
 
-	log.Printf("Processing request for URL: %s, Quality: %s", url, quality)
+	// A direct media URL skips yt-dlp, with an optional separate audio URL
+	direct := query.Get("direct") == "true"
+	audioParam := query.Get("aurl")
+	if direct && (selector != "" || subsLang != "") {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParameter, "'direct' can't be combined with 'yformat', 'simple' or 'subs'")
+		return
+	}
+	if audioParam != "" {
+		if !direct {
+			writeError(w, r, http.StatusBadRequest, codeInvalidParameter, "'aurl' requires 'direct=true'")
+			return
+		}
+		if !checkSourceURL(w, r, audioParam) {
+			return
+		}
+	}
+
+	slog.InfoContext(ctx, "Processing request", "url", redact.URL(url), "quality", quality)
 	startTime := time.Now()
 
+	if serveCachedOutput(w, r) {
+		return
+	}
+
+	if direct {
+		opts := streamer.StreamOptions{
+			VideoURL:     url,
+			AudioURL:     audioParam,
+			AudioOnly:    audioOnly,
+			Container:    container,
+			Start:        start,
+			Duration:     duration,
+			MaxBitrate:   maxBitrate,
+			AudioBitrate: audioBitrate,
+			Loudnorm:     loudnorm,
+			AudioSync:    audioSync,
+			AudioOffset:  audioOffset,
+			Faststart:    faststart,
+		}
+		if !checkAudioOffset(w, r, opts) {
+			return
+		}
+		streamDirect(w, r, opts, download, startTime)
+		return
+	}
+
+	// A yt-dlp format selector replaces both the metadata fetch and our own format selection
+	if selector != "" {
+		videoURL, audioURL, err := resolveFormatURLs(ctx, url, selector)
+		if err != nil {
+			writeInfoError(w, r, err)
+			return
+		}
+		if !checkMediaURL(w, r, videoURL) || (audioURL != "" && !checkMediaURL(w, r, audioURL)) {
+			return
+		}
+		// Without metadata the codecs are unknown, so the stream is transcoded
+		// to MP4, or copied into one in simple mode, and can't be proxied
+		opts := streamer.StreamOptions{
+			AudioOnly:    audioOnly,
+			Container:    container,
+			Start:        start,
+			Duration:     duration,
+			MaxBitrate:   maxBitrate,
+			AudioBitrate: audioBitrate,
+			Loudnorm:     loudnorm,
+			AudioSync:    audioSync,
+			AudioOffset:  audioOffset,
+			Faststart:    faststart,
+			CopyCodecs:   simple,
+		}
+		if opts.Container == streamer.ContainerWebM {
+			opts.Container = streamer.ContainerMP4
+		}
+		if audioOnly {
+			// A merged selection lists the audio second
+			opts.AudioURL = videoURL
+			if audioURL != "" {
+				opts.AudioURL = audioURL
+			}
+		} else {
+			opts.VideoURL = videoURL
+			opts.AudioURL = audioURL
+			if simple && audioURL == "" {
+				// Both streams come from the one merged input
+				opts.AudioURL = videoURL
+			}
+		}
+		if !checkAudioOffset(w, r, opts) {
+			return
+		}
+		slog.InfoContext(ctx, "Resolved yt-dlp format selector", "selector", selector, "separate_audio", audioURL != "")
+		streamResponse(w, r, opts, &ytdlp.Info{}, 0, download, startTime)
+		return
+	}
+
 	// Get Video Info
-	info, err := ytdlp.GetVideoInfo(ctx, url)
-	log.Printf("yt-dlp info fetch took: %v", time.Since(startTime))
+	info, err := getVideoInfo(ctx, url)
+	slog.InfoContext(ctx, "yt-dlp info fetched", "duration_ms", time.Since(startTime).Milliseconds())
 	if err != nil {
-		if errors.Is(err, ytdlp.ErrVideoNotFound) {
-			http.Error(w, "Video not found", http.StatusNotFound)
+		writeInfoError(w, r, err)
+		return
+	}
+
+	// A live stream only plays from the live edge
+	if info.IsLive && (start > 0 || duration > 0) {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParameter, "Seeking and clipping are not supported for live streams")
+		return
+	}
+	// The file would never be finished
+	if info.IsLive && faststart {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParameter, "Live streams can only be streamed")
+		return
+	}
+	// Live streams arrive in real time already
+	pace = pace && !info.IsLive
+
+	opts := streamer.StreamOptions{
+		Live:         info.IsLive,
+		AudioOnly:    audioOnly,
+		Container:    container,
+		Start:        start,
+		Duration:     duration,
+		MaxBitrate:   maxBitrate,
+		AudioBitrate: audioBitrate,
+		Loudnorm:     loudnorm,
+		AudioSync:    audioSync,
+		AudioOffset:  audioOffset,
+		Faststart:    faststart,
+	}
+	if chapters {
+		opts.Chapters = streamChapters(info.Chapters)
+	}
+	var video *ytdlp.Format
+
+	// The source bitrate in kbps from yt-dlp, for pacing and X-Source-Bitrate
+	var sourceKbps int
+	if audioOnly {
+		// Select Audio
+		var audio *ytdlp.Format
+		if formatID := query.Get("format"); formatID != "" {
+			_, audio, err = ytdlp.SelectFormatByID(info, formatID)
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, codeInvalidParameter, "Unknown 'format' parameter")
+				return
+			}
+		} else {
+			audio = ytdlp.SelectAudioFormat(info, alang)
+		}
+		if audio == nil {
+			// The video was found, it just has nothing to stream
+			writeError(w, r, http.StatusUnprocessableEntity, codeNoUsableFormat, "The video exists but has no usable audio format")
+			return
+		}
+		slog.InfoContext(ctx, "Selected audio", "audio", audio.FormatID, "acodec", audio.ACodec)
+		setSelectionHeaders(w, nil, audio)
+
+		audioURL, ok := formatURL(w, r, url, audio)
+		if !ok {
+			return
+		}
+		opts.AudioURL = audioURL
+		opts.AudioHeaders = formatHeaders(audio, info)
+		opts.ACodec = audio.ACodec
+		opts.AudioProtocol = audio.Protocol
+		sourceKbps = sourceBitrate(nil, audio)
+	} else {
+		// Select Formats
+		// An explicit format ID takes precedence over the quality buckets
+		var sel ytdlp.Selection
+		if formatID := query.Get("format"); formatID != "" {
+			video, audio, err := ytdlp.SelectFormatByID(info, formatID)
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, codeInvalidParameter, "Unknown 'format' parameter")
+				return
+			}
+			if video == nil {
+				writeError(w, r, http.StatusBadRequest, codeInvalidParameter, "Requested format has no video stream")
+				return
+			}
+			sel = ytdlp.NewSelection(video, audio)
+		} else {
+			sel = selectFormats(url, info, quality, ytdlp.SelectOptions{CodecPref: codecPref, Height: height, Language: alang, AudioCodec: audioCodec})
+			// Without a pair to copy into WebM, the VP9 would only be transcoded
+			// to H264 and end up worse than not asking
+			if preferWebM && sel.Video != nil && !codec.CanCopyToWebM(sel.Video.VCodec, audioCodecOf(sel.Audio)) {
+				slog.InfoContext(ctx, "No VP9 and Opus pair to copy into webm, ignoring prefer=webm", "vcodec", sel.Video.VCodec, "acodec", audioCodecOf(sel.Audio))
+				container = defaultContainer
+				sel = selectFormats(url, info, quality, ytdlp.SelectOptions{CodecPref: defaultPref, Height: height, Language: alang})
+			}
+		}
+		video = sel.Video
+		audio := sel.Audio
+		if err := sel.Err(); errors.Is(err, ytdlp.ErrFormatNotFound) {
+			writeError(w, r, http.StatusNotFound, codeFormatNotFound, "No video format within the server's height limit")
+			return
+		} else if err != nil {
+			msg := "The video exists but has no usable video format"
+			if ytdlp.SelectAudioFormat(info, "") != nil {
+				msg += ", try mode=audio"
+			}
+			writeError(w, r, http.StatusUnprocessableEntity, codeNoUsableFormat, msg)
+			return
+		}
+
+		// Log selection
+		if audio != nil {
+			slog.InfoContext(ctx, "Selected formats", "video", video.FormatID, "height", video.Height, "vcodec", video.VCodec,
+				"audio", audio.FormatID, "acodec", audio.ACodec, "same_input", sel.SameInput,
+				"transcode_video", sel.TranscodeVideo, "transcode_audio", sel.TranscodeAudio)
+		} else {
+			slog.InfoContext(ctx, "Selected formats, no audio", "video", video.FormatID, "height", video.Height, "vcodec", video.VCodec,
+				"transcode_video", sel.TranscodeVideo)
+		}
+		setSelectionHeaders(w, video, audio)
+
+		videoURL, ok := formatURL(w, r, url, video)
+		if !ok {
+			return
+		}
+		opts.VideoURL = videoURL
+		opts.VideoHeaders = formatHeaders(video, info)
+		opts.VCodec = video.VCodec
+		opts.VideoProtocol = video.Protocol
+		opts.FPS = video.FPS
+		opts.TranscodeVideo = sel.TranscodeVideo
+		// Without any audio the output is silent video, which clients are told about
+		opts.NoAudio = sel.AudioMissing
+		if audio != nil {
+			// A pre-merged format is the same input, no need to resolve it twice
+			audioURL := opts.VideoURL
+			if audio != video {
+				if audioURL, ok = formatURL(w, r, url, audio); !ok {
+					return
+				}
+			}
+			opts.AudioURL = audioURL
+			opts.AudioHeaders = formatHeaders(audio, info)
+			opts.ACodec = audio.ACodec
+			opts.AudioProtocol = audio.Protocol
+			opts.TranscodeAudio = sel.TranscodeAudio
+		}
+		sourceKbps = sourceBitrate(video, audio)
+
+		// Without an explicit container, let the Accept header decide
+		if container == "" {
+			opts.Container = negotiateOutput(r.Header.Get("Accept"), video, audio).Container
+			w.Header().Add("Vary", "Accept")
+		}
+
+		if subsLang != "" {
+			sub, err := ytdlp.SelectSubtitle(info, subsLang)
+			if err != nil {
+				writeError(w, r, http.StatusNotFound, codeSubtitlesNotFound, "Subtitles not available for language: "+subsLang)
+				return
+			}
+			if !checkMediaURL(w, r, sub.URL) {
+				return
+			}
+			opts.SubtitleURL = sub.URL
+			opts.SubtitleHeaders = info.HTTPHeaders
+			opts.BurnSubtitles = burnSubs
+			if opts.Container == streamer.ContainerWebM {
+				slog.InfoContext(ctx, "Subtitles requested, falling back to mp4")
+				opts.Container = streamer.ContainerMP4
+			}
+		}
+
+		// WebM is a passthrough only, fall back to MP4 when the codecs don't fit
+		// or the audio must be normalized or resynced
+		if opts.Container == streamer.ContainerWebM && (opts.Loudnorm || opts.AudioSync || !codec.CanCopyToWebM(opts.VCodec, opts.ACodec)) {
+			slog.InfoContext(ctx, "Streams can't be copied to webm, falling back to mp4", "vcodec", opts.VCodec, "acodec", opts.ACodec, "loudnorm", opts.Loudnorm)
+			opts.Container = streamer.ContainerMP4
+		}
+		// Asked only now that subtitles, loudnorm and the container are settled
+		slog.InfoContext(ctx, "Stream plan", "transcode_video", opts.TranscodesVideo(), "transcode_audio", opts.TranscodesAudio(), "container", opts.Container)
+	}
+
+	if !checkAudioOffset(w, r, opts) {
+		return
+	}
+	if pace {
+		opts.PaceBitrate = sourceKbps
+	}
+	if pace && opts.PaceBitrate == 0 {
+		slog.InfoContext(ctx, "Bitrate unknown, streaming without pacing")
+	}
+
+	// A progressive MP4 that needs no changes is served as is, without ffmpeg.
+	// That's the only case where the response size is known up front, since
+	// ffmpeg's fragmented MP4 remux always changes it. Paced streams go
+	// through ffmpeg, which does the pacing.
+	proxy := proxyProgressive && opts.PaceBitrate == 0 && video != nil && video.Ext == "mp4" && opts.CanProxy()
+	if isDryRun(r) {
+		writeDryRun(w, r, opts, proxy)
+		return
+	}
+	if proxy {
+		// Content-Length is forwarded from the upstream once it has answered
+		setStreamHeaders(w, opts, info, download)
+		metrics.Stats.StreamsInFlight.Add(1)
+		defer metrics.Stats.StreamsInFlight.Add(-1)
+		if err := proxyStream(ctx, opts.VideoURL, opts.VideoHeaders, w); err != nil {
+			if errors.Is(err, streamer.ErrClientDisconnected) {
+				slog.InfoContext(ctx, "Client disconnected during proxy", "err", err)
+				return
+			}
+			if errors.Is(err, streamer.ErrCancelled) {
+				slog.InfoContext(ctx, "Proxy cancelled")
+				return
+			}
+			// Nothing was sent yet, the client can still get a proper error
+			var streamErr *streamer.StreamError
+			if errors.As(err, &streamErr) {
+				slog.WarnContext(ctx, "Proxy failed before output", "err", err)
+				writeError(w, r, http.StatusBadGateway, streamErrorCode(streamErr.Reason), streamErrorMessage(streamErr.Reason))
+				return
+			}
+			slog.WarnContext(ctx, "Proxy error", "err", err)
 			return
 		}
-		log.Printf("Error getting video info: %v", err)
-		http.Error(w, "Failed to fetch video metadata", http.StatusInternalServerError)
+		metrics.Stats.StreamsServed.Add(1)
+		slog.InfoContext(ctx, "Proxy completed successfully", "duration_ms", time.Since(startTime).Milliseconds())
+		return
+	}
+
+	streamResponse(w, r, opts, info, sourceKbps, download, startTime)
+}
+
+// streamResponse runs ffmpeg once a stream slot is free and copies its output to w.
+// Failures before any output are still reported with a proper status.
+// sourceKbps is the source bitrate from metadata, zero if unknown.
+func streamResponse(w http.ResponseWriter, r *http.Request, opts streamer.StreamOptions, info *ytdlp.Info, sourceKbps int, download bool, startTime time.Time) {
+	ctx := r.Context()
+	if isDryRun(r) {
+		writeDryRun(w, r, opts, false)
 		return
 	}
 
-	// Select Formats
-	video, audio := ytdlp.SelectFormats(info, quality)
-	if video == nil {
-		http.Error(w, "No suitable video format found", http.StatusNotFound)
+	// Wait for a free ffmpeg slot, shedding load if the server stays saturated
+	if !streamSlots.acquire(ctx, streamSlotWait) {
+		slog.WarnContext(r.Context(), "All stream slots busy, rejecting request", "slots", cap(streamSlots))
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds))
+		writeError(w, r, http.StatusServiceUnavailable, codeServerBusy, "Server busy, try again later")
 		return
 	}
+	defer streamSlots.release()
 
-	// Log selection
-	audioUrl := ""
-	audioCodec := ""
-	if audio != nil {
-		audioUrl = audio.URL
-		audioCodec = audio.ACodec
-		log.Printf("Selected Video: %s (%dp, %s), Audio: %s (%s)",
-			video.FormatID, video.Height, video.VCodec, audio.FormatID, audio.ACodec)
+	setStreamHeaders(w, opts, info, download)
+	// Set from ffmpeg's stderr reader, which is done by the time streamVideo returns
+	var input streamer.InputInfo
+	if opts.SendsFile() {
+		// Sent with a Content-Length once ffmpeg is done, so the totals go in
+		// the headers: known by then, and net/http drops trailers without chunking
+		setStreamTrailers(w, opts, info, input, sourceKbps)
+		opts.InputFunc = func(in streamer.InputInfo) { setStreamTrailers(w, opts, info, in, sourceKbps) }
 	} else {
-		log.Printf("Selected Video: %s (%dp, %s), No separate audio",
-			video.FormatID, video.Height, video.VCodec)
+		// Totals are only known once ffmpeg has opened the source, after the headers are gone.
+		// Without metadata the bitrate only comes from ffmpeg, which doesn't report it at every loglevel.
+		trailer := "X-Stream-Duration"
+		if sourceKbps > 0 || streamer.ReportsInput() {
+			trailer += ", X-Source-Bitrate"
+		}
+		w.Header().Set("Trailer", trailer)
+		opts.InputFunc = func(in streamer.InputInfo) { input = in }
 	}
 
-	// Set Headers
-	w.Header().Set("Content-Type", "video/mp4")
+	// Finished outputs of anything but live streams can be served again from disk.
+	// yformat and direct sources don't say whether they are live, an unknown
+	// length is taken to mean they might be.
+	var out http.ResponseWriter = w
+	var cached *filecache.Writer
+	if !opts.Live && info.Duration > 0 {
+		if cached = cacheOutput(w, r); cached != nil {
+			// Only a complete stream is committed
+			defer cached.Abort()
+			out = cachingWriter{ResponseWriter: w, file: cached}
+		}
+	}
+
+	// Stream
+	metrics.Stats.StreamsInFlight.Add(1)
+	defer metrics.Stats.StreamsInFlight.Add(-1)
+	if err := streamVideo(ctx, opts, out); err != nil {
+		// Nobody is left to read an error response
+		if errors.Is(err, streamer.ErrClientDisconnected) {
+			slog.InfoContext(r.Context(), "Client disconnected during stream", "err", err)
+			return
+		}
+		// Asked for through POST /cancel, the stream just ends
+		if errors.Is(err, streamer.ErrCancelled) {
+			slog.InfoContext(r.Context(), "Stream cancelled", "err", err)
+			return
+		}
+		// If ffmpeg failed before writing anything we can still report it properly
+		var streamErr *streamer.StreamError
+		if errors.As(err, &streamErr) {
+			slog.WarnContext(r.Context(), "Streaming failed before output", "err", err)
+			writeError(w, r, streamErrorStatus(streamErr.Reason), streamErrorCode(streamErr.Reason), streamErrorMessage(streamErr.Reason))
+			return
+		}
+		// Otherwise headers are already written, this error will just log to server console
+		// and client will see a truncated stream.
+		slog.WarnContext(r.Context(), "Streaming error", "err", err)
+		return
+	}
+
+	if !opts.SendsFile() {
+		setStreamTrailers(w, opts, info, input, sourceKbps)
+	}
+	if cached != nil {
+		if err := cached.Commit(); err != nil {
+			slog.WarnContext(r.Context(), "Caching output failed", "err", err)
+		}
+	}
+	metrics.Stats.StreamsServed.Add(1)
+	slog.InfoContext(r.Context(), "Streaming completed successfully", "duration_ms", time.Since(startTime).Milliseconds())
+}
+
+// sourceBitrate returns the bitrate in kbps of the selected formats, for
+// pacing and X-Source-Bitrate, zero if yt-dlp doesn't know it
+func sourceBitrate(video, audio *ytdlp.Format) int {
+	var kbps float64
+	if video != nil {
+		kbps = video.TBR
+		if kbps == 0 {
+			return 0
+		}
+	}
+	if audio != nil && audio != video {
+		kbps += cmp.Or(audio.TBR, audio.ABR)
+	}
+	return int(math.Ceil(kbps))
+}
+
+// setStreamTrailers sets the trailers declared before the body, when their values are known
+func setStreamTrailers(w http.ResponseWriter, opts streamer.StreamOptions, info *ytdlp.Info, input streamer.InputInfo, sourceKbps int) {
+	// ffmpeg only reports the source duration at loglevel info, yt-dlp usually knows it too
+	total := input.Duration.Seconds()
+	if total == 0 {
+		total = info.Duration
+	}
+	if total > 0 && !opts.Live {
+		length := total - opts.Start
+		if opts.Duration > 0 && opts.Duration < length {
+			length = opts.Duration
+		}
+		if length > 0 {
+			w.Header().Set("X-Stream-Duration", strconv.FormatFloat(length, 'f', 2, 64))
+		}
+	}
+	// ffmpeg's figure is the actual input, metadata can only estimate it
+	if bitrate := cmp.Or(input.Bitrate, sourceKbps); bitrate > 0 {
+		w.Header().Set("X-Source-Bitrate", strconv.Itoa(bitrate))
+	}
+}
+
+// streamChapters converts yt-dlp's chapters for embedding in the stream
+func streamChapters(chapters []ytdlp.Chapter) []streamer.Chapter {
+	var out []streamer.Chapter
+	for _, c := range chapters {
+		out = append(out, streamer.Chapter{Start: c.StartTime, End: c.EndTime, Title: c.Title})
+	}
+	return out
+}
+
+// formatURL returns the format's media URL, resolving it with yt-dlp when the
+// metadata has none, e.g. for manifest-only entries.
+// It reports false after writing a 422 if the format can't be streamed directly,
+// the yt-dlp error if resolving it failed, or a 403 if its host is blocked.
+func formatURL(w http.ResponseWriter, r *http.Request, pageURL string, f *ytdlp.Format) (string, bool) {
+	mediaURL := f.URL
+	if mediaURL == "" {
+		var err error
+		mediaURL, _, err = resolveFormatURLs(r.Context(), pageURL, f.FormatID)
+		if err != nil && !errors.Is(err, ytdlp.ErrFormatNotFound) {
+			// Timeouts, blocks and the like aren't about the format
+			writeInfoError(w, r, err)
+			return "", false
+		}
+		if mediaURL == "" {
+			slog.WarnContext(r.Context(), "Format has no direct URL", "format", f.FormatID, "err", err)
+			writeError(w, r, http.StatusUnprocessableEntity, codeFormatNotStreamable, "Format not directly streamable")
+			return "", false
+		}
+		slog.InfoContext(r.Context(), "Resolved format URL with yt-dlp", "format", f.FormatID)
+	}
+	if !checkMediaURL(w, r, mediaURL) {
+		return "", false
+	}
+	return mediaURL, true
+}
+
+// checkAudioOffset reports whether the audio offset, if any, can be applied.
+// Only a separate audio input can be shifted, otherwise it writes a 400.
+func checkAudioOffset(w http.ResponseWriter, r *http.Request, opts streamer.StreamOptions) bool {
+	if opts.AudioOffset == 0 || opts.SeparateAudio() {
+		return true
+	}
+	writeError(w, r, http.StatusBadRequest, codeInvalidParameter, "'aoffset' needs the audio to come from a separate input")
+	return false
+}
+
+// streamErrorMessage describes an early ffmpeg failure for the client
+func streamErrorMessage(reason streamer.Reason) string {
+	switch reason {
+	case streamer.ReasonForbidden:
+		return "Source refused access to the media"
+	case streamer.ReasonNotFound:
+		return "Source media not found"
+	case streamer.ReasonUpstreamError:
+		return "Source server error"
+	case streamer.ReasonInvalidData:
+		return "Source media could not be decoded"
+	case streamer.ReasonFirstByteTimeout:
+		return "Stream took too long to start"
+	case streamer.ReasonOutputTooLarge:
+		return "Output exceeds the size limit for streaming=false, stream it instead"
+	}
+	return "Failed to start stream"
+}
+
+// setStreamHeaders sets the response headers shared by all stream outputs
+func setStreamHeaders(w http.ResponseWriter, opts streamer.StreamOptions, info *ytdlp.Info, download bool) {
+	w.Header().Set("Content-Type", opts.ContentType())
+	// Clips are named after their range even when played inline
+	if download || opts.Duration > 0 {
+		disposition := "inline"
+		if download {
+			disposition = "attachment"
+		}
+		name := info.Title
+		if opts.Duration > 0 {
+			name += " (" + clipRange(opts.Start, opts.Duration) + ")"
+		}
+		w.Header().Set("Content-Disposition", contentDisposition(disposition, name, opts.Extension()))
+	}
 	// Disable buffering in some proxies/clients?
 	w.Header().Set("X-Content-Type-Options", "nosniff")
+	// Media is compressed already, keep proxies from compressing it again,
+	// which costs CPU and buffers the stream. Nothing here compresses either.
+	w.Header().Set("Content-Encoding", "identity")
+	// The output comes from signed source URLs that soon expire
+	w.Header().Set("Cache-Control", "no-store, no-transform")
+	// The streamer's own decision, so burned subtitles count as a transcode too
+	if !opts.AudioOnly {
+		transcode := "copy"
+		if opts.TranscodesVideo() {
+			transcode = "h264"
+		}
+		w.Header().Set("X-Transcode", transcode)
+	}
+	if opts.NoAudio {
+		w.Header().Set("X-Audio", "none")
+	}
+	if info.IsLive {
+		// Any duration reported for a live stream is only how long it has been running
+		w.Header().Set("X-Is-Live", "true")
+	} else if info.Duration > 0 {
+		w.Header().Set("X-Video-Duration", strconv.FormatFloat(info.Duration, 'f', -1, 64))
+	}
+	// The fragmented MP4 output has no known length, so byte ranges can't be served.
+	// Clients should seek with the 'start' parameter instead.
+	w.Header().Set("Accept-Ranges", "none")
+}
 
-	// Stream
-	// Note: If audio is nil, audioUrl is empty string, handling inside streamer
-	var audioHeaders map[string]string
+// setSelectionHeaders describes the selected formats for debugging and
+// client-side analytics. A pre-merged format is reported as both.
+func setSelectionHeaders(w http.ResponseWriter, video, audio *ytdlp.Format) {
+	if video != nil {
+		w.Header().Set("X-Selected-Video-Format", video.FormatID)
+		if video.Width > 0 && video.Height > 0 {
+			w.Header().Set("X-Video-Resolution", fmt.Sprintf("%dx%d", video.Width, video.Height))
+		}
+	}
 	if audio != nil {
-		audioHeaders = audio.HTTPHeaders
+		w.Header().Set("X-Selected-Audio-Format", audio.FormatID)
+	}
+}
+
+// formatsResponse is the body returned by /formats
+type formatsResponse struct {
+	Duration float64         `json:"duration,omitempty"`
+	Formats  []formatSummary `json:"formats"`
+}
+
+// formatSummary is the public view of a format.
+// It deliberately omits the signed URL and headers.
+type formatSummary struct {
+	FormatID string  `json:"format_id"`
+	Width    int     `json:"width,omitempty"`
+	Height   int     `json:"height,omitempty"`
+	VCodec   string  `json:"vcodec"`
+	ACodec   string  `json:"acodec"`
+	FPS      float64 `json:"fps,omitempty"`
+	TBR      float64 `json:"tbr,omitempty"`
+	Protocol string  `json:"protocol,omitempty"`
+	Language string  `json:"language,omitempty"`
+	// Sizes in bytes, exact or estimated, with a readable version for pickers.
+	// Video-only formats also get the size with the audio they're paired with.
+	Filesize          int64  `json:"filesize,omitempty"`
+	Size              string `json:"size,omitempty"`
+	FilesizeWithAudio int64  `json:"filesize_with_audio,omitempty"`
+	SizeWithAudio     string `json:"size_with_audio,omitempty"`
+}
+
+// humanSize formats a byte count in binary units, e.g. "84.2 MiB", empty for zero
+func humanSize(n int64) string {
+	if n <= 0 {
+		return ""
+	}
+	const unit = 1024
+	if n < unit {
+		return strconv.FormatInt(n, 10) + " B"
+	}
+	size, exp := float64(n)/unit, 0
+	for size >= unit && exp < 3 {
+		size /= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", size, "KMGT"[exp])
+}
+
+func formatsHandler(w http.ResponseWriter, r *http.Request) {
+	url := r.URL.Query().Get("url")
+	if url == "" {
+		writeError(w, r, http.StatusBadRequest, codeMissingParameter, "Missing 'url' parameter")
+		return
+	}
+	if !checkSourceURL(w, r, url) {
+		return
 	}
 
-	err = streamer.StreamVideo(ctx, video.URL, video.HTTPHeaders, audioUrl, audioHeaders, video.VCodec, audioCodec, w)
+	info, err := getVideoInfo(r.Context(), url)
 	if err != nil {
-		// If we already wrote headers (likely), this error will just log to server console
-		// and client will see a truncated stream.
-		log.Printf("Streaming error: %v", err)
+		writeInfoError(w, r, err)
 		return
 	}
 
-	log.Printf("Streaming completed successfully. Total request time: %v", time.Since(startTime))
+	formats := make([]formatSummary, 0, len(info.Formats))
+	for _, f := range info.Formats {
+		summary := formatSummary{
+			FormatID: f.FormatID,
+			Width:    f.Width,
+			Height:   f.Height,
+			VCodec:   f.VCodec,
+			ACodec:   f.ACodec,
+			FPS:      f.FPS,
+			TBR:      f.TBR,
+			Protocol: f.Protocol,
+			Language: f.Language,
+			Filesize: f.EstimatedSize(info.Duration),
+		}
+		summary.Size = humanSize(summary.Filesize)
+		if f.VCodec != "none" && f.ACodec == "none" && summary.Filesize > 0 {
+			// The same pairing /video?format= streams
+			if _, audio, err := ytdlp.SelectFormatByID(info, f.FormatID); err == nil && audio != nil {
+				if size := audio.EstimatedSize(info.Duration); size > 0 {
+					summary.FilesizeWithAudio = summary.Filesize + size
+					summary.SizeWithAudio = humanSize(summary.FilesizeWithAudio)
+				}
+			}
+		}
+		formats = append(formats, summary)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	resp := formatsResponse{Duration: info.Duration, Formats: formats}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		slog.ErrorContext(r.Context(), "Error encoding formats", "err", err)
+	}
+}
+
+// metadataResponse is the body returned by /metadata
+type metadataResponse struct {
+	ID        string  `json:"id"`
+	Title     string  `json:"title"`
+	Duration  float64 `json:"duration"`
+	Thumbnail string  `json:"thumbnail"`
+	Uploader  string  `json:"uploader"`
+}
+
+func metadataHandler(w http.ResponseWriter, r *http.Request) {
+	url := r.URL.Query().Get("url")
+	if url == "" {
+		writeError(w, r, http.StatusBadRequest, codeMissingParameter, "Missing 'url' parameter")
+		return
+	}
+	if !checkSourceURL(w, r, url) {
+		return
+	}
+
+	info, err := getVideoInfo(r.Context(), url)
+	if err != nil {
+		writeInfoError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	resp := metadataResponse{
+		ID:        info.ID,
+		Title:     info.Title,
+		Duration:  info.Duration,
+		Thumbnail: info.Thumbnail,
+		Uploader:  info.Uploader,
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		slog.ErrorContext(r.Context(), "Error encoding metadata", "err", err)
+	}
+}
+
+// playlistResponse is the body returned by /playlist
+type playlistResponse struct {
+	ID      string                `json:"id"`
+	Title   string                `json:"title"`
+	Entries []ytdlp.PlaylistEntry `json:"entries"`
+}
+
+// playlistHandler lists a playlist's videos so clients can request each one from /video
+func playlistHandler(w http.ResponseWriter, r *http.Request) {
+	url := r.URL.Query().Get("url")
+	if url == "" {
+		writeError(w, r, http.StatusBadRequest, codeMissingParameter, "Missing 'url' parameter")
+		return
+	}
+	if !checkSourceURL(w, r, url) {
+		return
+	}
+
+	playlist, err := getPlaylist(r.Context(), url)
+	if err != nil {
+		writeInfoError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	resp := playlistResponse{
+		ID:      playlist.ID,
+		Title:   playlist.Title,
+		Entries: playlist.Entries,
+	}
+	if resp.Entries == nil {
+		resp.Entries = []ytdlp.PlaylistEntry{}
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		slog.ErrorContext(r.Context(), "Error encoding playlist", "err", err)
+	}
+}
+
+// writeInfoError writes the response for a failed GetVideoInfo call
+func writeInfoError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, ytdlp.ErrVideoNotFound) {
+		writeError(w, r, http.StatusNotFound, codeVideoNotFound, "Video not found")
+		return
+	}
+	if errors.Is(err, ytdlp.ErrAuthRequired) {
+		writeError(w, r, http.StatusForbidden, codeAuthRequired, "Video requires authentication")
+		return
+	}
+	if errors.Is(err, ytdlp.ErrPrivate) {
+		writeError(w, r, http.StatusForbidden, codeVideoPrivate, "Video is private")
+		return
+	}
+	// A bypass that didn't help leaves the country check standing, so only
+	// an unbypassed block is reported as one
+	if errors.Is(err, ytdlp.ErrGeoBlocked) && ytdlp.GeoBypass == "" {
+		writeError(w, r, http.StatusUnavailableForLegalReasons, codeGeoBlocked, "Video is not available in this region")
+		return
+	}
+	if errors.Is(err, ytdlp.ErrFormatNotFound) {
+		writeError(w, r, http.StatusNotFound, codeFormatNotFound, "No format matches the selector")
+		return
+	}
+	// With impersonation configured there is nothing left to suggest, so the
+	// block is reported like any other failure
+	if errors.Is(err, ytdlp.ErrBotCheck) && ytdlp.Impersonate == "" {
+		slog.WarnContext(r.Context(), "Blocked by a bot check, setting DLP_IMPERSONATE may help")
+		writeError(w, r, http.StatusBadGateway, codeBotCheck, "The site refused the request as a suspected bot")
+		return
+	}
+	if errors.Is(err, ytdlp.ErrIsPlaylist) {
+		writeError(w, r, http.StatusBadRequest, codeIsPlaylist, "URL is a playlist, list its videos with /playlist")
+		return
+	}
+	if errors.Is(err, ytdlp.ErrMetadataTimeout) {
+		writeError(w, r, http.StatusGatewayTimeout, codeMetadataTimeout, "Timed out fetching video metadata")
+		return
+	}
+	slog.ErrorContext(r.Context(), "Error getting video info", "err", err)
+	writeError(w, r, http.StatusInternalServerError, codeInternalError, "Failed to fetch video metadata")
+}
+
+// formatHeaders returns the HTTP headers needed to fetch the given format.
+// yt-dlp usually reports them per format, but some extractors only set them
+// on the top-level info, so fall back to those when the format has none.
+func formatHeaders(f *ytdlp.Format, info *ytdlp.Info) map[string]string {
+	if len(f.HTTPHeaders) > 0 {
+		return f.HTTPHeaders
+	}
+	return info.HTTPHeaders
 }
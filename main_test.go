@@ -0,0 +1,993 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"video-microservice/internal/streamer"
+	"video-microservice/internal/ytdlp"
+)
+
+// testInfo is a minimal video with separate H264 video and AAC audio
+func testInfo() *ytdlp.Info {
+	return &ytdlp.Info{
+		ID:    "test",
+		Title: "Test Video",
+		Formats: []ytdlp.Format{
+			{FormatID: "137", URL: "http://cdn/video", VCodec: "avc1.640028", ACodec: "none", Width: 1920, Height: 1080, TBR: 3000},
+			{FormatID: "140", URL: "http://cdn/audio", VCodec: "none", ACodec: "mp4a.40.2", TBR: 129, Protocol: "https"},
+		},
+	}
+}
+
+// publicLookup resolves every host to a public address without touching DNS
+func publicLookup(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	return []netip.Addr{netip.MustParseAddr("93.184.215.14")}, nil
+}
+
+// stubTools replaces yt-dlp and ffmpeg for the duration of the test
+func stubTools(t *testing.T, info *ytdlp.Info, stream func(ctx context.Context, opts streamer.StreamOptions, w io.Writer) error) {
+	t.Helper()
+	oldInfo, oldSelect, oldStream, oldLookup := getVideoInfo, selectFormats, streamVideo, lookupHost
+	getVideoInfo = func(ctx context.Context, videoURL string) (*ytdlp.Info, error) {
+		return info, nil
+	}
+	// Tests reuse URLs with different infos, a cached selection would leak between them
+	selectFormats = func(_ string, info *ytdlp.Info, quality ytdlp.Quality, opts ytdlp.SelectOptions) ytdlp.Selection {
+		return ytdlp.Select(info, quality, opts)
+	}
+	streamVideo = stream
+	lookupHost = publicLookup
+	t.Cleanup(func() {
+		getVideoInfo, selectFormats, streamVideo, lookupHost = oldInfo, oldSelect, oldStream, oldLookup
+	})
+}
+
+func TestServe_GracefulShutdown(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "done")
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	serveDone := make(chan error, 1)
+	go func() {
+		serveDone <- serve(ctx, ln, handler, 5*time.Second)
+	}()
+
+	// Start a long-running request
+	respCh := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Get("http://" + addr)
+		if err != nil {
+			t.Errorf("in-flight request failed: %v", err)
+			close(respCh)
+			return
+		}
+		respCh <- resp
+	}()
+	<-started
+
+	// Begin shutdown and wait for the listener to close
+	cancel()
+	deadline := time.Now().Add(time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("server still accepting connections after shutdown began")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The in-flight request is allowed to finish
+	close(release)
+	resp := <-respCh
+	if resp == nil {
+		t.FailNow()
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "done" {
+		t.Errorf("got body %q, want done", body)
+	}
+
+	if err := <-serveDone; err != nil {
+		t.Errorf("serve returned error: %v", err)
+	}
+}
+
+func TestVideoHandler_ConcurrencyLimit(t *testing.T) {
+	oldSlots, oldWait := streamSlots, streamSlotWait
+	streamSlots = newSemaphore(1)
+	streamSlotWait = 10 * time.Millisecond
+	defer func() {
+		streamSlots, streamSlotWait = oldSlots, oldWait
+	}()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	stubTools(t, testInfo(), func(ctx context.Context, opts streamer.StreamOptions, w io.Writer) error {
+		close(started)
+		<-release
+		return nil
+	})
+
+	// First request occupies the only slot
+	first := httptest.NewRecorder()
+	firstDone := make(chan struct{})
+	go func() {
+		videoHandler(first, httptest.NewRequest("GET", "/video?url=http://example.com/v", nil))
+		close(firstDone)
+	}()
+	<-started
+
+	// Second request is rejected while the first is streaming
+	second := httptest.NewRecorder()
+	videoHandler(second, httptest.NewRequest("GET", "/video?url=http://example.com/v", nil))
+	if second.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d, want 503", second.Code)
+	}
+	if second.Header().Get("Retry-After") == "" {
+		t.Error("Retry-After header missing")
+	}
+
+	close(release)
+	<-firstDone
+	if first.Code != http.StatusOK {
+		t.Errorf("first request got status %d, want 200", first.Code)
+	}
+
+	// The slot is freed once the first stream ends
+	if !streamSlots.acquire(context.Background(), 0) {
+		t.Error("slot not released after stream finished")
+	}
+}
+
+func TestMetadataHandler(t *testing.T) {
+	info := testInfo()
+	info.Duration = 212.5
+	info.Thumbnail = "https://i.ytimg.com/vi/test/maxresdefault.jpg"
+	info.Uploader = "Test Channel"
+	stubTools(t, info, nil)
+
+	rec := httptest.NewRecorder()
+	metadataHandler(rec, httptest.NewRequest("GET", "/metadata?url=http://example.com/v", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("got Content-Type %q, want application/json", ct)
+	}
+
+	var got map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	want := map[string]any{
+		"id":        "test",
+		"title":     "Test Video",
+		"duration":  212.5,
+		"thumbnail": "https://i.ytimg.com/vi/test/maxresdefault.jpg",
+		"uploader":  "Test Channel",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestMetadataHandler_NotFound(t *testing.T) {
+	stubTools(t, nil, nil)
+	getVideoInfo = func(ctx context.Context, videoURL string) (*ytdlp.Info, error) {
+		return nil, ytdlp.ErrVideoNotFound
+	}
+
+	rec := httptest.NewRecorder()
+	metadataHandler(rec, httptest.NewRequest("GET", "/metadata?url=http://example.com/v", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("got status %d, want 404", rec.Code)
+	}
+}
+
+func TestVideoHandler_PreferWebM(t *testing.T) {
+	info := testInfo()
+	info.Formats = append(info.Formats,
+		ytdlp.Format{FormatID: "243", URL: "http://cdn/vp9", VCodec: "vp9", ACodec: "none", Width: 640, Height: 360, TBR: 300},
+		ytdlp.Format{FormatID: "134", URL: "http://cdn/h264-360", VCodec: "avc1.4d401e", ACodec: "none", Width: 640, Height: 360, TBR: 400},
+		ytdlp.Format{FormatID: "249", URL: "http://cdn/opus", VCodec: "none", ACodec: "opus", ABR: 50},
+	)
+	var got streamer.StreamOptions
+	stubTools(t, info, func(ctx context.Context, opts streamer.StreamOptions, w io.Writer) error {
+		got = opts
+		return nil
+	})
+
+	rec := httptest.NewRecorder()
+	newMux().ServeHTTP(rec, httptest.NewRequest("GET", "/video?url=http://example.com/webm&quality=low&prefer=webm", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body.String())
+	}
+	if got.VideoURL != "http://cdn/vp9" || got.AudioURL != "http://cdn/opus" {
+		t.Errorf("expected VP9 and Opus, got %s and %s", got.VideoURL, got.AudioURL)
+	}
+	if got.Container != streamer.ContainerWebM || rec.Header().Get("Content-Type") != "video/webm" {
+		t.Errorf("expected a webm copy, got container %q, Content-Type %q", got.Container, rec.Header().Get("Content-Type"))
+	}
+
+	for _, query := range []string{"prefer=mkv", "prefer=webm&mode=audio", "prefer=webm&container=mp4"} {
+		rec := httptest.NewRecorder()
+		newMux().ServeHTTP(rec, httptest.NewRequest("GET", "/video?url=http://example.com/webm&"+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want 400", query, rec.Code)
+		}
+	}
+}
+
+func TestVideoHandler_PreferWebMWithoutOpus(t *testing.T) {
+	info := testInfo()
+	info.Formats = append(info.Formats,
+		ytdlp.Format{FormatID: "243", URL: "http://cdn/vp9", VCodec: "vp9", ACodec: "none", Width: 640, Height: 360, TBR: 300},
+		ytdlp.Format{FormatID: "134", URL: "http://cdn/h264-360", VCodec: "avc1.4d401e", ACodec: "none", Width: 640, Height: 360, TBR: 400},
+	)
+	var got streamer.StreamOptions
+	stubTools(t, info, func(ctx context.Context, opts streamer.StreamOptions, w io.Writer) error {
+		got = opts
+		return nil
+	})
+
+	// VP9 with AAC can't be copied into WebM, so the H264 is picked as without prefer=webm
+	rec := httptest.NewRecorder()
+	newMux().ServeHTTP(rec, httptest.NewRequest("GET", "/video?url=http://example.com/webm&quality=low&prefer=webm", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body.String())
+	}
+	if got.VideoURL != "http://cdn/h264-360" || got.AudioURL != "http://cdn/audio" {
+		t.Errorf("expected H264 and AAC, got %s and %s", got.VideoURL, got.AudioURL)
+	}
+	if got.Container != streamer.ContainerMP4 || got.TranscodesVideo() {
+		t.Errorf("expected an mp4 copy, got container %q, transcode %v", got.Container, got.TranscodesVideo())
+	}
+}
+
+func TestVideoHandler_NoUsableFormat(t *testing.T) {
+	storyboards := &ytdlp.Info{ID: "test", Title: "Test Video", Formats: []ytdlp.Format{
+		{FormatID: "sb0", URL: "http://cdn/sb0", VCodec: "none", ACodec: "none", Ext: "mhtml", Width: 160, Height: 90},
+	}}
+	stubTools(t, storyboards, func(ctx context.Context, opts streamer.StreamOptions, w io.Writer) error {
+		t.Error("nothing should be streamed")
+		return nil
+	})
+
+	for _, path := range []string{"/video?url=http://example.com/sb", "/video?url=http://example.com/sb&mode=audio"} {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Accept", "application/json")
+		rec := httptest.NewRecorder()
+		newMux().ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnprocessableEntity {
+			t.Errorf("%s: got status %d, want 422", path, rec.Code)
+		}
+		var resp errorResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.Error != codeNoUsableFormat {
+			t.Errorf("%s: got body %s, want code %s", path, rec.Body.String(), codeNoUsableFormat)
+		}
+	}
+}
+
+func TestVideoHandler_AboveMaxHeight(t *testing.T) {
+	stubTools(t, testInfo(), func(ctx context.Context, opts streamer.StreamOptions, w io.Writer) error {
+		t.Error("nothing should be streamed")
+		return nil
+	})
+	defer func(old int) { ytdlp.MaxHeight = old }(ytdlp.MaxHeight)
+	ytdlp.MaxHeight = 480
+
+	req := httptest.NewRequest("GET", "/video?url=http://example.com/capped", nil)
+	req.Header.Set("Accept", "application/json")
+	rec := httptest.NewRecorder()
+	newMux().ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("got status %d, want 404", rec.Code)
+	}
+	var resp errorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.Error != codeFormatNotFound {
+		t.Errorf("got body %s, want code %s", rec.Body.String(), codeFormatNotFound)
+	}
+}
+
+func TestVideoHandler_ContentLength(t *testing.T) {
+	payload := []byte("progressive-mp4-bytes")
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(payload)
+	}))
+	defer upstream.Close()
+
+	t.Run("Progressive copy", func(t *testing.T) {
+		info := &ytdlp.Info{Formats: []ytdlp.Format{{
+			FormatID: "18", URL: upstream.URL, Ext: "mp4",
+			VCodec: "avc1.42001E", ACodec: "mp4a.40.2", Width: 640, Height: 360,
+			Filesize: int64(len(payload)),
+		}}}
+		stubTools(t, info, func(ctx context.Context, opts streamer.StreamOptions, w io.Writer) error {
+			t.Error("ffmpeg should not be used for a progressive copy")
+			return nil
+		})
+
+		rec := httptest.NewRecorder()
+		videoHandler(rec, httptest.NewRequest("GET", "/video?url=http://example.com/v", nil))
+		if got := rec.Header().Get("Content-Length"); got != strconv.Itoa(len(payload)) {
+			t.Errorf("got Content-Length %q, want %d", got, len(payload))
+		}
+		if rec.Body.String() != string(payload) {
+			t.Errorf("got body %q, want source bytes", rec.Body.String())
+		}
+	})
+
+	t.Run("Transcode", func(t *testing.T) {
+		info := &ytdlp.Info{Formats: []ytdlp.Format{{
+			FormatID: "243", URL: upstream.URL, Ext: "webm",
+			VCodec: "vp9", ACodec: "opus", Width: 640, Height: 360,
+			Filesize: int64(len(payload)),
+		}}}
+		stubTools(t, info, func(ctx context.Context, opts streamer.StreamOptions, w io.Writer) error {
+			_, err := io.WriteString(w, "transcoded")
+			return err
+		})
+
+		rec := httptest.NewRecorder()
+		videoHandler(rec, httptest.NewRequest("GET", "/video?url=http://example.com/v", nil))
+		if got := rec.Header().Get("Content-Length"); got != "" {
+			t.Errorf("unexpected Content-Length %q for transcoded output", got)
+		}
+	})
+}
+
+func TestVideoHandler_EarlyStreamError(t *testing.T) {
+	stubTools(t, testInfo(), func(ctx context.Context, opts streamer.StreamOptions, w io.Writer) error {
+		return &streamer.StreamError{Reason: streamer.ReasonForbidden, Err: errors.New("exit status 1")}
+	})
+
+	rec := httptest.NewRecorder()
+	videoHandler(rec, httptest.NewRequest("GET", "/video?url=http://example.com/v", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("got status %d, want 502", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); strings.HasPrefix(ct, "video/") {
+		t.Errorf("error response has media Content-Type %q", ct)
+	}
+}
+
+func TestVideoHandler_Subtitles(t *testing.T) {
+	info := testInfo()
+	info.Subtitles = map[string][]ytdlp.Subtitle{"en": {{Ext: "vtt", URL: "http://cdn/en.vtt"}}}
+	var got streamer.StreamOptions
+	stubTools(t, info, func(ctx context.Context, opts streamer.StreamOptions, w io.Writer) error {
+		got = opts
+		return nil
+	})
+
+	rec := httptest.NewRecorder()
+	videoHandler(rec, httptest.NewRequest("GET", "/video?url=http://example.com/v&subs=en&subs_burn=true", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200", rec.Code)
+	}
+	if got.SubtitleURL != "http://cdn/en.vtt" || !got.BurnSubtitles {
+		t.Errorf("unexpected subtitle options: %+v", got)
+	}
+
+	rec = httptest.NewRecorder()
+	videoHandler(rec, httptest.NewRequest("GET", "/video?url=http://example.com/v&subs=fr", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("got status %d for missing language, want 404", rec.Code)
+	}
+}
+
+func TestVideoHandler_ProgressiveProxy(t *testing.T) {
+	payload := []byte("progressive-mp4-bytes")
+	var gotUA string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotUA = r.Header.Get("User-Agent")
+		w.Header().Set("Content-Type", "video/mp4; codecs=avc1")
+		w.Write(payload)
+	}))
+	defer upstream.Close()
+
+	info := &ytdlp.Info{Formats: []ytdlp.Format{{
+		FormatID: "18", URL: upstream.URL, Ext: "mp4",
+		VCodec: "avc1.42001E", ACodec: "mp4a.40.2", Width: 640, Height: 360,
+		HTTPHeaders: map[string]string{"User-Agent": "format-agent"},
+	}}}
+	spawned := false
+	stubTools(t, info, func(ctx context.Context, opts streamer.StreamOptions, w io.Writer) error {
+		spawned = true
+		_, err := io.WriteString(w, "remuxed")
+		return err
+	})
+
+	rec := httptest.NewRecorder()
+	videoHandler(rec, httptest.NewRequest("GET", "/video?url=http://example.com/v", nil))
+	if spawned {
+		t.Error("ffmpeg should not be spawned for a progressive MP4")
+	}
+	if rec.Body.String() != string(payload) {
+		t.Errorf("got body %q, want source bytes", rec.Body.String())
+	}
+	// No Filesize in the metadata, the upstream headers are forwarded instead
+	if got := rec.Header().Get("Content-Length"); got != strconv.Itoa(len(payload)) {
+		t.Errorf("got Content-Length %q, want %d", got, len(payload))
+	}
+	if got := rec.Header().Get("Content-Type"); got != "video/mp4; codecs=avc1" {
+		t.Errorf("got Content-Type %q, want the upstream one", got)
+	}
+	if gotUA != "format-agent" {
+		t.Errorf("upstream got User-Agent %q, want the format headers", gotUA)
+	}
+
+	// Disabled, ffmpeg handles it like any other stream
+	defer func(old bool) { proxyProgressive = old }(proxyProgressive)
+	proxyProgressive = false
+	rec = httptest.NewRecorder()
+	videoHandler(rec, httptest.NewRequest("GET", "/video?url=http://example.com/v", nil))
+	if !spawned || rec.Body.String() != "remuxed" {
+		t.Errorf("expected ffmpeg with the fast path disabled, got %q", rec.Body.String())
+	}
+}
+
+func TestVideoHandler_ProgressiveProxyForbidden(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer upstream.Close()
+
+	info := &ytdlp.Info{Formats: []ytdlp.Format{{
+		FormatID: "18", URL: upstream.URL, Ext: "mp4", Filesize: 1 << 20,
+		VCodec: "avc1.42001E", ACodec: "mp4a.40.2", Width: 640, Height: 360,
+	}}}
+	stubTools(t, info, func(ctx context.Context, opts streamer.StreamOptions, w io.Writer) error {
+		t.Error("ffmpeg should not be spawned for a progressive MP4")
+		return nil
+	})
+
+	req := httptest.NewRequest("GET", "/video?url=http://example.com/v", nil)
+	req.Header.Set("Accept", "application/json")
+	rec := httptest.NewRecorder()
+	videoHandler(rec, req)
+	if rec.Code != http.StatusBadGateway {
+		t.Fatalf("got status %d, want 502", rec.Code)
+	}
+	var body errorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Error != "upstream_forbidden" {
+		t.Errorf("got body %q, want upstream_forbidden", rec.Body.String())
+	}
+	if got := rec.Header().Get("Content-Length"); got == strconv.Itoa(1<<20) {
+		t.Error("the yt-dlp file size should not be promised for a failed proxy")
+	}
+}
+
+func TestVideoHandler_AudioMissing(t *testing.T) {
+	info := &ytdlp.Info{Formats: []ytdlp.Format{
+		{FormatID: "248", URL: "http://cdn/video", VCodec: "vp9", ACodec: "none", Width: 1920, Height: 1080},
+	}}
+	var got streamer.StreamOptions
+	stubTools(t, info, func(ctx context.Context, opts streamer.StreamOptions, w io.Writer) error {
+		got = opts
+		return nil
+	})
+
+	rec := httptest.NewRecorder()
+	videoHandler(rec, httptest.NewRequest("GET", "/video?url=http://example.com/v", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200", rec.Code)
+	}
+	if h := rec.Header().Get("X-Audio"); h != "none" {
+		t.Errorf("got X-Audio %q, want none", h)
+	}
+	if !got.NoAudio || got.AudioURL != "" {
+		t.Errorf("expected silent stream options, got %+v", got)
+	}
+
+	stubTools(t, testInfo(), func(ctx context.Context, opts streamer.StreamOptions, w io.Writer) error {
+		return nil
+	})
+	rec = httptest.NewRecorder()
+	videoHandler(rec, httptest.NewRequest("GET", "/video?url=http://example.com/v", nil))
+	if h := rec.Header().Get("X-Audio"); h != "" {
+		t.Errorf("got X-Audio %q for a video with audio", h)
+	}
+}
+
+func TestVideoHandler_AudioOffset(t *testing.T) {
+	var got streamer.StreamOptions
+	stubTools(t, testInfo(), func(ctx context.Context, opts streamer.StreamOptions, w io.Writer) error {
+		got = opts
+		return nil
+	})
+	rec := httptest.NewRecorder()
+	videoHandler(rec, httptest.NewRequest("GET", "/video?url=http://example.com/v&aoffset=250", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("separate audio: got status %d, want 200", rec.Code)
+	}
+	if got.AudioOffset != 0.25 {
+		t.Errorf("got AudioOffset %v, want 0.25", got.AudioOffset)
+	}
+
+	// A progressive format has nothing to shift the audio against
+	progressive := &ytdlp.Info{Formats: []ytdlp.Format{
+		{FormatID: "18", URL: "http://cdn/progressive", VCodec: "avc1.42001E", ACodec: "mp4a.40.2", Width: 640, Height: 360},
+	}}
+	stubTools(t, progressive, func(ctx context.Context, opts streamer.StreamOptions, w io.Writer) error {
+		t.Error("ffmpeg must not run for an offset it can't apply")
+		return nil
+	})
+	for _, query := range []string{
+		"url=http://example.com/v&aoffset=250",
+		"direct=true&url=http://cdn.example/h264.mp4&aoffset=-100",
+	} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/video?"+query, nil)
+		req.Header.Set("Accept", "application/json")
+		videoHandler(rec, req)
+		var body errorResponse
+		json.Unmarshal(rec.Body.Bytes(), &body)
+		if rec.Code != http.StatusBadRequest || body.Error != codeInvalidParameter {
+			t.Errorf("%s: got %d %q, want 400 %s", query, rec.Code, body.Error, codeInvalidParameter)
+		}
+	}
+}
+
+func TestVideoHandler_Clip(t *testing.T) {
+	var got streamer.StreamOptions
+	stubTools(t, testInfo(), func(ctx context.Context, opts streamer.StreamOptions, w io.Writer) error {
+		got = opts
+		return nil
+	})
+
+	tests := []struct {
+		query       string
+		status      int
+		duration    float64
+		disposition string
+	}{
+		{"start=30&end=90", http.StatusOK, 60, `inline; filename="Test Video (30-90).mp4"`},
+		{"start=30&duration=15.5&download=true", http.StatusOK, 15.5, `attachment; filename="Test Video (30-45.5).mp4"`},
+		{"end=10", http.StatusOK, 10, `inline; filename="Test Video (0-10).mp4"`},
+		{"start=30", http.StatusOK, 0, ""},
+		{"start=30&end=20", http.StatusBadRequest, 0, ""},
+		{"duration=0", http.StatusBadRequest, 0, ""},
+		{"end=90&duration=10", http.StatusBadRequest, 0, ""},
+	}
+	for _, tt := range tests {
+		got = streamer.StreamOptions{}
+		rec := httptest.NewRecorder()
+		videoHandler(rec, httptest.NewRequest("GET", "/video?url=http://example.com/v&"+tt.query, nil))
+		if rec.Code != tt.status {
+			t.Errorf("%s: got status %d, want %d", tt.query, rec.Code, tt.status)
+			continue
+		}
+		if got.Duration != tt.duration {
+			t.Errorf("%s: got duration %v, want %v", tt.query, got.Duration, tt.duration)
+		}
+		if tt.status == http.StatusOK {
+			if cd := rec.Header().Get("Content-Disposition"); cd != tt.disposition {
+				t.Errorf("%s: got Content-Disposition %q, want %q", tt.query, cd, tt.disposition)
+			}
+		}
+	}
+}
+
+func TestVideoHandler_StrictQuality(t *testing.T) {
+	defer func(old bool) { strictQuality = old }(strictQuality)
+	stubTools(t, testInfo(), func(ctx context.Context, opts streamer.StreamOptions, w io.Writer) error {
+		return nil
+	})
+
+	tests := []struct {
+		strict bool
+		query  string
+		status int
+	}{
+		{false, "quality=ultra", http.StatusOK},
+		{false, "quality=ultra&strict=true", http.StatusBadRequest},
+		{true, "quality=ultra", http.StatusBadRequest},
+		{true, "quality=low", http.StatusOK},
+		{true, "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		strictQuality = tt.strict
+		rec := httptest.NewRecorder()
+		videoHandler(rec, httptest.NewRequest("GET", "/video?url=http://example.com/v&"+tt.query, nil))
+		if rec.Code != tt.status {
+			t.Errorf("strict %v, %q: got status %d, want %d", tt.strict, tt.query, rec.Code, tt.status)
+		}
+	}
+}
+
+func TestVideoHandler_Trailers(t *testing.T) {
+	info := testInfo()
+	info.Duration = 300
+	var report *streamer.InputInfo
+	stubTools(t, info, func(ctx context.Context, opts streamer.StreamOptions, w io.Writer) error {
+		if report != nil {
+			opts.InputFunc(*report)
+		}
+		_, err := io.WriteString(w, "data")
+		return err
+	})
+
+	tests := []struct {
+		query    string
+		input    *streamer.InputInfo
+		duration string
+		bitrate  string
+	}{
+		{"", &streamer.InputInfo{Duration: 3*time.Minute + 21450*time.Millisecond, Bitrate: 1234}, "201.45", "1234"},
+		// The bitrate falls back to the selected formats' from yt-dlp
+		{"start=1.45", &streamer.InputInfo{Duration: 3*time.Minute + 21450*time.Millisecond}, "200.00", "3129"},
+		{"start=30&duration=15", &streamer.InputInfo{Duration: time.Hour}, "15.00", "3129"},
+		// Falls back to the yt-dlp duration when ffmpeg didn't report one
+		{"", nil, "300.00", "3129"},
+	}
+	for _, tt := range tests {
+		report = tt.input
+		rec := httptest.NewRecorder()
+		videoHandler(rec, httptest.NewRequest("GET", "/video?url=http://example.com/v&"+tt.query, nil))
+		res := rec.Result()
+		if !strings.Contains(res.Header.Get("Trailer"), "X-Stream-Duration") {
+			t.Errorf("%s: trailer not declared, got Trailer %q", tt.query, res.Header.Get("Trailer"))
+		}
+		if got := res.Trailer.Get("X-Stream-Duration"); got != tt.duration {
+			t.Errorf("%s: got X-Stream-Duration %q, want %q", tt.query, got, tt.duration)
+		}
+		if got := res.Trailer.Get("X-Source-Bitrate"); got != tt.bitrate {
+			t.Errorf("%s: got X-Source-Bitrate %q, want %q", tt.query, got, tt.bitrate)
+		}
+	}
+
+	// Without metadata only ffmpeg could tell the bitrate, and it doesn't at the default loglevel
+	oldResolve := resolveFormatURLs
+	t.Cleanup(func() { resolveFormatURLs = oldResolve })
+	resolveFormatURLs = func(ctx context.Context, pageURL, selector string) (string, string, error) {
+		return "http://cdn/merged", "", nil
+	}
+	report = nil
+	rec := httptest.NewRecorder()
+	videoHandler(rec, httptest.NewRequest("GET", "/video?url=http://example.com/v&yformat=best", nil))
+	if got := rec.Result().Header.Get("Trailer"); got != "X-Stream-Duration" {
+		t.Errorf("yformat: got Trailer %q, want only X-Stream-Duration", got)
+	}
+}
+
+func TestVideoHandler_FaststartTotals(t *testing.T) {
+	info := testInfo()
+	info.Duration = 300
+	stubTools(t, info, func(ctx context.Context, opts streamer.StreamOptions, w io.Writer) error {
+		// Like a Faststart output, nothing is sent before ffmpeg reported the input
+		opts.InputFunc(streamer.InputInfo{Duration: 3*time.Minute + 21450*time.Millisecond, Bitrate: 1234})
+		_, err := io.WriteString(w, "data")
+		return err
+	})
+
+	rec := httptest.NewRecorder()
+	videoHandler(rec, httptest.NewRequest("GET", "/video?url=http://example.com/v&streaming=false", nil))
+	res := rec.Result()
+	if got := res.Header.Get("Trailer"); got != "" {
+		t.Errorf("got Trailer %q, want none for a Faststart output", got)
+	}
+	if got := res.Header.Get("X-Stream-Duration"); got != "201.45" {
+		t.Errorf("got X-Stream-Duration header %q, want %q", got, "201.45")
+	}
+	if got := res.Header.Get("X-Source-Bitrate"); got != "1234" {
+		t.Errorf("got X-Source-Bitrate header %q, want %q", got, "1234")
+	}
+}
+
+func TestVideoHandler_FormatWithoutURL(t *testing.T) {
+	info := testInfo()
+	info.Formats = append(info.Formats, ytdlp.Format{FormatID: "dash-1", VCodec: "avc1.640028", ACodec: "none", Width: 1280, Height: 720})
+
+	var got streamer.StreamOptions
+	stubTools(t, info, func(ctx context.Context, opts streamer.StreamOptions, w io.Writer) error {
+		got = opts
+		return nil
+	})
+	oldResolve := resolveFormatURLs
+	t.Cleanup(func() { resolveFormatURLs = oldResolve })
+
+	// The format can't be resolved either, e.g. DRM protected
+	var gotSelector string
+	resolveFormatURLs = func(ctx context.Context, pageURL, selector string) (string, string, error) {
+		gotSelector = selector
+		return "", "", ytdlp.ErrFormatNotFound
+	}
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/video?url=http://example.com/v&format=dash-1", nil)
+	req.Header.Set("Accept", "application/json")
+	videoHandler(rec, req)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("got status %d, want 422", rec.Code)
+	}
+	if gotSelector != "dash-1" {
+		t.Errorf("expected the format ID to be resolved, got selector %q", gotSelector)
+	}
+	var body errorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Error != codeFormatNotStreamable {
+		t.Errorf("got body %q, want %s error", rec.Body.String(), codeFormatNotStreamable)
+	}
+
+	// Failing to resolve for other reasons is reported as such
+	resolveFormatURLs = func(ctx context.Context, pageURL, selector string) (string, string, error) {
+		return "", "", ytdlp.ErrMetadataTimeout
+	}
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/video?url=http://example.com/v&format=dash-1", nil)
+	req.Header.Set("Accept", "application/json")
+	videoHandler(rec, req)
+	body = errorResponse{}
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	if rec.Code != http.StatusGatewayTimeout || body.Error != codeMetadataTimeout {
+		t.Errorf("timeout: got %d %q, want 504 %s", rec.Code, body.Error, codeMetadataTimeout)
+	}
+
+	// A resolved URL is streamed like any other
+	resolveFormatURLs = func(ctx context.Context, pageURL, selector string) (string, string, error) {
+		return "http://cdn/dash-1", "", nil
+	}
+	rec = httptest.NewRecorder()
+	videoHandler(rec, httptest.NewRequest("GET", "/video?url=http://example.com/v&format=dash-1", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200", rec.Code)
+	}
+	if got.VideoURL != "http://cdn/dash-1" || got.AudioURL != "http://cdn/audio" {
+		t.Errorf("got inputs %q and %q", got.VideoURL, got.AudioURL)
+	}
+}
+
+func TestVideoHandler_FormatSelector(t *testing.T) {
+	var got streamer.StreamOptions
+	stubTools(t, nil, func(ctx context.Context, opts streamer.StreamOptions, w io.Writer) error {
+		got = opts
+		return nil
+	})
+	getVideoInfo = func(ctx context.Context, videoURL string) (*ytdlp.Info, error) {
+		t.Error("metadata must not be fetched with a selector")
+		return nil, errors.New("unexpected")
+	}
+	oldResolve := resolveFormatURLs
+	t.Cleanup(func() { resolveFormatURLs = oldResolve })
+	var gotSelector string
+	resolveFormatURLs = func(ctx context.Context, pageURL, selector string) (string, string, error) {
+		gotSelector = selector
+		if selector == "none" {
+			return "", "", ytdlp.ErrFormatNotFound
+		}
+		return "http://cdn/video", "http://cdn/audio", nil
+	}
+
+	rec := httptest.NewRecorder()
+	videoHandler(rec, httptest.NewRequest("GET", "/video?url=http://example.com/v&yformat="+url.QueryEscape("bv*[height<=720]+ba/b"), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200", rec.Code)
+	}
+	if gotSelector != "bv*[height<=720]+ba/b" {
+		t.Errorf("got selector %q", gotSelector)
+	}
+	if got.VideoURL != "http://cdn/video" || got.AudioURL != "http://cdn/audio" {
+		t.Errorf("got inputs %q and %q", got.VideoURL, got.AudioURL)
+	}
+
+	// Audio mode takes the audio of a merged selection
+	videoHandler(httptest.NewRecorder(), httptest.NewRequest("GET", "/video?url=http://example.com/v&mode=audio&yformat=ba", nil))
+	if !got.AudioOnly || got.AudioURL != "http://cdn/audio" {
+		t.Errorf("audio mode: got %+v", got)
+	}
+
+	rec = httptest.NewRecorder()
+	videoHandler(rec, httptest.NewRequest("GET", "/video?url=http://example.com/v&yformat=none", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("unmatched selector: got status %d, want 404", rec.Code)
+	}
+}
+
+func TestVideoHandler_Simple(t *testing.T) {
+	var got streamer.StreamOptions
+	stubTools(t, nil, func(ctx context.Context, opts streamer.StreamOptions, w io.Writer) error {
+		got = opts
+		return nil
+	})
+	getVideoInfo = func(ctx context.Context, videoURL string) (*ytdlp.Info, error) {
+		t.Error("metadata must not be fetched in simple mode")
+		return nil, errors.New("unexpected")
+	}
+	oldResolve := resolveFormatURLs
+	t.Cleanup(func() { resolveFormatURLs = oldResolve })
+	var gotSelector string
+	resolveFormatURLs = func(ctx context.Context, pageURL, selector string) (string, string, error) {
+		gotSelector = selector
+		return "http://cdn/merged", "", nil
+	}
+
+	rec := httptest.NewRecorder()
+	videoHandler(rec, httptest.NewRequest("GET", "/video?url=http://example.com/v&simple=true&container=webm", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200", rec.Code)
+	}
+	if gotSelector != "b" {
+		t.Errorf("got selector %q, want b", gotSelector)
+	}
+	if got.VideoURL != "http://cdn/merged" || got.AudioURL != got.VideoURL {
+		t.Errorf("got inputs %q and %q, want the merged URL for both", got.VideoURL, got.AudioURL)
+	}
+	if !got.CopyCodecs || got.Container != streamer.ContainerMP4 {
+		t.Errorf("expected the merged format copied into MP4: %+v", got)
+	}
+
+	rec = httptest.NewRecorder()
+	videoHandler(rec, httptest.NewRequest("GET", "/video?url=http://example.com/v&simple=true&yformat=ba", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("simple with yformat: got status %d, want 400", rec.Code)
+	}
+}
+
+func TestVideoHandler_SelectionHeaders(t *testing.T) {
+	info := testInfo()
+	info.Formats = append(info.Formats,
+		ytdlp.Format{FormatID: "248", URL: "http://cdn/vp9", VCodec: "vp9", ACodec: "none", Width: 2560, Height: 1440, TBR: 6000})
+	info.Subtitles = map[string][]ytdlp.Subtitle{"en": {{Ext: "vtt", URL: "http://cdn/en.vtt"}}}
+	stubTools(t, info, func(ctx context.Context, opts streamer.StreamOptions, w io.Writer) error {
+		return nil
+	})
+
+	tests := []struct {
+		name       string
+		query      string
+		video      string
+		audio      string
+		resolution string
+		transcode  string
+	}{
+		{"copy", "format=137", "137", "140", "1920x1080", "copy"},
+		{"transcode", "format=248", "248", "140", "2560x1440", "h264"},
+		{"burned subtitles", "format=137&subs=en&subs_burn=true", "137", "140", "1920x1080", "h264"},
+		{"audio only", "mode=audio", "", "140", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			videoHandler(rec, httptest.NewRequest("GET", "/video?url=http://example.com/v&"+tt.query, nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("got status %d", rec.Code)
+			}
+			for header, want := range map[string]string{
+				"X-Selected-Video-Format": tt.video,
+				"X-Selected-Audio-Format": tt.audio,
+				"X-Video-Resolution":      tt.resolution,
+				"X-Transcode":             tt.transcode,
+			} {
+				if got := rec.Header().Get(header); got != want {
+					t.Errorf("got %s %q, want %q", header, got, want)
+				}
+			}
+
+			// The dry run reports the same decision
+			rec = httptest.NewRecorder()
+			videoHandler(rec, httptest.NewRequest("GET", "/video?url=http://example.com/v&dryrun=true&"+tt.query, nil))
+			var plan dryRunResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &plan); err != nil {
+				t.Fatalf("invalid dry run %q: %v", rec.Body.String(), err)
+			}
+			if plan.TranscodeVideo != (tt.transcode == "h264") {
+				t.Errorf("dry run transcode_video %v, X-Transcode %q", plan.TranscodeVideo, tt.transcode)
+			}
+		})
+	}
+}
+
+func TestVideoHandler_Pace(t *testing.T) {
+	var got streamer.StreamOptions
+	stubTools(t, testInfo(), func(ctx context.Context, opts streamer.StreamOptions, w io.Writer) error {
+		got = opts
+		return nil
+	})
+
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"", 0},
+		{"&pace=true", 3129},
+		{"&pace=true&mode=audio", 129},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		videoHandler(rec, httptest.NewRequest("GET", "/video?url=http://example.com/v"+tt.query, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%q: got status %d", tt.query, rec.Code)
+		}
+		if got.PaceBitrate != tt.want {
+			t.Errorf("%q: got pace bitrate %d, want %d", tt.query, got.PaceBitrate, tt.want)
+		}
+	}
+}
+
+func TestFormatsHandler_Sizes(t *testing.T) {
+	info := testInfo()
+	info.Duration = 80
+	info.Formats[0].FilesizeApprox = 30_000_000
+	stubTools(t, info, nil)
+
+	rec := httptest.NewRecorder()
+	formatsHandler(rec, httptest.NewRequest("GET", "/formats?url=http://example.com/v", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d", rec.Code)
+	}
+	var resp formatsResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	video, audio := resp.Formats[0], resp.Formats[1]
+	if video.Filesize != 30_000_000 || video.Size != "28.6 MiB" {
+		t.Errorf("video: got %d (%q)", video.Filesize, video.Size)
+	}
+	// Estimated from 129 kbit/s over 80 seconds
+	if audio.Filesize != 1_290_000 || audio.FilesizeWithAudio != 0 {
+		t.Errorf("audio: got %d, with audio %d", audio.Filesize, audio.FilesizeWithAudio)
+	}
+	if video.FilesizeWithAudio != 31_290_000 || video.SizeWithAudio != "29.8 MiB" {
+		t.Errorf("video with audio: got %d (%q)", video.FilesizeWithAudio, video.SizeWithAudio)
+	}
+}
+
+func TestHumanSize(t *testing.T) {
+	for n, want := range map[int64]string{0: "", 512: "512 B", 1536: "1.5 KiB", 5 << 30: "5.0 GiB"} {
+		if got := humanSize(n); got != want {
+			t.Errorf("humanSize(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
+
+func TestVideoHandler_NoCompressionOrCaching(t *testing.T) {
+	stubTools(t, testInfo(), func(ctx context.Context, opts streamer.StreamOptions, w io.Writer) error {
+		_, err := w.Write([]byte("media"))
+		return err
+	})
+
+	req := httptest.NewRequest("GET", "/video?url=http://example.com/v", nil)
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	rec := httptest.NewRecorder()
+	newMux().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d", rec.Code)
+	}
+	if got := rec.Header().Get("Content-Encoding"); got != "identity" {
+		t.Errorf("got Content-Encoding %q, want identity", got)
+	}
+	if got := rec.Header().Get("Cache-Control"); got != "no-store, no-transform" {
+		t.Errorf("got Cache-Control %q, want no-store, no-transform", got)
+	}
+	if rec.Body.String() != "media" {
+		t.Errorf("got body %q, want it unchanged", rec.Body.String())
+	}
+}
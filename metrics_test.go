@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"video-microservice/internal/metrics"
+	"video-microservice/internal/streamer"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics_VideoRequest(t *testing.T) {
+	stubTools(t, testInfo(), func(ctx context.Context, opts streamer.StreamOptions, w io.Writer) error {
+		_, err := io.WriteString(w, "video")
+		return err
+	})
+
+	ok := metrics.Requests.WithLabelValues("medium", "200")
+	bad := metrics.Requests.WithLabelValues("default", "400")
+	okBefore, badBefore := testutil.ToFloat64(ok), testutil.ToFloat64(bad)
+
+	mux := newMux()
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/video?url=http://example.com/v&quality=medium", nil))
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/video", nil))
+
+	if got := testutil.ToFloat64(ok) - okBefore; got != 1 {
+		t.Errorf("medium/200 counter moved by %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(bad) - badBefore; got != 1 {
+		t.Errorf("default/400 counter moved by %v, want 1", got)
+	}
+
+	// The counters are exposed on /metrics
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), `dlp_requests_total{quality="medium",status="200"}`) {
+		t.Errorf("dlp_requests_total missing from /metrics output")
+	}
+}
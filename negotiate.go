@@ -0,0 +1,77 @@
+package main
+
+import (
+	"mime"
+	"strconv"
+	"strings"
+	"video-microservice/internal/codec"
+	"video-microservice/internal/streamer"
+	"video-microservice/internal/ytdlp"
+)
+
+// OutputSpec is the output picked for a request without an explicit container
+type OutputSpec struct {
+	Container string
+}
+
+// negotiateOutput picks WebM when the client prefers it in its Accept header
+// and the source can be copied into it, MP4 otherwise
+func negotiateOutput(accept string, video, audio *ytdlp.Format) OutputSpec {
+	mp4 := OutputSpec{Container: streamer.ContainerMP4}
+	if video == nil || acceptQuality(accept, "video/webm") <= acceptQuality(accept, "video/mp4") {
+		return mp4
+	}
+	if !codec.CanCopyToWebM(video.VCodec, audioCodecOf(audio)) {
+		return mp4
+	}
+	return OutputSpec{Container: streamer.ContainerWebM}
+}
+
+// audioCodecOf returns the audio format's codec, empty without audio
+func audioCodecOf(audio *ytdlp.Format) string {
+	if audio == nil {
+		return ""
+	}
+	return audio.ACodec
+}
+
+// acceptQuality returns the q-value the Accept header gives mediaType,
+// using the most specific matching range. An empty header accepts everything.
+func acceptQuality(accept, mediaType string) float64 {
+	if strings.TrimSpace(accept) == "" {
+		return 1
+	}
+	typ, _, _ := strings.Cut(mediaType, "/")
+
+	best, specificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		rng, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		var s int
+		switch {
+		case rng == mediaType:
+			s = 2
+		case rng == typ+"/*":
+			s = 1
+		case rng == "*/*":
+			s = 0
+		default:
+			continue
+		}
+		if s < specificity {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		if s > specificity || q > best {
+			best, specificity = q, s
+		}
+	}
+	return best
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+	"video-microservice/internal/streamer"
+	"video-microservice/internal/ytdlp"
+)
+
+func TestNegotiateOutput(t *testing.T) {
+	vp9 := &ytdlp.Format{VCodec: "vp09.00.40.08", ACodec: "none"}
+	opus := &ytdlp.Format{VCodec: "none", ACodec: "opus"}
+	h264 := &ytdlp.Format{VCodec: "avc1.640028", ACodec: "none"}
+	aac := &ytdlp.Format{VCodec: "none", ACodec: "mp4a.40.2"}
+
+	tests := []struct {
+		name         string
+		accept       string
+		video, audio *ytdlp.Format
+		want         string
+	}{
+		{"no header", "", vp9, opus, streamer.ContainerMP4},
+		{"anything", "*/*", vp9, opus, streamer.ContainerMP4},
+		{"explicit webm", "video/webm", vp9, opus, streamer.ContainerWebM},
+		{"firefox media", "video/webm,video/ogg,video/*;q=0.9,application/ogg;q=0.7,audio/*;q=0.6,*/*;q=0.5", vp9, opus, streamer.ContainerWebM},
+		{"mp4 preferred", "video/mp4,video/webm;q=0.8", vp9, opus, streamer.ContainerMP4},
+		{"webm preferred by q", "video/mp4;q=0.5,video/webm", vp9, opus, streamer.ContainerWebM},
+		{"webm refused", "video/webm;q=0,*/*", vp9, opus, streamer.ContainerMP4},
+		{"webm wanted but H264 source", "video/webm", h264, aac, streamer.ContainerMP4},
+		{"webm wanted but AAC audio", "video/webm", vp9, aac, streamer.ContainerMP4},
+	}
+	for _, tt := range tests {
+		if got := negotiateOutput(tt.accept, tt.video, tt.audio); got.Container != tt.want {
+			t.Errorf("%s: got container %q, want %q", tt.name, got.Container, tt.want)
+		}
+	}
+}
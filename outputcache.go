@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+	"video-microservice/internal/codec"
+	"video-microservice/internal/filecache"
+	"video-microservice/internal/metrics"
+	"video-microservice/internal/streamer"
+	"video-microservice/internal/ytdlp"
+)
+
+// File cache settings. Without a directory nothing is cached on disk.
+var (
+	fileCacheDir       string
+	fileCacheMaxMB     = 1024
+	fileCacheMaxFileMB = 64
+	// Outputs expire so a video taken down or made private isn't served forever
+	fileCacheTTL = time.Hour
+)
+
+// outputCache keeps the finished output of small streams, so identical
+// requests are served from disk without running ffmpeg. Nil when disabled.
+var outputCache *filecache.Cache
+
+// cachedHeaders are the response headers stored with an output and replayed
+// with it. Content-Encoding is left out, http.ServeContent drops Content-Length
+// when it is set.
+var cachedHeaders = []string{
+	"Content-Type", "Content-Disposition", "X-Content-Type-Options", "Cache-Control", "X-Audio", "X-Video-Duration", "Vary",
+	"X-Selected-Video-Format", "X-Selected-Audio-Format", "X-Video-Resolution", "X-Transcode",
+}
+
+// openOutputCache opens the file cache if a directory is configured
+func openOutputCache() error {
+	if fileCacheDir == "" {
+		return nil
+	}
+	c, err := filecache.New(fileCacheDir, int64(fileCacheMaxMB)<<20, int64(fileCacheMaxFileMB)<<20, fileCacheTTL)
+	if err != nil {
+		return err
+	}
+	outputCache = c
+	slog.Info("File cache enabled", "dir", fileCacheDir, "size_bytes", c.Size())
+	return nil
+}
+
+// outputCacheKey identifies the output a request produces: every query
+// parameter, the Accept header when the container is negotiated, and the
+// server settings the output depends on
+func outputCacheKey(r *http.Request) string {
+	query := r.URL.Query()
+	key := query.Encode()
+	if query.Get("container") == "" {
+		key += "\nAccept: " + r.Header.Get("Accept")
+	}
+	return key + "\nConfig: " + outputConfig()
+}
+
+// outputConfig describes the settings that change what a request produces,
+// so outputs made before a config change aren't replayed after it
+func outputConfig() string {
+	return fmt.Sprintf("quality=%s max_height=%d av1=%t probe=%t aac=%s loudnorm=%g hwaccel=%s preset=%s gop=%g cfr=%t extra=%q",
+		ytdlp.DefaultQuality, ytdlp.MaxHeight, codec.AllowAV1, streamer.ProbeBeforeCopy, streamer.AACBitrate, streamer.LoudnormTarget,
+		streamer.HWAccelMode, streamer.X264Preset, streamer.GOPSeconds, streamer.ConstantFrameRate, streamer.ExtraArgs)
+}
+
+// serveCachedOutput answers the request from the file cache if it holds its
+// output. Unlike a live stream the size is known, so ranges are supported.
+func serveCachedOutput(w http.ResponseWriter, r *http.Request) bool {
+	if outputCache == nil {
+		return false
+	}
+	entry, ok := outputCache.Get(outputCacheKey(r))
+	if !ok {
+		return false
+	}
+	defer entry.Close()
+
+	for k, v := range entry.Header {
+		w.Header()[k] = v
+	}
+	slog.InfoContext(r.Context(), "Serving cached output", "size", entry.Size)
+	// Sets Content-Length and Accept-Ranges, and answers Range requests
+	http.ServeContent(w, r, "", entry.ModTime, entry.File)
+	metrics.Stats.StreamsServed.Add(1)
+	return true
+}
+
+// cacheOutput starts storing the response body of a stream, with the
+// headers already set. It returns nil when caching is disabled or failed.
+func cacheOutput(w http.ResponseWriter, r *http.Request) *filecache.Writer {
+	if outputCache == nil {
+		return nil
+	}
+	header := http.Header{}
+	for _, k := range cachedHeaders {
+		if v := w.Header().Values(k); len(v) > 0 {
+			header[k] = v
+		}
+	}
+	fw, err := outputCache.NewWriter(outputCacheKey(r), header)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Not caching output", "err", err)
+		return nil
+	}
+	return fw
+}
+
+// cachingWriter copies the response body to the file cache as it is written
+type cachingWriter struct {
+	http.ResponseWriter
+	file *filecache.Writer
+}
+
+func (cw cachingWriter) Write(p []byte) (int, error) {
+	// Never fails, a Writer drops the file on errors instead
+	cw.file.Write(p)
+	return cw.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to flush
+func (cw cachingWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
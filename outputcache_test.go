@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"video-microservice/internal/filecache"
+	"video-microservice/internal/streamer"
+)
+
+// useOutputCache enables the file cache in a temp dir for the duration of the test
+func useOutputCache(t *testing.T) {
+	t.Helper()
+	c, err := filecache.New(t.TempDir(), 1<<20, 1<<20, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := outputCache
+	outputCache = c
+	t.Cleanup(func() { outputCache = old })
+}
+
+func TestVideoHandler_OutputCache(t *testing.T) {
+	useOutputCache(t)
+	runs := 0
+	info := testInfo()
+	info.Duration = 60
+	stubTools(t, info, func(ctx context.Context, opts streamer.StreamOptions, w io.Writer) error {
+		runs++
+		io.WriteString(w, "clip data")
+		return nil
+	})
+
+	const target = "/video?url=http://example.com/v&duration=10&download=true"
+	first := httptest.NewRecorder()
+	videoHandler(first, httptest.NewRequest("GET", target, nil))
+	if first.Code != http.StatusOK || first.Body.String() != "clip data" {
+		t.Fatalf("first request: got %d %q", first.Code, first.Body)
+	}
+
+	// The second identical request is served from disk, without ffmpeg
+	second := httptest.NewRecorder()
+	videoHandler(second, httptest.NewRequest("GET", target, nil))
+	if runs != 1 {
+		t.Errorf("ffmpeg ran %d times, want once", runs)
+	}
+	if second.Body.String() != "clip data" || second.Header().Get("Content-Length") != "9" {
+		t.Errorf("cached response: got %q with length %q", second.Body, second.Header().Get("Content-Length"))
+	}
+	for _, h := range []string{"Content-Type", "Content-Disposition"} {
+		if got, want := second.Header().Get(h), first.Header().Get(h); got != want {
+			t.Errorf("cached %s %q, want %q", h, got, want)
+		}
+	}
+
+	// The known size allows ranges
+	req := httptest.NewRequest("GET", target, nil)
+	req.Header.Set("Range", "bytes=5-8")
+	ranged := httptest.NewRecorder()
+	videoHandler(ranged, req)
+	if ranged.Code != http.StatusPartialContent || ranged.Body.String() != "data" || ranged.Header().Get("Accept-Ranges") != "bytes" {
+		t.Errorf("range request: got %d %q", ranged.Code, ranged.Body)
+	}
+
+	// Any other parameter is a different output
+	videoHandler(httptest.NewRecorder(), httptest.NewRequest("GET", target+"&quality=low", nil))
+	if runs != 2 {
+		t.Errorf("different request served from cache")
+	}
+
+	// So is the same request under settings that change the output
+	defer func(old string) { streamer.AACBitrate = old }(streamer.AACBitrate)
+	streamer.AACBitrate = "192k"
+	videoHandler(httptest.NewRecorder(), httptest.NewRequest("GET", target, nil))
+	if runs != 3 {
+		t.Errorf("output made under a different config served from cache")
+	}
+}
+
+func TestVideoHandler_OutputCacheSkipped(t *testing.T) {
+	useOutputCache(t)
+	runs := 0
+	fail := true
+	info := testInfo()
+	info.Duration = 60
+	stubTools(t, info, func(ctx context.Context, opts streamer.StreamOptions, w io.Writer) error {
+		runs++
+		io.WriteString(w, "data")
+		if fail {
+			return errors.New("ffmpeg execution failed")
+		}
+		return nil
+	})
+
+	// A failed stream isn't cached
+	for i := 0; i < 2; i++ {
+		videoHandler(httptest.NewRecorder(), httptest.NewRequest("GET", "/video?url=http://example.com/failed", nil))
+	}
+	if runs != 2 {
+		t.Errorf("failed stream ran %d times, want 2", runs)
+	}
+
+	// Neither is a live one
+	fail = false
+	info.IsLive = true
+	for i := 0; i < 2; i++ {
+		videoHandler(httptest.NewRecorder(), httptest.NewRequest("GET", "/video?url=http://example.com/live", nil))
+	}
+	if runs != 4 {
+		t.Errorf("live stream ran %d times, want 2", runs-2)
+	}
+
+	// Nor a yformat one, which could be live without anyone saying so
+	oldResolve := resolveFormatURLs
+	t.Cleanup(func() { resolveFormatURLs = oldResolve })
+	resolveFormatURLs = func(ctx context.Context, pageURL, selector string) (string, string, error) {
+		return "http://cdn/live.m3u8", "", nil
+	}
+	for i := 0; i < 2; i++ {
+		videoHandler(httptest.NewRecorder(), httptest.NewRequest("GET", "/video?url=http://example.com/live&yformat=best", nil))
+	}
+	if runs != 6 {
+		t.Errorf("yformat stream ran %d times, want 2", runs-4)
+	}
+}
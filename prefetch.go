@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"video-microservice/internal/redact"
+)
+
+// prefetchRequest is the body of POST /prefetch
+type prefetchRequest struct {
+	URL string `json:"url"`
+}
+
+// maxPrefetchBody bounds the request body, which only carries a URL
+const maxPrefetchBody = 64 << 10
+
+// goPrefetch runs a prefetch in the background, tests replace it to run inline
+var goPrefetch = func(f func()) { go f() }
+
+// prefetchSlots bounds the prefetches running at once, each one is a yt-dlp run
+var prefetchSlots = newSemaphore(8)
+
+// prefetches tracks the running prefetches, so shutdown can wait for them
+var prefetches sync.WaitGroup
+
+// waitPrefetches waits for the running prefetches until ctx is done,
+// reporting whether they all finished
+func waitPrefetches(ctx context.Context) bool {
+	done := make(chan struct{})
+	go func() {
+		prefetches.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// prefetchHandler warms the metadata cache for a video the client will
+// request soon, so its /video request starts faster. It answers 202 right
+// away, the fetch carries on after the response. With every prefetch slot
+// taken it answers 503, a prefetch is only a hint.
+func prefetchHandler(w http.ResponseWriter, r *http.Request) {
+	var req prefetchRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPrefetchBody)).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParameter, "Invalid JSON body")
+		return
+	}
+	if req.URL == "" {
+		writeError(w, r, http.StatusBadRequest, codeMissingParameter, "Missing 'url' field")
+		return
+	}
+	if !checkSourceURL(w, r, req.URL) {
+		return
+	}
+
+	if !prefetchSlots.acquire(r.Context(), 0) {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds))
+		writeError(w, r, http.StatusServiceUnavailable, codeServerBusy, "Too many prefetches running, try again later")
+		return
+	}
+
+	// Keep the request's values but not its cancellation
+	ctx := context.WithoutCancel(r.Context())
+	prefetches.Add(1)
+	goPrefetch(func() {
+		defer prefetches.Done()
+		defer prefetchSlots.release()
+		if _, err := getVideoInfo(ctx, req.URL); err != nil {
+			slog.WarnContext(ctx, "Prefetch failed", "url", redact.URL(req.URL), "err", err)
+			return
+		}
+		slog.InfoContext(ctx, "Prefetched video info", "url", redact.URL(req.URL))
+	})
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"video-microservice/internal/ytdlp"
+)
+
+func TestPrefetchHandler_WarmsCache(t *testing.T) {
+	stubTools(t, nil, nil)
+	getVideoInfo = ytdlp.GetVideoInfo
+	oldGo, oldBin := goPrefetch, ytdlp.BinaryPath
+	goPrefetch = func(f func()) { f() }
+	t.Cleanup(func() { goPrefetch, ytdlp.BinaryPath = oldGo, oldBin })
+
+	// yt-dlp stand-in recording each run
+	dir := t.TempDir()
+	runs := filepath.Join(dir, "runs")
+	ytdlp.BinaryPath = filepath.Join(dir, "yt-dlp")
+	script := "#!/bin/sh\necho run >> " + runs + "\necho '{\"id\":\"abc\",\"title\":\"Queued\"}'\n"
+	if err := os.WriteFile(ytdlp.BinaryPath, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	videoURL := "http://example.com/prefetch-warm"
+	req := httptest.NewRequest("POST", "/prefetch", strings.NewReader(`{"url":"`+videoURL+`"}`))
+	rec := httptest.NewRecorder()
+	newMux().ServeHTTP(rec, req)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("got status %d, want 202: %s", rec.Code, rec.Body.String())
+	}
+
+	info, err := ytdlp.GetVideoInfo(context.Background(), videoURL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if info.Title != "Queued" {
+		t.Errorf("got title %q, want Queued", info.Title)
+	}
+	out, err := os.ReadFile(runs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(out), "run"); n != 1 {
+		t.Errorf("expected yt-dlp to run once, cache hit after prefetch, got %d runs", n)
+	}
+}
+
+func TestPrefetchHandler_BadRequests(t *testing.T) {
+	stubTools(t, nil, nil)
+	called := false
+	getVideoInfo = func(ctx context.Context, videoURL string) (*ytdlp.Info, error) {
+		called = true
+		return nil, nil
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		want   int
+	}{
+		{"invalid json", "POST", `{"url":`, http.StatusBadRequest},
+		{"missing url", "POST", `{}`, http.StatusBadRequest},
+		{"bad url", "POST", `{"url":"ftp://example.com/v"}`, http.StatusBadRequest},
+		{"wrong method", "GET", ``, http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			newMux().ServeHTTP(rec, httptest.NewRequest(tt.method, "/prefetch", strings.NewReader(tt.body)))
+			if rec.Code != tt.want {
+				t.Errorf("got status %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+	if called {
+		t.Error("no video info should be fetched for rejected requests")
+	}
+}
+
+func TestPrefetchHandler_Busy(t *testing.T) {
+	stubTools(t, nil, nil)
+	release := make(chan struct{})
+	getVideoInfo = func(ctx context.Context, videoURL string) (*ytdlp.Info, error) {
+		<-release
+		return &ytdlp.Info{}, nil
+	}
+	defer func(old semaphore) { prefetchSlots = old }(prefetchSlots)
+	prefetchSlots = newSemaphore(1)
+
+	post := func() int {
+		rec := httptest.NewRecorder()
+		newMux().ServeHTTP(rec, httptest.NewRequest("POST", "/prefetch", strings.NewReader(`{"url":"http://example.com/prefetch-busy"}`)))
+		return rec.Code
+	}
+	if code := post(); code != http.StatusAccepted {
+		t.Fatalf("first prefetch got status %d, want 202", code)
+	}
+	if code := post(); code != http.StatusServiceUnavailable {
+		t.Errorf("prefetch with every slot taken got status %d, want 503", code)
+	}
+
+	// Shutdown waits for the running prefetch
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if waitPrefetches(ctx) {
+		t.Error("expected the wait to time out while a prefetch runs")
+	}
+	close(release)
+	if !waitPrefetches(context.Background()) {
+		t.Error("expected the prefetches to finish")
+	}
+	if n := len(prefetchSlots); n != 0 {
+		t.Errorf("expected the slot to be released, %d taken", n)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimit_BurstThenSteady(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newIPLimiter(1, 3) // 1 request/s, bursts of 3
+	l.now = func() time.Time { return now }
+
+	handler := rateLimit(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	do := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/video?url=x", nil)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// The burst goes through, then the client is cut off
+	for i := 0; i < 3; i++ {
+		if rec := do("10.0.0.1:1234"); rec.Code != http.StatusOK {
+			t.Fatalf("burst request %d: got status %d", i, rec.Code)
+		}
+	}
+	rec := do("10.0.0.1:1234")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("got status %d, want 429", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("got Retry-After %q, want 1", got)
+	}
+
+	// Other clients have their own bucket
+	if rec := do("10.0.0.2:1234"); rec.Code != http.StatusOK {
+		t.Errorf("other client: got status %d", rec.Code)
+	}
+
+	// Steady traffic at the refill rate is allowed, faster is not
+	for i := 0; i < 5; i++ {
+		now = now.Add(time.Second)
+		if rec := do("10.0.0.1:1234"); rec.Code != http.StatusOK {
+			t.Fatalf("steady request %d: got status %d", i, rec.Code)
+		}
+		if rec := do("10.0.0.1:1234"); rec.Code != http.StatusTooManyRequests {
+			t.Fatalf("extra request %d: got status %d, want 429", i, rec.Code)
+		}
+	}
+}
+
+func TestIPLimiter_Prune(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newIPLimiter(1, 2)
+	l.now = func() time.Time { return now }
+
+	l.allow("a")
+	l.allow("b")
+	l.allow("b")
+
+	now = now.Add(1500 * time.Millisecond)
+	l.prune()
+	if _, ok := l.buckets["a"]; ok {
+		t.Error("refilled bucket was not pruned")
+	}
+	if _, ok := l.buckets["b"]; !ok {
+		t.Error("partially empty bucket was pruned")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	req := httptest.NewRequest("GET", "/video", nil)
+	req.RemoteAddr = "192.0.2.1:5000"
+	req.Header.Set("X-Forwarded-For", "203.0.113.9, 198.51.100.7")
+
+	if got := clientIP(req, false); got != "192.0.2.1" {
+		t.Errorf("untrusted: got %q, want 192.0.2.1", got)
+	}
+	if got := clientIP(req, true); got != "198.51.100.7" {
+		t.Errorf("trusted: got %q, want 198.51.100.7", got)
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"net/http"
+	"video-microservice/internal/requestid"
+)
+
+// requestIDHeader carries the request id, both ways
+const requestIDHeader = "X-Request-ID"
+
+// withRequestID tags each request's context with an id, so its log lines can
+// be told apart from concurrent ones, and echoes it in the response.
+// A valid id from the client, e.g. set by a proxy, is kept.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !requestid.Valid(id) {
+			id = requestid.New()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(requestid.NewContext(r.Context(), id)))
+	})
+}
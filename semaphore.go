@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// semaphore bounds the number of concurrent holders
+type semaphore chan struct{}
+
+func newSemaphore(n int) semaphore {
+	return make(semaphore, n)
+}
+
+// acquire takes a slot, waiting at most wait for one to free up.
+// It returns false if no slot became available or ctx was cancelled.
+func (s semaphore) acquire(ctx context.Context, wait time.Duration) bool {
+	select {
+	case s <- struct{}{}:
+		return true
+	default:
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case s <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (s semaphore) release() {
+	<-s
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"video-microservice/internal/ytdlp"
+)
+
+// listExtractors returns yt-dlp's cached extractor list, tests replace it
+var listExtractors = ytdlp.Extractors
+
+// sitesResponse is the body returned by /sites
+type sitesResponse struct {
+	Count      int      `json:"count"`
+	Extractors []string `json:"extractors"`
+}
+
+// warmExtractors fetches the extractor list in the background at startup,
+// so the first /sites request doesn't wait for yt-dlp
+func warmExtractors() {
+	go func() {
+		if _, err := listExtractors(context.Background()); err != nil {
+			slog.Warn("Could not list yt-dlp extractors", "err", err)
+		}
+	}()
+}
+
+// sitesHandler lists the sites the installed yt-dlp supports, by extractor name
+func sitesHandler(w http.ResponseWriter, r *http.Request) {
+	list, err := listExtractors(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error listing extractors", "err", err)
+		writeError(w, r, http.StatusInternalServerError, codeInternalError, "Failed to list supported sites")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(sitesResponse{Count: len(list), Extractors: list}); err != nil {
+		slog.ErrorContext(r.Context(), "Error encoding sites", "err", err)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestSitesHandler(t *testing.T) {
+	old := listExtractors
+	t.Cleanup(func() { listExtractors = old })
+	listExtractors = func(ctx context.Context) ([]string, error) {
+		return []string{"vimeo", "youtube"}, nil
+	}
+
+	rec := httptest.NewRecorder()
+	newMux().ServeHTTP(rec, httptest.NewRequest("GET", "/sites", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d", rec.Code)
+	}
+	var resp sitesResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Count != 2 || !slices.Equal(resp.Extractors, []string{"vimeo", "youtube"}) {
+		t.Errorf("got %+v", resp)
+	}
+
+	listExtractors = func(ctx context.Context) ([]string, error) {
+		return nil, errors.New("yt-dlp missing")
+	}
+	rec = httptest.NewRecorder()
+	newMux().ServeHTTP(rec, httptest.NewRequest("GET", "/sites", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("got status %d on failure, want 500", rec.Code)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+	"video-microservice/internal/netguard"
+	"video-microservice/internal/redact"
+)
+
+// allowedHosts restricts the sites that can be fetched. A host matches an
+// entry exactly or as a subdomain. When empty, any public host is allowed.
+var allowedHosts []string
+
+// allowedSchemes are the URL schemes accepted for sources, lowercase
+var allowedSchemes = []string{"http", "https"}
+
+// lookupHost resolves source hosts, replaceable in tests
+var lookupHost = net.DefaultResolver.LookupNetIP
+
+// sourceLookupTimeout bounds the DNS lookup done when validating a source URL
+const sourceLookupTimeout = 5 * time.Second
+
+var (
+	errInvalidSourceURL = errors.New("invalid source URL")
+	// Still an invalid URL, with a more helpful message
+	errUnsupportedScheme = fmt.Errorf("%w: unsupported scheme", errInvalidSourceURL)
+	errHostNotAllowed    = errors.New("source host not allowed")
+	errPrivateAddress    = errors.New("source host resolves to a private address")
+	errUnresolvableHost  = errors.New("source host could not be resolved")
+)
+
+// validateSourceURL checks that raw is a URL we are willing to fetch, with one
+// of allowedSchemes, so the service can't be used to read local files or reach
+// internal addresses.
+// With an allowlist only the listed hosts pass, otherwise the host must not
+// resolve to an internal address.
+func validateSourceURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return errInvalidSourceURL
+	}
+	// url.Parse already lowercases the scheme
+	if !slices.Contains(allowedSchemes, u.Scheme) {
+		return errUnsupportedScheme
+	}
+	if u.Hostname() == "" {
+		return errInvalidSourceURL
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+
+	if len(allowedHosts) > 0 {
+		for _, allowed := range allowedHosts {
+			if host == allowed || strings.HasSuffix(host, "."+allowed) {
+				return nil
+			}
+		}
+		return errHostNotAllowed
+	}
+
+	return checkHostAddrs(host, netguard.IsInternal)
+}
+
+// validateMediaURL checks a media URL returned by yt-dlp, which may point
+// anywhere the extractor page says, against netguard.Blocked. The allowlist
+// doesn't apply, media is usually served from CDN hosts.
+func validateMediaURL(raw string) error {
+	if netguard.Blocked == nil {
+		return nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Hostname() == "" {
+		return errInvalidSourceURL
+	}
+	return checkHostAddrs(strings.ToLower(strings.TrimSuffix(u.Hostname(), ".")), netguard.Blocked)
+}
+
+// checkHostAddrs resolves host and fails if it can't be resolved or any of its
+// addresses is blocked. A failed lookup is rejected too, with split-horizon DNS
+// or a retry the host may still resolve to something internal later.
+func checkHostAddrs(host string, blocked func(netip.Addr) bool) error {
+	var addrs []netip.Addr
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addrs = []netip.Addr{addr}
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), sourceLookupTimeout)
+		defer cancel()
+		addrs, err = lookupHost(ctx, "ip", host)
+		if err != nil {
+			return fmt.Errorf("%w: %v", errUnresolvableHost, err)
+		}
+	}
+	for _, addr := range addrs {
+		if blocked(addr) {
+			return errPrivateAddress
+		}
+	}
+	return nil
+}
+
+// checkSourceURL validates the url parameter and writes the error response if it's rejected
+func checkSourceURL(w http.ResponseWriter, r *http.Request, raw string) bool {
+	err := validateSourceURL(raw)
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, errUnsupportedScheme):
+		msg := fmt.Sprintf("Unsupported 'url' scheme, use %s", strings.Join(allowedSchemes, " or "))
+		writeError(w, r, http.StatusBadRequest, codeInvalidParameter, msg)
+	case errors.Is(err, errInvalidSourceURL):
+		writeError(w, r, http.StatusBadRequest, codeInvalidParameter, "Invalid 'url' parameter")
+	default:
+		writeError(w, r, http.StatusForbidden, codeHostNotAllowed, "Source host not allowed")
+	}
+	return false
+}
+
+// checkMediaURL validates a media URL picked from the metadata and writes
+// the error response if it's rejected
+func checkMediaURL(w http.ResponseWriter, r *http.Request, raw string) bool {
+	if err := validateMediaURL(raw); err != nil {
+		slog.WarnContext(r.Context(), "Media URL rejected", "url", redact.URL(raw), "err", err)
+		writeError(w, r, http.StatusForbidden, codeHostNotAllowed, "Media host not allowed")
+		return false
+	}
+	return true
+}
+
+// parseHostList splits a comma-separated host list, normalizing each entry
+func parseHostList(v string) []string {
+	var hosts []string
+	for _, h := range strings.Split(v, ",") {
+		h = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(h), "."))
+		if h != "" {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts
+}
+
+// parseSchemeList splits a comma-separated scheme list, lowercasing each entry
+func parseSchemeList(v string) []string {
+	var schemes []string
+	for _, s := range strings.Split(v, ",") {
+		s = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(s), ":"))
+		if s != "" {
+			schemes = append(schemes, s)
+		}
+	}
+	return schemes
+}
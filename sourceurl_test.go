@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"video-microservice/internal/netguard"
+	"video-microservice/internal/streamer"
+	"video-microservice/internal/ytdlp"
+)
+
+func TestValidateSourceURL(t *testing.T) {
+	oldLookup, oldAllowed := lookupHost, allowedHosts
+	t.Cleanup(func() { lookupHost, allowedHosts = oldLookup, oldAllowed })
+	lookupHost = func(ctx context.Context, network, host string) ([]netip.Addr, error) {
+		switch host {
+		case "www.youtube.com", "vimeo.com":
+			return []netip.Addr{netip.MustParseAddr("142.250.74.14")}, nil
+		case "intranet.example":
+			return []netip.Addr{netip.MustParseAddr("10.1.2.3")}, nil
+		case "metadata.example":
+			return []netip.Addr{netip.MustParseAddr("142.250.74.14"), netip.MustParseAddr("169.254.169.254")}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	tests := []struct {
+		name    string
+		allowed []string
+		url     string
+		want    error
+	}{
+		{"public host", nil, "https://www.youtube.com/watch?v=x", nil},
+		{"unresolvable host", nil, "https://nowhere.example/v", errUnresolvableHost},
+		{"shared address space", nil, "http://100.64.1.2/", errPrivateAddress},
+		{"this network", nil, "http://0.1.2.3/", errPrivateAddress},
+		{"metadata IP", nil, "http://169.254.169.254/latest/meta-data/", errPrivateAddress},
+		{"loopback", nil, "http://127.0.0.1:8080/video", errPrivateAddress},
+		{"mapped loopback", nil, "http://[::ffff:127.0.0.1]/", errPrivateAddress},
+		{"IPv6 loopback", nil, "http://[::1]/", errPrivateAddress},
+		{"private DNS", nil, "http://intranet.example/v", errPrivateAddress},
+		{"any private address", nil, "http://metadata.example/v", errPrivateAddress},
+		{"file scheme", nil, "file:///etc/passwd", errInvalidSourceURL},
+		{"file scheme message", nil, "file:///etc/passwd", errUnsupportedScheme},
+		{"ftp scheme", nil, "ftp://files.example/v.mp4", errUnsupportedScheme},
+		{"no scheme", nil, "www.youtube.com/watch?v=x", errUnsupportedScheme},
+		{"scheme relative", nil, "//www.youtube.com/watch?v=x", errUnsupportedScheme},
+		{"uppercase scheme", nil, "HTTPS://www.youtube.com/watch?v=x", nil},
+		{"no host", nil, "http:///v", errInvalidSourceURL},
+		{"allowed exact", []string{"youtube.com", "vimeo.com"}, "https://vimeo.com/123", nil},
+		{"allowed subdomain", []string{"youtube.com"}, "https://www.YouTube.com/watch?v=x", nil},
+		{"denied host", []string{"youtube.com"}, "https://vimeo.com/123", errHostNotAllowed},
+		{"denied lookalike", []string{"youtube.com"}, "https://evilyoutube.com/v", errHostNotAllowed},
+		{"denied private", []string{"youtube.com"}, "http://169.254.169.254/", errHostNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowedHosts = tt.allowed
+			if err := validateSourceURL(tt.url); !errors.Is(err, tt.want) {
+				t.Errorf("validateSourceURL(%q) = %v, want %v", tt.url, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVideoHandler_SourceNotAllowed(t *testing.T) {
+	stubTools(t, testInfo(), nil)
+	oldAllowed := allowedHosts
+	t.Cleanup(func() { allowedHosts = oldAllowed })
+	allowedHosts = []string{"youtube.com"}
+
+	rec := httptest.NewRecorder()
+	videoHandler(rec, httptest.NewRequest("GET", "/video?url=http://example.com/v", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("got status %d, want 403", rec.Code)
+	}
+}
+
+func TestValidateSourceURL_Schemes(t *testing.T) {
+	oldLookup, oldSchemes := lookupHost, allowedSchemes
+	t.Cleanup(func() { lookupHost, allowedSchemes = oldLookup, oldSchemes })
+	lookupHost = publicLookup
+
+	allowedSchemes = []string{"https"}
+	if err := validateSourceURL("http://www.youtube.com/v"); !errors.Is(err, errUnsupportedScheme) {
+		t.Errorf("http allowed with only https configured: %v", err)
+	}
+	allowedSchemes = []string{"https", "ftp"}
+	if err := validateSourceURL("ftp://files.example/v.mp4"); err != nil {
+		t.Errorf("configured ftp rejected: %v", err)
+	}
+}
+
+func TestVideoHandler_UnsupportedScheme(t *testing.T) {
+	stubTools(t, testInfo(), nil)
+	for _, raw := range []string{"file:///etc/passwd", "ftp://files.example/v.mp4", "www.youtube.com/watch"} {
+		req := httptest.NewRequest("GET", "/video?url="+url.QueryEscape(raw), nil)
+		req.Header.Set("Accept", "application/json")
+		rec := httptest.NewRecorder()
+		videoHandler(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want 400", raw, rec.Code)
+		}
+		if body := rec.Body.String(); !strings.Contains(body, "use http or https") {
+			t.Errorf("%s: unclear message %q", raw, body)
+		}
+	}
+}
+
+func TestVideoHandler_InternalMediaURL(t *testing.T) {
+	info := &ytdlp.Info{Formats: []ytdlp.Format{
+		{FormatID: "137", URL: "http://169.254.169.254/latest/meta-data/", Ext: "mp4", VCodec: "avc1.640028", ACodec: "none", Width: 1920, Height: 1080},
+		{FormatID: "140", URL: "http://cdn/audio", Ext: "m4a", VCodec: "none", ACodec: "mp4a.40.2"},
+	}}
+	stubTools(t, info, func(ctx context.Context, opts streamer.StreamOptions, w io.Writer) error {
+		t.Error("ffmpeg should not be spawned for an internal media URL")
+		return nil
+	})
+	defer func(old func(netip.Addr) bool) { netguard.Blocked = old }(netguard.Blocked)
+	netguard.Blocked = netguard.IsInternal
+
+	rec := httptest.NewRecorder()
+	videoHandler(rec, httptest.NewRequest("GET", "/video?url=http://example.com/v", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("got status %d, want 403", rec.Code)
+	}
+}
+
+func TestParseSchemeList(t *testing.T) {
+	if got := parseSchemeList(" HTTPS, rtmp: ,,"); !slices.Equal(got, []string{"https", "rtmp"}) {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestParseHostList(t *testing.T) {
+	got := parseHostList(" YouTube.com, vimeo.com.,,")
+	if len(got) != 2 || got[0] != "youtube.com" || got[1] != "vimeo.com" {
+		t.Errorf("got %q", got)
+	}
+}
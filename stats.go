@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"video-microservice/internal/metrics"
+	"video-microservice/internal/ytdlp"
+)
+
+// statsResponse is the body returned by /stats
+type statsResponse struct {
+	StreamsInFlight int64   `json:"streams_in_flight"`
+	StreamsServed   int64   `json:"streams_served"`
+	CacheEntries    int     `json:"cache_entries"`
+	CacheHitRatio   float64 `json:"cache_hit_ratio"`
+	AvgTTFBMs       int64   `json:"avg_ttfb_ms"`
+	// OutputCacheBytes is left out while the output cache is disabled
+	OutputCacheBytes *int64 `json:"output_cache_bytes,omitempty"`
+}
+
+// statsHandler reports the service's counters since startup as JSON, for
+// dashboards that don't scrape /metrics
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	resp := statsResponse{
+		StreamsInFlight: metrics.Stats.StreamsInFlight.Load(),
+		StreamsServed:   metrics.Stats.StreamsServed.Load(),
+		CacheEntries:    ytdlp.CacheLen(),
+		CacheHitRatio:   metrics.Stats.CacheHitRatio(),
+		AvgTTFBMs:       metrics.Stats.AverageTTFB().Milliseconds(),
+	}
+	if outputCache != nil {
+		size := outputCache.Size()
+		resp.OutputCacheBytes = &size
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		slog.ErrorContext(r.Context(), "Error encoding stats", "err", err)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"video-microservice/internal/streamer"
+)
+
+func getStats(t *testing.T, handler http.Handler) statsResponse {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/stats", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp statsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid JSON %q: %v", rec.Body.String(), err)
+	}
+	return resp
+}
+
+func TestStatsHandler(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	stubTools(t, testInfo(), func(ctx context.Context, opts streamer.StreamOptions, w io.Writer) error {
+		w.Write([]byte("data"))
+		started <- struct{}{}
+		<-release
+		return nil
+	})
+
+	handler := newMux()
+	// The counters are global, other tests may have moved them already
+	before := getStats(t, handler)
+
+	done := make(chan struct{})
+	go func() {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/video?url=http://example.com/stats-test", nil))
+		close(done)
+	}()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream did not start")
+	}
+	if got := getStats(t, handler); got.StreamsInFlight != before.StreamsInFlight+1 {
+		t.Errorf("streams_in_flight = %d during a stream, want %d", got.StreamsInFlight, before.StreamsInFlight+1)
+	}
+	close(release)
+	<-done
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/video?url=http://example.com/stats-test-2", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("second stream got status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	after := getStats(t, handler)
+	if after.StreamsInFlight != before.StreamsInFlight {
+		t.Errorf("streams_in_flight = %d after the streams, want %d", after.StreamsInFlight, before.StreamsInFlight)
+	}
+	if after.StreamsServed != before.StreamsServed+2 {
+		t.Errorf("streams_served = %d, want %d", after.StreamsServed, before.StreamsServed+2)
+	}
+	if after.OutputCacheBytes != nil {
+		t.Errorf("expected no output_cache_bytes with the output cache disabled, got %d", *after.OutputCacheBytes)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+	"video-microservice/internal/netguard"
+	"video-microservice/internal/redact"
+	"video-microservice/internal/ytdlp"
+)
+
+// thumbnailClient fetches poster images, which are small so a short timeout is fine
+var thumbnailClient = &http.Client{Timeout: 15 * time.Second, Transport: netguard.Transport()}
+
+// thumbnailHandler serves the video's best thumbnail from this origin
+func thumbnailHandler(w http.ResponseWriter, r *http.Request) {
+	url := r.URL.Query().Get("url")
+	if url == "" {
+		writeError(w, r, http.StatusBadRequest, codeMissingParameter, "Missing 'url' parameter")
+		return
+	}
+	if !checkSourceURL(w, r, url) {
+		return
+	}
+
+	info, err := getVideoInfo(r.Context(), url)
+	if err != nil {
+		writeInfoError(w, r, err)
+		return
+	}
+
+	thumbURL := ytdlp.SelectThumbnail(info)
+	if thumbURL == "" {
+		writeError(w, r, http.StatusNotFound, codeThumbnailNotFound, "No thumbnail available")
+		return
+	}
+	if !checkMediaURL(w, r, thumbURL) {
+		return
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, thumbURL, nil)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Invalid thumbnail URL", "url", redact.URL(thumbURL), "err", err)
+		writeError(w, r, http.StatusBadGateway, codeUpstreamError, "Failed to fetch thumbnail")
+		return
+	}
+	for k, v := range info.HTTPHeaders {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := thumbnailClient.Do(req)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Thumbnail fetch failed", "err", err)
+		writeError(w, r, http.StatusBadGateway, codeUpstreamError, "Failed to fetch thumbnail")
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		slog.WarnContext(r.Context(), "Thumbnail upstream error", "status", resp.Status, "url", redact.URL(thumbURL))
+		writeError(w, r, http.StatusBadGateway, codeUpstreamError, "Failed to fetch thumbnail")
+		return
+	}
+
+	if ct := resp.Header.Get("Content-Type"); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	if cl := resp.Header.Get("Content-Length"); cl != "" {
+		w.Header().Set("Content-Length", cl)
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		slog.WarnContext(r.Context(), "Error copying thumbnail", "err", err)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"video-microservice/internal/ytdlp"
+)
+
+func TestThumbnailHandler(t *testing.T) {
+	image := []byte("\x89PNG fake image")
+	var gotUA string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/large.png" {
+			http.NotFound(w, r)
+			return
+		}
+		gotUA = r.Header.Get("User-Agent")
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(image)
+	}))
+	defer upstream.Close()
+
+	info := &ytdlp.Info{
+		Thumbnails: []ytdlp.Thumbnail{
+			{URL: upstream.URL + "/small.png", Width: 120, Height: 90},
+			{URL: upstream.URL + "/large.png", Width: 1280, Height: 720},
+		},
+		HTTPHeaders: map[string]string{"User-Agent": "test-agent"},
+	}
+	stubTools(t, info, nil)
+
+	rec := httptest.NewRecorder()
+	thumbnailHandler(rec, httptest.NewRequest("GET", "/thumbnail?url=http://example.com/v", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "image/png" {
+		t.Errorf("got Content-Type %q, want image/png", ct)
+	}
+	if rec.Body.String() != string(image) {
+		t.Errorf("got body %q", rec.Body.String())
+	}
+	if gotUA != "test-agent" {
+		t.Errorf("upstream got User-Agent %q, want test-agent", gotUA)
+	}
+}
+
+func TestThumbnailHandler_NoThumbnail(t *testing.T) {
+	stubTools(t, &ytdlp.Info{}, nil)
+
+	rec := httptest.NewRecorder()
+	thumbnailHandler(rec, httptest.NewRequest("GET", "/thumbnail?url=http://example.com/v", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("got status %d, want 404", rec.Code)
+	}
+}